@@ -0,0 +1,107 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of each new latency in the exponential moving average.
+	callStatsAlpha = 0.1
+	// Number of most recent latencies kept for computing percentiles.
+	callStatsSamples = 128
+)
+
+// CallStats are statistics about the calls made by a client.  Only calls that
+// were sent to the router are counted.  A call that ends with an error,
+// including a call canceled by its context, counts as an error.
+type CallStats struct {
+	// Number of calls completed.
+	Count int64
+	// Number of calls that returned an error.
+	Errors int64
+	// Fraction of calls that returned an error, from 0 to 1.
+	ErrorRate float64
+	// Exponential moving average of call latency.
+	EMA time.Duration
+	// Median and 95th percentile of the latency of the most recent calls.
+	P50 time.Duration
+	P95 time.Duration
+}
+
+// callStats collects the latency of calls.
+type callStats struct {
+	mutex   sync.Mutex
+	count   int64
+	errors  int64
+	ema     float64
+	samples []time.Duration
+	next    int
+}
+
+// record adds the latency and outcome of a call.  A zero latency means that
+// the call was not sent, and is not recorded.
+func (s *callStats) record(latency time.Duration, err error) {
+	if latency == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.count++
+	if err != nil {
+		s.errors++
+	}
+	if s.count == 1 {
+		s.ema = float64(latency)
+	} else {
+		s.ema += callStatsAlpha * (float64(latency) - s.ema)
+	}
+	if len(s.samples) < callStatsSamples {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % callStatsSamples
+	}
+}
+
+// stats returns a snapshot of the statistics.
+func (s *callStats) stats() CallStats {
+	s.mutex.Lock()
+	stats := CallStats{
+		Count:  s.count,
+		Errors: s.errors,
+		EMA:    time.Duration(s.ema),
+	}
+	sorted := make([]time.Duration, len(s.samples))
+	copy(sorted, s.samples)
+	s.mutex.Unlock()
+
+	if stats.Count == 0 {
+		return stats
+	}
+	stats.ErrorRate = float64(stats.Errors) / float64(stats.Count)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.P50 = percentile(sorted, 50)
+	stats.P95 = percentile(sorted, 95)
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of the sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (len(sorted)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// CallStats returns statistics about the latency and errors of the calls made
+// by the client, updated as each call completes.  The latency of a call is
+// the time from sending the CALL to receiving the final RESULT or ERROR, the
+// same as returned by CallTimed.  The percentiles are computed from the most
+// recent 128 calls.
+func (c *Client) CallStats() CallStats {
+	return c.callStats.stats()
+}
@@ -10,11 +10,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gammazero/nexus/v3/stdlog"
+	"github.com/gammazero/nexus/v3/transport"
 	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 )
@@ -29,19 +32,35 @@ const (
 
 // A Client routes messages to/from a WAMP router.
 type Client struct {
-	sess *wamp.Session
+	// Time, in Unix nanoseconds, that a message was last received from the
+	// router.  Keep 64-bit words first for atomic alignment on 32-bit
+	// platforms.
+	lastActivity int64
+
+	sess  *wamp.Session
+	realm wamp.URI
 
 	responseTimeout time.Duration
 	awaitingReply   map[wamp.ID]chan wamp.Message
+	pendingCalls    map[wamp.ID]*pendingCall
+	maxPendingCalls int
 	authHandlers    map[string]AuthFunc
 
-	eventHandlers map[wamp.ID]EventHandler
-	topicSubID    map[string]wamp.ID
+	eventHandlers     map[wamp.ID]EventHandler
+	topicSubID        map[string]wamp.ID
+	eventPanicHandler func(*wamp.Event, interface{})
+
+	// Handlers for messages with an unknown subscription or registration.
+	unhandledEventHandler      func(*wamp.Event)
+	unhandledInvocationHandler func(*wamp.Invocation)
 
 	invHandlers    map[wamp.ID]InvocationHandler
+	interceptors   []Interceptor
 	nameProcID     map[string]wamp.ID
 	invHandlerKill map[wamp.ID]context.CancelFunc
 	progGate       map[context.Context]wamp.ID
+	invStreams     map[wamp.ID]*invocationStream
+	streamGate     map[context.Context]chan *wamp.Invocation
 
 	activeInvHandlers sync.WaitGroup
 
@@ -56,9 +75,52 @@ type Client struct {
 
 	routerGoodbye *wamp.Goodbye
 	idGen         *wamp.SyncIDGen
+	requestIDs    func() wamp.ID
+
+	excludeMe bool
+
+	heartbeatDone chan struct{}
+
+	stateChanges chan ConnState
+
+	callStats callStats
+}
+
+// ConnState is a state of the client's connection to the router.
+type ConnState int
+
+const (
+	// ConnStateConnected is the state of a client that has joined a realm.
+	ConnStateConnected ConnState = iota
+	// ConnStateClosed is the state of a client that is no longer connected
+	// to the router, because the client was closed or the connection to the
+	// router was lost.
+	ConnStateClosed
+)
+
+// String returns the name of the connection state.
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
 }
 
-// InvokeResult represents the result of invoking a procedure.
+// pendingCall tracks a call that is waiting for a result, so that the call
+// can be canceled by CancelAll.
+type pendingCall struct {
+	cancel   context.CancelFunc
+	canceled bool
+	reason   string
+}
+
+// InvokeResult represents the result of invoking a procedure.  If Err is
+// set, then the caller is sent an ERROR with Err as the error URI.  Otherwise,
+// the caller is sent a successful result.  The zero InvokeResult is a
+// successful result without any arguments.
 type InvokeResult struct {
 	Args   wamp.List
 	Kwargs wamp.Dict
@@ -69,6 +131,22 @@ type InvokeResult struct {
 // the invocation was canceled.
 var InvocationCanceled = InvokeResult{Err: wamp.ErrCanceled}
 
+// NoResult returns an InvokeResult that sends the caller a successful result
+// without any arguments.  This is the same as the zero InvokeResult.
+func NoResult() InvokeResult {
+	return InvokeResult{}
+}
+
+// ResultError returns an InvokeResult that sends the caller an ERROR with the
+// given error URI and arguments.
+func ResultError(uri wamp.URI, args ...interface{}) InvokeResult {
+	var errArgs wamp.List
+	if len(args) != 0 {
+		errArgs = wamp.List(args)
+	}
+	return InvokeResult{Err: uri, Args: errArgs}
+}
+
 // NewClient takes a connected Peer, joins the realm specified in cfg, and if
 // successful, returns a new client.
 //
@@ -94,33 +172,109 @@ func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
 	}
 
 	c := &Client{
-		sess: sess,
+		sess:  sess,
+		realm: wamp.URI(cfg.Realm),
 
 		responseTimeout: cfg.ResponseTimeout,
 		awaitingReply:   map[wamp.ID]chan wamp.Message{},
+		pendingCalls:    map[wamp.ID]*pendingCall{},
+		maxPendingCalls: cfg.MaxPendingCalls,
 
-		eventHandlers: map[wamp.ID]EventHandler{},
-		topicSubID:    map[string]wamp.ID{},
+		eventHandlers:     map[wamp.ID]EventHandler{},
+		topicSubID:        map[string]wamp.ID{},
+		eventPanicHandler: cfg.EventPanicHandler,
 
 		invHandlers:    map[wamp.ID]InvocationHandler{},
 		nameProcID:     map[string]wamp.ID{},
 		invHandlerKill: map[wamp.ID]context.CancelFunc{},
 		progGate:       map[context.Context]wamp.ID{},
+		invStreams:     map[wamp.ID]*invocationStream{},
+		streamGate:     map[context.Context]chan *wamp.Invocation{},
 
 		log:        cfg.Logger,
 		debug:      cfg.Debug,
 		cancelMode: wamp.CancelModeKillNoWait,
 		idGen:      new(wamp.SyncIDGen),
+		requestIDs: cfg.RequestIDs,
+
+		excludeMe: cfg.ExcludePublisherByDefault,
+
+		// Buffered to hold every state, so that sending a state change never
+		// blocks the client.
+		stateChanges: make(chan ConnState, 2),
 	}
+	c.stateChanges <- ConnStateConnected
+	c.lastActivity = time.Now().UnixNano()
 	c.ctx, c.cancel = context.WithCancel(context.Background())
 	go c.run() // start the core goroutine
+	if cfg.HeartbeatInterval > 0 && (cfg.HeartbeatTopic != "" || cfg.HeartbeatProcedure != "") {
+		c.heartbeatDone = make(chan struct{})
+		go c.heartbeat(cfg)
+	}
 	return c, nil
 }
 
+// heartbeat sends an application-level heartbeat at the configured interval,
+// until the client is closed or disconnected from the router.
+func (c *Client) heartbeat(cfg Config) {
+	defer close(c.heartbeatDone)
+
+	ticker := time.NewTicker(cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		var err error
+		if cfg.HeartbeatProcedure != "" {
+			ctx, cancel := context.WithTimeout(c.ctx, c.responseTimeout)
+			_, err = c.Call(ctx, cfg.HeartbeatProcedure, nil, nil, nil, nil)
+			cancel()
+		} else {
+			err = c.Publish(cfg.HeartbeatTopic, wamp.Dict{wamp.OptAcknowledge: true}, nil, nil)
+		}
+		if err == nil {
+			continue
+		}
+		// Do not report errors caused by the client being closed.
+		if c.ctx.Err() != nil {
+			return
+		}
+		if cfg.HeartbeatErrorHandler != nil {
+			// Call the handler in its own goroutine, so that it can call
+			// Close without waiting for this goroutine to exit.
+			go cfg.HeartbeatErrorHandler(err)
+		} else {
+			c.log.Println("Heartbeat failed:", err)
+		}
+	}
+}
+
 // Done returns a channel that signals when the client is no longer connected
 // to a router and has shutdown.
 func (c *Client) Done() <-chan struct{} { return c.ctx.Done() }
 
+// StateChanges returns a channel that receives each change in the state of the
+// client's connection to the router.  The first state received is
+// ConnStateConnected, since a client is connected when it is created.  When
+// the client is closed or loses its connection, ConnStateClosed is received
+// after Done is signaled, and then the channel is closed.
+//
+// The channel is buffered to hold all state changes, so the client is never
+// blocked by a consumer that does not read the channel.  The same channel is
+// returned by each call, so there should only be one consumer.
+func (c *Client) StateChanges() <-chan ConnState { return c.stateChanges }
+
+// Context returns a context that is canceled when the client is no longer
+// connected to a router and has shutdown, whether the session ended cleanly or
+// not.  This is useful for tying the lifetime of other operations to the
+// client's session.
+func (c *Client) Context() context.Context { return c.ctx }
+
 // Connected returns true if the client is still connected to (receiving from)
 // the router.
 func (c *Client) Connected() bool { return c.ctx.Err() == nil }
@@ -136,12 +290,115 @@ func (c *Client) Logger() stdlog.StdLog { return c.log }
 // RealmDetails returns the realm information received in the WELCOME message.
 func (c *Client) RealmDetails() wamp.Dict { return c.sess.Details }
 
-// HasFeature returns true if the session has the specified feature for the
-// specified role.
+// Realm returns the URI of the realm that the client joined.
+func (c *Client) Realm() wamp.URI { return c.realm }
+
+// SessionDetails returns the details of the client's session, received in the
+// WELCOME message.  These include the session ID, as "session", and the
+// authid, authrole, and authmethod that the router assigned to the session.
+// The returned dictionary is a copy that the caller may modify.
+func (c *Client) SessionDetails() wamp.Dict {
+	details := copyDict(c.sess.Details)
+	details["session"] = c.sess.ID
+	return details
+}
+
+// BytesSent returns the number of bytes the client has sent to the router over
+// its transport.  Returns 0 if the transport does not count bytes, as with a
+// local connection to an in-process router.
+func (c *Client) BytesSent() uint64 {
+	if bc, ok := c.sess.Peer.(transport.ByteCounter); ok {
+		return bc.BytesSent()
+	}
+	return 0
+}
+
+// BytesReceived returns the number of bytes the client has received from the
+// router over its transport.  Returns 0 if the transport does not count bytes,
+// as with a local connection to an in-process router.
+func (c *Client) BytesReceived() uint64 {
+	if bc, ok := c.sess.Peer.(transport.ByteCounter); ok {
+		return bc.BytesReceived()
+	}
+	return 0
+}
+
+// Serialization returns the serialization negotiated with the router.  Returns
+// AUTO if the transport does not serialize messages, as with a local
+// connection to an in-process router.
+func (c *Client) Serialization() serialize.Serialization {
+	if sp, ok := c.sess.Peer.(interface {
+		Serialization() serialize.Serialization
+	}); ok {
+		return sp.Serialization()
+	}
+	return serialize.AUTO
+}
+
+// LastActivity returns the time when the client last received anything from
+// the router.  This includes transport-level pings and pongs, if the transport
+// reports them, as well as WAMP messages.  A watchdog can use this to detect a
+// connection that has silently stopped working.  Before any message is
+// received, this is the time the client joined the realm.
+func (c *Client) LastActivity() time.Time {
+	last := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	if at, ok := c.sess.Peer.(transport.ActivityTracker); ok {
+		if peerLast := at.LastRecv(); peerLast.After(last) {
+			last = peerLast
+		}
+	}
+	return last
+}
+
+// Ping measures the round-trip time to the router using a transport-level
+// ping, without sending any WAMP message.  Over websocket this sends a
+// websocket PING control frame, and over rawsocket a rawsocket PING message,
+// and waits for the matching PONG.  Returns an error if ctx is done before the
+// PONG is received, or ErrPingUnsupported if the transport does not support
+// pings, as with a local connection to an in-process router.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	if !c.Connected() {
+		return 0, ErrNotConn
+	}
+	p, ok := c.sess.Peer.(transport.Pinger)
+	if !ok {
+		return 0, ErrPingUnsupported
+	}
+	return p.Ping(ctx)
+}
+
+// HasFeature returns true if the router announced the specified feature for
+// the specified role, in the WELCOME message.  This is used to check that the
+// router supports an optional feature, such as progressive call results,
+// before using it:
+//
+//	if c.HasFeature(wamp.RoleDealer, wamp.FeatureProgCallResults) {
+//		...
+//	}
 func (c *Client) HasFeature(role, feature string) bool {
 	return c.sess.HasFeature(role, feature)
 }
 
+// SetUnhandledEventHandler sets a function that is called with each EVENT
+// received for a subscription that the client does not have a handler for,
+// such as an event that was sent before the client unsubscribed.  If not set,
+// these events are logged and dropped.  Setting nil removes the handler.
+func (c *Client) SetUnhandledEventHandler(handler func(*wamp.Event)) {
+	c.sess.Lock()
+	c.unhandledEventHandler = handler
+	c.sess.Unlock()
+}
+
+// SetUnhandledInvocationHandler sets a function that is called with each
+// INVOCATION received for a registration that the client does not have a
+// handler for.  The client still replies to the INVOCATION with an ERROR.  If
+// not set, these invocations are logged.  Setting nil removes the handler.
+func (c *Client) SetUnhandledInvocationHandler(handler func(*wamp.Invocation)) {
+	c.sess.Lock()
+	c.unhandledInvocationHandler = handler
+	c.sess.Unlock()
+}
+
 // EventHandler is a function that handles a publish event.
 type EventHandler func(event *wamp.Event)
 
@@ -157,6 +414,15 @@ type EventHandler func(event *wamp.Event)
 // To request a pattern-based subscription set:
 //   options["match"] = "prefix" or "wildcard"
 //
+// When connecting to a nexus router, the router can be asked to only send
+// events whose keyword arguments match a filter expression, by setting:
+//   options["filter"] = "severity >= 3 && source == 'db'"
+// A filter compares keyword arguments, selected by name, with number, string,
+// or bool values using ==, !=, <, <=, >, and >=.  Comparisons are combined
+// using &&, ||, !, and parentheses.  Nested keyword arguments are selected
+// using dotted names, such as host.name.  An invalid filter is rejected by
+// the router, causing Subscribe to return an error.
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 func (c *Client) Subscribe(topic string, fn EventHandler, options wamp.Dict) error {
 	if !c.Connected() {
@@ -166,8 +432,10 @@ func (c *Client) Subscribe(topic string, fn EventHandler, options wamp.Dict) err
 	if options == nil {
 		options = wamp.Dict{}
 	}
-	id := c.idGen.Next()
-	c.expectReply(id)
+	id, err := c.nextID(true)
+	if err != nil {
+		return err
+	}
 	c.sess.Send(&wamp.Subscribe{
 		Request: id,
 		Options: options,
@@ -237,8 +505,10 @@ func (c *Client) Unsubscribe(topic string) error {
 		return ErrNotConn
 	}
 
-	id := c.idGen.Next()
-	c.expectReply(id)
+	id, err := c.nextID(true)
+	if err != nil {
+		return err
+	}
 	c.sess.Send(&wamp.Unsubscribe{
 		Request:      id,
 		Subscription: subID,
@@ -260,6 +530,72 @@ func (c *Client) Unsubscribe(topic string) error {
 	return unexpectedMsgError(msg, wamp.UNSUBSCRIBED)
 }
 
+// UnsubscribeAll removes the subscriptions to all topics that start with
+// prefix.  An empty prefix removes all subscriptions.  All UNSUBSCRIBE
+// requests are sent before waiting for any replies.  If any of the requests
+// fail, then a BulkError is returned with the error for each failure.
+func (c *Client) UnsubscribeAll(prefix string) error {
+	var topics []string
+	var subIDs []wamp.ID
+	c.sess.Lock()
+	for topic, subID := range c.topicSubID {
+		if !strings.HasPrefix(topic, prefix) {
+			continue
+		}
+		topics = append(topics, topic)
+		subIDs = append(subIDs, subID)
+		// Delete the subscription anyway, as with Unsubscribe.
+		delete(c.topicSubID, topic)
+		delete(c.eventHandlers, subID)
+	}
+	c.sess.Unlock()
+
+	if len(topics) == 0 {
+		return nil
+	}
+	if !c.Connected() {
+		return ErrNotConn
+	}
+
+	var errs BulkError
+	reqIDs := make([]wamp.ID, len(subIDs))
+	for i := range subIDs {
+		id, err := c.nextID(true)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unsubscribing from '%s': %w", topics[i], err))
+			continue
+		}
+		reqIDs[i] = id
+		c.sess.Send(&wamp.Unsubscribe{
+			Request:      id,
+			Subscription: subIDs[i],
+		})
+	}
+
+	for i := range reqIDs {
+		if reqIDs[i] == 0 {
+			continue
+		}
+		msg, err := c.waitForReply(reqIDs[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unsubscribing from '%s': %w", topics[i], err))
+			continue
+		}
+		switch msg := msg.(type) {
+		case *wamp.Unsubscribed:
+		case *wamp.Error:
+			errs = append(errs, fmt.Errorf("unsubscribing from '%s': %s",
+				topics[i], wampErrorString(msg)))
+		default:
+			errs = append(errs, unexpectedMsgError(msg, wamp.UNSUBSCRIBED))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
 // Publish publishes an EVENT to all subscribed clients.
 //
 // Publish Options
@@ -292,23 +628,22 @@ func (c *Client) Unsubscribe(topic string) error {
 // To request that this publisher's identity is disclosed to subscribers, set:
 //   options["disclose_me"] = true
 //
+// If the client is configured with ExcludePublisherByDefault, then
+// options["exclude_me"] = true is set unless options already has exclude_me.
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 func (c *Client) Publish(topic string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
 	if !c.Connected() {
 		return ErrNotConn
 	}
 
-	id := c.idGen.Next()
+	options = c.publishOptions(options)
 
-	var pubAck bool
-	if options == nil {
-		options = wamp.Dict{}
-	} else {
-		// Check if the client is asking for a PUBLISHED response.
-		pubAck, _ = options[wamp.OptAcknowledge].(bool)
-		if pubAck {
-			c.expectReply(id)
-		}
+	// Check if the client is asking for a PUBLISHED response.
+	pubAck, _ := options[wamp.OptAcknowledge].(bool)
+	id, err := c.nextID(pubAck)
+	if err != nil {
+		return err
 	}
 
 	c.sess.Send(&wamp.Publish{
@@ -338,6 +673,97 @@ func (c *Client) Publish(topic string, options wamp.Dict, args wamp.List, kwargs
 	return nil
 }
 
+// PublishMulti publishes the same EVENT to each of the topics.  This is a
+// convenience for announcing a change on several topics, and is not a
+// transaction: each publication is separate, and some may fail while others
+// succeed.  All PUBLISH messages are sent before waiting for any replies.  The
+// options are the same as for Publish, and apply to every publication.
+//
+// If options["acknowledge"] is true, then the publication ID for each topic is
+// returned, in the same order as the topics.  If any of the publications fail,
+// then a BulkError is returned with the error for each failure, and the
+// publication ID for each failed topic is 0.  Without acknowledgement, no
+// publication IDs are returned.
+func (c *Client) PublishMulti(topics []string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) ([]wamp.ID, error) {
+	if !c.Connected() {
+		return nil, ErrNotConn
+	}
+
+	options = c.publishOptions(options)
+	pubAck, _ := options[wamp.OptAcknowledge].(bool)
+
+	var errs BulkError
+	reqIDs := make([]wamp.ID, len(topics))
+	for i := range topics {
+		id, err := c.nextID(pubAck)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("publishing to '%s': %w", topics[i], err))
+			continue
+		}
+		reqIDs[i] = id
+		c.sess.Send(&wamp.Publish{
+			Request:     id,
+			Options:     options,
+			Topic:       wamp.URI(topics[i]),
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+	}
+
+	if !pubAck {
+		if len(errs) != 0 {
+			return nil, errs
+		}
+		return nil, nil
+	}
+
+	pubIDs := make([]wamp.ID, len(topics))
+	for i := range reqIDs {
+		if reqIDs[i] == 0 {
+			continue
+		}
+		msg, err := c.waitForReply(reqIDs[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("publishing to '%s': %w", topics[i], err))
+			continue
+		}
+		switch msg := msg.(type) {
+		case *wamp.Published:
+			pubIDs[i] = msg.Publication
+		case *wamp.Error:
+			errs = append(errs, fmt.Errorf("publishing to '%s': %s",
+				topics[i], wampErrorString(msg)))
+		default:
+			errs = append(errs, fmt.Errorf("publishing to '%s': %w", topics[i],
+				unexpectedMsgError(msg, wamp.PUBLISHED)))
+		}
+	}
+	if len(errs) != 0 {
+		return pubIDs, errs
+	}
+	return pubIDs, nil
+}
+
+// publishOptions returns the options for a PUBLISH, with exclude_me set if the
+// client is configured with ExcludePublisherByDefault.
+func (c *Client) publishOptions(options wamp.Dict) wamp.Dict {
+	if c.excludeMe {
+		if _, ok := options[wamp.OptExcludeMe]; !ok {
+			// Copy options to avoid modifying the caller's options.
+			opts := make(wamp.Dict, len(options)+1)
+			for k, v := range options {
+				opts[k] = v
+			}
+			opts[wamp.OptExcludeMe] = true
+			options = opts
+		}
+	}
+	if options == nil {
+		options = wamp.Dict{}
+	}
+	return options
+}
+
 // InvocationHandler handles a remote procedure call.
 //
 // The Context is used to signal that the router issued an INTERRUPT request to
@@ -350,6 +776,42 @@ func (c *Client) Publish(topic string, options wamp.Dict, args wamp.List, kwargs
 // not required that the handler send any progressive results.
 type InvocationHandler func(context.Context, *wamp.Invocation) InvokeResult
 
+// Interceptor wraps an InvocationHandler with another InvocationHandler.  This
+// allows cross-cutting concerns, such as logging, authorization checks, and
+// panic recovery, to be handled around every invocation.  The returned handler
+// calls next to continue processing the invocation.
+type Interceptor func(next InvocationHandler) InvocationHandler
+
+// UseInterceptor adds an interceptor to the chain of interceptors that wrap
+// every InvocationHandler registered by the client.  Interceptors are called
+// in the order they were added, so the first interceptor added is the first
+// to see an invocation and the last to see its result.  The interceptor
+// applies to invocations received after it is added, including invocations of
+// procedures that were registered before it was added.
+func (c *Client) UseInterceptor(interceptor Interceptor) {
+	c.sess.Lock()
+	c.interceptors = append(c.interceptors, interceptor)
+	c.sess.Unlock()
+}
+
+// RecoverInterceptor is an Interceptor that recovers from a panic in an
+// InvocationHandler, and returns a wamp.error.runtime_error to the caller
+// instead of crashing the client.  The panic value is returned in the error
+// arguments.
+func RecoverInterceptor(next InvocationHandler) InvocationHandler {
+	return func(ctx context.Context, inv *wamp.Invocation) (result InvokeResult) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = InvokeResult{
+					Err:  wamp.ErrRuntimeError,
+					Args: wamp.List{fmt.Sprint(r)},
+				}
+			}
+		}()
+		return next(ctx, inv)
+	}
+}
+
 // Register registers the client to handle invocations of the specified
 // procedure.  The InvocationHandler is set to be called for each procedure
 // call received.
@@ -373,8 +835,10 @@ func (c *Client) Register(procedure string, fn InvocationHandler, options wamp.D
 	if !c.Connected() {
 		return ErrNotConn
 	}
-	id := c.idGen.Next()
-	c.expectReply(id)
+	id, err := c.nextID(true)
+	if err != nil {
+		return err
+	}
 	if options == nil {
 		options = wamp.Dict{}
 	}
@@ -439,8 +903,10 @@ func (c *Client) Unregister(procedure string) error {
 		return ErrNotConn
 	}
 
-	id := c.idGen.Next()
-	c.expectReply(id)
+	id, err := c.nextID(true)
+	if err != nil {
+		return err
+	}
 	c.sess.Send(&wamp.Unregister{
 		Request:      id,
 		Registration: procID,
@@ -463,6 +929,72 @@ func (c *Client) Unregister(procedure string) error {
 	return nil
 }
 
+// UnregisterAll removes the registrations of all procedures that start with
+// prefix.  An empty prefix removes all registrations.  All UNREGISTER requests
+// are sent before waiting for any replies.  If any of the requests fail, then
+// a BulkError is returned with the error for each failure.
+func (c *Client) UnregisterAll(prefix string) error {
+	var procs []string
+	var regIDs []wamp.ID
+	c.sess.Lock()
+	for proc, regID := range c.nameProcID {
+		if !strings.HasPrefix(proc, prefix) {
+			continue
+		}
+		procs = append(procs, proc)
+		regIDs = append(regIDs, regID)
+		// Delete the registration anyway, as with Unregister.
+		delete(c.nameProcID, proc)
+		delete(c.invHandlers, regID)
+	}
+	c.sess.Unlock()
+
+	if len(procs) == 0 {
+		return nil
+	}
+	if !c.Connected() {
+		return ErrNotConn
+	}
+
+	var errs BulkError
+	reqIDs := make([]wamp.ID, len(regIDs))
+	for i := range regIDs {
+		id, err := c.nextID(true)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unregistering procedure '%s': %w", procs[i], err))
+			continue
+		}
+		reqIDs[i] = id
+		c.sess.Send(&wamp.Unregister{
+			Request:      id,
+			Registration: regIDs[i],
+		})
+	}
+
+	for i := range reqIDs {
+		if reqIDs[i] == 0 {
+			continue
+		}
+		msg, err := c.waitForReply(reqIDs[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unregistering procedure '%s': %w", procs[i], err))
+			continue
+		}
+		switch msg := msg.(type) {
+		case *wamp.Unregistered:
+		case *wamp.Error:
+			errs = append(errs, fmt.Errorf("unregistering procedure '%s': %s",
+				procs[i], wampErrorString(msg)))
+		default:
+			errs = append(errs, unexpectedMsgError(msg, wamp.UNREGISTERED))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
 // ProgressHandler is a type of function that is registered to asynchronously
 // handle progressive results while Call is waiting for a final response.
 type ProgressHandler func(*wamp.Result)
@@ -472,7 +1004,9 @@ type ProgressHandler func(*wamp.Result)
 // If an ERROR message is received from the router, the error value returned
 // can be type asserted to RPCError to provide access to the returned ERROR
 // message.  This may be necessary for the client application to process error
-// data from the RPC invocation.
+// data from the RPC invocation.  If an error mapping is registered for the
+// ERROR's URI, using RegisterErrorMapping, then the mapped error is returned
+// instead.
 //
 // Call Canceling
 //
@@ -481,7 +1015,8 @@ type ProgressHandler func(*wamp.Result)
 // separate Cancel() API to do this.  If the call is canceled before a result
 // is received, then a CANCEL message is sent to the router to cancel the call
 // according to the specified mode.  The client's cancel mode can be set using
-// SetCallCancelMode().
+// SetCallCancelMode(), and the mode for a single call can be set in its
+// context using WithCancelMode().
 //
 // If the context is canceled or times out, then error returned will not be a
 // RPCError.  This allows the caller to distinguish between cancellation
@@ -503,6 +1038,20 @@ type ProgressHandler func(*wamp.Result)
 // To request automatic call timeout, by the router and callee, specify a
 // timeout in milliseconds: options["timeout"] = 30000
 //
+// If no timeout is specified in the options, and the context has a deadline,
+// then the timeout is set to the time remaining until the deadline.  This keeps
+// the router and callee timeout in sync with the context.  An explicit timeout
+// in the options is always used as given.
+//
+// The client also limits how long it waits for the result of the call, in case
+// the router does not time out the call.  If the context has a deadline, then
+// the client waits until the deadline.  Otherwise, if a timeout is specified
+// in the options, then the client waits for that timeout, independent of the
+// ResponseTimeout given in the client's Config, and then cancels the call.
+// The canceled call returns the router's ERROR, or ErrReplyTimeout if the
+// router does not reply to the cancel.  A call with neither waits until the
+// result is received or the context is canceled.
+//
 // Caller Identification
 //
 // A caller may request the disclosure of its identity (its WAMP session ID) to
@@ -524,18 +1073,83 @@ type ProgressHandler func(*wamp.Result)
 // There is no need to set the "receive_progress" option, as this is
 // automatically set if a progress callback is provided.
 //
-// IMPORTANT: If the context has a timeout, then the amount of time needs to be
-// sufficient for the caller to receive all progressive results as well as the
-// final result.
+// IMPORTANT: The context deadline, or call timeout, needs to be sufficient for
+// the caller to receive all progressive results as well as the final result.
 func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, progcb ProgressHandler) (*wamp.Result, error) {
+	result, elapsed, err := c.call(ctx, procedure, options, args, kwargs, progcb)
+	c.callStats.record(elapsed, err)
+	return result, err
+}
+
+// CallTimed is the same as Call, and also returns the time taken from sending
+// the CALL to receiving the final RESULT or ERROR.  The duration is zero if
+// the CALL was not sent.
+func (c *Client) CallTimed(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, progcb ProgressHandler) (*wamp.Result, time.Duration, error) {
+	result, elapsed, err := c.call(ctx, procedure, options, args, kwargs, progcb)
+	c.callStats.record(elapsed, err)
+	return result, elapsed, err
+}
+
+func (c *Client) call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, progcb ProgressHandler) (*wamp.Result, time.Duration, error) {
 	if !c.Connected() {
-		return nil, ErrNotConn
+		return nil, 0, ErrNotConn
 	}
 
+	// Make the call cancelable by CancelAll.  Fail without making the call if
+	// there are already too many pending calls.
+	c.sess.Lock()
+	if c.maxPendingCalls > 0 && len(c.pendingCalls) >= c.maxPendingCalls {
+		c.sess.Unlock()
+		return nil, 0, ErrTooManyPendingCalls
+	}
+	id, err := c.syncNextID()
+	if err != nil {
+		c.sess.Unlock()
+		return nil, 0, err
+	}
+	c.awaitingReply[id] = make(chan wamp.Message)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pc := &pendingCall{cancel: cancel}
+	c.pendingCalls[id] = pc
+	c.sess.Unlock()
+
 	if options == nil {
 		options = wamp.Dict{}
 	}
 
+	// Derive the call timeout from the context deadline, unless a timeout was
+	// given explicitly.
+	if _, ok := options[wamp.OptTimeout]; !ok {
+		if deadline, ok := ctx.Deadline(); ok {
+			// Round up so that the router does not time out the call before
+			// the context deadline.
+			timeout := int64((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+			if timeout < 1 {
+				timeout = 1
+			}
+			// Copy options to avoid modifying the caller's options.
+			opts := make(wamp.Dict, len(options)+1)
+			for k, v := range options {
+				opts[k] = v
+			}
+			opts[wamp.OptTimeout] = timeout
+			options = opts
+		}
+	}
+
+	// Without a context deadline, wait for the call timeout given in the
+	// options, if any.
+	waitCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		if ms, _ := wamp.AsInt64(options[wamp.OptTimeout]); ms > 0 {
+			var cancelWait context.CancelFunc
+			waitCtx, cancelWait = context.WithTimeout(ctx,
+				time.Duration(ms)*time.Millisecond)
+			defer cancelWait()
+		}
+	}
+
 	// If caller is willing to receive progressive results, create a channel to
 	// receive these on.  Then, start a goroutine to receive progressive
 	// results and call the callback for each.
@@ -553,8 +1167,7 @@ func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict,
 		}()
 	}
 
-	id := c.idGen.Next()
-	c.expectReply(id)
+	start := time.Now()
 	c.sess.Send(&wamp.Call{
 		Request:     id,
 		Procedure:   wamp.URI(procedure),
@@ -564,7 +1177,31 @@ func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict,
 	})
 
 	// Wait to receive RESULT message.
-	msg, err := c.waitForReplyWithCancel(ctx, id, procedure, progChan)
+	msg, err := c.waitForReplyWithCancel(waitCtx, id, procedure, progChan)
+	elapsed := time.Since(start)
+	if err == context.DeadlineExceeded && waitCtx != ctx && ctx.Err() == nil {
+		// The client's own wait timed out, not the caller's context.  Report
+		// the router's ERROR for the canceled call, if it was received.
+		if _, ok := msg.(*wamp.Error); ok {
+			err = nil
+		} else {
+			err = ErrReplyTimeout
+		}
+	}
+
+	c.sess.Lock()
+	delete(c.pendingCalls, id)
+	canceled, reason := pc.canceled, pc.reason
+	c.sess.Unlock()
+	if canceled {
+		// If the call was canceled by CancelAll, then report the reason
+		// given, unless the call completed first.
+		if err != nil {
+			err = fmt.Errorf("%w: %s", ErrCallCanceled, reason)
+		} else if errMsg, ok := msg.(*wamp.Error); ok && errMsg.Error == wamp.ErrCanceled {
+			msg, err = nil, fmt.Errorf("%w: %s", ErrCallCanceled, reason)
+		}
+	}
 
 	// Finish handling any remaining progressive results before returning the
 	// final result.
@@ -573,18 +1210,315 @@ func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict,
 		<-progDone
 	}
 
+	if err != nil {
+		return nil, elapsed, err
+	}
+
+	switch msg := msg.(type) {
+	case *wamp.Result:
+		return msg, elapsed, nil
+	case *wamp.Error:
+		return nil, elapsed, rpcError(msg, procedure)
+	default:
+		return nil, elapsed, unexpectedMsgError(msg, wamp.RESULT)
+	}
+}
+
+// CallAny calls each of the given procedures at the same time, and returns the
+// first successful result.  The calls that have not finished are then
+// canceled, which sends a CANCEL message for each.  This is used to call
+// equivalent procedures for failover, and take whichever replies first.
+//
+// If all of the calls fail, then a BulkError is returned with the error from
+// each call.  The options and arguments are the same for all calls, and are
+// used as described for Call.
+func (c *Client) CallAny(ctx context.Context, procedures []string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) (*wamp.Result, error) {
+	if len(procedures) == 0 {
+		return nil, errors.New("no procedures to call")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type callResult struct {
+		procedure string
+		result    *wamp.Result
+		err       error
+	}
+	results := make(chan callResult, len(procedures))
+	for _, procedure := range procedures {
+		go func(procedure string) {
+			result, err := c.Call(ctx, procedure, options, args, kwargs, nil)
+			results <- callResult{procedure, result, err}
+		}(procedure)
+	}
+
+	errs := make(BulkError, 0, len(procedures))
+	for range procedures {
+		res := <-results
+		if res.err == nil {
+			// Canceling the context cancels the other calls.
+			return res.result, nil
+		}
+		if _, ok := res.err.(RPCError); !ok {
+			res.err = fmt.Errorf("calling remote procedure '%s': %w", res.procedure, res.err)
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, errs
+}
+
+// CallCollect calls the procedure corresponding to the given URI, and returns
+// a single result that combines the progressive results and the final result
+// of the call.  This is used to receive a large result that the callee sends
+// in chunks as progressive results.
+//
+// The Arguments of the progressive results and of the final result are
+// concatenated in the order received.  The ArgumentsKw are merged, with a
+// later result replacing the value of a key in an earlier result.  The Details
+// are those of the final result.  The options and arguments are used as
+// described for Call.
+func (c *Client) CallCollect(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) (*wamp.Result, error) {
+	var collected wamp.List
+	var collectedKw wamp.Dict
+	collect := func(result *wamp.Result) {
+		collected = append(collected, result.Arguments...)
+		for k, v := range result.ArgumentsKw {
+			if collectedKw == nil {
+				collectedKw = wamp.Dict{}
+			}
+			collectedKw[k] = v
+		}
+	}
+	// The progress handler is not called after Call returns, so the final
+	// result can be collected without synchronization.
+	result, err := c.Call(ctx, procedure, options, args, kwargs, collect)
 	if err != nil {
 		return nil, err
 	}
+	collect(result)
+	return &wamp.Result{
+		Request:     result.Request,
+		Details:     result.Details,
+		Arguments:   collected,
+		ArgumentsKw: collectedKw,
+	}, nil
+}
+
+// WaitReady calls the readiness procedure until the call succeeds, and then
+// returns nil.  This is used to wait for services behind the router to be
+// ready after connecting.  The time between calls starts small and doubles
+// after each failed call, up to a limit.
+//
+// If the context is done before the call succeeds, then the context error is
+// returned, with the error from the last call if there was one.  If the client
+// is disconnected, then ErrNotConn is returned.
+func (c *Client) WaitReady(ctx context.Context, procedure string) error {
+	delay := waitReadyMinDelay
+	for {
+		_, err := c.Call(ctx, procedure, nil, nil, nil, nil)
+		if err == nil {
+			return nil
+		}
+		if !c.Connected() {
+			return ErrNotConn
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: last error: %s", ctx.Err(), err)
+		}
+		if c.debug {
+			c.log.Printf("Procedure %s not ready, retrying in %s: %s",
+				procedure, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: last error: %s", ctx.Err(), err)
+		}
+		if delay *= 2; delay > waitReadyMaxDelay {
+			delay = waitReadyMaxDelay
+		}
+	}
+}
+
+// Flush waits until the router has processed all messages that the client
+// sent before calling Flush.  This is done by calling a session meta procedure
+// and waiting for the reply.  The router handles the messages from a session
+// in order, so when the reply is received, all earlier messages, such as
+// unacknowledged publications, have been handed to the router's broker and
+// dealer.  An ERROR reply, such as when the meta procedure is not authorized,
+// also completes the flush.
+//
+// This is intended for tests that need to know that the router received a
+// message, instead of sleeping.  If the context is done before the reply is
+// received, then the context error is returned.
+func (c *Client) Flush(ctx context.Context) error {
+	_, err := c.Call(ctx, string(wamp.MetaProcSessionCount), nil, nil, nil, nil)
+	var rpcErr RPCError
+	if err != nil && !errors.As(err, &rpcErr) {
+		return err
+	}
+	return nil
+}
+
+// CallSink is used by a caller to send a call's arguments to the callee in
+// multiple chunks, using progressive call invocations.  A CallSink is created
+// by calling CallStream.
+type CallSink struct {
+	c         *Client
+	ctx       context.Context
+	id        wamp.ID
+	procedure string
+	options   wamp.Dict
+
+	mu      sync.Mutex
+	started bool
+	closed  bool
+
+	done   chan struct{}
+	result *wamp.Result
+	err    error
+}
+
+// CallStream calls the procedure corresponding to the given URI, and returns
+// a CallSink that the caller writes the call arguments to in chunks.  Each
+// chunk written with Send is delivered to the callee as a progressive
+// INVOCATION, and the chunk written by Finish is delivered as the final
+// INVOCATION.  The final result of the call is obtained from Result.
+//
+// The router must support progressive call invocations, otherwise
+// ErrRouterNoProgCall is returned.  If the callee does not support progressive
+// call invocations, then the router responds with an ERROR which is returned
+// by Result.
+//
+// The provided Context is used to cancel the call in the same way as for
+// Call.
+func (c *Client) CallStream(ctx context.Context, procedure string, options wamp.Dict) (*CallSink, error) {
+	if !c.Connected() {
+		return nil, ErrNotConn
+	}
+	if !c.HasFeature(wamp.RoleDealer, wamp.FeatureProgCallInvocations) {
+		return nil, ErrRouterNoProgCall
+	}
+	if options == nil {
+		options = wamp.Dict{}
+	}
+	return &CallSink{
+		c:         c,
+		ctx:       ctx,
+		procedure: procedure,
+		options:   options,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Send sends a chunk of call arguments to the callee as a progressive CALL.
+func (s *CallSink) Send(args wamp.List, kwargs wamp.Dict) error {
+	return s.send(args, kwargs, true)
+}
+
+// Finish sends the final chunk of call arguments to the callee.  No more
+// chunks can be sent after calling Finish.
+func (s *CallSink) Finish(args wamp.List, kwargs wamp.Dict) error {
+	return s.send(args, kwargs, false)
+}
+
+// Result waits for, and returns, the final result of the call.  If the
+// context is done before the result is available, then the context's error is
+// returned and the call is not affected.  Result does not return a result
+// until Finish is called, unless the call fails.
+func (s *CallSink) Result(ctx context.Context) (*wamp.Result, error) {
+	select {
+	case <-s.done:
+		return s.result, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when the final result of the call is
+// available.
+func (s *CallSink) Done() <-chan struct{} { return s.done }
 
+func (s *CallSink) send(args wamp.List, kwargs wamp.Dict, progress bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSinkClosed
+	}
+	if !s.c.Connected() {
+		return ErrNotConn
+	}
+
+	options := make(wamp.Dict, len(s.options)+1)
+	for k, v := range s.options {
+		options[k] = v
+	}
+	if progress {
+		options[wamp.OptProgress] = true
+	} else {
+		s.closed = true
+	}
+
+	if !s.started {
+		id, err := s.c.nextID(true)
+		if err != nil {
+			s.closed = true
+			return err
+		}
+		s.id = id
+		s.started = true
+		go s.waitResult()
+	}
+	select {
+	case <-s.done:
+		// The call already finished, so the callee is not accepting more.
+		s.closed = true
+		return ErrSinkClosed
+	default:
+	}
+	return s.c.sess.Send(&wamp.Call{
+		Request:     s.id,
+		Procedure:   wamp.URI(s.procedure),
+		Options:     options,
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	})
+}
+
+func (s *CallSink) waitResult() {
+	defer close(s.done)
+	msg, err := s.c.waitForReplyWithCancel(s.ctx, s.id, s.procedure, nil)
+	if err != nil {
+		s.err = err
+		return
+	}
 	switch msg := msg.(type) {
 	case *wamp.Result:
-		return msg, nil
+		s.result = msg
 	case *wamp.Error:
-		return nil, RPCError{msg, procedure}
+		s.err = rpcError(msg, s.procedure)
 	default:
-		return nil, unexpectedMsgError(msg, wamp.RESULT)
+		s.err = unexpectedMsgError(msg, wamp.RESULT)
+	}
+}
+
+// CancelAll cancels all calls that are waiting for a result.  A CANCEL message
+// is sent for each pending call, and each call returns an error that wraps
+// ErrCallCanceled and includes the given reason.  Calls that complete before
+// they are canceled return their results normally.
+func (c *Client) CancelAll(reason string) {
+	c.sess.Lock()
+	for _, pc := range c.pendingCalls {
+		if !pc.canceled {
+			pc.canceled = true
+			pc.reason = reason
+			pc.cancel()
+		}
 	}
+	c.sess.Unlock()
 }
 
 // SetCallCancelMode sets the client's call cancel mode to one of the
@@ -609,18 +1543,55 @@ func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict,
 //
 // If the callee does not support call canceling, then behavior is "skip".
 func (c *Client) SetCallCancelMode(cancelMode string) error {
-	switch cancelMode {
-	case wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip:
-	case "":
+	if cancelMode == "" {
 		cancelMode = wamp.CancelModeKillNoWait
-	default:
-		return fmt.Errorf("cancel mode not one of: %q, %q, %q",
-			wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip)
+	} else if err := checkCancelMode(cancelMode); err != nil {
+		return err
 	}
 	c.cancelMode = cancelMode
 	return nil
 }
 
+// cancelModeKey is the context key for the cancel mode set by WithCancelMode.
+type cancelModeKey struct{}
+
+// WithCancelMode returns a copy of ctx that carries a call cancel mode.  When
+// a call made with the returned context, or a context derived from it, is
+// canceled, the CANCEL message sent to the router has this mode instead of the
+// client's mode set by SetCallCancelMode.  The mode is one of "kill",
+// "killnowait", or "skip".  See SetCallCancelMode for the behavior of each
+// mode.
+//
+// For example, to cancel a progressive call without waiting for the callee:
+//
+//	ctx, err := client.WithCancelMode(ctx, wamp.CancelModeKillNoWait)
+//	ctx, cancel := context.WithCancel(ctx)
+//	result, err := cli.Call(ctx, procedure, options, args, kwargs, progcb)
+func WithCancelMode(ctx context.Context, cancelMode string) (context.Context, error) {
+	if err := checkCancelMode(cancelMode); err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, cancelModeKey{}, cancelMode), nil
+}
+
+// callCancelMode returns the cancel mode to use when a call made with the
+// context is canceled.
+func (c *Client) callCancelMode(ctx context.Context) string {
+	if mode, ok := ctx.Value(cancelModeKey{}).(string); ok {
+		return mode
+	}
+	return c.cancelMode
+}
+
+func checkCancelMode(cancelMode string) error {
+	switch cancelMode {
+	case wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip:
+		return nil
+	}
+	return fmt.Errorf("cancel mode not one of: %q, %q, %q",
+		wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip)
+}
+
 // RPCError is a wrapper for a WAMP ERROR message that is received as a result
 // of a CALL.  This allows the client application to type assert the error to a
 // RPCError and inspect the the ERROR message contents, as may be necessary to
@@ -637,6 +1608,51 @@ func (rpce RPCError) Error() string {
 		rpce.Procedure, wampErrorString(rpce.Err))
 }
 
+var (
+	errorMappings     map[wamp.URI]func(RPCError) error
+	errorMappingsLock sync.RWMutex
+)
+
+// RegisterErrorMapping registers a function that converts an RPCError, having
+// the given error URI, into an application-specific error.  When a call
+// returns an ERROR with the URI, the error returned by the function is
+// returned by Call instead of the RPCError.  This lets an application map the
+// error URIs that it knows to its own error types or sentinel errors, which
+// can be checked with errors.Is or errors.As.  If the function returns nil,
+// then the RPCError is returned.
+//
+// The mappings apply to all clients.  Registering a mapping for a URI replaces
+// any previous mapping, and registering a nil function removes the mapping.
+// To keep the ERROR message available, the returned error can wrap the
+// RPCError.
+func RegisterErrorMapping(uri wamp.URI, factory func(RPCError) error) {
+	errorMappingsLock.Lock()
+	defer errorMappingsLock.Unlock()
+	if factory == nil {
+		delete(errorMappings, uri)
+		return
+	}
+	if errorMappings == nil {
+		errorMappings = map[wamp.URI]func(RPCError) error{}
+	}
+	errorMappings[uri] = factory
+}
+
+// rpcError returns the error for an ERROR received in reply to a call.  This
+// is an RPCError, unless an error mapping is registered for the ERROR's URI.
+func rpcError(msg *wamp.Error, procedure string) error {
+	rpcErr := RPCError{msg, procedure}
+	errorMappingsLock.RLock()
+	factory := errorMappings[msg.Error]
+	errorMappingsLock.RUnlock()
+	if factory != nil {
+		if err := factory(rpcErr); err != nil {
+			return err
+		}
+	}
+	return rpcErr
+}
+
 // Close causes the client to leave the realm it has joined, and closes the
 // connection to the router.
 func (c *Client) Close() error {
@@ -676,6 +1692,11 @@ func (c *Client) Close() error {
 		}
 	}
 
+	// Wait for heartbeats to stop.
+	if c.heartbeatDone != nil {
+		<-c.heartbeatDone
+	}
+
 	// When for any running invocation handlers to finish.
 	c.activeInvHandlers.Wait()
 	c.sess.Close()
@@ -739,6 +1760,24 @@ func (c *Client) SendProgress(ctx context.Context, args wamp.List, kwArgs wamp.D
 	return nil
 }
 
+// ProgressiveInvocations returns the channel on which an InvocationHandler
+// receives the remaining INVOCATION messages of a progressive call invocation.
+// The first INVOCATION is the one passed to the handler, and the channel is
+// closed after the final INVOCATION is delivered.  INVOCATION messages are
+// queued until received from the channel, so a handler that is slow to
+// receive them does not hold up other messages to the client.  If more than
+// 64 INVOCATION messages are waiting to be received, then the invocation is
+// canceled.  If the invocation is not a progressive call invocation, then nil
+// is returned.
+//
+// IMPORTANT: The context passed into ProgressiveInvocations MUST be the same
+// context that was passed into the invocation handler.
+func (c *Client) ProgressiveInvocations(ctx context.Context) <-chan *wamp.Invocation {
+	c.sess.Lock()
+	defer c.sess.Unlock()
+	return c.streamGate[ctx]
+}
+
 // joinRealm joins a WAMP realm, handling challenge/response authentication if
 // needed.  The authHandlers portion of cfg supplies a map of WAMP authmethod
 // names to functions that handle each auth type.  This can be nil if router is
@@ -903,11 +1942,46 @@ func unexpectedMsgError(msg wamp.Message, expected wamp.MessageType) error {
 	return errors.New(s)
 }
 
-func (c *Client) expectReply(id wamp.ID) {
-	wait := make(chan wamp.Message)
+// nextID returns the ID for the next request sent by the client.  If reply is
+// true, then the client is set to receive the reply to the request, in the
+// same critical section that checks that the ID is not in use.
+func (c *Client) nextID(reply bool) (wamp.ID, error) {
+	if c.requestIDs == nil && !reply {
+		return c.idGen.Next(), nil
+	}
 	c.sess.Lock()
-	c.awaitingReply[id] = wait
-	c.sess.Unlock()
+	defer c.sess.Unlock()
+	id, err := c.syncNextID()
+	if err != nil {
+		return 0, err
+	}
+	if reply {
+		c.awaitingReply[id] = make(chan wamp.Message)
+	}
+	return id, nil
+}
+
+// syncNextID returns the ID for the next request.  IDs from RequestIDs that
+// are zero or in use are skipped, up to maxRequestIDTries times.  Must be
+// called with the session lock held.
+func (c *Client) syncNextID() (wamp.ID, error) {
+	if c.requestIDs == nil {
+		return c.idGen.Next(), nil
+	}
+	for i := 0; i < maxRequestIDTries; i++ {
+		id := c.requestIDs()
+		if id == 0 {
+			continue
+		}
+		if _, ok := c.awaitingReply[id]; ok {
+			continue
+		}
+		if _, ok := c.pendingCalls[id]; ok {
+			continue
+		}
+		return id, nil
+	}
+	return 0, ErrNoRequestID
 }
 
 // waitForReply waits for an expected reply from the router.
@@ -938,7 +2012,7 @@ func (c *Client) waitForReply(id wamp.ID) (wamp.Message, error) {
 	case <-timer.C:
 		err = ErrReplyTimeout
 	case <-c.Done():
-		err = ErrNotConn
+		err = c.disconnectErr()
 	}
 	c.sess.Lock()
 	delete(c.awaitingReply, id)
@@ -983,15 +2057,24 @@ CollectResults:
 				}
 			}
 		}
+		// If the router canceled the call because the timeout derived from
+		// the context deadline expired, then report the context's error, the
+		// same as when the context expires first.
+		if errMsg, isErr := msg.(*wamp.Error); isErr && errMsg.Error == wamp.ErrCanceled {
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				err = context.DeadlineExceeded
+			}
+		}
 	case <-ctx.Done():
 		err = ctx.Err()
+		cancelMode := c.callCancelMode(ctx)
 		if c.debug {
 			c.log.Printf("Call to %q canceled by caller (mode=%s): %s",
-				procedure, c.cancelMode, err)
+				procedure, cancelMode, err)
 		}
 		c.sess.Send(&wamp.Cancel{
 			Request: id,
-			Options: wamp.SetOption(nil, wamp.OptMode, c.cancelMode),
+			Options: wamp.SetOption(nil, wamp.OptMode, cancelMode),
 		})
 		// Wait for the ERROR from the dealer.
 		timer := time.NewTimer(c.responseTimeout)
@@ -1013,7 +2096,7 @@ CollectResults:
 			err = ErrReplyTimeout
 		}
 	case <-c.Done():
-		err = ErrNotConn
+		err = c.disconnectErr()
 	}
 	// All done with this call, so not waiting for more replies.
 	c.sess.Lock()
@@ -1023,9 +2106,25 @@ CollectResults:
 	return msg, err
 }
 
+// disconnectErr returns the error for a request that was still waiting for a
+// reply when the client was disconnected from the router.  If the router ended
+// the session by sending GOODBYE, then ErrGoodbyeAndOut is returned.
+//
+// Must only be called after c.Done() is closed.
+func (c *Client) disconnectErr() error {
+	if c.routerGoodbye != nil && c.routerGoodbye.Reason != wamp.CloseGoodbyeAndOut {
+		return ErrGoodbyeAndOut
+	}
+	return ErrNotConn
+}
+
 // run is the core client goroutine.  This handles messages received from the
 // router and serializes access to all mutable state.
 func (c *Client) run() {
+	defer func() {
+		c.stateChanges <- ConnStateClosed
+		close(c.stateChanges)
+	}()
 	defer c.cancel()
 	if c.debug {
 		defer c.log.Println("Client", c.sess, "closed")
@@ -1039,6 +2138,7 @@ func (c *Client) run() {
 			if !ok {
 				return
 			}
+			atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 			if c.runReceiveFromRouter(msg) {
 				return
 			}
@@ -1075,6 +2175,10 @@ func (c *Client) runReceiveFromRouter(msg wamp.Message) bool {
 	case *wamp.Unsubscribed:
 		c.runSignalReply(msg, msg.Request)
 	case *wamp.Unregistered:
+		if msg.Request == 0 {
+			c.runHandleRevoke(msg)
+			break
+		}
 		c.runSignalReply(msg, msg.Request)
 	case *wamp.Result:
 		c.runSignalReply(msg, msg.Request)
@@ -1085,6 +2189,15 @@ func (c *Client) runReceiveFromRouter(msg wamp.Message) bool {
 
 	case *wamp.Goodbye:
 		c.routerGoodbye = msg
+		// If the router initiated closing the session, then acknowledge with
+		// GOODBYE.  Any requests still waiting for a reply fail when run()
+		// exits.
+		if msg.Reason != wamp.CloseGoodbyeAndOut {
+			c.sess.TrySend(&wamp.Goodbye{
+				Reason:  wamp.CloseGoodbyeAndOut,
+				Details: wamp.Dict{},
+			})
+		}
 		return true
 
 	default:
@@ -1099,15 +2212,32 @@ func (c *Client) runReceiveFromRouter(msg wamp.Message) bool {
 // The eventHandlers are called serially so that they execute in the same order
 // as the messages are received in.  This could not be guaranteed if executing
 // concurrently in separate goroutines.
+//
+// A panic in an event handler is recovered from, so that it does not stop the
+// client from handling subsequent messages.
 func (c *Client) runHandleEvent(msg *wamp.Event) {
 	c.sess.Lock()
 	handler, ok := c.eventHandlers[msg.Subscription]
+	unhandled := c.unhandledEventHandler
 	c.sess.Unlock()
 	if !ok {
+		if unhandled != nil {
+			unhandled(msg)
+			return
+		}
 		c.log.Println("No handler registered for subscription:",
 			msg.Subscription)
 		return
 	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Printf("Recovered from panic in event handler for subscription %v: %v\n%s",
+				msg.Subscription, r, debug.Stack())
+			if c.eventPanicHandler != nil {
+				c.eventPanicHandler(msg, r)
+			}
+		}
+	}()
 	handler(msg)
 }
 
@@ -1116,11 +2246,23 @@ func (c *Client) runHandleEvent(msg *wamp.Event) {
 func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 	timeout, _ := wamp.AsInt64(msg.Details[wamp.OptTimeout])
 	progResOK, _ := msg.Details[wamp.OptReceiveProgress].(bool)
+	progress, _ := msg.Details[wamp.OptProgress].(bool)
 	reqID := msg.Request
 
 	c.sess.Lock()
+	if stream, ok := c.invStreams[reqID]; ok {
+		// This INVOCATION continues a progressive call invocation that is
+		// already being handled.
+		if !progress {
+			delete(c.invStreams, reqID)
+		}
+		c.sess.Unlock()
+		c.runDeliverInvocation(stream, msg, progress)
+		return
+	}
 	handler, ok := c.invHandlers[msg.Registration]
 	if !ok {
+		unhandled := c.unhandledInvocationHandler
 		c.sess.Unlock()
 		errMsg := fmt.Sprintf("client has no handler for registration %v",
 			msg.Registration)
@@ -1136,9 +2278,18 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 			Error:     wamp.ErrInvalidArgument,
 			Arguments: wamp.List{errMsg},
 		})
+		if unhandled != nil {
+			unhandled(msg)
+			return
+		}
 		c.log.Print(errMsg)
 		return
 	}
+	// Wrap the handler in the interceptors, so that the first interceptor
+	// added is the outermost.
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		handler = c.interceptors[i](handler)
+	}
 
 	// Create a kill switch so that invocation can be canceled.
 	var cancel context.CancelFunc
@@ -1158,6 +2309,18 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 	if progResOK {
 		c.progGate[ctx] = reqID
 	}
+	// If this is the first of a progressive call invocation, create the
+	// channel that delivers the remaining invocations to the handler.
+	if progress {
+		stream := &invocationStream{
+			ctx:    ctx,
+			chunks: make(chan *wamp.Invocation),
+			ready:  make(chan struct{}, 1),
+		}
+		c.invStreams[reqID] = stream
+		c.streamGate[ctx] = stream.chunks
+		go stream.forward(c.Done())
+	}
 	c.sess.Unlock()
 
 	// Start a goroutine to run the user-defined invocation handler.
@@ -1179,6 +2342,8 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 		defer func() {
 			c.sess.Lock()
 			delete(c.progGate, ctx)
+			delete(c.streamGate, ctx)
+			delete(c.invStreams, reqID)
 			delete(c.invHandlerKill, reqID)
 			c.sess.Unlock()
 			c.activeInvHandlers.Done()
@@ -1231,6 +2396,88 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 	}()
 }
 
+// invocationStream delivers the INVOCATION messages, of a progressive call
+// invocation, that follow the first INVOCATION.  Messages are queued until the
+// handler receives them, so that a slow handler does not block the client from
+// receiving other messages.
+type invocationStream struct {
+	ctx    context.Context
+	chunks chan *wamp.Invocation
+
+	mu      sync.Mutex
+	pending []*wamp.Invocation
+	final   bool
+	ready   chan struct{}
+}
+
+// forward sends the queued INVOCATION messages to the handler, and closes the
+// chunks channel after the final INVOCATION is sent.  Returns when the handler
+// finishes or the client is done.
+func (s *invocationStream) forward(done <-chan struct{}) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			final := s.final
+			s.mu.Unlock()
+			if final {
+				close(s.chunks)
+				return
+			}
+			select {
+			case <-s.ready:
+				continue
+			case <-s.ctx.Done():
+			case <-done:
+			}
+			return
+		}
+		msg := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.chunks <- msg:
+		case <-s.ctx.Done():
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// runDeliverInvocation queues an INVOCATION for the handler that is handling
+// the progressive call invocation.  If the handler has already finished, then
+// the INVOCATION is discarded.  If the queue is full, then the invocation is
+// canceled.
+func (c *Client) runDeliverInvocation(stream *invocationStream, msg *wamp.Invocation, progress bool) {
+	if stream.ctx.Err() != nil {
+		c.log.Println("Discarded INVOCATION", msg.Request,
+			"for finished invocation handler")
+		return
+	}
+	stream.mu.Lock()
+	if len(stream.pending) == maxPendingInvocations {
+		stream.mu.Unlock()
+		c.log.Println("Canceled INVOCATION", msg.Request,
+			"because handler is not receiving progressive call invocations")
+		c.sess.Lock()
+		cancel, ok := c.invHandlerKill[msg.Request]
+		c.sess.Unlock()
+		if ok {
+			cancel()
+		}
+		return
+	}
+	stream.pending = append(stream.pending, msg)
+	stream.final = !progress
+	stream.mu.Unlock()
+	select {
+	case stream.ready <- struct{}{}:
+	default:
+	}
+}
+
 // runHandleInterrupt processes an INTERRUPT message from the router,
 // requesting that a pending call be canceled.
 func (c *Client) runHandleInterrupt(msg *wamp.Interrupt) {
@@ -1250,6 +2497,23 @@ func (c *Client) runHandleInterrupt(msg *wamp.Interrupt) {
 	cancel()
 }
 
+// runHandleRevoke processes an UNREGISTERED message from the router that
+// revokes a registration, by removing the registration's handler.
+func (c *Client) runHandleRevoke(msg *wamp.Unregistered) {
+	regID, _ := wamp.AsID(msg.Details[wamp.OptRegistration])
+	c.sess.Lock()
+	delete(c.invHandlers, regID)
+	for proc, id := range c.nameProcID {
+		if id == regID {
+			delete(c.nameProcID, proc)
+			break
+		}
+	}
+	c.sess.Unlock()
+	reason, _ := wamp.AsURI(msg.Details[wamp.OptReason])
+	c.log.Println("Router revoked registration", regID, "reason:", reason)
+}
+
 func (c *Client) runSignalReply(msg wamp.Message, requestID wamp.ID) {
 	var w chan wamp.Message
 	var ok bool
@@ -1266,3 +2530,31 @@ func (c *Client) runSignalReply(msg wamp.Message, requestID wamp.ID) {
 	case <-c.Done():
 	}
 }
+
+// copyDict returns a copy of the dictionary.  Dictionaries and lists nested in
+// the dictionary are also copied.
+func copyDict(dict wamp.Dict) wamp.Dict {
+	out := make(wamp.Dict, len(dict)+1)
+	for k, v := range dict {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case wamp.Dict:
+		return copyDict(v)
+	case map[string]interface{}:
+		return copyDict(v)
+	case wamp.List:
+		out := make(wamp.List, len(v))
+		for i := range v {
+			out[i] = copyValue(v[i])
+		}
+		return out
+	case []interface{}:
+		return copyValue(wamp.List(v))
+	}
+	return v
+}
@@ -1,13 +1,30 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,8 +33,10 @@ import (
 	"github.com/gammazero/nexus/v3/router/auth"
 	"github.com/gammazero/nexus/v3/stdlog"
 	"github.com/gammazero/nexus/v3/transport"
+	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 	"github.com/gammazero/nexus/v3/wamp/crsign"
+	"golang.org/x/crypto/nacl/sign"
 )
 
 const (
@@ -216,6 +235,73 @@ func TestClientJoinRealmWithCRAuth(t *testing.T) {
 	r.Close()
 }
 
+func TestSessionDetails(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ticketAuth := auth.NewTicketAuthenticator(&serverKeyStore{"static"}, time.Second)
+	realmConfig := &router.RealmConfig{
+		URI:              wamp.URI("nexus.test.auth"),
+		StrictURI:        true,
+		Authenticators:   []auth.Authenticator{ticketAuth},
+		RequireLocalAuth: true,
+	}
+	r, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cfg := Config{
+		Realm: "nexus.test.auth",
+		HelloDetails: wamp.Dict{
+			"authid": "jdoe",
+		},
+		AuthHandlers: map[string]AuthFunc{
+			"ticket": func(c *wamp.Challenge) (string, wamp.Dict) {
+				return "ticketforjoe1234", wamp.Dict{}
+			},
+		},
+		Logger: logger,
+	}
+	client, err := ConnectLocal(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.Realm() != "nexus.test.auth" {
+		t.Fatal("wrong realm:", client.Realm())
+	}
+
+	details := client.SessionDetails()
+	if id, _ := wamp.AsID(details["session"]); id != client.ID() {
+		t.Fatal("wrong session ID:", details["session"])
+	}
+	if authid, _ := wamp.AsString(details["authid"]); authid != "jdoe" {
+		t.Fatal("wrong authid:", details["authid"])
+	}
+	if authrole, _ := wamp.AsString(details["authrole"]); authrole != "user" {
+		t.Fatal("wrong authrole:", details["authrole"])
+	}
+	if authmethod, _ := wamp.AsString(details["authmethod"]); authmethod != "ticket" {
+		t.Fatal("wrong authmethod:", details["authmethod"])
+	}
+
+	// Check that modifying the returned details does not change the client's
+	// session details.
+	details["authrole"] = "admin"
+	if roles, ok := wamp.AsDict(details["roles"]); ok {
+		delete(roles, "broker")
+	}
+	details = client.SessionDetails()
+	if authrole, _ := wamp.AsString(details["authrole"]); authrole != "user" {
+		t.Fatal("session details were modified:", details["authrole"])
+	}
+	if _, err = wamp.DictValue(details, []string{"roles", "broker"}); err != nil {
+		t.Fatal("nested session details were modified")
+	}
+}
+
 func TestSubscribe(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -470,6 +556,193 @@ func TestProgressiveCall(t *testing.T) {
 	r.Close()
 }
 
+func TestCallStream(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect two clients to the same server
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	// Handler aggregates the chunks sent by the caller.
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		var sum int64
+		addArgs := func(args wamp.List) {
+			for _, arg := range args {
+				if n, ok := wamp.AsInt64(arg); ok {
+					sum += n
+				}
+			}
+		}
+		addArgs(inv.Arguments)
+		chunks := callee.ProgressiveInvocations(ctx)
+		if chunks == nil {
+			return InvokeResult{Err: "test.not_progressive"}
+		}
+		count := 1
+		for inv = range chunks {
+			addArgs(inv.Arguments)
+			count++
+		}
+		return InvokeResult{Args: wamp.List{sum, count}}
+	}
+
+	procName := "nexus.test.streamproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+
+	sink, err := caller.CallStream(context.Background(), procName, nil)
+	if err != nil {
+		t.Fatal("Failed to create call stream:", err)
+	}
+	for i := 1; i < 10; i++ {
+		if err = sink.Send(wamp.List{i}, nil); err != nil {
+			t.Fatal("Failed to send chunk:", err)
+		}
+	}
+	if err = sink.Finish(wamp.List{10}, nil); err != nil {
+		t.Fatal("Failed to send final chunk:", err)
+	}
+	if err = sink.Send(wamp.List{11}, nil); err != ErrSinkClosed {
+		t.Fatal("Expected ErrSinkClosed, got:", err)
+	}
+
+	result, err := sink.Result(context.Background())
+	if err != nil {
+		t.Fatal("Failed to call procedure:", err)
+	}
+	sum, _ := wamp.AsInt64(result.Arguments[0])
+	if sum != 55 {
+		t.Fatal("Wrong result:", sum)
+	}
+	count, _ := wamp.AsInt64(result.Arguments[1])
+	if count != 10 {
+		t.Fatal("Expected 10 chunks, got", count)
+	}
+}
+
+func TestCallStreamSlowConsumer(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	// Handler does not receive chunks until released.
+	release := make(chan struct{})
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		chunks := callee.ProgressiveInvocations(ctx)
+		<-release
+		count := 1
+		for range chunks {
+			count++
+		}
+		return InvokeResult{Args: wamp.List{count}}
+	}
+	const streamProc = "nexus.test.slowstream"
+	if err = callee.Register(streamProc, handler, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+	const pingProc = "nexus.test.ping"
+	ping := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{}
+	}
+	if err = callee.Register(pingProc, ping, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+
+	sink, err := caller.CallStream(context.Background(), streamProc, nil)
+	if err != nil {
+		t.Fatal("Failed to create call stream:", err)
+	}
+	const numChunks = 50
+	for i := 1; i < numChunks; i++ {
+		if err = sink.Send(wamp.List{i}, nil); err != nil {
+			t.Fatal("Failed to send chunk:", err)
+		}
+	}
+	if err = sink.Finish(nil, nil); err != nil {
+		t.Fatal("Failed to send final chunk:", err)
+	}
+
+	// Check that the callee handles other calls while chunks are queued.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = caller.Call(ctx, pingProc, nil, nil, nil, nil); err != nil {
+		close(release)
+		t.Fatal("Call blocked by slow stream consumer:", err)
+	}
+
+	// Check that Result returns when its context is done.
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	if _, err = sink.Result(shortCtx); err != context.DeadlineExceeded {
+		close(release)
+		t.Fatal("Expected context.DeadlineExceeded, got:", err)
+	}
+
+	close(release)
+	result, err := sink.Result(ctx)
+	if err != nil {
+		t.Fatal("Failed to call procedure:", err)
+	}
+	if count, _ := wamp.AsInt64(result.Arguments[0]); count != numChunks {
+		t.Fatal("Expected", numChunks, "chunks, got", count)
+	}
+}
+
+func TestCallStreamQueueLimit(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	// Handler never receives chunks, and returns when canceled.
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		<-ctx.Done()
+		return InvokeResult{Err: wamp.ErrCanceled}
+	}
+	const streamProc = "nexus.test.stuckstream"
+	if err = callee.Register(streamProc, handler, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+
+	sink, err := caller.CallStream(context.Background(), streamProc, nil)
+	if err != nil {
+		t.Fatal("Failed to create call stream:", err)
+	}
+	// The first Send starts the call, and one chunk is held while it is
+	// forwarded to the handler, so send enough to go over the limit.
+	for i := 0; i < maxPendingInvocations+3; i++ {
+		if err = sink.Send(wamp.List{i}, nil); err != nil {
+			t.Fatal("Failed to send chunk:", err)
+		}
+	}
+
+	// Check that the invocation is canceled when too many chunks are queued.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = sink.Result(ctx)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Err.Error != wamp.ErrCanceled {
+		t.Fatal("Expected canceled error, got:", err)
+	}
+}
+
 func TestTimeoutCancelRemoteProcedureCall(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -687,6 +960,27 @@ func (ks *serverKeyStore) AuthRole(authid string) (string, error) {
 	return "user", nil
 }
 
+type cryptoSignKeyStore struct {
+	publicKey []byte
+}
+
+func (ks *cryptoSignKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if authid != "jdoe" || authmethod != "cryptosign" {
+		return nil, errors.New("no such user: " + authid)
+	}
+	return ks.publicKey, nil
+}
+
+func (ks *cryptoSignKeyStore) PasswordInfo(authid string) (string, int, int) {
+	return "", 0, 0
+}
+
+func (ks *cryptoSignKeyStore) Provider() string { return "static" }
+
+func (ks *cryptoSignKeyStore) AuthRole(authid string) (string, error) {
+	return "user", nil
+}
+
 // ---- network testing ----
 
 func TestConnectContext(t *testing.T) {
@@ -936,6 +1230,69 @@ func TestInvocationHandlerMissedDone(t *testing.T) {
 	r.Close()
 }
 
+// Test that a call waiting for a result fails promptly when the router ends
+// the caller's session with GOODBYE.
+func TestRouterGoodbyePendingCall(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	killer, err := newTestClient(r)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer killer.Close()
+
+	calledChan := make(chan struct{})
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		close(calledChan)
+		<-ctx.Done()
+		return InvocationCanceled
+	}
+	procName := "nexus.test.blockproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	errChan := make(chan error)
+	go func() {
+		_, callErr := caller.Call(context.Background(), procName, nil, nil, nil, nil)
+		errChan <- callErr
+	}()
+	<-calledChan
+
+	killArgs := wamp.List{caller.ID()}
+	killKwArgs := wamp.Dict{"reason": "com.session.kill"}
+	_, err = killer.Call(context.Background(), string(wamp.MetaProcSessionKill), nil, killArgs, killKwArgs, nil)
+	if err != nil {
+		t.Fatal("failed to kill caller session:", err)
+	}
+
+	select {
+	case err = <-errChan:
+		if !errors.Is(err, ErrGoodbyeAndOut) {
+			t.Fatal("Expected ErrGoodbyeAndOut, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Call did not return after router GOODBYE")
+	}
+
+	gb := caller.RouterGoodbye()
+	if gb == nil {
+		t.Fatal("Expected GOODBYE from router")
+	}
+	if gb.Reason != wamp.URI("com.session.kill") {
+		t.Fatal("Wrong GOODBYE reason:", gb.Reason)
+	}
+	if err = caller.Close(); err != nil {
+		t.Fatal("Failed to close client:", err)
+	}
+}
+
 func TestProgressDisconnect(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -1016,7 +1373,7 @@ func TestProgressDisconnect(t *testing.T) {
 
 	// Check for expected error from caller.
 	err = <-progErr
-	if err != ErrNotConn {
+	if !errors.Is(err, ErrNotConn) {
 		t.Fatalf("expected error from caller: %q got %q", ErrNotConn, err)
 	}
 
@@ -1175,3 +1532,2778 @@ func TestEventContentSafety(t *testing.T) {
 		}
 	}
 }
+
+func TestBytesCounted(t *testing.T) {
+	r, closer, err := createTestServer()
+	if err != nil {
+		t.Fatal("failed to create test server:", err)
+	}
+	defer r.Close()
+	defer closer.Close()
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Serialization:   MSGPACK,
+		Logger:          logger,
+	}
+	cli, err := ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", testAddress), cfg)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer cli.Close()
+
+	// Joining the realm is a round-trip.
+	sent, recvd := cli.BytesSent(), cli.BytesReceived()
+	if sent == 0 || recvd == 0 {
+		t.Fatal("expected non-zero byte counts after join, sent:", sent,
+			"received:", recvd)
+	}
+
+	// Subscribing is another round-trip.
+	if err = cli.Subscribe(testTopic, func(*wamp.Event) {}, nil); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	if cli.BytesSent() <= sent {
+		t.Fatal("bytes sent did not increase")
+	}
+	if cli.BytesReceived() <= recvd {
+		t.Fatal("bytes received did not increase")
+	}
+}
+
+func TestMsgpackBinaryKwargs(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, closer, err := createTestServer()
+	if err != nil {
+		t.Fatal("failed to create test server:", err)
+	}
+	defer r.Close()
+	defer closer.Close()
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Serialization:   MSGPACK,
+		Logger:          logger,
+	}
+	callee, err := ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", testAddress), cfg)
+	if err != nil {
+		t.Fatal("failed to connect callee:", err)
+	}
+	defer callee.Close()
+	caller, err := ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", testAddress), cfg)
+	if err != nil {
+		t.Fatal("failed to connect caller:", err)
+	}
+	defer caller.Close()
+
+	data := []byte{0x00, 0x01, 0x7f, 0x80, 0xfe, 0xff}
+	checkBinary := func(kwargs wamp.Dict) error {
+		b, ok := kwargs["data"].([]byte)
+		if !ok {
+			return fmt.Errorf("data is %T, not []byte", kwargs["data"])
+		}
+		if !bytes.Equal(b, data) {
+			return errors.New("wrong value for data")
+		}
+		nested, _ := wamp.AsDict(kwargs["nested"])
+		if b, ok = nested["data"].([]byte); !ok {
+			return fmt.Errorf("nested data is %T, not []byte", nested["data"])
+		}
+		if !bytes.Equal(b, data) {
+			return errors.New("wrong value for nested data")
+		}
+		return nil
+	}
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		if err := checkBinary(inv.ArgumentsKw); err != nil {
+			return ResultError(wamp.ErrInvalidArgument, err.Error())
+		}
+		return InvokeResult{Kwargs: inv.ArgumentsKw}
+	}
+	if err = callee.Register("test.echo.binary", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	kwargs := wamp.Dict{
+		"data":   data,
+		"nested": wamp.Dict{"data": data},
+	}
+	result, err := caller.Call(context.Background(), "test.echo.binary", nil, nil, kwargs, nil)
+	if err != nil {
+		t.Fatal("callee did not receive binary kwargs:", err)
+	}
+	if err = checkBinary(result.ArgumentsKw); err != nil {
+		t.Fatal("caller did not receive binary kwargs:", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, closer, err := createTestServer()
+	if err != nil {
+		t.Fatal("failed to create test server:", err)
+	}
+	defer r.Close()
+	defer closer.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go router.NewRawSocketServer(r).Serve(l)
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Logger:          logger,
+	}
+	for _, routerURL := range []string{
+		fmt.Sprintf("ws://%s/ws", testAddress),
+		"tcp://" + l.Addr().String(),
+	} {
+		cli, err := ConnectNet(context.Background(), routerURL, cfg)
+		if err != nil {
+			t.Fatal("failed to connect client:", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		rtt, err := cli.Ping(ctx)
+		cancel()
+		cli.Close()
+		if err != nil {
+			t.Fatalf("ping over %s failed: %s", routerURL, err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("expected positive round-trip time over %s, got %s", routerURL, rtt)
+		}
+	}
+
+	// Check that a local client does not support ping.
+	cli, err := ConnectLocal(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err = cli.Ping(context.Background()); err != ErrPingUnsupported {
+		t.Fatal("expected ErrPingUnsupported, got", err)
+	}
+}
+
+func TestExcludePublisherByDefault(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cfg := newTestClientConfig(testRealm, func(c *Config) {
+		c.ExcludePublisherByDefault = true
+	})
+	cli, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer cli.Close()
+
+	events := make(chan *wamp.Event, 1)
+	if err = cli.SubscribeChan(testTopic, events, nil); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	// Publisher must not receive its own event.
+	ack := wamp.Dict{wamp.OptAcknowledge: true}
+	if err = cli.Publish(testTopic, ack, wamp.List{"excluded"}, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if _, ok := ack[wamp.OptExcludeMe]; ok {
+		t.Fatal("publish modified caller's options")
+	}
+	select {
+	case <-events:
+		t.Fatal("publisher received its own event")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Option in publish overrides the default.
+	opts := wamp.Dict{wamp.OptExcludeMe: false}
+	if err = cli.Publish(testTopic, opts, wamp.List{"included"}, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Arguments[0] != "included" {
+			t.Fatal("received wrong event:", ev.Arguments)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publisher did not receive event when exclude_me=false")
+	}
+}
+
+func TestCallTimeoutFromDeadline(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	// Handler returns the timeout that the callee received.
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{Args: wamp.List{inv.Details[wamp.OptTimeout]}}
+	}
+	procName := "nexus.test.timeout"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := caller.Call(ctx, procName, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	timeout, ok := wamp.AsInt64(result.Arguments[0])
+	if !ok {
+		t.Fatal("call did not carry timeout option")
+	}
+	if timeout <= 4000 || timeout > 5000 {
+		t.Fatal("timeout does not match context deadline:", timeout)
+	}
+
+	// Explicit timeout option wins over context deadline.
+	opts := wamp.Dict{wamp.OptTimeout: 1234}
+	result, err = caller.Call(ctx, procName, opts, nil, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if timeout, _ = wamp.AsInt64(result.Arguments[0]); timeout != 1234 {
+		t.Fatal("expected explicit timeout 1234, got:", timeout)
+	}
+}
+
+func TestSerializationFallback(t *testing.T) {
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Create server that only supports JSON.
+	s := router.NewWebsocketServer(r)
+	s.Upgrader.Subprotocols = []string{"wamp.2.json"}
+	const addr = "localhost:8998"
+	closer, err := s.ListenAndServe(addr)
+	if err != nil {
+		t.Fatal("failed to create test server:", err)
+	}
+	defer closer.Close()
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Serializations:  []serialize.Serialization{MSGPACK, JSON},
+		Logger:          logger,
+	}
+	cli, err := ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", addr), cfg)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer cli.Close()
+
+	if cli.Serialization() != JSON {
+		t.Fatal("expected JSON serialization, got", cli.Serialization())
+	}
+
+	// Check that connecting fails if no serialization is supported.
+	cfg.Serializations = []serialize.Serialization{MSGPACK, CBOR}
+	_, err = ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", addr), cfg)
+	if !errors.Is(err, transport.ErrSerializerUnsupported) {
+		t.Fatal("expected ErrSerializerUnsupported, got", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := cli.Context()
+	if ctx.Err() != nil {
+		t.Fatal("context should not be canceled while connected")
+	}
+
+	cli.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after Close")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatal("expected context.Canceled, got", ctx.Err())
+	}
+
+	// Check that the context is canceled when the router goes away.
+	cli, err = newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	r.Close()
+	select {
+	case <-cli.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled after router closed")
+	}
+}
+
+func TestCancelAll(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	started := make(chan struct{})
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		started <- struct{}{}
+		<-ctx.Done() // handler will block until canceled.
+		return InvokeResult{Err: wamp.ErrCanceled}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	const callCount = 3
+	errChan := make(chan error, callCount)
+	for i := 0; i < callCount; i++ {
+		go func() {
+			_, e := caller.Call(context.Background(), procName, nil, nil, nil, nil)
+			errChan <- e
+		}()
+	}
+	// Wait for all calls to be invoked.
+	for i := 0; i < callCount; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("procedure was not invoked")
+		}
+	}
+
+	caller.CancelAll("shutting down")
+
+	timeout := time.After(time.Second)
+	for i := 0; i < callCount; i++ {
+		select {
+		case err = <-errChan:
+		case <-timeout:
+			t.Fatal("call was not canceled")
+		}
+		if !errors.Is(err, ErrCallCanceled) {
+			t.Fatal("expected ErrCallCanceled, got", err)
+		}
+		if !strings.Contains(err.Error(), "shutting down") {
+			t.Fatal("error does not contain reason:", err)
+		}
+	}
+
+	// Check that calls made after CancelAll are not affected.
+	if err = callee.Unregister(procName); err != nil {
+		t.Fatal("failed to unregister procedure:", err)
+	}
+	handler2 := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{Args: wamp.List{"ok"}}
+	}
+	if err = callee.Register(procName, handler2, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	if _, err = caller.Call(context.Background(), procName, nil, nil, nil, nil); err != nil {
+		t.Fatal("call failed after CancelAll:", err)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	var trace []string
+	traceInterceptor := func(name string) Interceptor {
+		return func(next InvocationHandler) InvocationHandler {
+			return func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+				trace = append(trace, name+" before")
+				result := next(ctx, inv)
+				trace = append(trace, name+" after")
+				return result
+			}
+		}
+	}
+	callee.UseInterceptor(traceInterceptor("first"))
+	callee.UseInterceptor(RecoverInterceptor)
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		trace = append(trace, "handler")
+		return InvokeResult{Args: wamp.List{"ok"}}
+	}
+	if err = callee.Register("test.ok", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	panicHandler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		panic("something bad")
+	}
+	if err = callee.Register("test.panic", panicHandler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	// Check that interceptors added after registering are used.
+	callee.UseInterceptor(traceInterceptor("second"))
+
+	if _, err = caller.Call(context.Background(), "test.ok", nil, nil, nil, nil); err != nil {
+		t.Fatal("call error:", err)
+	}
+	expect := []string{"first before", "second before", "handler", "second after", "first after"}
+	if strings.Join(trace, ",") != strings.Join(expect, ",") {
+		t.Fatal("wrong interceptor order:", trace)
+	}
+
+	// Check that a panicking handler returns an ERROR.
+	_, err = caller.Call(context.Background(), "test.panic", nil, nil, nil, nil)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatal("expected RPCError, got", err)
+	}
+	if rpcErr.Err.Error != wamp.ErrRuntimeError {
+		t.Fatal("wrong error URI:", rpcErr.Err.Error)
+	}
+	if msg, _ := wamp.AsString(rpcErr.Err.Arguments[0]); msg != "something bad" {
+		t.Fatal("wrong error message:", msg)
+	}
+	if !callee.Connected() {
+		t.Fatal("callee should still be connected")
+	}
+}
+
+func TestInvokeResultConstructors(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer callee.Close()
+	defer caller.Close()
+
+	const errURI = wamp.URI("test.error.bad_thing")
+	handlers := map[string]InvocationHandler{
+		"test.zero": func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			return InvokeResult{}
+		},
+		"test.noresult": func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			return NoResult()
+		},
+		"test.error": func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			return ResultError(errURI, "bad", 42)
+		},
+		"test.error.noargs": func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			return ResultError(errURI)
+		},
+	}
+	for proc, handler := range handlers {
+		if err = callee.Register(proc, handler, nil); err != nil {
+			t.Fatal("failed to register procedure:", err)
+		}
+	}
+
+	// Check that the zero InvokeResult and NoResult yield an empty result.
+	for _, proc := range []string{"test.zero", "test.noresult"} {
+		result, err := caller.Call(context.Background(), proc, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("call to %s failed: %s", proc, err)
+		}
+		if len(result.Arguments) != 0 || len(result.ArgumentsKw) != 0 {
+			t.Fatalf("expected empty result from %s, got %v %v", proc,
+				result.Arguments, result.ArgumentsKw)
+		}
+	}
+
+	// Check that ResultError returns an ERROR with the given arguments.
+	_, err = caller.Call(context.Background(), "test.error", nil, nil, nil, nil)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatal("expected RPCError, got", err)
+	}
+	if rpcErr.Err.Error != errURI {
+		t.Fatal("wrong error URI:", rpcErr.Err.Error)
+	}
+	if len(rpcErr.Err.Arguments) != 2 {
+		t.Fatal("expected 2 error arguments, got", rpcErr.Err.Arguments)
+	}
+	if s, _ := wamp.AsString(rpcErr.Err.Arguments[0]); s != "bad" {
+		t.Fatal("wrong first error argument:", rpcErr.Err.Arguments[0])
+	}
+	if n, _ := wamp.AsInt64(rpcErr.Err.Arguments[1]); n != 42 {
+		t.Fatal("wrong second error argument:", rpcErr.Err.Arguments[1])
+	}
+
+	_, err = caller.Call(context.Background(), "test.error.noargs", nil, nil, nil, nil)
+	if !errors.As(err, &rpcErr) {
+		t.Fatal("expected RPCError, got", err)
+	}
+	if rpcErr.Err.Error != errURI || len(rpcErr.Err.Arguments) != 0 {
+		t.Fatal("wrong error:", rpcErr.Err.Error, rpcErr.Err.Arguments)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "nexustest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "nexus.sock")
+
+	// Serve rawsocket clients on a unix socket listener.
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go router.NewRawSocketServer(r).Serve(l)
+
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Logger:          logger,
+	}
+	callee, err := ConnectNet(context.Background(), "unix://"+sockPath, cfg)
+	if err != nil {
+		t.Fatal("failed to connect callee:", err)
+	}
+	defer callee.Close()
+	caller, err := ConnectNet(context.Background(), "unix://"+sockPath, cfg)
+	if err != nil {
+		t.Fatal("failed to connect caller:", err)
+	}
+	defer caller.Close()
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{Args: inv.Arguments}
+	}
+	if err = callee.Register("test.echo", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	result, err := caller.Call(context.Background(), "test.echo", nil, wamp.List{"hello"}, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if s, _ := wamp.AsString(result.Arguments[0]); s != "hello" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+}
+
+// nonceAuthenticator implements a custom challenge-response authentication
+// method, where the client signs a nonce and salt given in the CHALLENGE.
+type nonceAuthenticator struct {
+	secret string
+}
+
+func (a *nonceAuthenticator) AuthMethod() string { return "nonce-hmac" }
+
+func (a *nonceAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	nonce := fmt.Sprint("nonce-", sid)
+	client.Send(&wamp.Challenge{
+		AuthMethod: a.AuthMethod(),
+		Extra: wamp.Dict{
+			"nonce": nonce,
+			"params": wamp.Dict{
+				"salt": "pepper",
+			},
+		},
+	})
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	authMsg, ok := msg.(*wamp.Authenticate)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s message", msg.MessageType())
+	}
+	if authMsg.Signature != nonceSignature(a.secret, nonce, "pepper") {
+		return nil, errors.New("invalid signature")
+	}
+	return &wamp.Welcome{
+		Details: wamp.Dict{
+			"authid":     "jdoe",
+			"authrole":   "user",
+			"authmethod": a.AuthMethod(),
+		},
+	}, nil
+}
+
+func nonceSignature(secret, nonce, salt string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce + salt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthFuncChallengeDetails(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	realmConfig := &router.RealmConfig{
+		URI:            wamp.URI("nexus.test.auth"),
+		Authenticators: []auth.Authenticator{&nonceAuthenticator{"secret"}},
+	}
+	r, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Use a websocket connection so that the challenge is serialized.
+	server := httptest.NewServer(router.NewWebsocketServer(r))
+	defer server.Close()
+
+	authFunc := func(c *wamp.Challenge) (string, wamp.Dict) {
+		nonce, _ := wamp.AsString(c.Extra["nonce"])
+		salt, _ := wamp.DictValue(c.Extra, []string{"params", "salt"})
+		saltStr, _ := wamp.AsString(salt)
+		return nonceSignature("secret", nonce, saltStr), wamp.Dict{}
+	}
+	cfg := Config{
+		Realm:           "nexus.test.auth",
+		ResponseTimeout: time.Second,
+		HelloDetails:    wamp.Dict{"authid": "jdoe"},
+		AuthHandlers:    map[string]AuthFunc{"nonce-hmac": authFunc},
+		Logger:          logger,
+	}
+	cli, err := ConnectNet(context.Background(), server.URL, cfg)
+	if err != nil {
+		t.Fatal("failed to authenticate:", err)
+	}
+	cli.Close()
+
+	// Check that a wrong signature is refused.
+	cfg.AuthHandlers = map[string]AuthFunc{
+		"nonce-hmac": func(c *wamp.Challenge) (string, wamp.Dict) {
+			return nonceSignature("wrong", "", ""), wamp.Dict{}
+		},
+	}
+	if _, err = ConnectNet(context.Background(), server.URL, cfg); err == nil {
+		t.Fatal("expected authentication error")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscriber, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	const hbTopic = "nexus.test.heartbeat"
+	const interval = 50 * time.Millisecond
+	events := make(chan time.Time, 100)
+	err = subscriber.Subscribe(hbTopic, func(event *wamp.Event) {
+		events <- time.Now()
+	}, nil)
+	if err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	hbErrs := make(chan error, 10)
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.HeartbeatInterval = interval
+		cfg.HeartbeatTopic = hbTopic
+		cfg.HeartbeatErrorHandler = func(err error) { hbErrs <- err }
+	})
+	hbClient, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that heartbeats arrive at about the configured interval.
+	start := time.Now()
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case last = <-events:
+		case <-time.After(time.Second):
+			t.Fatal("did not receive heartbeat")
+		}
+	}
+	if elapsed := last.Sub(start); elapsed < 3*interval-interval/2 {
+		t.Fatal("heartbeats sent too often:", elapsed)
+	}
+	select {
+	case err = <-hbErrs:
+		t.Fatal("unexpected heartbeat error:", err)
+	default:
+	}
+
+	// Check that heartbeats stop when the client is closed.
+	if err = hbClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Drain any heartbeat that was in flight during close.
+	time.Sleep(interval)
+	for len(events) != 0 {
+		<-events
+	}
+	select {
+	case <-events:
+		t.Fatal("received heartbeat after close")
+	case <-time.After(3 * interval):
+	}
+
+	// Check that a failed heartbeat is reported to the error handler.
+	cfg = newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.HeartbeatInterval = interval
+		cfg.HeartbeatProcedure = "nexus.test.noproc"
+		cfg.HeartbeatErrorHandler = func(err error) { hbErrs <- err }
+	})
+	hbClient, err = newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hbClient.Close()
+	select {
+	case err = <-hbErrs:
+		var rpcErr RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Err.Error != wamp.ErrNoSuchProcedure {
+			t.Fatal("expected no such procedure error, got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat error not reported")
+	}
+}
+
+func TestHeartbeatErrorClose(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Check that the error handler can close the client.
+	closeErrs := make(chan error, 10)
+	clients := make(chan *Client, 1)
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+		cfg.HeartbeatProcedure = "nexus.test.noproc"
+		cfg.HeartbeatErrorHandler = func(err error) {
+			select {
+			case cli := <-clients:
+				closeErrs <- cli.Close()
+			default:
+			}
+		}
+	})
+	hbClient, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients <- hbClient
+	select {
+	case err = <-closeErrs:
+		if err != nil {
+			t.Fatal("close from heartbeat error handler failed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat error handler did not close client")
+	}
+	select {
+	case <-hbClient.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+}
+
+func TestDial(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	wsServer := httptest.NewServer(router.NewWebsocketServer(r))
+	defer wsServer.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go router.NewRawSocketServer(r).Serve(l)
+
+	// The dialer records the address dialed and connects to the real router
+	// address instead, so connecting only succeeds if the dialer is used.
+	const fakeAddr = "router.nexus.invalid:8000"
+	var dialed []string
+	dialTo := func(realAddr string) func(context.Context, string, string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			var d net.Dialer
+			return d.DialContext(ctx, network, realAddr)
+		}
+	}
+
+	wsAddr := strings.TrimPrefix(wsServer.URL, "http://")
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.Dial = dialTo(wsAddr)
+	})
+	cli, err := ConnectNet(context.Background(), "ws://"+fakeAddr+"/", *cfg)
+	if err != nil {
+		t.Fatal("failed to connect websocket client:", err)
+	}
+	cli.Close()
+
+	cfg.Dial = dialTo(l.Addr().String())
+	cli, err = ConnectNet(context.Background(), "tcp://"+fakeAddr+"/", *cfg)
+	if err != nil {
+		t.Fatal("failed to connect rawsocket client:", err)
+	}
+	cli.Close()
+
+	if len(dialed) != 2 {
+		t.Fatal("expected dialer to be called twice, called", len(dialed))
+	}
+	for _, addr := range dialed {
+		if addr != fakeAddr {
+			t.Fatal("dialer called with wrong address:", addr)
+		}
+	}
+}
+
+func TestOnConn(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	wsServer := httptest.NewServer(router.NewWebsocketServer(r))
+	defer wsServer.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go router.NewRawSocketServer(r).Serve(l)
+
+	var conns []net.Conn
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.OnConn = func(conn net.Conn) {
+			conns = append(conns, conn)
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetNoDelay(true)
+			}
+		}
+	})
+	checkConn := func(addr string) {
+		if len(conns) != 1 {
+			t.Fatal("expected OnConn to be called once, called", len(conns))
+		}
+		if conns[0] == nil {
+			t.Fatal("OnConn called with nil conn")
+		}
+		if conns[0].RemoteAddr().String() != addr {
+			t.Fatal("OnConn conn has wrong remote address:", conns[0].RemoteAddr())
+		}
+		conns = nil
+	}
+
+	wsAddr := strings.TrimPrefix(wsServer.URL, "http://")
+	cli, err := ConnectNet(context.Background(), wsServer.URL, *cfg)
+	if err != nil {
+		t.Fatal("failed to connect websocket client:", err)
+	}
+	cli.Close()
+	checkConn(wsAddr)
+
+	cli, err = ConnectNet(context.Background(), "tcp://"+l.Addr().String()+"/", *cfg)
+	if err != nil {
+		t.Fatal("failed to connect rawsocket client:", err)
+	}
+	cli.Close()
+	checkConn(l.Addr().String())
+
+	// Check that OnConn is called with the connection made by Dial.
+	var dialed int
+	cfg.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed++
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	cli, err = ConnectNet(context.Background(), "tcp://"+l.Addr().String()+"/", *cfg)
+	if err != nil {
+		t.Fatal("failed to connect rawsocket client:", err)
+	}
+	cli.Close()
+	checkConn(l.Addr().String())
+	if dialed != 1 {
+		t.Fatal("expected dialer to be called once, called", dialed)
+	}
+}
+
+func TestEventHandlerPanic(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	panics := make(chan interface{}, 1)
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.EventPanicHandler = func(event *wamp.Event, recovered interface{}) {
+			panics <- recovered
+		}
+	})
+	subscriber, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	publisher, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	events := make(chan string, 1)
+	err = subscriber.Subscribe(testTopic, func(event *wamp.Event) {
+		s, _ := wamp.AsString(event.Arguments[0])
+		if s == "panic" {
+			panic("event handler panic")
+		}
+		events <- s
+	}, nil)
+	if err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	if err = publisher.Publish(testTopic, nil, wamp.List{"panic"}, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case v := <-panics:
+		if v != "event handler panic" {
+			t.Fatal("wrong recovered value:", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic handler not called")
+	}
+
+	// Check that the next event is still delivered.
+	if err = publisher.Publish(testTopic, nil, wamp.List{"hello"}, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case s := <-events:
+		if s != "hello" {
+			t.Fatal("wrong event:", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered after panic")
+	}
+	if !subscriber.Connected() {
+		t.Fatal("subscriber not connected")
+	}
+}
+
+func TestMaxPendingCalls(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.MaxPendingCalls = 2
+	})
+	caller, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		started <- struct{}{}
+		<-release
+		return InvokeResult{}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	// Saturate the pending call limit.
+	errChan := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, e := caller.Call(context.Background(), procName, nil, nil, nil, nil)
+			errChan <- e
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("procedure was not invoked")
+		}
+	}
+
+	// Check that the next call fails immediately.
+	start := time.Now()
+	_, err = caller.Call(context.Background(), procName, nil, nil, nil, nil)
+	if !errors.Is(err, ErrTooManyPendingCalls) {
+		t.Fatal("expected ErrTooManyPendingCalls, got:", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("call did not fail fast")
+	}
+
+	// Complete one call and check that it frees a slot.
+	release <- struct{}{}
+	if err = <-errChan; err != nil {
+		t.Fatal("call error:", err)
+	}
+	go func() {
+		_, e := caller.Call(context.Background(), procName, nil, nil, nil, nil)
+		errChan <- e
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("procedure was not invoked after slot freed")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err = <-errChan; err != nil {
+			t.Fatal("call error:", err)
+		}
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	subscriber, publisher, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	// Check that a malformed filter is rejected at subscribe time.
+	err = subscriber.Subscribe(testTopic, func(*wamp.Event) {},
+		wamp.Dict{wamp.OptFilter: "severity >>= 3"})
+	if err == nil {
+		t.Fatal("expected error for malformed filter")
+	}
+	if !strings.Contains(err.Error(), string(wamp.ErrInvalidArgument)) {
+		t.Fatal("expected invalid argument error, got:", err)
+	}
+
+	events := make(chan int64, 10)
+	err = subscriber.Subscribe(testTopic, func(event *wamp.Event) {
+		severity, _ := wamp.AsInt64(event.ArgumentsKw["severity"])
+		events <- severity
+	}, wamp.Dict{wamp.OptFilter: "severity >= 3 && source == 'db'"})
+	if err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	publish := func(severity int, source string) {
+		kwargs := wamp.Dict{"severity": severity, "source": source}
+		if err := publisher.Publish(testTopic, nil, nil, kwargs); err != nil {
+			t.Fatal("publish error:", err)
+		}
+	}
+	publish(1, "db")
+	publish(5, "web")
+	publish(3, "db")
+	publish(2, "db")
+	publish(4, "db")
+
+	// Check that only matching events are delivered, in order.
+	for _, expect := range []int64{3, 4} {
+		select {
+		case severity := <-events:
+			if severity != expect {
+				t.Fatal("expected event with severity", expect, "got", severity)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not receive matching event")
+		}
+	}
+	select {
+	case severity := <-events:
+		t.Fatal("received event that did not match filter, severity", severity)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	subscriber, publisher, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	events := make(chan struct{}, 1)
+	err = subscriber.Subscribe(testTopic, func(*wamp.Event) {
+		events <- struct{}{}
+	}, nil)
+	if err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+
+	before := subscriber.LastActivity()
+	if before.IsZero() {
+		t.Fatal("LastActivity is zero after joining realm")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = publisher.Publish(testTopic, nil, nil, nil); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("did not receive event")
+	}
+	if after := subscriber.LastActivity(); !after.After(before) {
+		t.Fatal("LastActivity did not advance after receiving event")
+	}
+
+	// Check that transport pongs are counted as activity.
+	server := httptest.NewServer(router.NewWebsocketServer(r))
+	defer server.Close()
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.WsCfg.KeepAlive = 20 * time.Millisecond
+	})
+	cli, err := ConnectNet(context.Background(), server.URL, *cfg)
+	if err != nil {
+		t.Fatal("failed to connect websocket client:", err)
+	}
+	defer cli.Close()
+	before = cli.LastActivity()
+	time.Sleep(100 * time.Millisecond)
+	if after := cli.LastActivity(); !after.After(before) {
+		t.Fatal("LastActivity did not advance after receiving pongs")
+	}
+}
+
+func TestCallTimed(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	const delay = 200 * time.Millisecond
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		time.Sleep(delay)
+		return InvokeResult{Args: wamp.List{"done"}}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	result, elapsed, err := caller.CallTimed(context.Background(), procName, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if s, _ := wamp.AsString(result.Arguments[0]); s != "done" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+	if elapsed < delay {
+		t.Fatal("call duration", elapsed, "less than callee delay", delay)
+	}
+	if elapsed > delay+time.Second {
+		t.Fatal("call duration", elapsed, "too long for callee delay", delay)
+	}
+
+	// Check that the duration is reported for an error result.
+	_, elapsed, err = caller.CallTimed(context.Background(), "nosuchproc", nil, nil, nil, nil)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatal("expected RPCError, got:", err)
+	}
+	if elapsed <= 0 {
+		t.Fatal("expected positive call duration, got", elapsed)
+	}
+}
+
+func TestCallStats(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	if stats := caller.CallStats(); stats != (CallStats{}) {
+		t.Fatal("expected no stats before any call, got", stats)
+	}
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		delay, _ := wamp.AsInt64(inv.Arguments[0])
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		if len(inv.Arguments) > 1 {
+			return ResultError(wamp.URI("test.error"))
+		}
+		return InvokeResult{}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	// Make 9 fast calls and 1 slow call, and fail 2 of the fast calls.
+	const fast, slow = 20, 200
+	for i := 0; i < 10; i++ {
+		args := wamp.List{fast}
+		if i == 9 {
+			args = wamp.List{slow}
+		} else if i%4 == 0 && i != 0 {
+			args = append(args, "fail")
+		}
+		_, err = caller.Call(context.Background(), procName, nil, args, nil, nil)
+		if (len(args) > 1) != (err != nil) {
+			t.Fatal("unexpected call error:", err)
+		}
+	}
+
+	stats := caller.CallStats()
+	if stats.Count != 10 {
+		t.Fatal("expected 10 calls, got", stats.Count)
+	}
+	if stats.Errors != 2 || stats.ErrorRate != 0.2 {
+		t.Fatal("expected 2 errors and error rate 0.2, got", stats.Errors, stats.ErrorRate)
+	}
+	fastDelay := fast * time.Millisecond
+	slowDelay := slow * time.Millisecond
+	if stats.P50 < fastDelay || stats.P50 >= slowDelay {
+		t.Fatal("p50", stats.P50, "not a fast call duration")
+	}
+	if stats.P95 < slowDelay {
+		t.Fatal("p95", stats.P95, "less than slow call delay", slowDelay)
+	}
+	// After 9 fast calls, the slow call moves the average 10% of the way
+	// toward the slow call duration.
+	if stats.EMA <= stats.P50 || stats.EMA >= stats.P50+(slowDelay-fastDelay)/5 {
+		t.Fatal("unexpected moving average", stats.EMA, "with p50", stats.P50)
+	}
+
+	// Check that a canceled call is counted as an error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = caller.Call(ctx, procName, nil, wamp.List{0}, nil, nil); err == nil {
+		t.Fatal("expected error from canceled call")
+	}
+	if stats = caller.CallStats(); stats.Count != 11 || stats.Errors != 3 {
+		t.Fatal("expected 11 calls and 3 errors, got", stats.Count, stats.Errors)
+	}
+}
+
+func TestUnsubscribeUnregisterAll(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	c1, c2, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer c1.Close()
+	defer c2.Close()
+
+	evHandler := func(ev *wamp.Event) {}
+	invHandler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{}
+	}
+	topics := []string{"mod1.topic1", "mod1.topic2", "mod2.topic1"}
+	procs := []string{"mod1.proc1", "mod1.proc2", "mod2.proc1"}
+	for i := range topics {
+		if err = c1.Subscribe(topics[i], evHandler, nil); err != nil {
+			t.Fatal("subscribe error:", err)
+		}
+		if err = c1.Register(procs[i], invHandler, nil); err != nil {
+			t.Fatal("register error:", err)
+		}
+	}
+
+	if err = c1.UnsubscribeAll("mod1."); err != nil {
+		t.Fatal("unsubscribe all error:", err)
+	}
+	if err = c1.UnregisterAll("mod1."); err != nil {
+		t.Fatal("unregister all error:", err)
+	}
+
+	// Check that only the topics and procedures with the prefix were removed.
+	for i := range topics {
+		_, subscribed := c1.SubscriptionID(topics[i])
+		_, registered := c1.RegistrationID(procs[i])
+		expect := strings.HasPrefix(topics[i], "mod2.")
+		if subscribed != expect {
+			t.Fatalf("topic %s subscribed is %v, expected %v", topics[i], subscribed, expect)
+		}
+		if registered != expect {
+			t.Fatalf("procedure %s registered is %v, expected %v", procs[i], registered, expect)
+		}
+	}
+
+	// Check that the router removed the registrations.
+	ctx := context.Background()
+	if _, err = c2.Call(ctx, "mod1.proc1", nil, nil, nil, nil); err == nil {
+		t.Fatal("expected error calling unregistered procedure")
+	}
+	if _, err = c2.Call(ctx, "mod2.proc1", nil, nil, nil, nil); err != nil {
+		t.Fatal("call error:", err)
+	}
+
+	// Check that nothing to remove is not an error.
+	if err = c1.UnsubscribeAll("mod1."); err != nil {
+		t.Fatal("unsubscribe all error:", err)
+	}
+	if err = c1.UnregisterAll("mod3."); err != nil {
+		t.Fatal("unregister all error:", err)
+	}
+}
+
+func TestPublishMulti(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	subscriber, publisher, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	topics := []string{"multi.topic1", "multi.topic2", "multi.topic3"}
+	events := make([]chan *wamp.Event, len(topics))
+	for i := range topics {
+		events[i] = make(chan *wamp.Event, 2)
+		if err = subscriber.SubscribeChan(topics[i], events[i], nil); err != nil {
+			t.Fatal("subscribe error:", err)
+		}
+	}
+	recvEvents := func() []*wamp.Event {
+		t.Helper()
+		evs := make([]*wamp.Event, len(topics))
+		for i := range events {
+			select {
+			case evs[i] = <-events[i]:
+			case <-time.After(time.Second):
+				t.Fatal("did not receive event for", topics[i])
+			}
+			if s, _ := wamp.AsString(evs[i].Arguments[0]); s != "changed" {
+				t.Fatal("wrong event arguments:", evs[i].Arguments)
+			}
+		}
+		return evs
+	}
+
+	// Check that every topic receives the event.
+	args := wamp.List{"changed"}
+	pubIDs, err := publisher.PublishMulti(topics, nil, args, nil)
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if pubIDs != nil {
+		t.Fatal("expected no publication IDs without acknowledge")
+	}
+	recvEvents()
+
+	// Check that acknowledged publications return the publication IDs.
+	ack := wamp.Dict{wamp.OptAcknowledge: true}
+	pubIDs, err = publisher.PublishMulti(topics, ack, args, nil)
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if len(pubIDs) != len(topics) {
+		t.Fatal("expected", len(topics), "publication IDs, got", len(pubIDs))
+	}
+	for i, ev := range recvEvents() {
+		if pubIDs[i] == 0 || ev.Publication != pubIDs[i] {
+			t.Fatal("event publication", ev.Publication, "does not match", pubIDs[i])
+		}
+	}
+
+	// Check that a failed publication is reported, and the others are still
+	// published.
+	pubIDs, err = publisher.PublishMulti([]string{topics[0], "bad topic!"}, ack, args, nil)
+	var bulkErr BulkError
+	if !errors.As(err, &bulkErr) || len(bulkErr) != 1 {
+		t.Fatal("expected BulkError with 1 error, got", err)
+	}
+	if pubIDs[0] == 0 || pubIDs[1] != 0 {
+		t.Fatal("wrong publication IDs:", pubIDs)
+	}
+	select {
+	case <-events[0]:
+	case <-time.After(time.Second):
+		t.Fatal("did not receive event for", topics[0])
+	}
+}
+
+func TestScanEvent(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	subscriber, publisher, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	events := make(chan *wamp.Event, 1)
+	if err = subscriber.SubscribeChan(testTopic, events, nil); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	type point struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	args := wamp.List{"moved", 3, wamp.Dict{"x": 1, "y": 2}}
+	kwargs := wamp.Dict{"x": 4, "y": 5}
+	if err = publisher.Publish(testTopic, nil, args, kwargs); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	var event *wamp.Event
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("did not receive event")
+	}
+
+	// Check positional arguments.
+	var name string
+	var count int64
+	var pt point
+	if err = ScanEvent(event, &name, &count, &pt); err != nil {
+		t.Fatal("scan error:", err)
+	}
+	if name != "moved" || count != 3 || pt != (point{1, 2}) {
+		t.Fatal("wrong scanned values:", name, count, pt)
+	}
+	// Check that a nil pointer skips an argument.
+	count = 0
+	if err = ScanEvent(event, nil, &count); err != nil || count != 3 {
+		t.Fatal("scan with skipped argument failed:", count, err)
+	}
+
+	// Check keyword arguments.
+	if err = ScanEventKw(event, &pt); err != nil {
+		t.Fatal("scan keyword arguments error:", err)
+	}
+	if pt != (point{4, 5}) {
+		t.Fatal("wrong scanned keyword arguments:", pt)
+	}
+
+	// Check that too few arguments is an error.
+	if err = ScanEvent(event, &name, &count, &pt, &name); err == nil {
+		t.Fatal("expected error scanning too many arguments")
+	}
+	// Check that a type mismatch reports the argument.
+	err = ScanEvent(event, &name, &name)
+	var argErr *wamp.ArgumentError
+	if !errors.As(err, &argErr) || argErr.Index != 1 {
+		t.Fatal("expected ArgumentError for argument 1, got", err)
+	}
+	if err = ScanEventKw(event, &count); err == nil {
+		t.Fatal("expected error scanning keyword arguments into int")
+	}
+}
+
+func TestCallAny(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	fastHandler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{Args: wamp.List{"fast"}}
+	}
+	slowCanceled := make(chan struct{})
+	slowHandler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		select {
+		case <-ctx.Done():
+			close(slowCanceled)
+			return InvokeResult{Err: wamp.ErrCanceled}
+		case <-time.After(5 * time.Second):
+		}
+		return InvokeResult{Args: wamp.List{"slow"}}
+	}
+	if err = callee.Register("proc.fast", fastHandler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	if err = callee.Register("proc.slow", slowHandler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	ctx := context.Background()
+	result, err := caller.CallAny(ctx, []string{"proc.slow", "proc.fast"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if s, _ := wamp.AsString(result.Arguments[0]); s != "fast" {
+		t.Fatal("expected fast result, got:", result.Arguments)
+	}
+
+	// Check that the slow call was canceled.
+	select {
+	case <-slowCanceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow call was not canceled")
+	}
+
+	// Check that an error is returned for each call when all calls fail.
+	_, err = caller.CallAny(ctx, []string{"proc.none1", "proc.none2"}, nil, nil, nil)
+	var bulkErr BulkError
+	if !errors.As(err, &bulkErr) {
+		t.Fatal("expected BulkError, got:", err)
+	}
+	if len(bulkErr) != 2 {
+		t.Fatal("expected 2 errors, got:", len(bulkErr))
+	}
+	for i := range bulkErr {
+		var rpcErr RPCError
+		if !errors.As(bulkErr[i], &rpcErr) {
+			t.Fatal("expected RPCError, got:", bulkErr[i])
+		}
+		if rpcErr.Err.Error != wamp.ErrNoSuchProcedure {
+			t.Fatal("wrong error:", rpcErr.Err.Error)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{}
+	}
+	if err = callee.Register("test.meta.proc", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	if err = callee.Subscribe(testTopic, func(*wamp.Event) {}, nil); err != nil {
+		t.Fatal("failed to subscribe:", err)
+	}
+
+	ctx := context.Background()
+	meta := NewMeta(caller)
+
+	count, err := meta.SessionCount(ctx)
+	if err != nil {
+		t.Fatal("session count error:", err)
+	}
+	if count != 2 {
+		t.Fatal("expected 2 sessions, got", count)
+	}
+	if count, err = meta.SessionCount(ctx, "no-such-role"); err != nil {
+		t.Fatal("session count error:", err)
+	}
+	if count != 0 {
+		t.Fatal("expected 0 sessions with role, got", count)
+	}
+
+	ids, err := meta.SessionList(ctx)
+	if err != nil {
+		t.Fatal("session list error:", err)
+	}
+	if len(ids) != 2 {
+		t.Fatal("expected 2 session IDs, got", ids)
+	}
+
+	info, err := meta.SessionGet(ctx, callee.ID())
+	if err != nil {
+		t.Fatal("session get error:", err)
+	}
+	if info.ID != callee.ID() {
+		t.Fatal("wrong session ID:", info.ID)
+	}
+	if info.AuthRole != "anonymous" {
+		t.Fatal("wrong authrole:", info.AuthRole)
+	}
+	_, err = meta.SessionGet(ctx, wamp.GlobalID())
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Err.Error != wamp.ErrNoSuchSession {
+		t.Fatal("expected no such session error, got:", err)
+	}
+
+	subs, err := meta.SubscriptionList(ctx)
+	if err != nil {
+		t.Fatal("subscription list error:", err)
+	}
+	if len(subs.Exact) != 1 || len(subs.Prefix) != 0 || len(subs.Wildcard) != 0 {
+		t.Fatal("wrong subscriptions:", subs)
+	}
+	subscribers, err := meta.SubscriptionListSubscribers(ctx, subs.Exact[0])
+	if err != nil {
+		t.Fatal("list subscribers error:", err)
+	}
+	if len(subscribers) != 1 || subscribers[0] != callee.ID() {
+		t.Fatal("wrong subscribers:", subscribers)
+	}
+
+	regs, err := meta.RegistrationList(ctx)
+	if err != nil {
+		t.Fatal("registration list error:", err)
+	}
+	// The router's meta procedures are also registered.
+	regID, _ := callee.RegistrationID("test.meta.proc")
+	var found bool
+	for _, id := range regs.Exact {
+		if id == regID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatal("registration not listed:", regs)
+	}
+	callees, err := meta.RegistrationListCallees(ctx, regID)
+	if err != nil {
+		t.Fatal("list callees error:", err)
+	}
+	if len(callees) != 1 || callees[0] != callee.ID() {
+		t.Fatal("wrong callees:", callees)
+	}
+}
+
+func TestCryptoSignSerializers(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	publicKey, privateKey, err := sign.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csAuth := auth.NewCryptoSignAuthenticator(&cryptoSignKeyStore{publicKey[:]}, time.Second)
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:            wamp.URI("nexus.test.auth"),
+		StrictURI:      true,
+		Authenticators: []auth.Authenticator{csAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	closer, err := router.NewWebsocketServer(r).ListenAndServe(testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// The challenge is signed as raw bytes, so the same signing logic works
+	// with any serializer.
+	signChallenge := func(c *wamp.Challenge) (string, wamp.Dict) {
+		challengeHex, _ := wamp.AsString(c.Extra["challenge"])
+		challenge, err := hex.DecodeString(challengeHex)
+		if err != nil {
+			return "", wamp.Dict{}
+		}
+		return hex.EncodeToString(sign.Sign(nil, challenge, privateKey)), wamp.Dict{}
+	}
+
+	for _, s := range []serialize.Serialization{JSON, MSGPACK} {
+		cfg := Config{
+			Realm:         "nexus.test.auth",
+			HelloDetails:  wamp.Dict{"authid": "jdoe"},
+			AuthHandlers:  map[string]AuthFunc{"cryptosign": signChallenge},
+			Serialization: s,
+			Logger:        logger,
+		}
+		cli, err := ConnectNet(context.Background(), fmt.Sprintf("ws://%s/ws", testAddress), cfg)
+		if err != nil {
+			t.Fatal("failed to authenticate with serialization", s, "error:", err)
+		}
+		if authmethod, _ := wamp.AsString(cli.SessionDetails()["authmethod"]); authmethod != "cryptosign" {
+			t.Fatal("wrong authmethod:", authmethod)
+		}
+		cli.Close()
+	}
+}
+
+func TestCallCollect(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	// Handler sends the result in chunks as progressive results.
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		chunks := []wamp.List{{"a", "b"}, {"c"}, {"d", "e"}}
+		for i, chunk := range chunks {
+			kwargs := wamp.Dict{"chunks": i + 1}
+			if err := callee.SendProgress(ctx, chunk, kwargs); err != nil {
+				return InvokeResult{Err: "test.failed"}
+			}
+		}
+		return InvokeResult{Args: wamp.List{"f"}, Kwargs: wamp.Dict{"done": true}}
+	}
+	if err = callee.Register("test.collect", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	result, err := caller.CallCollect(context.Background(), "test.collect", nil, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	expect := wamp.List{"a", "b", "c", "d", "e", "f"}
+	if len(result.Arguments) != len(expect) {
+		t.Fatal("wrong collected arguments:", result.Arguments)
+	}
+	for i := range expect {
+		if s, _ := wamp.AsString(result.Arguments[i]); s != expect[i] {
+			t.Fatal("wrong collected arguments:", result.Arguments)
+		}
+	}
+	if n, _ := wamp.AsInt64(result.ArgumentsKw["chunks"]); n != 3 {
+		t.Fatal("wrong collected kwargs:", result.ArgumentsKw)
+	}
+	if done, _ := wamp.AsBool(result.ArgumentsKw["done"]); !done {
+		t.Fatal("final kwargs not collected:", result.ArgumentsKw)
+	}
+	if progress, _ := wamp.AsBool(result.Details[wamp.OptProgress]); progress {
+		t.Fatal("collected result has progress detail")
+	}
+
+	// Check that an error is returned without a result.
+	result, err = caller.CallCollect(context.Background(), "test.none", nil, nil, nil)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) || result != nil {
+		t.Fatal("expected RPCError, got:", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	// Readiness procedure fails until called three times.
+	var calls int
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		if calls++; calls < 3 {
+			return InvokeResult{Err: wamp.ErrUnavailable}
+		}
+		return InvokeResult{}
+	}
+	if err = callee.Register("test.ready", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = caller.WaitReady(ctx, "test.ready"); err != nil {
+		t.Fatal("wait ready error:", err)
+	}
+	if calls != 3 {
+		t.Fatal("expected 3 calls to readiness procedure, got", calls)
+	}
+
+	// Check that the context error is returned if never ready.
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = caller.WaitReady(ctx, "test.none")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded error, got:", err)
+	}
+}
+
+func TestHasFeature(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:           wamp.URI(testRealm),
+		AnonymousAuth: true,
+		Features: router.Features{
+			DisableProgressiveCallResults: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cli, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if !cli.HasFeature(wamp.RoleDealer, wamp.FeatureCallCanceling) {
+		t.Fatal("expected router to announce call canceling")
+	}
+	if !cli.HasFeature(wamp.RoleBroker, wamp.FeaturePatternSub) {
+		t.Fatal("expected router to announce pattern-based subscription")
+	}
+	if cli.HasFeature(wamp.RoleDealer, wamp.FeatureProgCallResults) {
+		t.Fatal("router announced disabled progressive call results")
+	}
+	if cli.HasFeature(wamp.RoleBroker, wamp.FeatureCallCanceling) {
+		t.Fatal("broker announced dealer feature")
+	}
+	if cli.HasFeature("nosuchrole", wamp.FeatureCallCanceling) {
+		t.Fatal("unknown role has feature")
+	}
+}
+
+func TestUnhandledMessageHandlers(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect the client to a fake router, so that the test can send it
+	// messages for unknown subscriptions and registrations.
+	cliSide, rtrSide := transport.LinkedPeers()
+	go func() {
+		<-rtrSide.Recv() // HELLO
+		rtrSide.Send(&wamp.Welcome{
+			ID: wamp.GlobalID(),
+			Details: wamp.Dict{
+				"roles": wamp.Dict{
+					wamp.RoleBroker: wamp.Dict{},
+					wamp.RoleDealer: wamp.Dict{},
+				},
+			},
+		})
+	}()
+	cli, err := NewClient(cliSide, Config{
+		Realm:           testRealm,
+		ResponseTimeout: time.Second,
+		Logger:          logger,
+	})
+	if err != nil {
+		t.Fatal("failed to create client:", err)
+	}
+
+	events := make(chan *wamp.Event, 1)
+	cli.SetUnhandledEventHandler(func(event *wamp.Event) {
+		events <- event
+	})
+	invocations := make(chan *wamp.Invocation, 1)
+	cli.SetUnhandledInvocationHandler(func(inv *wamp.Invocation) {
+		invocations <- inv
+	})
+
+	rtrSide.Send(&wamp.Event{Subscription: 999, Publication: 1})
+	select {
+	case event := <-events:
+		if event.Subscription != 999 {
+			t.Fatal("wrong subscription ID:", event.Subscription)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unhandled event handler not called")
+	}
+
+	rtrSide.Send(&wamp.Invocation{Request: 7, Registration: 888})
+	// Check that the client still replies with an ERROR.
+	msg, err := wamp.RecvTimeout(rtrSide, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Request != 7 {
+		t.Fatal("expected ERROR for invocation, got:", msg)
+	}
+	select {
+	case inv := <-invocations:
+		if inv.Registration != 888 {
+			t.Fatal("wrong registration ID:", inv.Registration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unhandled invocation handler not called")
+	}
+
+	// Reply to the client's GOODBYE when closing.
+	go func() {
+		if _, ok := (<-rtrSide.Recv()).(*wamp.Goodbye); ok {
+			rtrSide.Send(&wamp.Goodbye{Reason: wamp.CloseGoodbyeAndOut})
+		}
+		rtrSide.Close()
+	}()
+	cli.Close()
+}
+
+// selfSignedCert creates a self-signed TLS certificate for 127.0.0.1.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nexus test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := getTestRouter(&router.RealmConfig{
+		URI:           wamp.URI(testRealm),
+		AnonymousAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	wsCloser, err := router.NewWebsocketServer(r).ListenAndServeTLS("127.0.0.1:0", tlsCfg, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsCloser.Close()
+	rsCloser, err := router.NewRawSocketServer(r).ListenAndServeTLS("tcp", "127.0.0.1:0", tlsCfg, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsCloser.Close()
+
+	pinned := sha256.Sum256(cert.Certificate[0])
+	pin := func(fingerprint [sha256.Size]byte) func([][]byte, [][]*x509.Certificate) error {
+		return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) != 0 && sha256.Sum256(rawCerts[0]) == fingerprint {
+				return nil
+			}
+			return errors.New("certificate not pinned")
+		}
+	}
+
+	urls := []string{
+		"wss://" + wsCloser.(net.Listener).Addr().String() + "/",
+		"tcps://" + rsCloser.(net.Listener).Addr().String(),
+	}
+	for _, u := range urls {
+		cfg := Config{
+			Realm:                 testRealm,
+			Logger:                logger,
+			TlsCfg:                &tls.Config{InsecureSkipVerify: true},
+			VerifyPeerCertificate: pin([sha256.Size]byte{}),
+		}
+		if _, err = ConnectNet(context.Background(), u, cfg); err == nil {
+			t.Fatal("expected error connecting to", u, "with wrong pinned certificate")
+		}
+
+		cfg.VerifyPeerCertificate = pin(pinned)
+		cli, err := ConnectNet(context.Background(), u, cfg)
+		if err != nil {
+			t.Fatal("failed to connect to", u, "with pinned certificate:", err)
+		}
+		if err = cli.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterHTTP(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Name", req.URL.Query().Get("name"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", req.URL.Path, req.Header.Get("X-Greeting"), body)
+	})
+	if err = callee.RegisterHTTP("test.http", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	ctx := context.Background()
+	result, err := caller.Call(ctx, "test.http", nil, nil, wamp.Dict{
+		"method":  "POST",
+		"path":    "/greet?name=alice",
+		"headers": wamp.Dict{"X-Greeting": "hello"},
+		"body":    "world",
+	}, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if status, _ := wamp.AsInt64(result.ArgumentsKw["status"]); status != http.StatusCreated {
+		t.Fatal("wrong status:", result.ArgumentsKw["status"])
+	}
+	if body, _ := result.ArgumentsKw["body"].([]byte); string(body) != "/greet hello world" {
+		t.Fatal("wrong body:", result.ArgumentsKw["body"])
+	}
+	headers, _ := wamp.AsDict(result.ArgumentsKw["headers"])
+	names, _ := wamp.AsList(headers["X-Name"])
+	if len(names) != 1 || names[0] != "alice" {
+		t.Fatal("wrong X-Name header:", headers["X-Name"])
+	}
+
+	// Check that the default method is GET.
+	result, err = caller.Call(ctx, "test.http", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	if status, _ := wamp.AsInt64(result.ArgumentsKw["status"]); status != http.StatusMethodNotAllowed {
+		t.Fatal("wrong status:", result.ArgumentsKw["status"])
+	}
+
+	// Check that invalid arguments are rejected.
+	_, err = caller.Call(ctx, "test.http", nil, nil, wamp.Dict{"path": 42}, nil)
+	var rErr RPCError
+	if !errors.As(err, &rErr) || rErr.Err.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected invalid argument error, got:", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	other, publisher, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer publisher.Close()
+	defer other.Close()
+
+	// Publish a retained event without acknowledgement, and flush to ensure
+	// that the router has processed the publication.
+	const topic = "test.flush"
+	err = publisher.Publish(topic, wamp.Dict{wamp.OptRetain: true}, wamp.List{"hello"}, nil)
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = publisher.Flush(ctx); err != nil {
+		t.Fatal("flush error:", err)
+	}
+
+	// The retained event must now be sent to a new subscriber.  A router
+	// peer is used, instead of a client, to receive the retained event that
+	// immediately follows SUBSCRIBED.
+	peer := getTestPeer(r)
+	peer.Send(&wamp.Hello{Realm: testRealm, Details: wamp.Dict{
+		"roles": wamp.Dict{"subscriber": wamp.Dict{}},
+	}})
+	recv := func(expect wamp.MessageType) wamp.Message {
+		t.Helper()
+		msg, err := wamp.RecvTimeout(peer, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for", expect)
+		}
+		if msg.MessageType() != expect {
+			t.Fatal("expected", expect, "got:", msg.MessageType())
+		}
+		return msg
+	}
+	recv(wamp.WELCOME)
+	peer.Send(&wamp.Subscribe{
+		Request: 1,
+		Topic:   topic,
+		Options: wamp.Dict{wamp.OptGetRetained: true},
+	})
+	recv(wamp.SUBSCRIBED)
+	event := recv(wamp.EVENT).(*wamp.Event)
+	if len(event.Arguments) != 1 || event.Arguments[0] != "hello" {
+		t.Fatal("wrong retained event arguments:", event.Arguments)
+	}
+	peer.Close()
+
+	publisher.Close()
+	if err = publisher.Flush(ctx); err != ErrNotConn {
+		t.Fatal("expected ErrNotConn flushing closed client, got:", err)
+	}
+}
+
+func TestLocalSerializer(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.LocalSerializer = &serialize.MessagePackSerializer{}
+	})
+	cli, err := newTestClientWithConfig(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		return InvokeResult{Args: inv.Arguments}
+	}
+	if err = cli.Register("test.echo", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	result, err := cli.Call(context.Background(), "test.echo", nil, wamp.List{42}, nil, nil)
+	if err != nil {
+		t.Fatal("call error:", err)
+	}
+	// The int argument is only returned as an int if it was not serialized.
+	if _, ok := result.Arguments[0].(int); ok {
+		t.Fatal("call was not serialized")
+	}
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != 42 {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+}
+
+func TestWithCancelMode(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	if _, err = WithCancelMode(context.Background(), "bogus"); err == nil {
+		t.Fatal("expected error for invalid cancel mode")
+	}
+
+	// The per-call mode overrides the client's mode.
+	if err = caller.SetCallCancelMode(wamp.CancelModeSkip); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip} {
+		// The handler is interrupted unless the mode is skip, and does not
+		// return until released.
+		interrupted := make(chan struct{})
+		release := make(chan struct{})
+		handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			select {
+			case <-ctx.Done():
+				close(interrupted)
+			case <-release:
+				return InvokeResult{}
+			}
+			<-release
+			return InvokeResult{Err: wamp.ErrCanceled}
+		}
+		procName := "test.cancel." + mode
+		if err = callee.Register(procName, handler, nil); err != nil {
+			t.Fatal("failed to register procedure:", err)
+		}
+
+		ctx, err := WithCancelMode(context.Background(), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		errChan := make(chan error, 1)
+		go func() {
+			_, e := caller.Call(ctx, procName, nil, nil, nil, nil)
+			errChan <- e
+		}()
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		select {
+		case err = <-errChan:
+		case <-time.After(time.Second):
+			t.Fatal(mode, "mode call was not canceled")
+		}
+		if err != context.Canceled {
+			t.Fatal("expected context.Canceled error, got:", err)
+		}
+
+		switch mode {
+		case wamp.CancelModeKill, wamp.CancelModeKillNoWait:
+			select {
+			case <-interrupted:
+			case <-time.After(time.Second):
+				t.Fatal("callee not interrupted in", mode, "mode")
+			}
+			close(release)
+		case wamp.CancelModeSkip:
+			// The callee is not interrupted.
+			select {
+			case <-interrupted:
+				t.Fatal("callee interrupted in skip mode")
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+		}
+		if err = callee.Unregister(procName); err != nil {
+			t.Fatal("failed to unregister procedure:", err)
+		}
+	}
+}
+
+func TestWebsocketHeader(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Record the headers of the websocket upgrade request.
+	upgradeHeader := make(chan http.Header, 1)
+	wsServer := router.NewWebsocketServer(r)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upgradeHeader <- req.Header.Clone()
+		wsServer.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.WsCfg.Header = http.Header{
+			"X-Route":       []string{"blue"},
+			"Authorization": []string{"Bearer xyzzy"},
+		}
+	})
+	cli, err := ConnectNet(context.Background(), server.URL, *cfg)
+	if err != nil {
+		t.Fatal("failed to connect websocket client:", err)
+	}
+	cli.Close()
+
+	header := <-upgradeHeader
+	if v := header.Get("X-Route"); v != "blue" {
+		t.Fatal("expected X-Route header blue, got", v)
+	}
+	if v := header.Get("Authorization"); v != "Bearer xyzzy" {
+		t.Fatal("expected Authorization header, got", v)
+	}
+	if header.Get("Sec-Websocket-Protocol") == "" {
+		t.Fatal("missing websocket protocol header")
+	}
+}
+
+// testCallRecorder implements Authorizer that records each CALL message
+// serialized as JSON.
+type testCallRecorder struct {
+	mu    sync.Mutex
+	calls [][]byte
+}
+
+func (a *testCallRecorder) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if call, ok := msg.(*wamp.Call); ok {
+		b, err := (&serialize.JSONSerializer{}).Serialize(call)
+		if err != nil {
+			return false, err
+		}
+		a.mu.Lock()
+		a.calls = append(a.calls, b)
+		a.mu.Unlock()
+	}
+	return true, nil
+}
+
+// sequenceIDs returns a request ID source that returns the given IDs, and then
+// continues counting from the last one.
+func sequenceIDs(ids ...wamp.ID) func() wamp.ID {
+	var i int
+	var last wamp.ID
+	return func() wamp.ID {
+		if i < len(ids) {
+			last = ids[i]
+			i++
+		} else {
+			last++
+		}
+		return last
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Call a procedure with a new router and client, and return the CALL
+	// messages that the router received.
+	callBytes := func() [][]byte {
+		recorder := &testCallRecorder{}
+		r, err := getTestRouter(newTestRealmConfig(testRealm, func(cfg *router.RealmConfig) {
+			cfg.Authorizer = recorder
+			cfg.RequireLocalAuthz = true
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		cfg := newTestClientConfig(testRealm, func(cfg *Config) {
+			cfg.RequestIDs = sequenceIDs(0, 1000)
+		})
+		cli, err := newTestClientWithConfig(r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		for i := 0; i < 2; i++ {
+			_, err = cli.Call(context.Background(), "test.no.such.proc", nil, wamp.List{i}, nil, nil)
+			if err == nil {
+				t.Fatal("expected error calling missing procedure")
+			}
+		}
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return recorder.calls
+	}
+
+	first := callBytes()
+	second := callBytes()
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatal("expected 2 calls in each run, got", len(first), "and", len(second))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("call %d differs between runs: %s != %s", i, first[i], second[i])
+		}
+	}
+	if !bytes.Contains(first[0], []byte("[48,1000,")) {
+		t.Fatal("first call does not use first non-zero ID:", string(first[0]))
+	}
+
+	// Check that an ID used by a call in progress is skipped.
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+	caller.requestIDs = sequenceIDs(7, 7)
+
+	release := make(chan struct{})
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		<-release
+		return InvokeResult{}
+	}
+	if err = callee.Register("test.block", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, e := caller.Call(context.Background(), "test.block", nil, nil, nil, nil)
+		errChan <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if id, err := caller.nextID(false); err != nil || id != 8 {
+		close(release)
+		t.Fatal("expected in-flight ID 7 to be skipped, got", id, err)
+	}
+
+	// Check that an ID is reserved for a reply as soon as it is taken, and
+	// that a source that only returns IDs in use fails instead of retrying
+	// forever.
+	caller.requestIDs = sequenceIDs(9, 9)
+	id, err := caller.nextID(true)
+	if err != nil || id != 9 {
+		close(release)
+		t.Fatal("expected ID 9, got", id, err)
+	}
+	caller.requestIDs = func() wamp.ID { return 9 }
+	if id, err = caller.nextID(true); err != ErrNoRequestID {
+		close(release)
+		t.Fatal("expected ErrNoRequestID for reserved ID, got", id, err)
+	}
+	caller.requestIDs = func() wamp.ID { return 7 }
+	err = caller.Publish(testTopic, wamp.Dict{wamp.OptAcknowledge: true}, nil, nil)
+	if err != ErrNoRequestID {
+		close(release)
+		t.Fatal("expected ErrNoRequestID publishing, got", err)
+	}
+	caller.sess.Lock()
+	delete(caller.awaitingReply, 9)
+	caller.sess.Unlock()
+
+	close(release)
+	if err = <-errChan; err != nil {
+		t.Fatal("call failed:", err)
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the states of a client that is closed, and of a client that loses
+	// its connection to the router.
+	closedClient, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droppedClient, err := newTestClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer droppedClient.Close()
+
+	checkStates := func(cli *Client, drop func()) {
+		t.Helper()
+		states := cli.StateChanges()
+		if state := <-states; state != ConnStateConnected {
+			t.Fatal("expected connected state, got", state)
+		}
+		select {
+		case state := <-states:
+			t.Fatal("unexpected state change to", state)
+		default:
+		}
+		drop()
+		select {
+		case state := <-states:
+			if state != ConnStateClosed {
+				t.Fatal("expected closed state, got", state)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not receive closed state")
+		}
+		if cli.Connected() {
+			t.Fatal("client connected after closed state")
+		}
+		if _, ok := <-states; ok {
+			t.Fatal("state changes channel not closed")
+		}
+	}
+	checkStates(closedClient, func() { closedClient.Close() })
+	// The router is closed to drop the connection.
+	checkStates(droppedClient, r.Close)
+}
+
+// notFoundError is an application error that wraps the RPCError it is mapped
+// from.
+type notFoundError struct {
+	RPCError
+}
+
+func (e notFoundError) Is(target error) bool { return target == errNotFound }
+func (e notFoundError) Unwrap() error        { return e.RPCError }
+
+var errNotFound = errors.New("not found")
+
+func TestRegisterErrorMapping(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const (
+		notFoundURI = wamp.URI("test.error.not_found")
+		nilURI      = wamp.URI("test.error.nil_mapping")
+		otherURI    = wamp.URI("test.error.other")
+	)
+	RegisterErrorMapping(notFoundURI, func(rpcErr RPCError) error {
+		return notFoundError{rpcErr}
+	})
+	defer RegisterErrorMapping(notFoundURI, nil)
+	RegisterErrorMapping(nilURI, func(RPCError) error { return nil })
+	defer RegisterErrorMapping(nilURI, nil)
+
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+	defer r.Close()
+	defer caller.Close()
+	defer callee.Close()
+
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		uri, _ := wamp.AsURI(inv.Arguments[0])
+		return ResultError(uri, "detail")
+	}
+	if err = callee.Register("test.fail", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	call := func(uri wamp.URI) error {
+		_, err := caller.Call(context.Background(), "test.fail", nil, wamp.List{uri}, nil, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		return err
+	}
+
+	// Check that a mapped URI returns the mapped error, which still provides
+	// the RPCError.
+	err = call(notFoundURI)
+	if !errors.Is(err, errNotFound) {
+		t.Fatal("expected errNotFound, got:", err)
+	}
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Err.Arguments[0] != "detail" {
+		t.Fatal("mapped error does not wrap RPCError:", err)
+	}
+
+	// Check that other URIs, and mappings that return nil, return RPCError.
+	for _, uri := range []wamp.URI{otherURI, nilURI} {
+		err = call(uri)
+		if _, ok := err.(RPCError); !ok {
+			t.Fatal("expected RPCError, got:", err)
+		}
+		if errors.Is(err, errNotFound) {
+			t.Fatal("unmapped error is errNotFound")
+		}
+	}
+
+	// Check that removing the mapping returns RPCError.
+	RegisterErrorMapping(notFoundURI, nil)
+	if _, ok := call(notFoundURI).(RPCError); !ok {
+		t.Fatal("expected RPCError after removing mapping")
+	}
+}
+
+func TestRegistrationReplaced(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm, func(config *router.RealmConfig) {
+		config.DuplicateRegistration = router.DuplicateRegistrationReplace
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	callee1, err := newTestClient(r)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer callee1.Close()
+	callee2, err := newTestClient(r)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer callee2.Close()
+
+	handler := func(name string) InvocationHandler {
+		return func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+			return InvokeResult{Args: wamp.List{name}}
+		}
+	}
+	procName := "myproc"
+	if err = callee1.Register(procName, handler("callee1"), nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	if err = callee2.Register(procName, handler("callee2"), nil); err != nil {
+		t.Fatal("failed to register replacement procedure:", err)
+	}
+
+	result, err := callee1.Call(context.Background(), procName, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if s, _ := wamp.AsString(result.Arguments[0]); s != "callee2" {
+		t.Fatal("expected call to replacement callee, got", s)
+	}
+
+	// Check that the revoked registration is removed from the first callee.
+	for i := 0; ; i++ {
+		if _, ok := callee1.RegistrationID(procName); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("revoked registration not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = callee1.Unregister(procName); err != ErrNotRegistered {
+		t.Fatal("expected ErrNotRegistered, got", err)
+	}
+}
+
+func TestCallTimeoutPrecedence(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := getTestRouter(newTestRealmConfig(testRealm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	callee, err := newTestClient(r)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer callee.Close()
+	const responseTimeout = 100 * time.Millisecond
+	caller, err := newTestClientWithConfig(r, newTestClientConfig(testRealm, func(cfg *Config) {
+		cfg.ResponseTimeout = responseTimeout
+	}))
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	defer caller.Close()
+
+	// The procedure replies after the number of milliseconds given as its
+	// argument.
+	handler := func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		delay, _ := wamp.AsInt64(inv.Arguments[0])
+		select {
+		case <-time.After(time.Duration(delay) * time.Millisecond):
+		case <-ctx.Done():
+			return InvokeResult{Err: wamp.ErrCanceled}
+		}
+		return InvokeResult{Args: wamp.List{"done"}}
+	}
+	procName := "myproc"
+	if err = callee.Register(procName, handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+
+	call := func(ctx context.Context, timeout time.Duration, delay int) error {
+		var options wamp.Dict
+		if timeout != 0 {
+			options = wamp.Dict{wamp.OptTimeout: int64(timeout / time.Millisecond)}
+		}
+		_, err := caller.Call(ctx, procName, options, wamp.List{delay}, nil, nil)
+		return err
+	}
+
+	// Check that the call is not limited without a deadline or timeout.
+	if err = call(context.Background(), 0, 300); err != nil {
+		t.Fatal("call failed without deadline or call timeout:", err)
+	}
+
+	// Check that the call timeout is used instead of the response timeout.
+	if err = call(context.Background(), 400*time.Millisecond, 200); err != nil {
+		t.Fatal("call failed with call timeout longer than response timeout:", err)
+	}
+	// A call that exceeds the call timeout is canceled, and returns the
+	// router's ERROR for the canceled call.
+	err = call(context.Background(), responseTimeout, 500)
+	var rpcErr RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Err.Error != wamp.ErrCanceled {
+		t.Fatal("expected canceled RPCError, got", err)
+	}
+
+	// Check that the context deadline is used instead of the call timeout or
+	// response timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	if err = call(ctx, 0, 200); err != nil {
+		t.Fatal("call failed with deadline longer than response timeout:", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = call(ctx, time.Second, 500); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", err)
+	}
+}
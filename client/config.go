@@ -1,7 +1,10 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"net"
 	"time"
 
 	"github.com/gammazero/nexus/v3/stdlog"
@@ -14,6 +17,10 @@ import (
 // any WELCOME message details.  If the signature is accepted, the details are
 // used to populate the welcome message, as well as the session attributes.
 //
+// The CHALLENGE message is passed as received from the router, so the
+// authmethod and the complete Extra dict, containing any values such as a
+// nonce or salting parameters, are available to compute the signature.
+//
 // In response to a CHALLENGE message, the Client MUST send an AUTHENTICATE
 // message.  Therefore, AuthFunc does not return an error.  If an error is
 // encountered within AuthFunc, then an empty signature should be returned
@@ -50,23 +57,125 @@ type Config struct {
 	// Set to JSON or MSGPACK.  Default (zero-value) is JSON.
 	Serialization serialize.Serialization
 
+	// Serializations is an ordered list of acceptable serializations.  If
+	// set, it overrides Serialization and ConnectNet tries each in order
+	// until the router accepts one.  Use Client.Serialization to get the
+	// serialization that was chosen.
+	Serializations []serialize.Serialization
+
 	// Provide a tls.Config to connect the client using TLS.  The zero
 	// configuration specifies using defaults.  A nil tls.Config means do not
 	// use TLS.
 	TlsCfg *tls.Config
 
+	// VerifyPeerCertificate, if not nil, is called during the TLS handshake
+	// with the certificates presented by the router, and the handshake fails
+	// if it returns an error.  It replaces the VerifyPeerCertificate of
+	// TlsCfg, and is used with the websocket (wss) and rawsocket (tcps)
+	// transports.  It is called after normal certificate verification, unless
+	// TlsCfg.InsecureSkipVerify is set, in which case verifiedChains is nil.
+	//
+	// Use this to pin the router's certificate.  For example, to accept only
+	// a certificate with a known SHA-256 fingerprint:
+	//
+	//	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	//		if len(rawCerts) != 0 && sha256.Sum256(rawCerts[0]) == pinned {
+	//			return nil
+	//		}
+	//		return errors.New("router certificate is not pinned")
+	//	}
+	//
+	// To pin a self-signed certificate, also set TlsCfg.InsecureSkipVerify so
+	// that the certificate chain is not verified.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
 	// For local clients only.  This configures the router-to-client queue size
 	// and is the maximum number of messages that are enqueued for the client
 	// to read.  If the client does not read messages, then additional messages
 	// from the router are dropped.  A value of zero specifies the default.
 	LocalQueueSize int
 
+	// For local clients only.  If not nil, each message sent between the
+	// client and router is serialized and deserialized using this serializer,
+	// the same as messages sent over a network connection.  This is used in
+	// tests to exercise serialization without a network connection.  The
+	// default (nil) passes messages as is, which is faster.
+	LocalSerializer serialize.Serializer
+
+	// RequestIDs, if not nil, supplies the IDs of requests sent by the client,
+	// instead of the default session-scope sequence that starts at 1.  This
+	// lets tests use a deterministic sequence of request IDs that does not
+	// depend on what else the client has sent.  An ID that is zero, or that is
+	// used by a request that is still waiting for a reply, is skipped and the
+	// next ID is taken.  If no usable ID is found after many tries, then the
+	// request fails with ErrNoRequestID.  The function is called with the
+	// client's session lock held, and must not call the client.
+	RequestIDs func() wamp.ID
+
 	// Client receive limit for use with RawSocket transport.
 	// If recvLimit is > 0, then the client will not receive messages with size
 	// larger than the nearest power of 2 greater than or equal to recvLimit.
-	// If recvLimit is <= 0, then the default of 16M is used.
+	// If recvLimit is <= 0, then the default of 16M is used.  Messages sent to
+	// the router are limited to the smaller of this limit and the router's
+	// limit.
 	RecvLimit int
 
 	// Websocket transport configuration.
 	WsCfg transport.WebsocketConfig
+
+	// Dial, if set, is used to make the network connection to the router for
+	// websocket, TCP, and unix socket transports, instead of a net.Dialer.
+	// This allows the use of a proxy-aware or instrumented dialer.  For
+	// websocket, this overrides WsCfg.Dial and WsCfg.DialContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// OnConn, if set, is called with the network connection to the router as
+	// soon as it is made, before any TLS, websocket, or rawsocket handshake,
+	// and before the WAMP session is opened.  This allows setting socket
+	// options, such as TCP_NODELAY or SO_KEEPALIVE, or reading the local and
+	// remote addresses.  The connection must not be read from, written to,
+	// closed, or have deadlines set by OnConn or later, since doing so breaks
+	// the session.  OnConn is not called for clients created by ConnectLocal.
+	OnConn func(net.Conn)
+
+	// ExcludePublisherByDefault sets exclude_me=true in the options of every
+	// publication that does not specify exclude_me, so that the client does
+	// not receive events for its own publications.  Setting exclude_me in the
+	// options of a publication overrides this default.
+	ExcludePublisherByDefault bool
+
+	// HeartbeatInterval is the interval at which the client sends an
+	// application-level heartbeat, by publishing to HeartbeatTopic or calling
+	// HeartbeatProcedure.  This gives the application a liveness signal that
+	// is separate from any transport-level ping.  A value of 0, or not setting
+	// either HeartbeatTopic or HeartbeatProcedure, disables heartbeats.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTopic is the topic that heartbeats are published to.  Each
+	// heartbeat is published with acknowledge=true, so that a failure to
+	// publish is detected.
+	HeartbeatTopic string
+
+	// HeartbeatProcedure is the procedure that is called for each heartbeat.
+	// If set, this is used instead of HeartbeatTopic.
+	HeartbeatProcedure string
+
+	// HeartbeatErrorHandler is called with the error from any heartbeat that
+	// fails.  If not set, heartbeat failures are logged.  The handler is called
+	// in a separate goroutine, and may call Close on the client.
+	HeartbeatErrorHandler func(error)
+
+	// EventPanicHandler, if set, is called with the event and the recovered
+	// value when an EventHandler panics.  This allows panics to be reported
+	// for alerting.  Panics in an EventHandler are always recovered from and
+	// logged, and delivery of subsequent events continues.
+	EventPanicHandler func(event *wamp.Event, recovered interface{})
+
+	// MaxPendingCalls is the maximum number of calls that may be waiting for
+	// a result at once.  When this many calls are pending, Call fails
+	// immediately with ErrTooManyPendingCalls, instead of sending another
+	// call.  This bounds the memory used by pending calls and detects callers
+	// that make calls faster than results are received.  A value of 0 means
+	// no limit.
+	MaxPendingCalls int
 }
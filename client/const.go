@@ -10,4 +10,17 @@ const (
 
 	// Time client will wait for expected router response if not specified.
 	defaultResponseTimeout = 5 * time.Second
+
+	// Number of IDs taken from Config.RequestIDs to find one that is not in
+	// use, before giving up.
+	maxRequestIDTries = 1000
+
+	// Number of INVOCATION messages, of a progressive call invocation, that
+	// are queued for a handler that is not receiving them.
+	maxPendingInvocations = 64
+
+	// Initial and maximum time WaitReady waits between calls to the readiness
+	// procedure.
+	waitReadyMinDelay = 50 * time.Millisecond
+	waitReadyMaxDelay = 2 * time.Second
 )
@@ -1,13 +1,48 @@
 package client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
 
 var (
-	ErrAlreadyClosed = errors.New("already closed")
-	ErrCallerNoProg  = errors.New("caller not accepting progressive results")
-	ErrNotConn       = errors.New("not connected")
-	ErrNotRegistered = errors.New("not registered for procedure")
-	ErrNotSubscribed = errors.New("not subscribed to topic")
-	ErrReplyTimeout  = errors.New("timeout waiting for reply")
-	ErrRouterNoRoles = errors.New("router did not announce any supported roles")
+	ErrAlreadyClosed    = errors.New("already closed")
+	ErrCallCanceled     = errors.New("call canceled")
+	ErrCallerNoProg     = errors.New("caller not accepting progressive results")
+	ErrNotConn          = errors.New("not connected")
+	ErrNotRegistered    = errors.New("not registered for procedure")
+	ErrNotSubscribed    = errors.New("not subscribed to topic")
+	ErrPingUnsupported  = errors.New("transport does not support ping")
+	ErrReplyTimeout     = errors.New("timeout waiting for reply")
+	ErrRouterNoProgCall = errors.New("router does not support progressive call invocations")
+	ErrRouterNoRoles    = errors.New("router did not announce any supported roles")
+	ErrSinkClosed       = errors.New("call sink already closed")
+
+	// ErrTooManyPendingCalls is returned by Call when the number of calls
+	// waiting for a result is at the limit set by Config.MaxPendingCalls.
+	ErrTooManyPendingCalls = errors.New("too many pending calls")
+
+	// ErrNoRequestID is returned when Config.RequestIDs does not supply a
+	// request ID that is not already in use.
+	ErrNoRequestID = errors.New("no unused request ID")
+
+	// ErrGoodbyeAndOut is returned for requests that were waiting for a reply
+	// when the router ended the session with GOODBYE.  It wraps ErrNotConn.
+	ErrGoodbyeAndOut = fmt.Errorf("%w: session closed by router (%s)", ErrNotConn, wamp.CloseGoodbyeAndOut)
 )
+
+// BulkError is returned by UnsubscribeAll, UnregisterAll, and PublishMulti
+// when any of the requests fail, and by CallAny when all of the calls fail.
+// It contains the error for each failed request.
+type BulkError []error
+
+func (e BulkError) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
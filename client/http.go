@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Keyword arguments of a call to a procedure registered by RegisterHTTP, and
+// of its result.
+const (
+	httpMethod  = "method"
+	httpPath    = "path"
+	httpHeaders = "headers"
+	httpBody    = "body"
+	httpStatus  = "status"
+)
+
+// RegisterHTTP registers a procedure that is handled by an http.Handler.  This
+// exposes an existing HTTP handler to WAMP callers.  The options are the same
+// as for Register.
+//
+// Each call is converted into an HTTP request that is passed to the handler,
+// using these keyword arguments of the call:
+//
+//	"method"  - HTTP method, default "GET"
+//	"path"    - request URI, including any query, default "/"
+//	"headers" - dict of header name to a string or list of strings
+//	"body"    - request body, as a string or bytes
+//
+// Positional arguments of the call are ignored.  The handler's response is
+// returned to the caller with these keyword arguments of the result:
+//
+//	"status"  - HTTP status code
+//	"headers" - dict of header name to list of strings
+//	"body"    - response body, as bytes
+//
+// The response status is returned in the result, even if it is an HTTP
+// error.  A call with invalid keyword arguments is answered with a
+// wamp.error.invalid_argument ERROR.  The request's context is canceled if
+// the call is canceled.
+func (c *Client) RegisterHTTP(procedure string, h http.Handler, options wamp.Dict) error {
+	return c.Register(procedure, httpInvocationHandler(h), options)
+}
+
+// httpInvocationHandler returns an InvocationHandler that calls the
+// http.Handler.
+func httpInvocationHandler(h http.Handler) InvocationHandler {
+	return func(ctx context.Context, inv *wamp.Invocation) InvokeResult {
+		req, err := newHTTPRequest(ctx, inv.ArgumentsKw)
+		if err != nil {
+			return ResultError(wamp.ErrInvalidArgument, err.Error())
+		}
+		rsp := &httpResponse{header: http.Header{}}
+		h.ServeHTTP(rsp, req)
+		if rsp.status == 0 {
+			rsp.status = http.StatusOK
+		}
+
+		headers := make(wamp.Dict, len(rsp.header))
+		for name, values := range rsp.header {
+			list := make(wamp.List, len(values))
+			for i := range values {
+				list[i] = values[i]
+			}
+			headers[name] = list
+		}
+		return InvokeResult{Kwargs: wamp.Dict{
+			httpStatus:  rsp.status,
+			httpHeaders: headers,
+			httpBody:    append([]byte(nil), rsp.body.Bytes()...),
+		}}
+	}
+}
+
+// httpResponse is an http.ResponseWriter that keeps the response written by
+// a handler, so that it can be returned as the result of a call.
+type httpResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *httpResponse) Header() http.Header { return r.header }
+
+func (r *httpResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *httpResponse) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// newHTTPRequest creates an HTTP request from the keyword arguments of a call.
+func newHTTPRequest(ctx context.Context, kwargs wamp.Dict) (*http.Request, error) {
+	method := http.MethodGet
+	if v, ok := kwargs[httpMethod]; ok {
+		if method, ok = wamp.AsString(v); !ok || method == "" {
+			return nil, fmt.Errorf("%s must be a non-empty string", httpMethod)
+		}
+	}
+	path := "/"
+	if v, ok := kwargs[httpPath]; ok {
+		if path, ok = wamp.AsString(v); !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%s must be a string starting with /", httpPath)
+		}
+	}
+	var body string
+	if v, ok := kwargs[httpBody]; ok {
+		if body, ok = wamp.AsString(v); !ok {
+			return nil, fmt.Errorf("%s must be a string or bytes", httpBody)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = path
+
+	if v, ok := kwargs[httpHeaders]; ok {
+		headers, ok := wamp.AsDict(v)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a dict", httpHeaders)
+		}
+		for name, val := range headers {
+			if s, ok := wamp.AsString(val); ok {
+				req.Header.Add(name, s)
+				continue
+			}
+			list, ok := wamp.AsList(val)
+			if !ok {
+				return nil, fmt.Errorf("header %s must be a string or list of strings", name)
+			}
+			for i := range list {
+				s, ok := wamp.AsString(list[i])
+				if !ok {
+					return nil, fmt.Errorf("header %s must be a string or list of strings", name)
+				}
+				req.Header.Add(name, s)
+			}
+		}
+	}
+	return req, nil
+}
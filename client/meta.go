@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Meta provides typed access to the session, subscription, and registration
+// meta procedures of the router.  Each method calls a meta procedure using the
+// client, and decodes the result.  The router may require authorization to
+// call meta procedures.
+type Meta struct {
+	c *Client
+}
+
+// MatchIDs are the IDs of subscriptions or registrations, grouped by match
+// policy.
+type MatchIDs struct {
+	Exact    []wamp.ID
+	Prefix   []wamp.ID
+	Wildcard []wamp.ID
+}
+
+// NewMeta returns a Meta that calls the meta procedures using the given
+// client.
+func NewMeta(c *Client) *Meta {
+	return &Meta{c: c}
+}
+
+// SessionCount returns the number of sessions attached to the realm.  If any
+// authroles are given, then only sessions with one of the authroles are
+// counted.
+func (m *Meta) SessionCount(ctx context.Context, authroles ...string) (int, error) {
+	result, err := m.call(ctx, wamp.MetaProcSessionCount, authrolesArgs(authroles))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := wamp.AsInt64(result)
+	if !ok {
+		return 0, metaResultError(wamp.MetaProcSessionCount, result)
+	}
+	return int(count), nil
+}
+
+// SessionList returns the IDs of the sessions attached to the realm.  If any
+// authroles are given, then only sessions with one of the authroles are
+// listed.
+func (m *Meta) SessionList(ctx context.Context, authroles ...string) ([]wamp.ID, error) {
+	result, err := m.call(ctx, wamp.MetaProcSessionList, authrolesArgs(authroles))
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := asIDs(result)
+	if !ok {
+		return nil, metaResultError(wamp.MetaProcSessionList, result)
+	}
+	return ids, nil
+}
+
+// SessionGet returns information about the session with the given ID.  The
+// Joined time is not available from the meta procedure, and is always zero.
+func (m *Meta) SessionGet(ctx context.Context, id wamp.ID) (wamp.SessionInfo, error) {
+	result, err := m.call(ctx, wamp.MetaProcSessionGet, wamp.List{id})
+	if err != nil {
+		return wamp.SessionInfo{}, err
+	}
+	details, ok := wamp.AsDict(result)
+	if !ok {
+		return wamp.SessionInfo{}, metaResultError(wamp.MetaProcSessionGet, result)
+	}
+	info := wamp.SessionInfo{ID: id}
+	if sid, ok := wamp.AsID(details["session"]); ok {
+		info.ID = sid
+	}
+	info.AuthID, _ = wamp.AsString(details["authid"])
+	info.AuthRole, _ = wamp.AsString(details["authrole"])
+	info.AuthMethod, _ = wamp.AsString(details["authmethod"])
+	return info, nil
+}
+
+// SubscriptionList returns the IDs of all subscriptions in the realm.
+func (m *Meta) SubscriptionList(ctx context.Context) (MatchIDs, error) {
+	return m.matchIDs(ctx, wamp.MetaProcSubList)
+}
+
+// SubscriptionListSubscribers returns the session IDs of the subscribers to
+// the subscription with the given ID.
+func (m *Meta) SubscriptionListSubscribers(ctx context.Context, id wamp.ID) ([]wamp.ID, error) {
+	result, err := m.call(ctx, wamp.MetaProcSubListSubscribers, wamp.List{id})
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := asIDs(result)
+	if !ok {
+		return nil, metaResultError(wamp.MetaProcSubListSubscribers, result)
+	}
+	return ids, nil
+}
+
+// RegistrationList returns the IDs of all registrations in the realm.
+func (m *Meta) RegistrationList(ctx context.Context) (MatchIDs, error) {
+	return m.matchIDs(ctx, wamp.MetaProcRegList)
+}
+
+// RegistrationListCallees returns the session IDs of the callees of the
+// registration with the given ID.
+func (m *Meta) RegistrationListCallees(ctx context.Context, id wamp.ID) ([]wamp.ID, error) {
+	result, err := m.call(ctx, wamp.MetaProcRegListCallees, wamp.List{id})
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := asIDs(result)
+	if !ok {
+		return nil, metaResultError(wamp.MetaProcRegListCallees, result)
+	}
+	return ids, nil
+}
+
+// call calls the meta procedure and returns the first result argument.
+func (m *Meta) call(ctx context.Context, procedure wamp.URI, args wamp.List) (interface{}, error) {
+	result, err := m.c.Call(ctx, string(procedure), nil, args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Arguments) == 0 {
+		return nil, fmt.Errorf("no result from %s", procedure)
+	}
+	return result.Arguments[0], nil
+}
+
+// matchIDs calls a list meta procedure that returns IDs by match policy.
+func (m *Meta) matchIDs(ctx context.Context, procedure wamp.URI) (MatchIDs, error) {
+	result, err := m.call(ctx, procedure, nil)
+	if err != nil {
+		return MatchIDs{}, err
+	}
+	dict, ok := wamp.AsDict(result)
+	if !ok {
+		return MatchIDs{}, metaResultError(procedure, result)
+	}
+	var ids MatchIDs
+	for match, dst := range map[string]*[]wamp.ID{
+		wamp.MatchExact:    &ids.Exact,
+		wamp.MatchPrefix:   &ids.Prefix,
+		wamp.MatchWildcard: &ids.Wildcard,
+	} {
+		if *dst, ok = asIDs(dict[match]); !ok {
+			return MatchIDs{}, metaResultError(procedure, result)
+		}
+	}
+	return ids, nil
+}
+
+// authrolesArgs returns the arguments for a session meta procedure that
+// filters sessions by authrole.
+func authrolesArgs(authroles []string) wamp.List {
+	if len(authroles) == 0 {
+		return nil
+	}
+	return wamp.List{authroles}
+}
+
+// asIDs converts a list of IDs to a slice of wamp.ID.
+func asIDs(v interface{}) ([]wamp.ID, bool) {
+	list, ok := wamp.AsList(v)
+	if !ok {
+		return nil, false
+	}
+	ids := make([]wamp.ID, len(list))
+	for i := range list {
+		if ids[i], ok = wamp.AsID(list[i]); !ok {
+			return nil, false
+		}
+	}
+	return ids, true
+}
+
+func metaResultError(procedure wamp.URI, result interface{}) error {
+	return fmt.Errorf("unexpected result from %s: %v", procedure, result)
+}
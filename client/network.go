@@ -3,8 +3,10 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"path"
@@ -32,12 +34,43 @@ import (
 //
 // For Unix socket clients, the routerURL has the form "unix://path".  The path
 // portion specifies a path on the local file system where the Unix socket is
-// created.  TLS is not used for unix sockets.
+// created, such as "unix:///var/run/nexus.sock" for an absolute path.  TLS is
+// not used for unix sockets.  The router serves unix socket clients using a
+// RawSocketServer.
 func ConnectNet(ctx context.Context, routerURL string, cfg Config) (*Client, error) {
 	if cfg.Logger == nil {
 		cfg.Logger = log.New(os.Stderr, "", 0)
 	}
 
+	if len(cfg.Serializations) == 0 {
+		p, err := connectPeer(ctx, routerURL, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(p, cfg)
+	}
+
+	// Try each serialization in order of preference until one is supported
+	// by the router.
+	var err error
+	for _, s := range cfg.Serializations {
+		cfg.Serialization = s
+		var p wamp.Peer
+		p, err = connectPeer(ctx, routerURL, &cfg)
+		if err == nil {
+			return NewClient(p, cfg)
+		}
+		if !errors.Is(err, transport.ErrSerializerUnsupported) {
+			break
+		}
+		cfg.Logger.Printf("Router does not support serialization %d", s)
+	}
+	return nil, err
+}
+
+// connectPeer connects a peer to the router at routerURL using the
+// serialization specified in cfg.
+func connectPeer(ctx context.Context, routerURL string, cfg *Config) (wamp.Peer, error) {
 	u, err := url.Parse(routerURL)
 	if err != nil {
 		return nil, err
@@ -54,24 +87,31 @@ func ConnectNet(ctx context.Context, routerURL string, cfg Config) (*Client, err
 		routerURL = u.String()
 		fallthrough
 	case "ws", "wss":
+		wsCfg := cfg.WsCfg
+		dial := wsCfg.DialContext
+		if dial == nil && wsCfg.Dial != nil {
+			netDial := wsCfg.Dial
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return netDial(network, addr)
+			}
+		}
+		wsCfg.DialContext = dialFunc(cfg, dial)
 		p, err = transport.ConnectWebsocketPeer(ctx, routerURL,
-			cfg.Serialization, cfg.TlsCfg, cfg.Logger, &cfg.WsCfg)
+			cfg.Serialization, tlsConfig(cfg, u.Scheme == "wss"), cfg.Logger, &wsCfg)
 	case "tcps", "tcp4s", "tcp6s":
 		u.Scheme = u.Scheme[:len(u.Scheme)-1]
-		if cfg.TlsCfg == nil {
-			cfg.TlsCfg = new(tls.Config)
-		}
-		fallthrough
+		p, err = transport.ConnectRawSocketPeerDial(ctx, dialFunc(cfg, nil), u.Scheme, u.Host,
+			cfg.Serialization, tlsConfig(cfg, true), cfg.Logger, cfg.RecvLimit)
 	case "tcp", "tcp4", "tcp6":
-		p, err = transport.ConnectRawSocketPeer(ctx, u.Scheme, u.Host,
-			cfg.Serialization, cfg.TlsCfg, cfg.Logger, cfg.RecvLimit)
+		p, err = transport.ConnectRawSocketPeerDial(ctx, dialFunc(cfg, nil), u.Scheme, u.Host,
+			cfg.Serialization, tlsConfig(cfg, false), cfg.Logger, cfg.RecvLimit)
 	case "unix":
 		if cfg.TlsCfg != nil {
 			return nil, fmt.Errorf("tls not supported for %s", u.Scheme)
 		}
 		// If a relative path was specified, u.Host is first part of path.
 		addr := path.Clean(u.Host + u.Path)
-		p, err = transport.ConnectRawSocketPeer(ctx, u.Scheme, addr,
+		p, err = transport.ConnectRawSocketPeerDial(ctx, dialFunc(cfg, nil), u.Scheme, addr,
 			cfg.Serialization, nil, cfg.Logger, cfg.RecvLimit)
 	default:
 		err = fmt.Errorf("invalid url: %s", routerURL)
@@ -79,7 +119,52 @@ func ConnectNet(ctx context.Context, routerURL string, cfg Config) (*Client, err
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(p, cfg)
+	return p, nil
+}
+
+// dialFunc returns the function that makes the network connection to the
+// router, or nil to use the default of the transport.  cfg.Dial, if set,
+// overrides dial.  If cfg.OnConn is set, then the returned function calls it
+// with each new connection.
+func dialFunc(cfg *Config, dial transport.DialContextFunc) transport.DialContextFunc {
+	if cfg.Dial != nil {
+		dial = cfg.Dial
+	}
+	if cfg.OnConn == nil {
+		return dial
+	}
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	onConn := cfg.OnConn
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		onConn(conn)
+		return conn, nil
+	}
+}
+
+// tlsConfig returns the TLS configuration to connect with, or nil to connect
+// without TLS.  If useTLS is true, then the default configuration is used when
+// cfg.TlsCfg is nil.  If cfg.VerifyPeerCertificate is set, then it is set in a
+// copy of the configuration.
+func tlsConfig(cfg *Config, useTLS bool) *tls.Config {
+	tlsCfg := cfg.TlsCfg
+	if tlsCfg == nil {
+		if !useTLS {
+			return nil
+		}
+		tlsCfg = new(tls.Config)
+	}
+	if cfg.VerifyPeerCertificate != nil {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.VerifyPeerCertificate = cfg.VerifyPeerCertificate
+	}
+	return tlsCfg
 }
 
 // CookieURL takes a websocket URL string and outputs a url.URL that can be
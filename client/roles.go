@@ -19,20 +19,22 @@ var clientRoles = wamp.Dict{
 	},
 	wamp.RoleCallee: wamp.Dict{
 		"features": wamp.Dict{
-			wamp.FeaturePatternBasedReg: true,
-			wamp.FeatureSharedReg:       true,
-			wamp.FeatureCallCanceling:   true,
-			wamp.FeatureCallTimeout:     true,
-			wamp.FeatureCallerIdent:     true,
-			wamp.FeatureProgCallResults: true,
+			wamp.FeaturePatternBasedReg:     true,
+			wamp.FeatureSharedReg:           true,
+			wamp.FeatureCallCanceling:       true,
+			wamp.FeatureCallTimeout:         true,
+			wamp.FeatureCallerIdent:         true,
+			wamp.FeatureProgCallInvocations: true,
+			wamp.FeatureProgCallResults:     true,
 		},
 	},
 	wamp.RoleCaller: wamp.Dict{
 		"features": wamp.Dict{
-			wamp.FeatureCallCanceling:   true,
-			wamp.FeatureCallTimeout:     true,
-			wamp.FeatureCallerIdent:     true,
-			wamp.FeatureProgCallResults: true,
+			wamp.FeatureCallCanceling:       true,
+			wamp.FeatureCallTimeout:         true,
+			wamp.FeatureCallerIdent:         true,
+			wamp.FeatureProgCallInvocations: true,
+			wamp.FeatureProgCallResults:     true,
 		},
 	},
 }
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// ScanEvent decodes the positional arguments of an event into the values
+// pointed to by argPtrs, in order.  An argument that can be assigned to the
+// pointed to value is stored directly.  Otherwise, the argument is converted
+// using the JSON encoding rules of the encoding/json package, so that numbers
+// can be decoded into any numeric type, and dicts into structs using json
+// field tags.  A nil pointer skips the corresponding argument.
+//
+// An error is returned if the event has fewer arguments than argPtrs.  Extra
+// arguments are ignored.  If an argument cannot be decoded, then a
+// *wamp.ArgumentError is returned that gives the index of the argument.
+//
+// For example, in an event handler:
+//
+//	var name string
+//	var count int
+//	if err := client.ScanEvent(event, &name, &count); err != nil {
+//		log.Print("bad event:", err)
+//		return
+//	}
+func ScanEvent(event *wamp.Event, argPtrs ...interface{}) error {
+	if len(event.Arguments) < len(argPtrs) {
+		return fmt.Errorf("event has %d arguments, expected at least %d",
+			len(event.Arguments), len(argPtrs))
+	}
+	for i, ptr := range argPtrs {
+		if ptr == nil {
+			continue
+		}
+		if err := decodeValue(event.Arguments[i], ptr); err != nil {
+			return &wamp.ArgumentError{Index: i, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// ScanEventKw decodes the keyword arguments of an event into the value pointed
+// to by out, which is typically a struct or a map.  The keyword arguments are
+// converted the same as arguments are by ScanEvent.
+func ScanEventKw(event *wamp.Event, out interface{}) error {
+	if err := decodeValue(event.ArgumentsKw, out); err != nil {
+		return fmt.Errorf("event keyword arguments %s", err)
+	}
+	return nil
+}
+
+// decodeValue stores v in the value pointed to by ptr, converting v if it
+// cannot be assigned directly.  The returned error describes the problem for
+// use in an error message about v.
+func decodeValue(v interface{}, ptr interface{}) error {
+	pv := reflect.ValueOf(ptr)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() {
+		return fmt.Errorf("cannot be stored in non-pointer %T", ptr)
+	}
+	dst := pv.Elem()
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if val := reflect.ValueOf(v); val.Type().AssignableTo(dst.Type()) {
+		dst.Set(val)
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("has type %T that cannot be converted: %s", v, err)
+	}
+	if err = json.Unmarshal(b, ptr); err != nil {
+		return fmt.Errorf("has type %T, cannot decode into %s", v, dst.Type())
+	}
+	return nil
+}
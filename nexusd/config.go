@@ -30,6 +30,9 @@ type Config struct {
 		AllowOrigins []string `json:"allow_origins"`
 		// Limit on number of pending messages to send to each client.
 		OutQueueSize int `json:"out_queue_size"`
+		// Time in seconds allowed for a client to open a session.  Set to 0
+		// for the default.
+		HandshakeTimeout time.Duration `json:"handshake_timeout"`
 	}
 
 	// RawSocket configuration parameters.
@@ -47,6 +50,9 @@ type Config struct {
 		KeyFile  string `json:"key_file"`
 		// Limit on number of pending messages to send to each client.
 		OutQueueSize int `json:"out_queue_size"`
+		// Time in seconds allowed for a client to open a session.  Set to 0
+		// for the default.
+		HandshakeTimeout time.Duration `json:"handshake_timeout"`
 	}
 
 	// File to write log data to.  If not specified, log to stdout.
@@ -74,5 +80,26 @@ func LoadConfig(path string) *Config {
 	if config.RawSocket.TCPKeepAliveInterval != 0 {
 		config.RawSocket.TCPKeepAliveInterval *= time.Second
 	}
+	config.WebSocket.HandshakeTimeout *= time.Second
+	config.RawSocket.HandshakeTimeout *= time.Second
+
+	// Router durations are given in seconds, except for event_batch_window,
+	// which is given in milliseconds.
+	config.Router.GoodbyeTimeout *= time.Second
+	config.Router.LogSampleWindow *= time.Second
+	for _, realmConfig := range config.Router.RealmConfigs {
+		scaleRealmDurations(realmConfig)
+	}
+	if config.Router.RealmTemplate != nil {
+		scaleRealmDurations(config.Router.RealmTemplate)
+	}
 	return &config
 }
+
+// scaleRealmDurations converts the durations read from the JSON configuration
+// of a realm to the units they are given in.
+func scaleRealmDurations(realmConfig *router.RealmConfig) {
+	realmConfig.IdleTimeout *= time.Second
+	realmConfig.PublishDedupWindow *= time.Second
+	realmConfig.EventBatchWindow *= time.Millisecond
+}
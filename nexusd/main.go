@@ -139,6 +139,10 @@ func main() {
 			wss.OutQueueSize = conf.WebSocket.OutQueueSize
 			logger.Printf("Websocket outbound queue size: %d", wss.OutQueueSize)
 		}
+		if conf.WebSocket.HandshakeTimeout != 0 {
+			wss.HandshakeTimeout = conf.WebSocket.HandshakeTimeout
+			logger.Printf("Websocket handshake timeout: %s", wss.HandshakeTimeout)
+		}
 		var closer io.Closer
 		var sockDesc string
 		if conf.WebSocket.CertFile != "" && conf.WebSocket.KeyFile != "" {
@@ -166,6 +170,10 @@ func main() {
 			rss.OutQueueSize = conf.RawSocket.OutQueueSize
 			logger.Printf("raw socket outbound queue size: %d", rss.OutQueueSize)
 		}
+		if conf.RawSocket.HandshakeTimeout != 0 {
+			rss.HandshakeTimeout = conf.RawSocket.HandshakeTimeout
+			logger.Printf("raw socket handshake timeout: %s", rss.HandshakeTimeout)
+		}
 		if conf.RawSocket.TCPAddress != "" {
 			if conf.RawSocket.TCPKeepAliveInterval != 0 {
 				rss.KeepAlive = conf.RawSocket.TCPKeepAliveInterval
@@ -1,6 +1,14 @@
 package router
 
-import "github.com/gammazero/nexus/v3/wamp"
+import (
+	"errors"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// ErrNotAuthorized is the reason given to RealmConfig.OnDeny when the
+// Authorizer does not authorize a message, without returning an error.
+var ErrNotAuthorized = errors.New("not authorized")
 
 // Authorizer is the interface implemented by a type that provides the ability
 // to authorize sending messages.
@@ -16,6 +24,14 @@ type Authorizer interface {
 	// work as an interceptor of messages that can change their content and/or
 	// change the sending session based on the intercepted message.  This
 	// functionality may be used to set values in the session upon encountering
-	// certain messages sent by that session.
+	// certain messages sent by that session.  If the authorizer changes the
+	// session's authid or authrole, then the router publishes a
+	// wamp.session.on_reauth meta event with the session ID and the old and
+	// new values.
+	//
+	// Calls to meta procedures, such as wamp.session.list and
+	// wamp.session.kill, are authorized like any other CALL message.  This
+	// allows an Authorizer to permit some meta procedures while denying
+	// others, based on the procedure URI.
 	Authorize(*wamp.Session, wamp.Message) (bool, error)
 }
@@ -1,6 +1,8 @@
 package router
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 const (
 	denyTopic  = wamp.URI("forbidden.topic")
 	allowTopic = wamp.URI("allowed.topic")
+	denyProc   = wamp.URI("forbidden.proc")
 )
 
 // testAuthz implements Authorizer interface.
@@ -25,6 +28,55 @@ func (a *testAuthz) Authorize(session *wamp.Session, msg wamp.Message) (bool, er
 	return true, nil
 }
 
+// testAuthzCall implements Authorizer that denies calls to procedures with the
+// denyProc prefix.
+type testAuthzCall struct{}
+
+func (a *testAuthzCall) Authorize(session *wamp.Session, msg wamp.Message) (bool, error) {
+	if m, ok := msg.(*wamp.Call); ok {
+		return !m.Procedure.PrefixMatch(denyProc), nil
+	}
+	return true, nil
+}
+
+// testAuthzMeta implements Authorizer that denies the session kill meta
+// procedures.
+type testAuthzMeta struct{}
+
+func (a *testAuthzMeta) Authorize(session *wamp.Session, msg wamp.Message) (bool, error) {
+	if m, ok := msg.(*wamp.Call); ok {
+		if strings.HasPrefix(string(m.Procedure), "wamp.session.kill") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// testAuthzRole implements Authorizer that only allows sessions having the
+// "guest" authrole to subscribe.
+type testAuthzRole struct{}
+
+func (a *testAuthzRole) Authorize(session *wamp.Session, msg wamp.Message) (bool, error) {
+	if _, ok := msg.(*wamp.Subscribe); ok {
+		authrole, _ := wamp.AsString(session.Details["authrole"])
+		return authrole == "guest", nil
+	}
+	return true, nil
+}
+
+// testAuthzElevate implements Authorizer that gives the "admin" authrole to
+// sessions that subscribe to elevateTopic.
+type testAuthzElevate struct{}
+
+const elevateTopic = wamp.URI("elevate.topic")
+
+func (a *testAuthzElevate) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if m, ok := msg.(*wamp.Subscribe); ok && m.Topic == elevateTopic {
+		sess.Details["authrole"] = "admin"
+	}
+	return true, nil
+}
+
 type testAuthzMod struct{}
 
 // Authorize implementation that modifies the session details.
@@ -78,6 +130,68 @@ func TestAuthorizer(t *testing.T) {
 	}
 }
 
+// Test that calls to meta procedures are authorized by procedure URI.
+func TestAuthorizerMetaProcedures(t *testing.T) {
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthzMeta{},
+				RequireLocalAuthz: true,
+				EnableMetaKill:    true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test that authorizer allows listing sessions.
+	cli.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionList})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Result); !ok {
+		t.Fatal("Expected RESULT, got:", msg.MessageType())
+	}
+
+	// Test that authorizer forbids killing a session.
+	cli.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionKill,
+		Arguments: wamp.List{other.ID},
+	})
+	msg, err = wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected", wamp.ErrNotAuthorized, "got", errMsg.Error)
+	}
+
+	// Check that the other session was not killed.
+	if _, err = wamp.RecvTimeout(other, 100*time.Millisecond); err == nil {
+		t.Fatal("Session should not have been killed")
+	}
+}
+
 // Test that authorizer is not called with a local session and config does not
 // specify RequireLocalAuthz=true.
 func TestAuthorizerBypassLocal(t *testing.T) {
@@ -250,3 +364,647 @@ func TestAuthorizerRace(t *testing.T) {
 	<-done
 	<-done
 }
+
+// testAuthzDenyCall implements an Authorizer that denies all CALL messages.
+type testAuthzDenyCall struct{}
+
+func (a *testAuthzDenyCall) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if _, ok := msg.(*wamp.Call); ok {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Test that replacing the Authorizer of a running realm changes authorization
+// of the next message from a session that is already attached.
+func TestSetAuthorizer(t *testing.T) {
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthz{},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callSessionCount := func(req wamp.ID) wamp.Message {
+		cli.Send(&wamp.Call{Request: req, Procedure: wamp.MetaProcSessionCount})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	if msg := callSessionCount(1); msg.MessageType() != wamp.RESULT {
+		t.Fatal("Expected RESULT, got:", msg.MessageType())
+	}
+
+	if err = r.(RealmUpdater).SetAuthorizer(testRealm, &testAuthzDenyCall{}); err != nil {
+		t.Fatal(err)
+	}
+	msg := callSessionCount(2)
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected", wamp.ErrNotAuthorized, "got", errMsg.Error)
+	}
+
+	// Remove the authorizer using UpdateRealmConfig, and check that the
+	// previously denied topic is now allowed.
+	err = r.(RealmUpdater).UpdateRealmConfig(testRealm, func(cfg *RealmConfig) {
+		cfg.Authorizer = nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Send(&wamp.Subscribe{Request: 3, Topic: denyTopic})
+	msg, err = wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	if err = r.(RealmUpdater).SetAuthorizer("no.such.realm", nil); err == nil {
+		t.Fatal("Expected error for non-existent realm")
+	}
+}
+
+// Test that anonymous sessions have the realm's default authrole, and are
+// authorized according to that role.
+func TestDefaultAuthRole(t *testing.T) {
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				AnonymousAuth:     true,
+				DefaultAuthRole:   "guest",
+				RequireLocalAuth:  true,
+				RequireLocalAuthz: true,
+				Authorizer:        &testAuthzRole{},
+			},
+		},
+		Debug: debug,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authrole, _ := wamp.AsString(sub.Details["authrole"]); authrole != "guest" {
+		t.Fatal("expected authrole guest, got", authrole)
+	}
+	if authmethod, _ := wamp.AsString(sub.Details["authmethod"]); authmethod != "anonymous" {
+		t.Fatal("expected authmethod anonymous, got", authmethod)
+	}
+
+	// Test that the authorizer allows the guest role to subscribe.
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: allowTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	// Test that anonymous sessions get the default "anonymous" role, which is
+	// not authorized, when the default role is not set.
+	err = r.(RealmUpdater).UpdateRealmConfig(testRealm, func(cfg *RealmConfig) {
+		cfg.DefaultAuthRole = ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err = testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authrole, _ := wamp.AsString(sub.Details["authrole"]); authrole != "anonymous" {
+		t.Fatal("expected authrole anonymous, got", authrole)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: allowTopic})
+	msg, err = wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Error); !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+}
+
+// Test that a CALL that is not authorized is answered with not_authorized, and
+// that a call to a procedure that is not registered is answered with
+// no_such_procedure, in the order given by CheckProcedureBeforeAuthz.
+func TestAuthorizerCallOrder(t *testing.T) {
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthzCall{},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee.Send(&wamp.Register{Request: wamp.GlobalID(), Procedure: denyProc})
+	msg, err := wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Registered); !ok {
+		t.Fatal("Expected REGISTERED, got:", msg.MessageType())
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCallError := func(procedure, expect wamp.URI) {
+		t.Helper()
+		reqID := wamp.GlobalID()
+		caller.Send(&wamp.Call{Request: reqID, Procedure: procedure})
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errMsg, ok := msg.(*wamp.Error)
+		if !ok {
+			t.Fatal("Expected ERROR, got:", msg.MessageType())
+		}
+		if errMsg.Request != reqID {
+			t.Fatal("wrong request ID in ERROR")
+		}
+		if errMsg.Error != expect {
+			t.Fatalf("calling %s: expected error %s, got %s", procedure, expect, errMsg.Error)
+		}
+	}
+
+	// Check that authorization is checked first by default.
+	checkCallError(denyProc, wamp.ErrNotAuthorized)
+	checkCallError(denyProc+".absent", wamp.ErrNotAuthorized)
+	checkCallError("allowed.absent", wamp.ErrNoSuchProcedure)
+
+	err = r.(RealmUpdater).UpdateRealmConfig(testRealm, func(cfg *RealmConfig) {
+		cfg.CheckProcedureBeforeAuthz = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that existence is checked first when configured.
+	checkCallError(denyProc, wamp.ErrNotAuthorized)
+	checkCallError(denyProc+".absent", wamp.ErrNoSuchProcedure)
+	checkCallError("allowed.absent", wamp.ErrNoSuchProcedure)
+}
+
+// Test that a change of authrole made by the Authorizer generates a
+// wamp.session.on_reauth meta event with the old and new values.
+func TestAuthorizerReauthMetaEvent(t *testing.T) {
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthzElevate{},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscribe := func(sess *wamp.Session, topic wamp.URI) {
+		t.Helper()
+		sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+		}
+	}
+
+	observer, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(observer, wamp.MetaEventSessionOnReauth)
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRole, _ := wamp.AsString(sess.Details["authrole"])
+	oldID, _ := wamp.AsString(sess.Details["authid"])
+
+	// Check that a message that does not change the session does not
+	// generate an event.
+	subscribe(sess, allowTopic)
+	if msg, err := wamp.RecvTimeout(observer, 200*time.Millisecond); err == nil {
+		t.Fatal("Unexpected message:", msg.MessageType())
+	}
+
+	subscribe(sess, elevateTopic)
+	msg, err := wamp.RecvTimeout(observer, time.Second)
+	if err != nil {
+		t.Fatal("did not receive on_reauth event:", err)
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	}
+	if len(event.Arguments) != 3 {
+		t.Fatal("expected 3 event arguments, got", len(event.Arguments))
+	}
+	if id, _ := wamp.AsID(event.Arguments[0]); id != sess.ID {
+		t.Fatal("wrong session ID in event:", event.Arguments[0])
+	}
+	before, _ := wamp.AsDict(event.Arguments[1])
+	after, _ := wamp.AsDict(event.Arguments[2])
+	if before["authrole"] != oldRole || after["authrole"] != "admin" {
+		t.Fatalf("expected authrole change %q to admin, got %v to %v",
+			oldRole, before["authrole"], after["authrole"])
+	}
+	if before["authid"] != oldID || after["authid"] != oldID {
+		t.Fatal("authid should not change, got", before["authid"], "to", after["authid"])
+	}
+
+	// Check that the session keeps the new role.
+	subscribe(sess, elevateTopic)
+	if msg, err = wamp.RecvTimeout(observer, 200*time.Millisecond); err == nil {
+		t.Fatal("Unexpected message:", msg.MessageType())
+	}
+}
+
+// testAuthzFail implements Authorizer that fails to authorize publications.
+type testAuthzFail struct{}
+
+var errAuthzFail = errors.New("authorizer unavailable")
+
+func (a *testAuthzFail) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if _, ok := msg.(*wamp.Publish); ok {
+		return false, errAuthzFail
+	}
+	return (&testAuthz{}).Authorize(sess, msg)
+}
+
+func TestAuthorizerOnDeny(t *testing.T) {
+	type denial struct {
+		sess   *wamp.Session
+		msg    wamp.Message
+		reason error
+	}
+	denials := make(chan denial, 1)
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthzFail{},
+				RequireLocalAuthz: true,
+				OnDeny: func(sess *wamp.Session, msg wamp.Message, reason error) {
+					denials <- denial{sess, msg, reason}
+				},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authid, _ := wamp.AsString(sess.Details["authid"])
+	recvDenial := func() denial {
+		t.Helper()
+		select {
+		case d := <-denials:
+			if d.sess.ID != sess.ID {
+				t.Fatal("wrong session ID:", d.sess.ID)
+			}
+			if id, _ := wamp.AsString(d.sess.Details["authid"]); id != authid {
+				t.Fatal("wrong authid:", id)
+			}
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("OnDeny not called")
+		}
+		return denial{}
+	}
+
+	// Check that a denied message is reported.
+	sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: denyTopic})
+	d := recvDenial()
+	if sub, ok := d.msg.(*wamp.Subscribe); !ok || sub.Topic != denyTopic {
+		t.Fatal("expected SUBSCRIBE to", denyTopic, "got", d.msg)
+	}
+	if d.reason != ErrNotAuthorized {
+		t.Fatal("expected ErrNotAuthorized, got", d.reason)
+	}
+	if msg, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Error); !ok {
+		t.Fatal("Expected ERROR, got:", msg.MessageType())
+	}
+
+	// Check that a failure to authorize is reported with the error.
+	sess.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: allowTopic})
+	d = recvDenial()
+	if pub, ok := d.msg.(*wamp.Publish); !ok || pub.Topic != allowTopic {
+		t.Fatal("expected PUBLISH to", allowTopic, "got", d.msg)
+	}
+	if d.reason != errAuthzFail {
+		t.Fatal("expected authorizer error, got", d.reason)
+	}
+
+	// Check that an authorized message is not reported.
+	sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: allowTopic})
+	if msg, err := wamp.RecvTimeout(sess, time.Second); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+	select {
+	case d = <-denials:
+		t.Fatal("unexpected denial of", d.msg.MessageType())
+	default:
+	}
+}
+
+// Test that an observer session can call meta procedures that read meta
+// information, and cannot send any other message.
+func TestObserverAuthRoles(t *testing.T) {
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				AnonymousAuth:     true,
+				DefaultAuthRole:   "observer",
+				RequireLocalAuth:  true,
+				ObserverAuthRoles: []string{"observer"},
+				EnableMetaKill:    true,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() wamp.Message {
+		t.Helper()
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	checkDenied := func(msg wamp.Message) {
+		t.Helper()
+		sess.Send(msg)
+		rsp := recv()
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("Expected ERROR for", msg.MessageType(), "got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("Expected not_authorized, got:", errMsg.Error)
+		}
+	}
+
+	// Check that the observer can list sessions.
+	sess.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSessionList})
+	msg := recv()
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("Expected RESULT, got:", msg.MessageType())
+	}
+	ids, _ := wamp.AsList(result.Arguments[0])
+	if len(ids) != 1 || ids[0] != sess.ID {
+		t.Fatal("expected session list to contain observer, got", ids)
+	}
+
+	// Check that the observer can subscribe to meta events.
+	sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: wamp.MetaEventSessionOnJoin})
+	if msg = recv(); msg.MessageType() != wamp.SUBSCRIBED {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	// Check that the observer cannot publish, subscribe to other topics,
+	// register, call procedures other than meta procedures, or change the
+	// router.
+	checkDenied(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   allowTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	checkDenied(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: allowTopic})
+	checkDenied(&wamp.Register{Request: wamp.GlobalID(), Procedure: testProcedure})
+	checkDenied(&wamp.Call{Request: wamp.GlobalID(), Procedure: testProcedure})
+	checkDenied(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcSessionKill,
+		Arguments: wamp.List{sess.ID},
+	})
+
+	// Check that the observer cannot call a meta procedure added by the
+	// application, since it may change the router.
+	const flushProc = wamp.URI("wamp.myapp.flush_cache")
+	flush := func(inv *wamp.Invocation) wamp.Message {
+		return &wamp.Yield{}
+	}
+	if err = r.(MetaProcedureRegistrar).RegisterMetaProcedure(testRealm, flushProc, flush); err != nil {
+		t.Fatal(err)
+	}
+	checkDenied(&wamp.Call{Request: wamp.GlobalID(), Procedure: flushProc})
+
+	// Check that a session without an observer authrole is not restricted.
+	err = r.(RealmUpdater).UpdateRealmConfig(testRealm, func(cfg *RealmConfig) {
+		cfg.DefaultAuthRole = ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err = testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   allowTopic,
+		Options: wamp.Dict{wamp.OptAcknowledge: true},
+	})
+	if msg = recv(); msg.MessageType() != wamp.PUBLISHED {
+		t.Fatal("Expected PUBLISHED, got:", msg.MessageType())
+	}
+}
+
+// Test that a local session without an observer authrole still bypasses the
+// Authorizer when the realm has observer authroles.
+func TestObserverAuthRolesBypassLocal(t *testing.T) {
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthz{},
+				ObserverAuthRoles: []string{"observer"},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sess, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: denyTopic})
+	msg, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+}
+
+// testAuthzDenyProc implements an Authorizer that denies calls to one
+// procedure.
+type testAuthzDenyProc struct {
+	procedure wamp.URI
+}
+
+func (a *testAuthzDenyProc) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if call, ok := msg.(*wamp.Call); ok && call.Procedure == a.procedure {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Test that a call forwarded to a fallback procedure is not authorized, as
+// documented for CallFallbacks.
+func TestCallFallbackAuthorization(t *testing.T) {
+	const primaryProc = wamp.URI("nexus.test.primary")
+	const fallbackProc = wamp.URI("nexus.test.fallback")
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				Authorizer:        &testAuthzDenyProc{procedure: fallbackProc},
+				RequireLocalAuthz: true,
+				CallFallbacks:     map[wamp.URI]wamp.URI{primaryProc: fallbackProc},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	callee, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, proc := range []wamp.URI{primaryProc, fallbackProc} {
+		callee.Send(&wamp.Register{Request: wamp.ID(i + 1), Procedure: proc})
+		msg, err := wamp.RecvTimeout(callee, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*wamp.Registered); !ok {
+			t.Fatal("Expected REGISTERED, got:", msg.MessageType())
+		}
+	}
+
+	// Check that the fallback cannot be called directly.
+	caller.Send(&wamp.Call{Request: 1, Procedure: fallbackProc})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected not_authorized ERROR, got:", msg)
+	}
+
+	// Check that a failed call to the primary is forwarded to the fallback.
+	caller.Send(&wamp.Call{Request: 2, Procedure: primaryProc})
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, ok := msg.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("Expected INVOCATION, got:", msg.MessageType())
+	}
+	callee.Send(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Details: wamp.Dict{},
+		Error:   wamp.ErrUnavailable,
+	})
+	msg, err = wamp.RecvTimeout(callee, time.Second)
+	if err != nil {
+		t.Fatal("call not forwarded to fallback:", err)
+	}
+	if inv, ok = msg.(*wamp.Invocation); !ok {
+		t.Fatal("Expected INVOCATION, got:", msg.MessageType())
+	}
+	callee.Send(&wamp.Yield{Request: inv.Request, Options: wamp.Dict{}})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := msg.(*wamp.Result); !ok || result.Request != 2 {
+		t.Fatal("Expected RESULT, got:", msg)
+	}
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gammazero/nexus/v3/stdlog"
 	"github.com/gammazero/nexus/v3/wamp"
@@ -9,11 +10,21 @@ import (
 
 const (
 	detailTopic = "topic"
+
+	// Events that cannot be sent right away to a subscriber with reliable QoS
+	// are kept for retry, up to this many per subscriber.
+	reliableQueueSize = 64
+	// Interval at which sending kept events is retried.
+	reliableRetryInterval = 10 * time.Millisecond
+	// If no kept event can be sent to a subscriber for this long, then the
+	// subscriber is a slow consumer and its kept events are dropped.
+	reliableRetryTimeout = 500 * time.Millisecond
 )
 
 // Role information for this broker.
 var brokerRole = wamp.Dict{
 	"features": wamp.Dict{
+		wamp.FeatureEventRetention:       true,
 		wamp.FeaturePatternSub:           true,
 		wamp.FeaturePubExclusion:         true,
 		wamp.FeaturePubIdent:             true,
@@ -25,11 +36,60 @@ var brokerRole = wamp.Dict{
 
 // subscription manages all the subscribers to a particular topic.
 type subscription struct {
-	id          wamp.ID  // subscription ID
-	topic       wamp.URI // topic URI
-	match       string   // match policy
-	created     string   // when subscription was created
-	subscribers map[*wamp.Session]struct{}
+	id      wamp.ID  // subscription ID
+	topic   wamp.URI // topic URI
+	match   string   // match policy
+	created string   // when subscription was created
+
+	// Subscriber -> filter that events must match, or nil if no filter.
+	subscribers map[*wamp.Session]eventFilter
+	// Subscribers that requested reliable QoS.  Nil if there are none.
+	reliable map[*wamp.Session]struct{}
+}
+
+// setReliable sets whether events are sent to the subscriber with reliable
+// QoS.
+func (s *subscription) setReliable(subscriber *wamp.Session, reliable bool) {
+	if !reliable {
+		delete(s.reliable, subscriber)
+		return
+	}
+	if s.reliable == nil {
+		s.reliable = map[*wamp.Session]struct{}{}
+	}
+	s.reliable[subscriber] = struct{}{}
+}
+
+// reliableEvents are events waiting to be retried for a subscriber with
+// reliable QoS.
+type reliableEvents struct {
+	events []*wamp.Event
+	// Time after which the events are dropped if none can be sent.
+	deadline time.Time
+}
+
+// retainedEvent is the last publication to a topic that was published with
+// the retain option.  It is sent to new subscribers that request it.  Only the
+// publisher identity to disclose is kept, not the publisher's session, so that
+// the session is not kept after the publisher leaves.
+type retainedEvent struct {
+	msg        *wamp.Publish
+	pubID      wamp.ID
+	pubDetails wamp.Dict // publisher identity, nil if not disclosed
+	filter     PublishFilter
+	expires    time.Time // zero if the event does not expire
+}
+
+// dedupKey identifies a publication for deduplication.
+type dedupKey struct {
+	topic wamp.URI
+	key   string
+}
+
+// dedupEntry is a publication dedup key and the time that it expires.
+type dedupEntry struct {
+	key     dedupKey
+	expires time.Time
 }
 
 type broker struct {
@@ -44,6 +104,13 @@ type broker struct {
 	// Session -> subscription ID set
 	sessionSubIDSet map[*wamp.Session]map[wamp.ID]struct{}
 
+	// topic -> retained event
+	retained map[wamp.URI]*retainedEvent
+	// Fires when the retained event that expires first expires.
+	retainTimer   Timer
+	retainC       <-chan time.Time
+	retainExpires time.Time
+
 	actionChan chan func()
 
 	// Generate subscription IDs.
@@ -51,6 +118,39 @@ type broker struct {
 
 	strictURI     bool
 	allowDisclose bool
+	allowSubCount bool
+
+	// Maximum number of subscribers to each subscription.  Zero if no limit.
+	maxSubscribers int
+
+	// If true, publication IDs are assigned from pubIDSeq instead of being
+	// random.
+	pubIDCounter bool
+	pubIDSeq     uint64
+
+	// Limits the rate of publications from each session.  Nil if no limit.
+	rateLimiter *rateLimiter
+
+	// Publications with a dedup key that repeats a key seen on the same topic
+	// within dedupWindow are not sent to subscribers.  Zero if disabled.
+	dedupWindow time.Duration
+	// dedup key -> expiration time
+	dedupSeen map[dedupKey]time.Time
+	// Dedup keys in order of expiration, for removing expired keys.
+	dedupOrder []dedupEntry
+
+	// Events waiting to be sent to each subscriber when batching is enabled.
+	batchWindow time.Duration
+	eventBatch  map[*wamp.Session][]*wamp.Event
+	flushTimer  Timer
+	flushC      <-chan time.Time
+
+	// Events waiting to be retried for subscribers with reliable QoS.
+	retryEvents map[*wamp.Session]*reliableEvents
+	retryTimer  Timer
+	retryC      <-chan time.Time
+
+	clock Clock
 
 	log           stdlog.StdLog
 	debug         bool
@@ -59,12 +159,26 @@ type broker struct {
 
 // newBroker returns a new default broker implementation instance.
 func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publishFilter FilterFactory) *broker {
+	return newRealmBroker(&RealmConfig{
+		StrictURI:            strictURI,
+		AllowDisclose:        allowDisclose,
+		PublishFilterFactory: publishFilter,
+	}, logger, debug, realClock{})
+}
+
+// newRealmBroker creates a broker that is configured by the broker settings
+// of the realm configuration.  If clock is nil, then the system clock is used.
+func newRealmBroker(config *RealmConfig, logger stdlog.StdLog, debug bool, clock Clock) *broker {
 	if logger == nil {
 		panic("logger is nil")
 	}
+	publishFilter := config.PublishFilterFactory
 	if publishFilter == nil {
 		publishFilter = NewSimplePublishFilter
 	}
+	if clock == nil {
+		clock = realClock{}
+	}
 	b := &broker{
 		topicSubscription:    map[wamp.URI]*subscription{},
 		pfxTopicSubscription: map[wamp.URI]*subscription{},
@@ -72,6 +186,7 @@ func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 
 		subscriptions:   map[wamp.ID]*subscription{},
 		sessionSubIDSet: map[*wamp.Session]map[wamp.ID]struct{}{},
+		retained:        map[wamp.URI]*retainedEvent{},
 
 		// The action handler should be nearly always runable, since it is the
 		// critical section that does the only routing.  So, and unbuffered
@@ -80,13 +195,28 @@ func newBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 
 		idGen: new(wamp.IDGen),
 
-		strictURI:     strictURI,
-		allowDisclose: allowDisclose,
+		strictURI:     config.StrictURI,
+		allowDisclose: config.AllowDisclose,
+		allowSubCount: config.AllowSubscriberCount,
+		rateLimiter: newRateLimiter(config.PublishRateLimit,
+			config.PublishRateBurst, config.PublishRateLimitPerTopic, clock),
+
+		maxSubscribers: config.MaxSubscribersPerTopic,
+		pubIDCounter:   config.PublicationIDScheme == PublicationIDCounter,
+
+		batchWindow: config.EventBatchWindow,
+		eventBatch:  map[*wamp.Session][]*wamp.Event{},
+		retryEvents: map[*wamp.Session]*reliableEvents{},
+		clock:       clock,
 
 		log:           logger,
 		debug:         debug,
 		filterFactory: publishFilter,
 	}
+	if config.PublishDedupWindow > 0 {
+		b.dedupWindow = config.PublishDedupWindow
+		b.dedupSeen = map[dedupKey]time.Time{}
+	}
 	go b.run()
 	return b
 }
@@ -134,6 +264,25 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 		return
 	}
 
+	// Check the publish rate limit.  This is done here, and not in the broker
+	// goroutine, so that a publisher exceeding the limit does not delay
+	// other publications.
+	if b.rateLimiter != nil && !b.rateLimiter.allow(pub, msg.Topic) {
+		if !pubAck {
+			b.log.Printf("Publish rate limit exceeded by session %s, dropped publication to %s",
+				pub, msg.Topic)
+			return
+		}
+		b.trySend(pub, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrRateLimitExceeded,
+			Arguments: wamp.List{"publish rate limit exceeded"},
+		})
+		return
+	}
+
 	excludePub := true
 	if exclude, ok := msg.Options[wamp.OptExcludeMe].(bool); ok {
 		if !pub.HasFeature(wamp.RolePublisher, wamp.FeaturePubExclusion) {
@@ -169,13 +318,129 @@ func (b *broker) publish(pub *wamp.Session, msg *wamp.Publish) {
 		}
 		disclose = true
 	}
-	pubID := wamp.GlobalID()
+
+	// A publisher may request the number of subscribers that the event was
+	// delivered to.  This is only meaningful for acknowledged publications.
+	var subCount bool
+	if opt, _ := msg.Options[wamp.OptDiscloseSubscriberCount].(bool); opt && pubAck {
+		// Broker MAY deny a publisher's request to disclose subscriber count.
+		if !b.allowSubCount {
+			b.trySend(pub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrOptionNotAllowed,
+				Arguments: wamp.List{"disclosing subscriber count not allowed"},
+			})
+			return
+		}
+		subCount = true
+	}
+
+	// A publisher may ask the broker to retain the event, so that it is sent
+	// to subscribers that subscribe later, for an optional number of seconds.
+	retain, _ := msg.Options[wamp.OptRetain].(bool)
+	var retainTTL int64
+	if opt, ok := msg.Options[wamp.OptRetainTTL]; ok && retain {
+		var valid bool
+		retainTTL, valid = wamp.AsInt64(opt)
+		if !valid || retainTTL < 0 {
+			if pubAck {
+				b.trySend(pub, &wamp.Error{
+					Type:      msg.MessageType(),
+					Request:   msg.Request,
+					Details:   wamp.Dict{},
+					Error:     wamp.ErrInvalidArgument,
+					Arguments: wamp.List{"retain_ttl must be a non-negative integer"},
+				})
+			}
+			return
+		}
+	}
+
+	// A publisher may give a dedup key, so that the broker drops repeats of
+	// the publication if deduplication is enabled.
+	var dedupID string
+	if opt, ok := msg.Options[wamp.OptDedupKey]; ok {
+		var valid bool
+		if dedupID, valid = wamp.AsString(opt); !valid || dedupID == "" {
+			if pubAck {
+				b.trySend(pub, &wamp.Error{
+					Type:      msg.MessageType(),
+					Request:   msg.Request,
+					Details:   wamp.Dict{},
+					Error:     wamp.ErrInvalidArgument,
+					Arguments: wamp.List{"dedup_key must be a non-empty string"},
+				})
+			}
+			return
+		}
+	}
 
 	// Get blacklists and whitelists, if any, from publish message.
 	filter := b.filterFactory(msg)
 
+	var ret *retainedEvent
+	if retain {
+		ret = &retainedEvent{
+			msg:    msg,
+			filter: filter,
+		}
+		if disclose {
+			ret.pubDetails = wamp.Dict{}
+			disclosePublisher(pub, ret.pubDetails)
+		}
+		if retainTTL != 0 {
+			ret.expires = b.clock.Now().Add(time.Duration(retainTTL) * time.Second)
+		}
+	}
+
+	// Publication IDs from the counter are assigned in the broker goroutine,
+	// so that events are sent in publication ID order.
+	var pubID wamp.ID
+	if !b.pubIDCounter {
+		pubID = wamp.GlobalID()
+	}
+	doPublish := func() int {
+		if b.pubIDCounter {
+			pubID = b.syncNextPubID()
+		}
+		if dedupID != "" && b.syncDuplicate(msg.Topic, dedupID) {
+			if b.debug {
+				b.log.Printf("Dropped duplicate publication to %s from %s with %s %q",
+					msg.Topic, pub, wamp.OptDedupKey, dedupID)
+			}
+			return 0
+		}
+		count := b.syncPublish(pub, msg, pubID, excludePub, disclose, filter)
+		if ret != nil {
+			ret.pubID = pubID
+			b.syncRetain(ret)
+		}
+		return count
+	}
+
+	if subCount || (pubAck && b.pubIDCounter) {
+		// Wait for the event to be sent to all subscribers to know how many
+		// subscribers it was delivered to, and to know the publication ID if
+		// it is assigned in the broker goroutine.
+		var count int
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			count = doPublish()
+			close(sync)
+		}
+		<-sync
+		published := &wamp.Published{Request: msg.Request, Publication: pubID}
+		if subCount {
+			published.Details = wamp.Dict{wamp.OptSubscriberCount: count}
+		}
+		b.trySend(pub, published)
+		return
+	}
+
 	b.actionChan <- func() {
-		b.syncPublish(pub, msg, pubID, excludePub, disclose, filter)
+		doPublish()
 	}
 
 	// Send PUBLISHED message if acknowledge is present and true.
@@ -217,8 +482,50 @@ func (b *broker) subscribe(sub *wamp.Session, msg *wamp.Subscribe) {
 		return
 	}
 
+	// Parse the subscriber's event filter, if one is given.
+	var evFilter eventFilter
+	if filterOpt, ok := msg.Options[wamp.OptFilter]; ok {
+		expr, ok := wamp.AsString(filterOpt)
+		var err error
+		if !ok {
+			err = fmt.Errorf("filter must be a string")
+		} else {
+			evFilter, err = parseEventFilter(expr)
+		}
+		if err != nil {
+			b.trySend(sub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{fmt.Sprint("invalid filter: ", err)},
+				Details:   wamp.Dict{},
+			})
+			return
+		}
+	}
+
+	// Get the subscriber's quality of service.
+	var reliable bool
+	if qosOpt, ok := msg.Options[wamp.OptQoS]; ok {
+		qos, _ := wamp.AsString(qosOpt)
+		switch qos {
+		case wamp.QoSBestEffort:
+		case wamp.QoSReliable:
+			reliable = true
+		default:
+			b.trySend(sub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{fmt.Sprint("invalid qos: ", qosOpt)},
+				Details:   wamp.Dict{},
+			})
+			return
+		}
+	}
+
 	b.actionChan <- func() {
-		b.syncSubscribe(sub, msg, match)
+		b.syncSubscribe(sub, msg, match, evFilter, reliable)
 	}
 }
 
@@ -240,6 +547,9 @@ func (b *broker) removeSession(sess *wamp.Session) {
 	if sess == nil {
 		return
 	}
+	if b.rateLimiter != nil {
+		b.rateLimiter.removeSession(sess)
+	}
 	b.actionChan <- func() {
 		b.syncRemoveSession(sess)
 	}
@@ -251,46 +561,119 @@ func (b *broker) close() {
 }
 
 func (b *broker) run() {
-	for action := range b.actionChan {
-		action()
+actionLoop:
+	for {
+		select {
+		case action, ok := <-b.actionChan:
+			if !ok {
+				break actionLoop
+			}
+			action()
+		case <-b.flushC:
+			b.flushC = nil
+			b.syncFlushEvents()
+		case <-b.retryC:
+			b.retryC = nil
+			b.syncRetryEvents()
+		case <-b.retainC:
+			b.retainC = nil
+			b.syncExpireRetained()
+		}
+	}
+	// Send any events still waiting in batches.
+	if b.flushTimer != nil {
+		b.flushTimer.Stop()
+	}
+	b.syncFlushEvents()
+	if b.retryTimer != nil {
+		b.retryTimer.Stop()
+	}
+	if b.retainTimer != nil {
+		b.retainTimer.Stop()
 	}
 	if b.debug {
 		b.log.Print("Broker stopped")
 	}
 }
 
-func (b *broker) syncPublish(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) {
+// syncNextPubID returns a new publication ID.  If the broker uses a counter
+// for publication IDs, then each ID is one greater than the previous.  The
+// uint64 counter does not exceed the maximum WAMP ID of 2^53 for as long as
+// a router could practically run.
+func (b *broker) syncNextPubID() wamp.ID {
+	if !b.pubIDCounter {
+		return wamp.GlobalID()
+	}
+	b.pubIDSeq++
+	return wamp.ID(b.pubIDSeq)
+}
+
+// syncPublish sends the event to the subscribers of all subscriptions matching
+// the topic.  Returns the number of events delivered.
+func (b *broker) syncPublish(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) int {
+	var count int
 	// Publish to subscribers with exact match.
 	if sub, ok := b.topicSubscription[msg.Topic]; ok {
-		b.syncPubEvent(pub, msg, pubID, sub, excludePub, false, disclose, filter)
+		count += b.syncPubEvent(pub, msg, pubID, sub, excludePub, false, disclose, filter)
 	}
 
 	// Publish to subscribers with prefix match.
 	for pfxTopic, sub := range b.pfxTopicSubscription {
 		if msg.Topic.PrefixMatch(pfxTopic) {
-			b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+			count += b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
 		}
 	}
 
 	// Publish to subscribers with wildcard match.
 	for wcTopic, sub := range b.wcTopicSubscription {
 		if msg.Topic.WildcardMatch(wcTopic) {
-			b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+			count += b.syncPubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
 		}
 	}
+	return count
+}
+
+// syncDuplicate returns true if the dedup key was already seen for the topic
+// within the dedup window.  Otherwise, the key is recorded for the topic and
+// false is returned.
+func (b *broker) syncDuplicate(topic wamp.URI, id string) bool {
+	if b.dedupWindow == 0 {
+		return false
+	}
+	now := b.clock.Now()
+
+	// Remove expired keys.  A key that was seen again after expiring has a
+	// later expiration time in dedupSeen, and is not removed.
+	for len(b.dedupOrder) != 0 && !now.Before(b.dedupOrder[0].expires) {
+		entry := b.dedupOrder[0]
+		if b.dedupSeen[entry.key].Equal(entry.expires) {
+			delete(b.dedupSeen, entry.key)
+		}
+		b.dedupOrder[0] = dedupEntry{}
+		b.dedupOrder = b.dedupOrder[1:]
+	}
+
+	key := dedupKey{topic: topic, key: id}
+	if _, ok := b.dedupSeen[key]; ok {
+		return true
+	}
+	expires := now.Add(b.dedupWindow)
+	b.dedupSeen[key] = expires
+	b.dedupOrder = append(b.dedupOrder, dedupEntry{key: key, expires: expires})
+	return false
 }
 
-func newSubscription(id wamp.ID, subscriber *wamp.Session, topic wamp.URI, match string) *subscription {
+func newSubscription(id wamp.ID, subscriber *wamp.Session, topic wamp.URI, match string, evFilter eventFilter) *subscription {
 	return &subscription{
 		id:          id,
 		topic:       topic,
 		match:       match,
 		created:     wamp.NowISO8601(),
-		subscribers: map[*wamp.Session]struct{}{subscriber: struct{}{}},
+		subscribers: map[*wamp.Session]eventFilter{subscriber: evFilter},
 	}
 }
 
-func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, match string) {
+func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, match string, evFilter eventFilter, reliable bool) {
 	var sub *subscription
 	var existingSub bool
 
@@ -300,7 +683,7 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 		sub, existingSub = b.pfxTopicSubscription[msg.Topic]
 		if !existingSub {
 			// Create a new prefix subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
+			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match, evFilter)
 			b.pfxTopicSubscription[msg.Topic] = sub
 		}
 	case wamp.MatchWildcard:
@@ -308,7 +691,7 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 		sub, existingSub = b.wcTopicSubscription[msg.Topic]
 		if !existingSub {
 			// Create a new wildcard subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
+			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match, evFilter)
 			b.wcTopicSubscription[msg.Topic] = sub
 		}
 	default:
@@ -316,7 +699,7 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 		sub, existingSub = b.topicSubscription[msg.Topic]
 		if !existingSub {
 			// Create a new subscription.
-			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match)
+			sub = newSubscription(b.idGen.Next(), subscriber, msg.Topic, match, evFilter)
 			b.topicSubscription[msg.Topic] = sub
 		}
 	}
@@ -326,16 +709,30 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 	// a subscription is already subscribed to the topic.
 	if existingSub {
 		if _, already := sub.subscribers[subscriber]; already {
-			// Already subscribed; send existing subscription ID.
+			// Already subscribed; replace the event filter and QoS, and send
+			// existing subscription ID.
+			sub.subscribers[subscriber] = evFilter
+			sub.setReliable(subscriber, reliable)
 			b.trySend(subscriber, &wamp.Subscribed{
 				Request:      msg.Request,
 				Subscription: sub.id,
 			})
 			return
 		}
+		if b.maxSubscribers != 0 && len(sub.subscribers) >= b.maxSubscribers {
+			b.trySend(subscriber, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Error:     wamp.ErrQuotaExceeded,
+				Arguments: wamp.List{"topic has maximum number of subscribers"},
+				Details:   wamp.Dict{},
+			})
+			return
+		}
 		// Add subscriber to existing subscription.
-		sub.subscribers[subscriber] = struct{}{}
+		sub.subscribers[subscriber] = evFilter
 	}
+	sub.setReliable(subscriber, reliable)
 
 	// Add the subscription ID to the set of subscriptions for the subscriber.
 	subIdSet, ok := b.sessionSubIDSet[subscriber]
@@ -349,6 +746,11 @@ func (b *broker) syncSubscribe(subscriber *wamp.Session, msg *wamp.Subscribe, ma
 	// Tell sender the new subscription ID.
 	b.trySend(subscriber, &wamp.Subscribed{Request: msg.Request, Subscription: sub.id})
 
+	// Send the retained events for the subscription, if requested.
+	if getRetained, _ := msg.Options[wamp.OptGetRetained].(bool); getRetained {
+		b.syncSendRetained(subscriber, sub, evFilter)
+	}
+
 	if !existingSub {
 		b.syncPubSubCreateMeta(msg.Topic, subscriber.ID, sub)
 	}
@@ -391,6 +793,7 @@ func (b *broker) syncUnsubscribe(subscriber *wamp.Session, msg *wamp.Unsubscribe
 
 	// Remove subscribed session from subscription.
 	delete(sub.subscribers, subscriber)
+	delete(sub.reliable, subscriber)
 
 	// If no more subscribers on this subscription, delete subscription and
 	// send on_delete meta event.
@@ -429,6 +832,9 @@ func (b *broker) syncUnsubscribe(subscriber *wamp.Session, msg *wamp.Unsubscribe
 
 // syncRemoveSession removed all subscriptions for the session.
 func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
+	delete(b.eventBatch, subscriber)
+	delete(b.retryEvents, subscriber)
+
 	subIDSet, ok := b.sessionSubIDSet[subscriber]
 	if !ok {
 		return
@@ -446,6 +852,7 @@ func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
 		}
 		// Remove subscribed session from subscription.
 		delete(sub.subscribers, subscriber)
+		delete(sub.reliable, subscriber)
 
 		// If no more subscribers on this subscription.
 		if len(sub.subscribers) == 0 {
@@ -458,63 +865,310 @@ func (b *broker) syncRemoveSession(subscriber *wamp.Session) {
 }
 
 // syncPubEvent sends an event to all subscribers that are not excluded from
-// receiving the event.
-func (b *broker) syncPubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter) {
-	for subscriber, _ := range sub.subscribers {
+// receiving the event.  Returns the number of subscribers the event was sent
+// to.
+func (b *broker) syncPubEvent(pub *wamp.Session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter) int {
+	var count int
+	for subscriber, evFilter := range sub.subscribers {
 		// Do not send event to publisher.
 		if subscriber == pub && excludePublisher {
 			continue
 		}
+		if !eventAllowed(subscriber, msg, evFilter, filter) {
+			continue
+		}
 
-		// Check if receiver is restricted.
-		if filter != nil {
-			// Create a safe session to prevent access to the session.Peer.
-			safeSession := wamp.Session{
-				ID:      subscriber.ID,
-				Details: subscriber.Details,
-			}
-			subscriber.Lock()
-			ok := filter.Allowed(&safeSession)
-			subscriber.Unlock()
-			if !ok {
-				continue
+		// TODO: Handle publication trust levels
+
+		event := newEvent(pub, subscriber, msg, pubID, sub.id, sendTopic, disclose)
+		if b.syncSendEvent(subscriber, event) {
+			count++
+		}
+	}
+	return count
+}
+
+// eventAllowed returns true if the event for the publication matches the
+// subscriber's filter and the subscriber is not restricted from receiving it.
+func eventAllowed(subscriber *wamp.Session, msg *wamp.Publish, evFilter eventFilter, filter PublishFilter) bool {
+	// Do not send event if it does not match the subscriber's filter.
+	if evFilter != nil && !evFilter.match(msg.ArgumentsKw) {
+		return false
+	}
+
+	// Check if receiver is restricted.
+	if filter != nil {
+		// Create a safe session to prevent access to the session.Peer.
+		safeSession := wamp.Session{
+			ID:      subscriber.ID,
+			Details: subscriber.Details,
+		}
+		subscriber.Lock()
+		ok := filter.Allowed(&safeSession)
+		subscriber.Unlock()
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newEvent creates the event for the publication to send to the subscriber.
+func newEvent(pub, subscriber *wamp.Session, msg *wamp.Publish, pubID, subID wamp.ID, sendTopic, disclose bool) *wamp.Event {
+	event := &wamp.Event{
+		Publication:  pubID,
+		Subscription: subID,
+		Arguments:    msg.Arguments,
+		ArgumentsKw:  msg.ArgumentsKw,
+		Details:      wamp.Dict{},
+	}
+	// If a subscription was established with a pattern-based matching
+	// policy, a Broker MUST supply the original PUBLISH.Topic as provided
+	// by the Publisher in EVENT.Details.topic|uri.
+	if sendTopic {
+		event.Details[detailTopic] = msg.Topic
+	}
+	if disclose && subscriber.HasFeature(wamp.RoleSubscriber, wamp.FeaturePubIdent) {
+		disclosePublisher(pub, event.Details)
+	}
+
+	if subscriber.Peer.IsLocal() {
+		if len(msg.Arguments) != 0 {
+			event.Arguments = make([]interface{}, len(msg.Arguments))
+			copy(event.Arguments, msg.Arguments)
+		}
+		if len(msg.ArgumentsKw) != 0 {
+			argsKw := make(map[string]interface{}, len(msg.ArgumentsKw))
+			for k, v := range msg.ArgumentsKw {
+				argsKw[k] = v
 			}
+			event.ArgumentsKw = argsKw
 		}
+	}
+	return event
+}
 
-		// TODO: Handle publication trust levels
+// syncRetain keeps the event as the retained event for its topic, replacing
+// any previously retained event.  An event without arguments clears the
+// retained event for the topic.
+func (b *broker) syncRetain(ret *retainedEvent) {
+	if len(ret.msg.Arguments) == 0 && len(ret.msg.ArgumentsKw) == 0 {
+		delete(b.retained, ret.msg.Topic)
+		return
+	}
+	b.retained[ret.msg.Topic] = ret
+	if !ret.expires.IsZero() {
+		b.syncScheduleExpiry(ret.expires)
+	}
+}
 
-		event := &wamp.Event{
-			Publication:  pubID,
-			Subscription: sub.id,
-			Arguments:    msg.Arguments,
-			ArgumentsKw:  msg.ArgumentsKw,
-			Details:      wamp.Dict{},
+// syncScheduleExpiry sets the retain timer to fire when a retained event
+// expires, unless the timer is already set to fire sooner.
+func (b *broker) syncScheduleExpiry(expires time.Time) {
+	if b.retainC != nil {
+		if !expires.Before(b.retainExpires) {
+			return
 		}
-		// If a subscription was established with a pattern-based matching
-		// policy, a Broker MUST supply the original PUBLISH.Topic as provided
-		// by the Publisher in EVENT.Details.topic|uri.
-		if sendTopic {
-			event.Details[detailTopic] = msg.Topic
+		if !b.retainTimer.Stop() {
+			// Discard the time if the timer already fired.
+			select {
+			case <-b.retainC:
+			default:
+			}
+		}
+	}
+	d := expires.Sub(b.clock.Now())
+	if b.retainTimer == nil {
+		b.retainTimer = b.clock.NewTimer(d)
+	} else {
+		b.retainTimer.Reset(d)
+	}
+	b.retainC = b.retainTimer.C()
+	b.retainExpires = expires
+}
+
+// syncExpireRetained removes the retained events that have expired, and sets
+// the retain timer for the next retained event to expire.
+func (b *broker) syncExpireRetained() {
+	now := b.clock.Now()
+	var next time.Time
+	for topic, ret := range b.retained {
+		if ret.expires.IsZero() {
+			continue
+		}
+		if !now.Before(ret.expires) {
+			delete(b.retained, topic)
+			continue
 		}
-		if disclose && subscriber.HasFeature(wamp.RoleSubscriber, wamp.FeaturePubIdent) {
-			disclosePublisher(pub, event.Details)
+		if next.IsZero() || ret.expires.Before(next) {
+			next = ret.expires
 		}
+	}
+	if !next.IsZero() {
+		b.syncScheduleExpiry(next)
+	}
+}
 
-		if subscriber.Peer.IsLocal() {
-			if len(msg.Arguments) != 0 {
-				event.Arguments = make([]interface{}, len(msg.Arguments))
-				copy(event.Arguments, msg.Arguments)
+// syncSendRetained sends the subscriber the retained events for all topics
+// matching the subscription.  Retained events that have expired are removed.
+func (b *broker) syncSendRetained(subscriber *wamp.Session, sub *subscription, evFilter eventFilter) {
+	now := b.clock.Now()
+	for topic, ret := range b.retained {
+		if !ret.expires.IsZero() && !now.Before(ret.expires) {
+			delete(b.retained, topic)
+			continue
+		}
+		switch sub.match {
+		case wamp.MatchPrefix:
+			if !topic.PrefixMatch(sub.topic) {
+				continue
 			}
-			if len(msg.ArgumentsKw) != 0 {
-				argsKw := make(map[string]interface{}, len(msg.ArgumentsKw))
-				for k, v := range msg.ArgumentsKw {
-					argsKw[k] = v
-				}
-				event.ArgumentsKw = argsKw
+		case wamp.MatchWildcard:
+			if !topic.WildcardMatch(sub.topic) {
+				continue
+			}
+		default:
+			if topic != sub.topic {
+				continue
+			}
+		}
+		if !eventAllowed(subscriber, ret.msg, evFilter, ret.filter) {
+			continue
+		}
+		sendTopic := sub.match == wamp.MatchPrefix || sub.match == wamp.MatchWildcard
+		event := newEvent(nil, subscriber, ret.msg, ret.pubID, sub.id, sendTopic, false)
+		if ret.pubDetails != nil && subscriber.HasFeature(wamp.RoleSubscriber, wamp.FeaturePubIdent) {
+			for k, v := range ret.pubDetails {
+				event.Details[k] = v
 			}
 		}
+		event.Details[wamp.OptRetained] = true
+		b.syncSendEvent(subscriber, event)
+	}
+}
+
+// syncSendEvent sends an event to a subscriber, or adds the event to the
+// subscriber's batch of events if batching is enabled.  Local subscribers do
+// not write to a transport, so their events are not batched.
+func (b *broker) syncSendEvent(subscriber *wamp.Session, event *wamp.Event) bool {
+	if b.batchWindow == 0 || subscriber.Peer.IsLocal() {
+		return b.syncDeliver(subscriber, event)
+	}
+	// Start the flush timer when the first event is batched.
+	if b.flushC == nil {
+		if b.flushTimer == nil {
+			b.flushTimer = b.clock.NewTimer(b.batchWindow)
+		} else {
+			b.flushTimer.Reset(b.batchWindow)
+		}
+		b.flushC = b.flushTimer.C()
+	}
+	b.eventBatch[subscriber] = append(b.eventBatch[subscriber], event)
+	return true
+}
+
+// syncFlushEvents sends all batched events to their subscribers.  The events
+// for each subscriber are sent together, allowing the subscriber's transport
+// to write them to the connection at once.
+func (b *broker) syncFlushEvents() {
+	for subscriber, events := range b.eventBatch {
+		for _, event := range events {
+			if !b.syncDeliver(subscriber, event) {
+				break
+			}
+		}
+		delete(b.eventBatch, subscriber)
+	}
+}
+
+// syncDeliver sends an event to a subscriber.  If the subscriber has reliable
+// QoS for the event's subscription, and the event cannot be sent right away,
+// then the event is kept and sending it is retried.  Otherwise, the event is
+// dropped if it cannot be sent.  Returns false if the event was dropped.
+func (b *broker) syncDeliver(subscriber *wamp.Session, event *wamp.Event) bool {
+	retry, retrying := b.retryEvents[subscriber]
+	if !b.syncReliable(subscriber, event) {
+		return b.trySend(subscriber, event)
+	}
+	// Keep events in order behind events already waiting to be retried.
+	if retrying {
+		if len(retry.events) >= reliableQueueSize {
+			b.log.Printf("!!! Dropped %s to session %s: retry queue full",
+				event.MessageType(), subscriber)
+			return false
+		}
+		retry.events = append(retry.events, event)
+		return true
+	}
+	if subscriber.TrySend(event) == nil {
+		return true
+	}
+	b.retryEvents[subscriber] = &reliableEvents{
+		events:   []*wamp.Event{event},
+		deadline: b.clock.Now().Add(reliableRetryTimeout),
+	}
+	b.syncStartRetry()
+	return true
+}
+
+// syncReliable returns true if the subscriber has reliable QoS for the
+// subscription of the event.
+func (b *broker) syncReliable(subscriber *wamp.Session, event *wamp.Event) bool {
+	sub, ok := b.subscriptions[event.Subscription]
+	if !ok {
+		return false
+	}
+	_, ok = sub.reliable[subscriber]
+	return ok
+}
 
-		b.trySend(subscriber, event)
+// syncStartRetry starts the retry timer, if it is not already running.
+func (b *broker) syncStartRetry() {
+	if b.retryC != nil {
+		return
+	}
+	if b.retryTimer == nil {
+		b.retryTimer = b.clock.NewTimer(reliableRetryInterval)
+	} else {
+		b.retryTimer.Reset(reliableRetryInterval)
+	}
+	b.retryC = b.retryTimer.C()
+}
+
+// syncRetryEvents retries sending the events kept for subscribers with
+// reliable QoS.  Sending an event moves the subscriber's deadline forward.  If
+// a subscriber's deadline passes without any event being sent, then the
+// subscriber is a slow consumer and its remaining events are dropped.
+func (b *broker) syncRetryEvents() {
+	now := b.clock.Now()
+	for subscriber, retry := range b.retryEvents {
+		var sent int
+		for _, event := range retry.events {
+			if subscriber.TrySend(event) != nil {
+				break
+			}
+			sent++
+		}
+		if sent == len(retry.events) {
+			delete(b.retryEvents, subscriber)
+			continue
+		}
+		if sent != 0 {
+			for i := 0; i < sent; i++ {
+				retry.events[i] = nil
+			}
+			retry.events = retry.events[sent:]
+			retry.deadline = now.Add(reliableRetryTimeout)
+			continue
+		}
+		if !now.Before(retry.deadline) {
+			b.log.Printf("!!! Dropped %d %s to slow session %s", len(retry.events),
+				wamp.EVENT, subscriber)
+			delete(b.retryEvents, subscriber)
+		}
+	}
+	if len(b.retryEvents) != 0 {
+		b.syncStartRetry()
 	}
 }
 
@@ -542,7 +1196,7 @@ func (b *broker) syncPubMeta(metaTopic wamp.URI, sendMeta func(metaSub *subscrip
 // syncPubSubMeta publishes a subscription meta event when a subscription is
 // added, removed, or deleted.
 func (b *broker) syncPubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
-	pubID := wamp.GlobalID() // create here so that it is same for all events
+	pubID := b.syncNextPubID() // create here so that it is same for all events
 	b.syncPubMeta(metaTopic, func(metaSub *subscription, sendTopic bool) {
 		makeEvent := func() *wamp.Event {
 			evt := &wamp.Event{
@@ -586,7 +1240,7 @@ func (b *broker) syncPubSubMeta(metaTopic wamp.URI, subSessID, subID wamp.ID) {
 // Fired when a subscription is created through a subscription request for a
 // topic which was previously without subscribers.
 func (b *broker) syncPubSubCreateMeta(topic wamp.URI, subSessID wamp.ID, sub *subscription) {
-	pubID := wamp.GlobalID() // create here so that it is same for all events
+	pubID := b.syncNextPubID() // create here so that it is same for all events
 	b.syncPubMeta(wamp.MetaEventSubOnCreate, func(metaSub *subscription, sendTopic bool) {
 		makeEvent := func() *wamp.Event {
 			evt := &wamp.Event{
@@ -756,25 +1410,67 @@ func (b *broker) subMatch(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// subCount obtains the number of subscribers that an event published to a
+// topic would be delivered to.  This is the sum of the subscribers of all
+// subscriptions matching the topic, so a session with more than one matching
+// subscription is counted once for each.
+func (b *broker) subCount(msg *wamp.Invocation) wamp.Message {
+	var topic wamp.URI
+	var ok bool
+	if len(msg.Arguments) != 0 {
+		topic, ok = wamp.AsURI(msg.Arguments[0])
+	}
+	if !ok {
+		return &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{"missing or invalid topic"},
+		}
+	}
+	var count int
+	sync := make(chan struct{})
+	b.actionChan <- func() {
+		if sub, ok := b.topicSubscription[topic]; ok {
+			count += len(sub.subscribers)
+		}
+		for pfxTopic, sub := range b.pfxTopicSubscription {
+			if topic.PrefixMatch(pfxTopic) {
+				count += len(sub.subscribers)
+			}
+		}
+		for wcTopic, sub := range b.wcTopicSubscription {
+			if topic.WildcardMatch(wcTopic) {
+				count += len(sub.subscribers)
+			}
+		}
+		close(sync)
+	}
+	<-sync
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{count},
+	}
+}
+
 // subGet retrieves information on a particular subscription.
 func (b *broker) subGet(msg *wamp.Invocation) wamp.Message {
 	var dict wamp.Dict
-	if len(msg.Arguments) != 0 {
-		if subID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, ok := b.subscriptions[subID]; ok {
-					dict = wamp.Dict{
-						"id":          subID,
-						"created":     sub.created,
-						"uri":         sub.topic,
-						wamp.OptMatch: sub.match,
-					}
+	if subID, err := wamp.InvocationArgID(msg, 0); err == nil {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if sub, ok := b.subscriptions[subID]; ok {
+				dict = wamp.Dict{
+					"id":          subID,
+					"created":     sub.created,
+					"uri":         sub.topic,
+					wamp.OptMatch: sub.match,
 				}
-				close(sync)
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if dict == nil {
 		return &wamp.Error{
@@ -794,22 +1490,20 @@ func (b *broker) subGet(msg *wamp.Invocation) wamp.Message {
 // attached to the subscription.
 func (b *broker) subListSubscribers(msg *wamp.Invocation) wamp.Message {
 	var subscriberIDs []wamp.ID
-	if len(msg.Arguments) != 0 {
-		if subID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, ok := b.subscriptions[subID]; ok {
-					subscriberIDs = make([]wamp.ID, len(sub.subscribers))
-					var i int
-					for subscriber := range sub.subscribers {
-						subscriberIDs[i] = subscriber.ID
-						i++
-					}
+	if subID, err := wamp.InvocationArgID(msg, 0); err == nil {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if sub, ok := b.subscriptions[subID]; ok {
+				subscriberIDs = make([]wamp.ID, len(sub.subscribers))
+				var i int
+				for subscriber := range sub.subscribers {
+					subscriberIDs[i] = subscriber.ID
+					i++
 				}
-				close(sync)
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if len(subscriberIDs) == 0 {
 		return &wamp.Error{
@@ -829,21 +1523,19 @@ func (b *broker) subListSubscribers(msg *wamp.Invocation) wamp.Message {
 // subscription.
 func (b *broker) subCountSubscribers(msg *wamp.Invocation) wamp.Message {
 	var count int
-	var ok bool
-	if len(msg.Arguments) != 0 {
-		var subID wamp.ID
-		if subID, ok = wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, found := b.subscriptions[subID]; found {
-					count = len(sub.subscribers)
-				} else {
-					ok = false
-				}
-				close(sync)
+	subID, err := wamp.InvocationArgID(msg, 0)
+	ok := err == nil
+	if ok {
+		sync := make(chan struct{})
+		b.actionChan <- func() {
+			if sub, found := b.subscriptions[subID]; found {
+				count = len(sub.subscribers)
+			} else {
+				ok = false
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if !ok {
 		return &wamp.Error{
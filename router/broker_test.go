@@ -2,9 +2,14 @@ package router
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gammazero/nexus/v3/transport"
+	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 )
 
@@ -573,6 +578,86 @@ func TestSubscriberBlackwhiteListing(t *testing.T) {
 	}
 }
 
+func TestSubscriberAuthidFiltering(t *testing.T) {
+	broker := newBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribers jdoe1 and jdoe2 are two sessions with the same authid.
+	newSub := func(authid string) *wamp.Session {
+		details := wamp.Dict{"authid": authid, "authrole": "user"}
+		sess := wamp.NewSession(newTestPeer(), wamp.GlobalID(), details, nil)
+		broker.subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("subscribe session did not get response to SUBSCRIBE")
+		}
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		return sess
+	}
+	jdoe1 := newSub("jdoe")
+	jdoe2 := newSub("jdoe")
+	alice := newSub("alice")
+	subs := []*wamp.Session{jdoe1, jdoe2, alice}
+
+	pubSess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+
+	// checkRecv publishes with the options and checks that only the expected
+	// subscribers receive the event.
+	checkRecv := func(opts wamp.Dict, expect ...*wamp.Session) {
+		broker.publish(pubSess, &wamp.Publish{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: opts,
+		})
+		for _, sub := range subs {
+			var expected bool
+			for i := range expect {
+				if expect[i] == sub {
+					expected = true
+					break
+				}
+			}
+			_, err := wamp.RecvTimeout(sub, 100*time.Millisecond)
+			if expected && err != nil {
+				t.Fatalf("subscriber %v did not receive event with options %v", sub.Details["authid"], opts)
+			}
+			if !expected && err == nil {
+				t.Fatalf("subscriber %v received event with options %v", sub.Details["authid"], opts)
+			}
+		}
+	}
+
+	// Eligible by authid reaches every session with the authid.
+	checkRecv(wamp.Dict{"eligible_authid": wamp.List{"jdoe"}}, jdoe1, jdoe2)
+
+	// Eligible by authid and by session ID must both be satisfied.
+	checkRecv(wamp.Dict{
+		"eligible_authid": wamp.List{"jdoe"},
+		wamp.WhitelistKey: wamp.List{jdoe2.ID, alice.ID},
+	}, jdoe2)
+
+	// Excluding by session ID composes with eligible by authid.
+	checkRecv(wamp.Dict{
+		"eligible_authid": wamp.List{"jdoe"},
+		wamp.BlacklistKey: wamp.List{jdoe1.ID},
+	}, jdoe2)
+
+	// Excluding by authid composes with eligible by session ID.
+	checkRecv(wamp.Dict{
+		"exclude_authid":  wamp.List{"jdoe"},
+		wamp.WhitelistKey: wamp.List{jdoe1.ID, alice.ID},
+	}, alice)
+
+	// Filtering uses the subscriber's current authid.
+	jdoe2.Lock()
+	jdoe2.Details["authid"] = "alice"
+	jdoe2.Unlock()
+	checkRecv(wamp.Dict{"eligible_authid": wamp.List{"alice"}}, jdoe2, alice)
+	checkRecv(wamp.Dict{"exclude_authid": wamp.List{"alice"}}, jdoe1)
+}
+
 func TestPublisherExclusion(t *testing.T) {
 	broker := newBroker(logger, false, true, debug, nil)
 	subscriber := newTestPeer()
@@ -693,3 +778,722 @@ func TestPublisherIdentification(t *testing.T) {
 		t.Fatal("incorrect publisher ID disclosed")
 	}
 }
+
+func TestPublishSubscriberCount(t *testing.T) {
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true, AllowSubscriberCount: true}, logger, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribe three sessions to topic.
+	const subCount = 3
+	for i := 0; i < subCount; i++ {
+		sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+		if _, ok := (<-sess.Recv()).(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED)
+		}
+		defer broker.removeSession(sess)
+	}
+
+	// Publish and request the subscriber count.
+	publisher := newTestPeer()
+	pubSess := wamp.NewSession(publisher, 0, nil, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 124,
+		Topic:   testTopic,
+		Options: wamp.Dict{
+			wamp.OptAcknowledge:             true,
+			wamp.OptDiscloseSubscriberCount: true,
+		},
+	})
+	rsp := <-pubSess.Recv()
+	published, ok := rsp.(*wamp.Published)
+	if !ok {
+		t.Fatal("expected", wamp.PUBLISHED, "got:", rsp.MessageType())
+	}
+	count, _ := wamp.AsInt64(published.Details[wamp.OptSubscriberCount])
+	if count != subCount {
+		t.Fatal("expected subscriber count", subCount, "got", count)
+	}
+
+	// Check that subscriber count is refused if not allowed by realm.
+	broker = newBroker(logger, false, true, debug, nil)
+	broker.publish(pubSess, &wamp.Publish{
+		Request: 125,
+		Topic:   testTopic,
+		Options: wamp.Dict{
+			wamp.OptAcknowledge:             true,
+			wamp.OptDiscloseSubscriberCount: true,
+		},
+	})
+	rsp = <-pubSess.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrOptionNotAllowed {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+}
+
+func TestMaxSubscribersPerTopic(t *testing.T) {
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true, MaxSubscribersPerTopic: 2}, logger, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	subscribe := func(sess *wamp.Session, req wamp.ID, topic wamp.URI, match string) wamp.Message {
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: req,
+			Topic:   topic,
+			Options: wamp.Dict{wamp.OptMatch: match},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for subscribe response")
+		}
+		return rsp
+	}
+	checkQuotaError := func(rsp wamp.Message, req wamp.ID) {
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrQuotaExceeded {
+			t.Fatal("wrong error:", errMsg.Error)
+		}
+		if errMsg.Request != req {
+			t.Fatal("wrong request ID in error")
+		}
+	}
+
+	sessions := make([]*wamp.Session, 3)
+	for i := range sessions {
+		sessions[i] = wamp.NewSession(newTestPeer(), wamp.ID(i+1), nil, nil)
+	}
+
+	// Test that the subscriber after the limit is rejected.
+	var subID wamp.ID
+	for i := 0; i < 2; i++ {
+		rsp := subscribe(sessions[i], 100, testTopic, wamp.MatchExact)
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		subID = subMsg.Subscription
+	}
+	checkQuotaError(subscribe(sessions[2], 101, testTopic, wamp.MatchExact), 101)
+
+	// Test that an existing subscriber can subscribe again.
+	rsp := subscribe(sessions[0], 102, testTopic, wamp.MatchExact)
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Test that a prefix subscription is counted against its pattern, and not
+	// against the exact topic.
+	for i := 0; i < 2; i++ {
+		rsp = subscribe(sessions[i+1], 103, "nexus.test", wamp.MatchPrefix)
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+	checkQuotaError(subscribe(sessions[0], 104, "nexus.test", wamp.MatchPrefix), 104)
+
+	// Test that a subscriber can subscribe after another unsubscribes.
+	broker.unsubscribe(sessions[1], &wamp.Unsubscribe{Request: 105, Subscription: subID})
+	if _, err := wamp.RecvTimeout(sessions[1], time.Second); err != nil {
+		t.Fatal("timed out waiting for UNSUBSCRIBED")
+	}
+	rsp = subscribe(sessions[2], 106, testTopic, wamp.MatchExact)
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	// Allow bursts of 2 publications, and then very few.
+	broker := newRealmBroker(&RealmConfig{
+		AllowDisclose:    true,
+		PublishRateLimit: 0.001,
+		PublishRateBurst: 2,
+	}, logger, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	subscriber := &testPeer{in: make(chan wamp.Message, 8)}
+	subSess := wamp.NewSession(subscriber, 0, nil, nil)
+	broker.subscribe(subSess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, ok := (<-subSess.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED)
+	}
+
+	// Test that acknowledged publications exceeding the limit get an error.
+	publisher := &testPeer{in: make(chan wamp.Message, 8)}
+	pubSess := wamp.NewSession(publisher, 0, nil, nil)
+	opts := wamp.Dict{wamp.OptAcknowledge: true}
+	for i := 0; i < 2; i++ {
+		broker.publish(pubSess, &wamp.Publish{Request: wamp.ID(i + 1), Topic: testTopic, Options: opts})
+		rsp := <-pubSess.Recv()
+		if _, ok := rsp.(*wamp.Published); !ok {
+			t.Fatal("expected", wamp.PUBLISHED, "got:", rsp.MessageType())
+		}
+		<-subSess.Recv()
+	}
+	broker.publish(pubSess, &wamp.Publish{Request: 3, Topic: testTopic, Options: opts})
+	rsp := <-pubSess.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected", wamp.ERROR, "got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrRateLimitExceeded {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+	if errMsg.Request != 3 {
+		t.Fatal("wrong request ID in error")
+	}
+
+	// Test that unacknowledged publications exceeding the limit are dropped,
+	// and that the limit is per session.
+	publisher2 := &testPeer{in: make(chan wamp.Message, 8)}
+	pubSess2 := wamp.NewSession(publisher2, 0, nil, nil)
+	for i := 0; i < 5; i++ {
+		broker.publish(pubSess2, &wamp.Publish{Request: wamp.ID(i + 1), Topic: testTopic})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case rsp = <-subSess.Recv():
+			if _, ok = rsp.(*wamp.Event); !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("did not receive event")
+		}
+	}
+	select {
+	case <-subSess.Recv():
+		t.Fatal("received event exceeding rate limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case rsp = <-pubSess2.Recv():
+		t.Fatal("unacknowledged publication got response:", rsp.MessageType())
+	default:
+	}
+
+	// Test that the limit can be applied per topic.
+	broker = newRealmBroker(&RealmConfig{
+		AllowDisclose:            true,
+		PublishRateLimit:         0.001,
+		PublishRateBurst:         1,
+		PublishRateLimitPerTopic: true,
+	}, logger, debug, nil)
+	for i, topic := range []wamp.URI{"nexus.test.a", "nexus.test.b", "nexus.test.a"} {
+		broker.publish(pubSess, &wamp.Publish{Request: 4, Topic: topic, Options: opts})
+		rsp = <-pubSess.Recv()
+		expect := wamp.PUBLISHED
+		if i == 2 {
+			expect = wamp.ERROR
+		}
+		if rsp.MessageType() != expect {
+			t.Fatal("expected", expect, "publishing to", topic, "got:",
+				rsp.MessageType())
+		}
+	}
+}
+
+// writeCountingConn counts the number of writes to a connection.
+type writeCountingConn struct {
+	net.Conn
+	writes *uint64
+}
+
+func (c writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddUint64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+type writeCountingListener struct {
+	net.Listener
+	writes *uint64
+}
+
+func (l writeCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return writeCountingConn{conn, l.writes}, nil
+}
+
+// Benchmark publishing events to a rawsocket subscriber, with and without
+// event batching, and report the number of writes to the subscriber's
+// connection per event.
+func BenchmarkEventBatching(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprint("window=", window), func(b *testing.B) {
+			benchmarkEventBatching(b, window)
+		})
+	}
+}
+
+func benchmarkEventBatching(b *testing.B, window time.Duration) {
+	const burstSize = 50
+
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:              testRealm,
+				AnonymousAuth:    true,
+				EventBatchWindow: window,
+			},
+		},
+	}, logger)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var writes uint64
+	s := NewRawSocketServer(r)
+	go s.requestHandler(writeCountingListener{l, &writes})
+	defer l.Close()
+
+	sub, err := transport.ConnectRawSocketPeer(context.Background(), "tcp",
+		l.Addr().String(), serialize.JSON, nil, logger, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sub.Close()
+	sub.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if msg, err := wamp.RecvTimeout(sub, time.Second); err != nil {
+		b.Fatal(err)
+	} else if _, ok := msg.(*wamp.Welcome); !ok {
+		b.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	if msg, err := wamp.RecvTimeout(sub, time.Second); err != nil {
+		b.Fatal(err)
+	} else if _, ok := msg.(*wamp.Subscribed); !ok {
+		b.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	pub, err := testClient(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	atomic.StoreUint64(&writes, 0)
+	b.ResetTimer()
+	for sent := 0; sent < b.N; {
+		// Publish a burst of events and wait for the subscriber to receive
+		// them.
+		n := burstSize
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		for i := 0; i < n; i++ {
+			pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic})
+		}
+		for i := 0; i < n; i++ {
+			if _, err = wamp.RecvTimeout(sub, time.Second); err != nil {
+				b.Fatal("did not receive event:", err)
+			}
+		}
+		sent += n
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&writes))/float64(b.N), "writes/op")
+}
+
+func TestRetainedEventTTL(t *testing.T) {
+	clock := newFakeClock()
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true}, logger, debug, clock)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	publisher := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	broker.publish(publisher, &wamp.Publish{
+		Request:   123,
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptRetain: true, wamp.OptRetainTTL: 10},
+		Arguments: wamp.List{"hello"},
+	})
+
+	// Subscribes a new session and returns the retained event received, if
+	// any.
+	subscribe := func(req wamp.ID, topic wamp.URI, match string) *wamp.Event {
+		// Buffer SUBSCRIBED and the retained event.
+		peer := &testPeer{in: make(chan wamp.Message, 2)}
+		sess := wamp.NewSession(peer, 0, nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: req,
+			Topic:   topic,
+			Options: wamp.Dict{wamp.OptGetRetained: true, wamp.OptMatch: match},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for SUBSCRIBED")
+		}
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		rsp, err = wamp.RecvTimeout(sess, 100*time.Millisecond)
+		if err != nil {
+			return nil
+		}
+		event, ok := rsp.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		return event
+	}
+
+	// Check that the retained event is delivered before the TTL expires.
+	clock.Advance(9 * time.Second)
+	event := subscribe(124, testTopic, wamp.MatchExact)
+	if event == nil {
+		t.Fatal("did not receive retained event")
+	}
+	if len(event.Arguments) != 1 || event.Arguments[0] != "hello" {
+		t.Fatal("wrong arguments in retained event")
+	}
+	if retained, _ := event.Details[wamp.OptRetained].(bool); !retained {
+		t.Fatal("event does not have retained detail")
+	}
+	event = subscribe(125, "nexus.test", wamp.MatchPrefix)
+	if event == nil {
+		t.Fatal("did not receive retained event for prefix subscription")
+	}
+	if event.Details[detailTopic] != testTopic {
+		t.Fatal("retained event for prefix subscription missing topic")
+	}
+
+	// Check that the retained event is not delivered after the TTL expires.
+	clock.Advance(time.Second)
+	if event = subscribe(126, testTopic, wamp.MatchExact); event != nil {
+		t.Fatal("received retained event after TTL expired")
+	}
+
+	// Check that a retained event without TTL is kept, and that publishing a
+	// retained event without arguments clears it.
+	broker.publish(publisher, &wamp.Publish{
+		Request:   127,
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptRetain: true},
+		Arguments: wamp.List{"hello"},
+	})
+	clock.Advance(time.Hour)
+	if event = subscribe(128, testTopic, wamp.MatchExact); event == nil {
+		t.Fatal("did not receive retained event without TTL")
+	}
+	broker.publish(publisher, &wamp.Publish{
+		Request: 129,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptRetain: true},
+	})
+	if event = subscribe(130, testTopic, wamp.MatchExact); event != nil {
+		t.Fatal("received retained event after it was cleared")
+	}
+
+	// Check that an invalid TTL is rejected.
+	broker.publish(publisher, &wamp.Publish{
+		Request:   131,
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptRetain: true, wamp.OptRetainTTL: -1, wamp.OptAcknowledge: true},
+		Arguments: wamp.List{"hello"},
+	})
+	rsp, err := wamp.RecvTimeout(publisher, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument)
+	}
+}
+
+func TestRetainedEventExpiry(t *testing.T) {
+	clock := newFakeClock()
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true}, logger, debug, clock)
+
+	// Publish retained events with a publisher that asks to be disclosed.
+	pubSess := wamp.NewSession(newTestPeer(), wamp.GlobalID(),
+		wamp.Dict{"authid": "alice", "authrole": "user"}, nil)
+	for i, ttl := range []int{10, 20} {
+		broker.publish(pubSess, &wamp.Publish{
+			Request:   wamp.ID(i + 1),
+			Topic:     wamp.URI(fmt.Sprint("nexus.test.topic", i)),
+			Options:   wamp.Dict{wamp.OptRetain: true, wamp.OptRetainTTL: ttl, wamp.OptDiscloseMe: true},
+			Arguments: wamp.List{"hello"},
+		})
+	}
+	numRetained := func() int {
+		count := make(chan int)
+		broker.actionChan <- func() {
+			for _, ret := range broker.retained {
+				if ret.pubDetails["publisher_authid"] != "alice" {
+					t.Error("retained event missing publisher authid")
+				}
+			}
+			count <- len(broker.retained)
+		}
+		return <-count
+	}
+	// Wait for the broker to finish publishing.
+	if n := numRetained(); n != 2 {
+		t.Fatal("expected 2 retained events, got", n)
+	}
+
+	// Check that expired events are removed without a subscriber asking for
+	// them.
+	waitRetained := func(expect int) {
+		for i := 0; i < 100; i++ {
+			if numRetained() == expect {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("expected", expect, "retained events, got", numRetained())
+	}
+	clock.Advance(10 * time.Second)
+	waitRetained(1)
+	clock.Advance(10 * time.Second)
+	waitRetained(0)
+}
+
+func TestPublicationIDCounter(t *testing.T) {
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true, PublicationIDScheme: PublicationIDCounter}, logger, debug, nil)
+	subscriber := newTestPeer()
+	sess := wamp.NewSession(subscriber, 0, nil, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+	broker.subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for SUBSCRIBED")
+	}
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	publisher := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	var prevID wamp.ID
+	for i := 0; i < 10; i++ {
+		broker.publish(publisher, &wamp.Publish{
+			Request: wamp.ID(200 + i),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptAcknowledge: true},
+		})
+		rsp, err = wamp.RecvTimeout(publisher, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for PUBLISHED")
+		}
+		published, ok := rsp.(*wamp.Published)
+		if !ok {
+			t.Fatal("expected", wamp.PUBLISHED, "got:", rsp.MessageType())
+		}
+		rsp, err = wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for EVENT")
+		}
+		event, ok := rsp.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		if event.Publication != published.Publication {
+			t.Fatal("publication ID in EVENT does not match PUBLISHED")
+		}
+		if event.Publication <= prevID {
+			t.Fatalf("publication ID %d not greater than previous ID %d",
+				event.Publication, prevID)
+		}
+		prevID = event.Publication
+	}
+}
+
+func TestPublishDedup(t *testing.T) {
+	clock := newFakeClock()
+	broker := newRealmBroker(&RealmConfig{
+		AllowDisclose:      true,
+		PublishDedupWindow: 10 * time.Second,
+	}, logger, debug, clock)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	subscriber := newTestPeer()
+	subSess := wamp.NewSession(subscriber, 0, nil, nil)
+	broker.subscribe(subSess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	if _, ok := (<-subscriber.Recv()).(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED")
+	}
+
+	publisher := newTestPeer()
+	pubSess := wamp.NewSession(publisher, 0, nil, nil)
+	// Publishes with the dedup key, and returns true if the subscriber
+	// received the event.
+	publish := func(req wamp.ID) bool {
+		broker.publish(pubSess, &wamp.Publish{
+			Request: req,
+			Topic:   testTopic,
+			Options: wamp.Dict{
+				wamp.OptAcknowledge: true,
+				wamp.OptDedupKey:    "order-1",
+			},
+		})
+		rsp, err := wamp.RecvTimeout(pubSess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for PUBLISHED")
+		}
+		if _, ok := rsp.(*wamp.Published); !ok {
+			t.Fatal("expected PUBLISHED, got:", rsp.MessageType())
+		}
+		_, err = wamp.RecvTimeout(subSess, 100*time.Millisecond)
+		return err == nil
+	}
+
+	if !publish(124) {
+		t.Fatal("subscriber did not receive first publication")
+	}
+	clock.Advance(5 * time.Second)
+	if publish(125) {
+		t.Fatal("subscriber received duplicate publication within window")
+	}
+	clock.Advance(6 * time.Second)
+	if !publish(126) {
+		t.Fatal("subscriber did not receive publication after window")
+	}
+
+	// Check that publications without a dedup key are not deduplicated.
+	for i := 0; i < 2; i++ {
+		broker.publish(pubSess, &wamp.Publish{Request: 127, Topic: testTopic})
+		if _, err := wamp.RecvTimeout(subSess, time.Second); err != nil {
+			t.Fatal("subscriber did not receive publication without dedup key")
+		}
+	}
+}
+
+func TestSubscriptionQoS(t *testing.T) {
+	clock := newFakeClock()
+	broker := newRealmBroker(&RealmConfig{AllowDisclose: true, PublicationIDScheme: PublicationIDCounter}, logger, debug, clock)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribes a session, with the given QoS, that can hold one message
+	// before it stalls.
+	subscribe := func(qos string) *wamp.Session {
+		sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+		broker.subscribe(sess, &wamp.Subscribe{
+			Request: wamp.GlobalID(),
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptQoS: qos},
+		})
+		rsp, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for SUBSCRIBED")
+		}
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		return sess
+	}
+	// Receives an event, and returns its sequence number, or 0 if no event.
+	recvEvent := func(sess *wamp.Session) int {
+		select {
+		case rsp := <-sess.Recv():
+			event, ok := rsp.(*wamp.Event)
+			if !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+			}
+			return event.Arguments[0].(int)
+		case <-time.After(100 * time.Millisecond):
+			return 0
+		}
+	}
+	// Waits for the broker to finish what it is doing.
+	waitBroker := func() {
+		sync := make(chan struct{})
+		broker.actionChan <- func() { close(sync) }
+		<-sync
+	}
+	// Publishes n events, numbered in sequence starting at 1.
+	var seq int
+	publish := func(n int) {
+		pub := wamp.NewSession(newTestPeer(), 0, nil, nil)
+		for i := 0; i < n; i++ {
+			seq++
+			broker.publish(pub, &wamp.Publish{
+				Request:   wamp.GlobalID(),
+				Topic:     testTopic,
+				Arguments: wamp.List{seq},
+			})
+		}
+		waitBroker()
+	}
+
+	bestEffort := subscribe(wamp.QoSBestEffort)
+	reliable := subscribe(wamp.QoSReliable)
+
+	// Check that an invalid QoS is rejected.
+	sess := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	broker.subscribe(sess, &wamp.Subscribe{Request: 1, Topic: testTopic, Options: wamp.Dict{wamp.OptQoS: "bogus"}})
+	rsp, err := wamp.RecvTimeout(sess, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected invalid_argument ERROR, got:", rsp)
+	}
+
+	// Publish 3 events while the subscribers are stalled.  Each subscriber can
+	// only hold the first event.
+	publish(3)
+	select {
+	case <-clock.created:
+	case <-time.After(time.Second):
+		t.Fatal("broker did not start retry timer")
+	}
+
+	// Check that the best-effort subscriber dropped the events it could not
+	// hold.
+	if id := recvEvent(bestEffort); id != 1 {
+		t.Fatal("expected event 1, got", id)
+	}
+	clock.Advance(reliableRetryInterval)
+	if id := recvEvent(bestEffort); id != 0 {
+		t.Fatal("best effort subscriber received dropped event", id)
+	}
+
+	// Check that the reliable subscriber receives all events in order once it
+	// recovers.
+	for want := 1; want <= 3; want++ {
+		if id := recvEvent(reliable); id != want {
+			t.Fatalf("expected event %d, got %d", want, id)
+		}
+		// Make sure the broker has restarted the retry timer.
+		waitBroker()
+		clock.Advance(reliableRetryInterval)
+	}
+	if id := recvEvent(reliable); id != 0 {
+		t.Fatal("unexpected event", id)
+	}
+
+	// Check that the events kept for a reliable subscriber that stays stalled
+	// are dropped, as for a slow consumer.
+	publish(2)
+	clock.Advance(reliableRetryTimeout)
+	clock.Advance(reliableRetryInterval)
+	// Wait for the broker to drop the kept event before the subscriber
+	// recovers.
+	for retrying := true; retrying; {
+		done := make(chan struct{})
+		broker.actionChan <- func() {
+			retrying = len(broker.retryEvents) != 0
+			close(done)
+		}
+		<-done
+	}
+	if id := recvEvent(reliable); id != 4 {
+		t.Fatal("expected event 4, got", id)
+	}
+	clock.Advance(reliableRetryInterval)
+	if id := recvEvent(reliable); id != 0 {
+		t.Fatal("slow subscriber received dropped event", id)
+	}
+	broker.close()
+}
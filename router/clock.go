@@ -0,0 +1,43 @@
+package router
+
+import "time"
+
+// Clock provides the current time and timers to the router.  All time-based
+// router logic, such as call timeouts, event batching, publication rate
+// limits, and goodbye timeouts, uses the router's Clock.  This allows tests to
+// supply a fake Clock that advances time deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a Timer that sends the current time on its channel
+	// after at least duration d.
+	NewTimer(d time.Duration) Timer
+	// After waits for duration d to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a single event timer created by a Clock.  It behaves the same as
+// time.Timer, except that its channel is returned by the C method.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing.  Returns false if the timer has
+	// already expired or been stopped.
+	Stop() bool
+	// Reset changes the timer to expire after duration d.  Returns true if the
+	// timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock that uses the system time.  This is the Clock used
+// when none is specified.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
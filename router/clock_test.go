@@ -0,0 +1,219 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// fakeClock is a Clock whose time only changes when advanced by a test.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// Receives a value each time a timer is created.
+	created chan struct{}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		created: make(chan struct{}, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		active: true,
+	}
+	c.timers = append(c.timers, t)
+	c.mutex.Unlock()
+
+	select {
+	case c.created <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing any timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			t.c <- c.now
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	return wasActive
+}
+
+func TestCallTimeoutFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	dealer := newDealer(logger, false, true, debug, clock)
+
+	// Register a procedure with a callee that supports call timeout.
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 0, nil, wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{wamp.FeatureCallTimeout: true},
+			},
+		},
+	})
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+
+	// Call the procedure with a one hour timeout.
+	dealer.call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 3600000},
+	})
+	rsp = <-callee.Recv()
+	if _, ok := rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Wait for the dealer to start the call timeout timer.
+	select {
+	case <-clock.created:
+	case <-time.After(time.Second):
+		t.Fatal("dealer did not create call timeout timer")
+	}
+
+	// Check that the call does not time out before the timeout elapses.
+	clock.Advance(59 * time.Minute)
+	select {
+	case rsp = <-caller.Recv():
+		t.Fatal("caller received unexpected", rsp.MessageType())
+	default:
+	}
+
+	// Advance past the timeout and check that the call is canceled.
+	clock.Advance(time.Minute)
+	rsp, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 124 {
+		t.Fatal("wrong request ID in ERROR")
+	}
+	if errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("expected error", wamp.ErrCanceled, "got", errMsg.Error)
+	}
+	if len(errMsg.Arguments) == 0 || errMsg.Arguments[0] != "call timeout" {
+		t.Fatal("expected call timeout argument")
+	}
+}
+
+// Test that a call timeout that fires while the dealer is closing does not
+// send to the closed action channel.
+func TestCallTimeoutDealerClosed(t *testing.T) {
+	clock := newFakeClock()
+	dealer := newDealer(logger, false, true, debug, clock)
+
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 0, nil, wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{wamp.FeatureCallTimeout: true},
+			},
+		},
+	})
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	callerSession := wamp.NewSession(newTestPeer(), 0, nil, nil)
+	dealer.call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 1000},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	select {
+	case <-clock.created:
+	case <-time.After(time.Second):
+		t.Fatal("dealer did not create call timeout timer")
+	}
+
+	// Keep the dealer busy so that the timer cannot deliver the timeout, and
+	// close the dealer while the timer is waiting to send it.
+	block := make(chan struct{})
+	dealer.actionChan <- func() { <-block }
+	clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		dealer.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("dealer close blocked by call timeout timer")
+	}
+	close(block)
+
+	// A timer that sends after the close would panic here.
+	time.Sleep(50 * time.Millisecond)
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gammazero/nexus/v3/stdlog"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// Broker routes events from publishers to subscribers.  Each realm of a
+// Router has a Broker, and a Broker can also be used without a Router by an
+// application that manages its own sessions.
+//
+// The sessions given to a Broker are *wamp.Session values, created by
+// wamp.NewSession, that must each have a unique ID.  The Broker uses only the
+// following parts of a session: the ID; the Details, for the roles and
+// features the client announced and the authid and authrole used to filter
+// subscribers; and the Peer, which the Broker calls TrySend and IsLocal on to
+// deliver replies and events.  The Broker locks the session while reading
+// its Details, so the application must do the same when changing them.
+type Broker interface {
+	// Submit routes a PUBLISH, SUBSCRIBE, or UNSUBSCRIBE message from the
+	// session.  Any reply is sent to the session's Peer.  An error is
+	// returned if the Broker does not handle the type of message.
+	Submit(sess *wamp.Session, msg wamp.Message) error
+
+	// RemoveSession removes all subscriptions of the session.  This must be
+	// called when the session ends.
+	RemoveSession(sess *wamp.Session)
+
+	// Role returns the role information for the broker role, for use in a
+	// WELCOME message.
+	Role() wamp.Dict
+
+	// Close stops the Broker.
+	Close()
+}
+
+// Dealer routes calls from callers to the callees that registered the called
+// procedures.  Each realm of a Router has a Dealer, and a Dealer can also be
+// used without a Router by an application that manages its own sessions.
+//
+// The sessions given to a Dealer have the same requirements as for a Broker,
+// except that the Dealer also calls Send on the Peer of a callee.  A Dealer
+// that is not part of a Router does not publish registration meta events.
+type Dealer interface {
+	// Submit routes a REGISTER, UNREGISTER, CALL, CANCEL, or YIELD message,
+	// or an ERROR in reply to an INVOCATION, from the session.  Any reply is
+	// sent to the Peer of the session that it is for.  An error is returned
+	// if the Dealer does not handle the type of message.
+	Submit(sess *wamp.Session, msg wamp.Message) error
+
+	// RemoveSession removes all registrations of the session and cancels its
+	// calls.  This must be called when the session ends.
+	RemoveSession(sess *wamp.Session)
+
+	// Role returns the role information for the dealer role, for use in a
+	// WELCOME message.
+	Role() wamp.Dict
+
+	// Close stops the Dealer.
+	Close()
+}
+
+// NewBroker returns a Broker that is configured by the broker settings of the
+// realm configuration, such as StrictURI, AllowDisclose, and the publish rate
+// limits.  The realm URI and the settings that do not apply to a broker are
+// ignored.  If logger is nil, then the Broker logs to stdout.
+func NewBroker(config *RealmConfig, logger stdlog.StdLog, debug bool) Broker {
+	if logger == nil {
+		logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	return &standaloneBroker{newRealmBroker(config, logger, debug, realClock{})}
+}
+
+// NewDealer returns a Dealer that is configured by the dealer settings of the
+// realm configuration, such as StrictURI, AllowDisclose, and
+// MaxPendingInvocations.  The realm URI and the settings that do not apply to
+// a dealer are ignored.  If logger is nil, then the Dealer logs to stdout.  An
+// error is returned if the dealer settings are not valid.
+func NewDealer(config *RealmConfig, logger stdlog.StdLog, debug bool) (Dealer, error) {
+	if logger == nil {
+		logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	d, err := newRealmDealer(config, logger, debug, realClock{})
+	if err != nil {
+		return nil, err
+	}
+	return &standaloneDealer{d}, nil
+}
+
+// newRealmDealer creates the dealer for a realm.
+func newRealmDealer(config *RealmConfig, logger stdlog.StdLog, debug bool, clock Clock) (*dealer, error) {
+	switch config.DuplicateRegistration {
+	case "", DuplicateRegistrationReject, DuplicateRegistrationReplace, DuplicateRegistrationShared:
+	default:
+		return nil, fmt.Errorf("invalid duplicate registration mode: %q",
+			config.DuplicateRegistration)
+	}
+	for proc, fallback := range config.CallFallbacks {
+		if !proc.ValidURI(config.StrictURI, "") || !fallback.ValidURI(config.StrictURI, "") {
+			return nil, fmt.Errorf("invalid call fallback: %v -> %v", proc, fallback)
+		}
+		if _, ok := config.CallFallbacks[fallback]; ok {
+			return nil, fmt.Errorf("call fallback %v has a fallback", fallback)
+		}
+	}
+	d := newDealer(logger, config.StrictURI, config.AllowDisclose, debug, clock)
+	if len(config.CallFallbacks) != 0 {
+		d.setCallFallbacks(config.CallFallbacks, config.CallFallbackErrors)
+	}
+	if config.MaxPendingInvocations > 0 {
+		d.setMaxPending(config.MaxPendingInvocations)
+	}
+	if config.DuplicateRegistration != "" {
+		d.setDuplicateRegistration(config.DuplicateRegistration)
+	}
+	return d, nil
+}
+
+// standaloneBroker implements Broker.
+type standaloneBroker struct {
+	b *broker
+}
+
+func (s *standaloneBroker) Submit(sess *wamp.Session, msg wamp.Message) error {
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		s.b.publish(sess, msg)
+	case *wamp.Subscribe:
+		s.b.subscribe(sess, msg)
+	case *wamp.Unsubscribe:
+		s.b.unsubscribe(sess, msg)
+	default:
+		return fmt.Errorf("broker cannot handle %s message", msg.MessageType())
+	}
+	return nil
+}
+
+func (s *standaloneBroker) RemoveSession(sess *wamp.Session) { s.b.removeSession(sess) }
+func (s *standaloneBroker) Role() wamp.Dict                  { return s.b.role() }
+func (s *standaloneBroker) Close()                           { s.b.close() }
+
+// standaloneDealer implements Dealer.
+type standaloneDealer struct {
+	d *dealer
+}
+
+func (s *standaloneDealer) Submit(sess *wamp.Session, msg wamp.Message) error {
+	switch msg := msg.(type) {
+	case *wamp.Register:
+		s.d.register(sess, msg)
+	case *wamp.Unregister:
+		s.d.unregister(sess, msg)
+	case *wamp.Call:
+		s.d.call(sess, msg)
+	case *wamp.Yield:
+		s.d.yield(sess, msg)
+	case *wamp.Cancel:
+		s.d.cancel(sess, msg)
+	case *wamp.Error:
+		if msg.Type != wamp.INVOCATION {
+			return fmt.Errorf("dealer cannot handle ERROR for %s", msg.Type)
+		}
+		s.d.error(msg)
+	default:
+		return fmt.Errorf("dealer cannot handle %s message", msg.MessageType())
+	}
+	return nil
+}
+
+func (s *standaloneDealer) RemoveSession(sess *wamp.Session) { s.d.removeSession(sess) }
+func (s *standaloneDealer) Role() wamp.Dict                  { return s.d.role() }
+func (s *standaloneDealer) Close()                           { s.d.close() }
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestStandaloneBroker(t *testing.T) {
+	broker := NewBroker(&RealmConfig{StrictURI: true}, logger, debug)
+	defer broker.Close()
+
+	if _, ok := broker.Role()["features"]; !ok {
+		t.Fatal("broker role has no features")
+	}
+
+	const testTopic = wamp.URI("nexus.test.topic")
+	newSession := func(id wamp.ID) *wamp.Session {
+		return wamp.NewSession(&testPeer{in: make(chan wamp.Message, 4)}, id, nil, nil)
+	}
+	recv := func(sess *wamp.Session) wamp.Message {
+		t.Helper()
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("session", sess.ID, "did not receive message")
+		}
+		return msg
+	}
+
+	// Subscribe two sessions.
+	subs := []*wamp.Session{newSession(1), newSession(2)}
+	var subID wamp.ID
+	for _, sub := range subs {
+		err := broker.Submit(sub, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribed, ok := recv(sub).(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected SUBSCRIBED")
+		}
+		subID = subscribed.Subscription
+	}
+
+	// Check that the event published by a third session reaches both
+	// subscribers.
+	pub := newSession(3)
+	err := broker.Submit(pub, &wamp.Publish{
+		Request:   wamp.GlobalID(),
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptAcknowledge: true},
+		Arguments: wamp.List{"hello"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recv(pub).(*wamp.Published); !ok {
+		t.Fatal("expected PUBLISHED")
+	}
+	for _, sub := range subs {
+		event, ok := recv(sub).(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT")
+		}
+		if event.Subscription != subID || event.Arguments[0] != "hello" {
+			t.Fatal("wrong event:", event)
+		}
+	}
+
+	// Check that a removed session no longer receives events.
+	broker.RemoveSession(subs[0])
+	err = broker.Submit(pub, &wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recv(subs[1]).(*wamp.Event); !ok {
+		t.Fatal("expected EVENT")
+	}
+	if msg, err := wamp.RecvTimeout(subs[0], 100*time.Millisecond); err == nil {
+		t.Fatal("removed session received", msg.MessageType())
+	}
+
+	// Check that messages the broker does not handle are refused.
+	if err = broker.Submit(pub, &wamp.Call{Request: 1, Procedure: "nexus.test.proc"}); err == nil {
+		t.Fatal("expected error submitting CALL to broker")
+	}
+}
+
+func TestNewDealerInvalidConfig(t *testing.T) {
+	_, err := NewDealer(&RealmConfig{DuplicateRegistration: "sahred"}, logger, debug)
+	if err == nil {
+		t.Fatal("expected error for invalid duplicate registration mode")
+	}
+	_, err = NewDealer(&RealmConfig{
+		CallFallbacks: map[wamp.URI]wamp.URI{
+			"nexus.test.a": "nexus.test.b",
+			"nexus.test.b": "nexus.test.a",
+		},
+	}, logger, debug)
+	if err == nil {
+		t.Fatal("expected error for call fallback that has a fallback")
+	}
+	_, err = NewDealer(&RealmConfig{
+		StrictURI:     true,
+		CallFallbacks: map[wamp.URI]wamp.URI{"nexus.test.a": "nexus..b"},
+	}, logger, debug)
+	if err == nil {
+		t.Fatal("expected error for invalid call fallback URI")
+	}
+
+	dealer, err := NewDealer(&RealmConfig{
+		DuplicateRegistration: DuplicateRegistrationShared,
+	}, logger, debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dealer.Close()
+}
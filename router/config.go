@@ -1,6 +1,8 @@
 package router
 
 import (
+	"time"
+
 	"github.com/gammazero/nexus/v3/router/auth"
 	"github.com/gammazero/nexus/v3/wamp"
 )
@@ -20,14 +22,90 @@ type Config struct {
 	// allows unauthenticated clients to create new realms.
 	RealmTemplate *RealmConfig `json:"realm_template"`
 
+	// RealmProvider, if not nil, is called when a client requests to join a
+	// realm that does not exist, and returns the configuration of the realm
+	// to create.  This allows realms to be created on demand, such as for
+	// new tenants, with a different configuration for each realm.  The URI of
+	// the returned configuration is set to the requested realm.  If
+	// RealmProvider returns false, then RealmTemplate is used if there is
+	// one, and otherwise the client is sent an ABORT with
+	// wamp.error.no_such_realm.
+	//
+	// RealmProvider is called by the goroutine handling the new client, and
+	// may be called concurrently.  This value is not set via json config,
+	// but is configured when embedding nexus.
+	RealmProvider func(realm wamp.URI) (*RealmConfig, bool) `json:"-"`
+
 	// Enable debug logging for router, realm, broker, dealer
 	Debug bool
 	// Interval in seconds for logging memory stats.  O to disable.
 	// Logs Alloc, Mallocs, Frees, and NumGC.  For a description of these, see
 	// https://golang.org/pkg/runtime/#MemStats
 	MemStatsLogSec int `json:"mem_stats_log_sec"`
+	// Set pprof labels, with the realm URI and session ID, on the goroutine
+	// that handles each session's messages, and on the goroutines it starts.
+	// This identifies the realm and session of goroutines in profiles, at the
+	// cost of setting the labels for each session.
+	ProfileLabels bool `json:"profile_labels"`
+	// GoodbyeTimeout is the time the router waits for a client to reply to a
+	// GOODBYE sent by the router, when the router ends the session because
+	// of shutdown or a session kill.  If the client does not reply within
+	// this time, then the router closes the client's transport.  A value of
+	// zero does not wait for a reply.  In the nexusd JSON configuration, this
+	// is given in seconds.
+	GoodbyeTimeout time.Duration `json:"goodbye_timeout"`
+	// LogSampleWindow enables sampling of the router's log messages, so that
+	// a flood of identical messages, such as protocol violations repeated by
+	// a misbehaving client, does not become a bottleneck.  The first
+	// occurrence of a message is logged, and identical messages within this
+	// time window are only counted.  The count is logged after the window
+	// ends.  A value of zero logs every message.  The nexusd JSON
+	// configuration gives this in seconds.
+	LogSampleWindow time.Duration `json:"log_sample_window"`
+	// Clock, if not nil, is used by the router for all time-based logic,
+	// such as call timeouts and publication rate limits.  This is intended
+	// for tests that need to control the passage of time.  If nil, the system
+	// clock is used.
+	Clock Clock `json:"-"`
+}
+
+// TransportInfo describes the transport that a client is connected to the
+// router over.  This is given to RealmConfig.MethodSelector to select the
+// authmethods allowed for the client.
+type TransportInfo struct {
+	// Type is the type of transport: "websocket", "rawsocket", or "local".
+	Type string
+	// Local is true if the client is in the same process as the router.
+	Local bool
+	// TLS is true if the connection is secured using TLS.
+	TLS bool
+	// RemoteAddr is the network address of the client, if known.
+	RemoteAddr string
 }
 
+// Policies for handling messages that the router does not handle.  See
+// RealmConfig.UnknownMessagePolicy.
+const (
+	UnknownMessageAbort  = "abort"
+	UnknownMessageError  = "error"
+	UnknownMessageIgnore = "ignore"
+)
+
+// Schemes for assigning publication IDs.  See
+// RealmConfig.PublicationIDScheme.
+const (
+	PublicationIDRandom  = "random"
+	PublicationIDCounter = "counter"
+)
+
+// Modes for handling a registration of a procedure that is already
+// registered.  See RealmConfig.DuplicateRegistration.
+const (
+	DuplicateRegistrationReject  = "reject"
+	DuplicateRegistrationReplace = "replace"
+	DuplicateRegistrationShared  = "shared"
+)
+
 // RealmConfig configures a single realm in the router.  The router
 // configuration may specify a list of realms to configure.
 type RealmConfig struct {
@@ -38,12 +116,42 @@ type RealmConfig struct {
 	// Allow anonymous authentication.  If an auth.AnonymousAuth Authenticator
 	// if not supplied, then router supplies on with AuthRole of "anonymous".
 	AnonymousAuth bool `json:"anonymous_auth"`
+	// DefaultAuthRole is the authrole given to anonymous sessions, when the
+	// router supplies the anonymous Authenticator, and to sessions whose
+	// Authenticator does not assign an authrole.  If not set, anonymous
+	// sessions have the authrole "anonymous".
+	DefaultAuthRole string `json:"default_auth_role"`
 	// Allow publisher and caller identity disclosure when requested.
 	AllowDisclose bool `json:"allow_disclose"`
+	// Allow publishers to request the number of subscribers an event was
+	// delivered to, by setting disclose_subscriber_count in the options of an
+	// acknowledged publication.
+	AllowSubscriberCount bool `json:"allow_subscriber_count"`
 	// Slice of Authenticator interfaces.
 	Authenticators []auth.Authenticator
 	// Authorizer called for each message.
 	Authorizer Authorizer
+	// OnDeny, if set, is called for each message that the Authorizer does
+	// not authorize, with the sending session and the message, for
+	// monitoring authorization denials.  The reason is ErrNotAuthorized, or
+	// the error returned by the Authorizer if authorization failed.  OnDeny
+	// is called by the goroutine that handles messages from the session,
+	// without holding any router lock, so it should return quickly.  The
+	// session and message must not be modified.
+	OnDeny func(sess *wamp.Session, msg wamp.Message, reason error) `json:"-"`
+	// ObserverAuthRoles are the authroles of observer sessions.  An observer
+	// session may read the router's meta information, but may not otherwise
+	// use the realm.  It may subscribe to meta events, such as
+	// wamp.session.on_join, and may only call the built-in session,
+	// registration, and subscription meta procedures that read information,
+	// such as wamp.session.list.  It may not call the session kill,
+	// modify_details, or testament meta procedures, or procedures added by
+	// RegisterMetaProcedure.  Any other message from an observer is answered
+	// with a wamp.error.not_authorized ERROR, as if denied by the Authorizer.
+	// This applies to all sessions with an observer authrole, including local
+	// sessions, whether or not the realm has an Authorizer.  An Authorizer
+	// can make a session an observer by changing its authrole.
+	ObserverAuthRoles []string `json:"observer_auth_roles"`
 	// Require authentication for local clients.  Normally local clients are
 	// always trusted.  Setting this treats local clients the same as remote.
 	RequireLocalAuth bool `json:"require_local_auth"`
@@ -51,6 +159,63 @@ type RealmConfig struct {
 	// always authorized, even when the router has an authorizer.  Setting this
 	// treats local clients the same as remote.
 	RequireLocalAuthz bool `json:"require_local_authz"`
+	// CheckProcedureBeforeAuthz checks that a called procedure is registered
+	// before authorizing the CALL.  A call to a procedure that is not
+	// registered is then answered with wamp.error.no_such_procedure, even if
+	// the caller is not authorized to call it.  By default, the CALL is
+	// authorized first, so a caller that is not authorized receives
+	// wamp.error.not_authorized whether or not the procedure exists, which
+	// hides the existence of procedures from unauthorized callers.
+	CheckProcedureBeforeAuthz bool `json:"check_procedure_before_authz"`
+	// MethodSelector, if set, is called with information about the transport
+	// a client connected over, and returns the authmethods that the client
+	// may authenticate with.  Only the authmethods requested in the client's
+	// HELLO that are also in the returned list are used to authenticate the
+	// client.  This allows, for example, anonymous authentication only for
+	// local clients, and requiring cryptosign for clients connected over the
+	// network.  Local clients are only authenticated, and so only subject to
+	// MethodSelector, if RequireLocalAuth is set.
+	MethodSelector func(TransportInfo) []string `json:"-"`
+	// PostAuthHook, if set, is called with each session that has
+	// successfully authenticated, before the session is welcomed to the
+	// realm.  This allows rejecting a session for reasons other than its
+	// credentials, such as a suspended account.  If the hook returns an
+	// error, then the client is sent an ABORT and the session does not join
+	// the realm.  The ABORT reason is that of a returned *RejectSessionError,
+	// or wamp.error.not_authorized for any other error.
+	PostAuthHook func(sess *wamp.Session) error `json:"-"`
+	// AllowedCIDRs and DeniedCIDRs restrict the network addresses that
+	// clients may join the realm from.  These are lists of CIDR notation IP
+	// address ranges, such as "10.0.0.0/8".  A client whose address is in a
+	// denied range, or is not in any allowed range when AllowedCIDRs is not
+	// empty, is sent an ABORT before authentication.  Clients without an IP
+	// address, such as unix socket clients, are only allowed if AllowedCIDRs
+	// is empty.  Local clients in the same process as the router are always
+	// allowed.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	DeniedCIDRs  []string `json:"denied_cidrs"`
+	// MaxSessions is the maximum number of sessions that may be joined to the
+	// realm at the same time.  A client that tries to join a realm that has
+	// the maximum number of sessions is sent an ABORT with the
+	// MaxSessionsReason, after authentication.  A value of zero means no
+	// limit.
+	MaxSessions int `json:"max_sessions"`
+	// MaxSessionsReason is the ABORT reason sent to a client that cannot join
+	// the realm because of MaxSessions.  If empty, wamp.error.quota_exceeded
+	// is used.
+	MaxSessionsReason wamp.URI `json:"max_sessions_reason"`
+	// IdleTimeout is how long a session may go without sending any message
+	// to the router.  A session that is idle for longer is sent a GOODBYE
+	// with the reason wamp.close.timeout, and is closed.  A value of zero
+	// means sessions are never closed for being idle.  The nexusd JSON
+	// configuration gives this in seconds.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	// IdleTimeoutTransportActivity counts anything received by the
+	// transport, such as websocket keepalive pings and pongs, as session
+	// activity for IdleTimeout.  Only transports that track activity, such
+	// as websocket, are affected.  When false, only WAMP messages count as
+	// activity.
+	IdleTimeoutTransportActivity bool `json:"idle_timeout_transport_activity"`
 
 	// When true, only include standard session details in on_join event and
 	// session_get response.  Standard details include: session, authid,
@@ -63,6 +228,19 @@ type RealmConfig struct {
 	// additional session details values to include.
 	MetaIncludeSessionDetails []string `json:"meta_include_session_details"`
 
+	// UnknownMessagePolicy is how the router handles a message, from a
+	// client, of a type that the router does not handle.  This is a message
+	// type unknown to the router or a message type that only a router sends.
+	// The policy is one of:
+	//
+	//   "abort"  - abort the session (default)
+	//   "error"  - reply with an ERROR and continue the session
+	//   "ignore" - drop the message and continue the session
+	//
+	// Messages with an unrecognized type code cannot be decoded, and are
+	// dropped by the transport before reaching the router.
+	UnknownMessagePolicy string `json:"unknown_message_policy"`
+
 	// EnableMetaKill enables the wamp.session.kill* session meta procedures.
 	// These are disabled by default to avoid requiring Authorizer logic when
 	// it may not be needed otherwise.
@@ -72,6 +250,105 @@ type RealmConfig struct {
 	// logic when it may not be needed otherwise.
 	EnableMetaModify bool `json:"enable_meta_modify"`
 
+	// EventBatchWindow enables batching of events sent to subscribers, for
+	// higher throughput at very high publish rates.  Events for the same
+	// subscriber that are published within this time window are sent
+	// together, so that the subscriber's transport can write them to the
+	// connection in a single write.  Each event is still a separate WAMP
+	// message.  Events are delayed by up to the window duration, and the
+	// outbound queue size of subscriber transports must be large enough to
+	// hold the events published in one window.  A value of zero disables
+	// batching.  Since the window is normally very short, the nexusd JSON
+	// configuration gives this in milliseconds.
+	EventBatchWindow time.Duration `json:"event_batch_window"`
+
+	// PublishRateLimit is the maximum number of publications per second that
+	// each session may publish.  Acknowledged publications that exceed the
+	// limit are answered with a wamp.error.rate_limit_exceeded ERROR, and
+	// unacknowledged publications that exceed the limit are dropped.  A value
+	// of zero disables rate limiting.
+	PublishRateLimit float64 `json:"publish_rate_limit"`
+	// PublishRateBurst is the number of publications that a session may
+	// publish at once before the rate limit applies.  If zero, the burst is
+	// one second of publications at the PublishRateLimit rate.
+	PublishRateBurst int `json:"publish_rate_burst"`
+	// PublishRateLimitPerTopic applies the publish rate limit to each topic a
+	// session publishes to, instead of to all of the session's publications.
+	PublishRateLimitPerTopic bool `json:"publish_rate_limit_per_topic"`
+
+	// MaxSubscribersPerTopic is the maximum number of sessions that may
+	// subscribe to a topic.  Prefix and wildcard subscriptions are counted
+	// against their topic pattern, separately from exact subscriptions.
+	// Subscribing beyond the limit is answered with a
+	// wamp.error.quota_exceeded ERROR.  A value of zero means no limit.
+	MaxSubscribersPerTopic int `json:"max_subscribers_per_topic"`
+
+	// PublicationIDScheme is how the IDs of publications to the realm, and
+	// of the events sent for them, are assigned.  The scheme is one of:
+	//
+	//   "random"  - random IDs (default)
+	//   "counter" - IDs from a per-realm counter, starting at 1
+	//
+	// With the counter scheme, each publication has a greater ID than all
+	// previous publications to the realm, so that subscribers can rely on the
+	// ordering of publication IDs.  Subscription meta events are also given
+	// IDs from the counter, so IDs seen by a subscriber may not be
+	// consecutive.
+	PublicationIDScheme string `json:"publication_id_scheme"`
+
+	// PublishDedupWindow enables deduplication of publications, for
+	// publishers that may repeat a publication when retrying.  A publication
+	// with a "dedup_key" option that has the same key as an earlier
+	// publication to the same topic, within this time window, is acknowledged
+	// but is not sent to any subscribers.  A value of zero disables
+	// deduplication, and the dedup_key option is ignored.  The nexusd JSON
+	// configuration gives this in seconds.
+	PublishDedupWindow time.Duration `json:"publish_dedup_window"`
+
+	// CallFallbacks maps procedure URIs to fallback procedure URIs.  When
+	// the callee of a call to a procedure in the map returns one of the
+	// CallFallbackErrors, the dealer calls the fallback procedure with the
+	// same arguments and options, and returns the fallback's result or error
+	// to the caller instead.  The caller is not told that the call was
+	// forwarded.  A fallback procedure cannot have a fallback of its own.
+	// Progressive call invocations and canceled calls are not forwarded.
+	//
+	// Forwarded calls bypass authorization: the Authorizer is only asked
+	// about the CALL to the original procedure, and not about the fallback
+	// procedure.  A caller that is not authorized to call a fallback directly
+	// still reaches it through a failed call to the original procedure.
+	CallFallbacks map[wamp.URI]wamp.URI `json:"call_fallbacks"`
+	// CallFallbackErrors are the error URIs returned by a callee that cause a
+	// call to be forwarded to its fallback procedure.  If empty, then only
+	// wamp.error.unavailable causes a call to be forwarded.
+	CallFallbackErrors []wamp.URI `json:"call_fallback_errors"`
+
+	// DuplicateRegistration is how the dealer handles a REGISTER for a
+	// procedure that is already registered, when the registrations do not
+	// share the procedure using the same invocation policy.  The mode is one
+	// of:
+	//
+	//   "reject"  - answer with wamp.error.procedure_already_exists (default)
+	//   "replace" - revoke the existing registration, and register the new
+	//               callee
+	//   "shared"  - treat registrations with the single invocation policy as
+	//               shared registrations with the roundrobin policy
+	//
+	// The replace mode allows swapping callees without a period where the
+	// procedure is not registered.  Each callee of a replaced registration is
+	// sent an UNREGISTERED with a request ID of 0, and with details giving
+	// the registration ID and the reason wamp.error.registration_replaced.
+	// Calls already in progress are still answered by the replaced callee.
+	DuplicateRegistration string `json:"duplicate_registration"`
+
+	// MaxPendingInvocations is the maximum number of calls that may be in
+	// progress in the realm at the same time, including calls queued waiting
+	// for a callee that is at its concurrency limit.  A call beyond the
+	// maximum is rejected with wamp.error.overload.  This bounds the memory
+	// the dealer uses for calls, independent of the concurrency of each
+	// callee.  A value of zero means no limit.
+	MaxPendingInvocations int `json:"max_pending_invocations"`
+
 	// PublishFilterFactory is a function used to create a
 	// PublishFilter to check which sessions a publication should be
 	// sent to.
@@ -79,4 +356,49 @@ type RealmConfig struct {
 	// This value is not set via json config, but is configured when
 	// embedding nexus.  A value of nil enables the default filtering.
 	PublishFilterFactory FilterFactory
+
+	// Features disables advanced profile features in the realm.
+	Features Features `json:"features"`
+
+	// Transform, if not nil, is called with each message that the router
+	// sends to a client session in the realm, such as EVENT and RESULT, and
+	// returns the message to send instead.  Transform may return the message
+	// it is given.  A message may be sent to more than one session, so
+	// Transform must not modify the message it is given, and should return a
+	// modified copy instead.  Transform is called concurrently for different
+	// sessions, and is not called while holding any router lock.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	Transform func(msg wamp.Message) wamp.Message `json:"-"`
+}
+
+// Features disables advanced profile features for a realm.  A disabled
+// feature is not announced in the broker and dealer roles of the WELCOME
+// message, and messages that use the feature are answered with a
+// wamp.error.feature_not_supported ERROR.  An unacknowledged PUBLISH that uses
+// a disabled feature is dropped.  The zero value enables all features.
+type Features struct {
+	DisableCallCanceling              bool `json:"disable_call_canceling"`
+	DisableCallTimeout                bool `json:"disable_call_timeout"`
+	DisableProgressiveCallResults     bool `json:"disable_progressive_call_results"`
+	DisableProgressiveCallInvocations bool `json:"disable_progressive_call_invocations"`
+	DisablePatternBasedRegistration   bool `json:"disable_pattern_based_registration"`
+	DisableSharedRegistration         bool `json:"disable_shared_registration"`
+	DisablePatternBasedSubscription   bool `json:"disable_pattern_based_subscription"`
+	DisableEventRetention             bool `json:"disable_event_retention"`
+}
+
+// RejectSessionError is returned by a PostAuthHook to reject a session with
+// the given ABORT reason.
+type RejectSessionError struct {
+	Reason  wamp.URI
+	Message string
+}
+
+func (e *RejectSessionError) Error() string {
+	if e.Message == "" {
+		return string(e.Reason)
+	}
+	return e.Message
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gammazero/nexus/v3/stdlog"
@@ -18,20 +19,27 @@ const (
 	sendResultDeadline = time.Minute
 	// yieldRetryDelay is the initial delay before reprocessin a blocked yield
 	yieldRetryDelay = time.Millisecond
+	// maxFinishedInvocations is the number of finished invocation IDs that
+	// are remembered to detect YIELD messages sent after the final YIELD.
+	maxFinishedInvocations = 1024
+	// maxQueuedChunks is the number of progressive call invocation CALLs that
+	// are held for a call that is waiting in a queue for a callee.
+	maxQueuedChunks = 64
 )
 
 // Role information for this broker.
 var dealerRole = wamp.Dict{
 	"features": wamp.Dict{
-		wamp.FeatureCallCanceling:    true,
-		wamp.FeatureCallTimeout:      true,
-		wamp.FeatureCallerIdent:      true,
-		wamp.FeaturePatternBasedReg:  true,
-		wamp.FeatureProgCallResults:  true,
-		wamp.FeatureSessionMetaAPI:   true,
-		wamp.FeatureSharedReg:        true,
-		wamp.FeatureRegMetaAPI:       true,
-		wamp.FeatureTestamentMetaAPI: true,
+		wamp.FeatureCallCanceling:       true,
+		wamp.FeatureCallTimeout:         true,
+		wamp.FeatureCallerIdent:         true,
+		wamp.FeaturePatternBasedReg:     true,
+		wamp.FeatureProgCallInvocations: true,
+		wamp.FeatureProgCallResults:     true,
+		wamp.FeatureSessionMetaAPI:      true,
+		wamp.FeatureSharedReg:           true,
+		wamp.FeatureRegMetaAPI:          true,
+		wamp.FeatureTestamentMetaAPI:    true,
 	},
 }
 
@@ -48,15 +56,60 @@ type registration struct {
 	// Multiple sessions can register as callees depending on invocation policy
 	// resulting in multiple procedures for the same registration ID.
 	callees []*wamp.Session
+
+	// Maximum number of simultaneous invocations each callee accepts for this
+	// registration.  A callee without an entry is not limited.
+	concurrency map[*wamp.Session]int
+	// Number of invocations in progress for each callee.
+	active map[*wamp.Session]int
+	// Calls waiting for a callee that is below its concurrency limit, in
+	// order of priority and then of arrival.
+	queue []*queuedCall
+}
+
+// enqueue adds the call to the registration's queue, after all queued calls
+// with the same or a higher priority.
+func (reg *registration) enqueue(qc *queuedCall) {
+	i := len(reg.queue)
+	for i > 0 && reg.queue[i-1].priority < qc.priority {
+		i--
+	}
+	reg.queue = append(reg.queue, nil)
+	copy(reg.queue[i+1:], reg.queue[i:])
+	reg.queue[i] = qc
+}
+
+// queuedCall is a call waiting for a callee to become available.
+type queuedCall struct {
+	callID   requestID
+	caller   *wamp.Session
+	msg      *wamp.Call
+	chunks   []*wamp.Call // subsequent CALLs of progressive call invocation
+	priority int64
+	canceled bool
+	progress bool // more CALLs of progressive call invocation may follow
+
+	// Stops the call timeout timer, which runs while the call is queued and
+	// then while it is invoked.
+	timerCancel context.CancelFunc
 }
 
 // invocation tracks in-progress invocation
 type invocation struct {
 	callID      requestID
 	callee      *wamp.Session
+	regID       wamp.ID
 	canceled    bool
 	retryCount  int
 	timerCancel context.CancelFunc
+
+	// The called procedure, and whether more CALLs of a progressive call
+	// invocation may follow.  Used to check the CALLs that continue the call.
+	procedure wamp.URI
+	progress  bool
+
+	// The CALL, if it can be forwarded to a fallback procedure.
+	call *wamp.Call
 }
 
 type requestID struct {
@@ -83,12 +136,27 @@ type dealer struct {
 	// call ID -> invocation ID (for cancel)
 	invocationByCall map[requestID]wamp.ID
 
+	// call ID -> call waiting for an available callee
+	queuedCalls map[requestID]*queuedCall
+
+	// Invocation IDs of recently finished invocations, in order of finishing.
+	// Used to recognize YIELD messages sent after the final YIELD.
+	finished      map[wamp.ID]struct{}
+	finishedOrder []wamp.ID
+
 	// callee session -> registration ID set.
 	// Used to lookup registrations when removing a callee session.
 	calleeRegIDSet map[*wamp.Session]map[wamp.ID]struct{}
 
 	actionChan chan func()
 
+	// Canceled when the dealer is closed, to stop call timeout timers.
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	// Held by call timeout timers while sending to actionChan, so that the
+	// channel is not closed during the send.
+	closeLock sync.RWMutex
+
 	// Generate registration IDs.
 	idGen *wamp.IDGen
 
@@ -101,6 +169,20 @@ type dealer struct {
 
 	metaPeer wamp.Peer
 
+	// procedure URI -> fallback procedure URI
+	fallbacks map[wamp.URI]wamp.URI
+	// Callee errors that cause a call to be forwarded to its fallback.
+	fallbackErrors map[wamp.URI]struct{}
+
+	// Maximum number of calls in progress, including queued calls.  Zero
+	// means no limit.
+	maxPending int
+
+	// How a REGISTER for an already registered procedure is handled.
+	dupRegMode string
+
+	clock Clock
+
 	// Meta-procedure registration ID -> handler func.
 	metaProcMap map[wamp.ID]func(*wamp.Invocation) wamp.Message
 
@@ -114,7 +196,12 @@ type dealer struct {
 // This serialization is limited to the work of determining the message's
 // destination, and then the message is handed off to the next goroutine,
 // typically the receiving client's send handler.
-func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *dealer {
+//
+// If clock is nil, then the system clock is used.
+func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, clock Clock) *dealer {
+	if clock == nil {
+		clock = realClock{}
+	}
 	d := &dealer{
 		procRegMap:    map[wamp.URI]*registration{},
 		pfxProcRegMap: map[wamp.URI]*registration{},
@@ -125,6 +212,8 @@ func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *deal
 		calls:            map[requestID]*wamp.Session{},
 		invocations:      map[wamp.ID]*invocation{},
 		invocationByCall: map[requestID]wamp.ID{},
+		queuedCalls:      map[requestID]*queuedCall{},
+		finished:         map[wamp.ID]struct{}{},
 		calleeRegIDSet:   map[*wamp.Session]map[wamp.ID]struct{}{},
 
 		// The action handler should be nearly always runable, since it is the
@@ -133,14 +222,17 @@ func newDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *deal
 		actionChan: make(chan func()),
 
 		idGen: new(wamp.IDGen),
-		prng:  rand.New(rand.NewSource(time.Now().Unix())),
+		prng:  rand.New(rand.NewSource(clock.Now().Unix())),
 
 		strictURI:     strictURI,
 		allowDisclose: allowDisclose,
 
+		clock: clock,
+
 		log:   logger,
 		debug: debug,
 	}
+	d.ctx, d.cancelCtx = context.WithCancel(context.Background())
 	go d.run()
 	return d
 }
@@ -152,6 +244,45 @@ func (d *dealer) setMetaPeer(metaPeer wamp.Peer) {
 	}
 }
 
+// setCallFallbacks sets the fallback procedure for each procedure in the
+// fallbacks map, and the callee errors that cause a call to be forwarded to
+// the fallback.  If errs is empty, then calls are forwarded on
+// wamp.error.unavailable.
+func (d *dealer) setCallFallbacks(fallbacks map[wamp.URI]wamp.URI, errs []wamp.URI) {
+	fbCopy := make(map[wamp.URI]wamp.URI, len(fallbacks))
+	for proc, fallback := range fallbacks {
+		fbCopy[proc] = fallback
+	}
+	if len(errs) == 0 {
+		errs = []wamp.URI{wamp.ErrUnavailable}
+	}
+	errSet := make(map[wamp.URI]struct{}, len(errs))
+	for _, errURI := range errs {
+		errSet[errURI] = struct{}{}
+	}
+	d.actionChan <- func() {
+		d.fallbacks = fbCopy
+		d.fallbackErrors = errSet
+	}
+}
+
+// setMaxPending sets the maximum number of calls that may be in progress at
+// the same time, including calls queued waiting for a callee.  A call beyond
+// the maximum is rejected with wamp.error.overload.
+func (d *dealer) setMaxPending(max int) {
+	d.actionChan <- func() {
+		d.maxPending = max
+	}
+}
+
+// setDuplicateRegistration sets how a REGISTER for a procedure that is already
+// registered is handled.  The mode is one of the DuplicateRegistration values.
+func (d *dealer) setDuplicateRegistration(mode string) {
+	d.actionChan <- func() {
+		d.dupRegMode = mode
+	}
+}
+
 // role returns the role information for the "dealer" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (d *dealer) role() wamp.Dict {
@@ -223,10 +354,25 @@ func (d *dealer) register(callee *wamp.Session, msg *wamp.Register) {
 	}
 
 	invoke, _ := wamp.AsString(msg.Options[wamp.OptInvoke])
+
+	// A callee may limit the number of invocations of the procedure it
+	// handles at the same time.
+	concurrency, _ := wamp.AsInt64(msg.Options[wamp.OptConcurrency])
+	if concurrency < 0 {
+		d.trySend(callee, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{fmt.Sprint("invalid concurrency ", concurrency)},
+			Details:   wamp.Dict{},
+		})
+		return
+	}
+
 	var metaPubs []*wamp.Publish
 	done := make(chan struct{})
 	d.actionChan <- func() {
-		metaPubs = d.syncRegister(callee, msg, match, invoke, disclose, wampURI)
+		metaPubs = d.syncRegister(callee, msg, match, invoke, disclose, wampURI, int(concurrency))
 		close(done)
 	}
 	<-done
@@ -263,6 +409,19 @@ func (d *dealer) call(caller *wamp.Session, msg *wamp.Call) {
 	}
 }
 
+// hasProcedure returns true if a callee is registered for the procedure.
+func (d *dealer) hasProcedure(procedure wamp.URI) bool {
+	var found bool
+	done := make(chan struct{})
+	d.actionChan <- func() {
+		reg, ok := d.syncMatchProcedure(procedure)
+		found = ok && len(reg.callees) != 0
+		close(done)
+	}
+	<-done
+	return found
+}
+
 // cancel actively cancels a call that is in progress.
 //
 // Cancellation behaves differently depending on the mode:
@@ -330,15 +489,15 @@ func (d *dealer) yield(callee *wamp.Session, msg *wamp.Yield) {
 	if again {
 		retry := true
 		delay := yieldRetryDelay
-		start := time.Now()
+		start := d.clock.Now()
 		// Retry processing YIELD until caller gone or deadline reached
 		for {
 			if d.debug {
 				d.log.Println("Retry sending RESULT after", delay)
 			}
-			<-time.After(delay)
+			<-d.clock.After(delay)
 			// Do not retry if the elapsed time exceeds deadline
-			if time.Since(start) >= sendResultDeadline {
+			if d.clock.Now().Sub(start) >= sendResultDeadline {
 				retry = false
 			}
 			d.actionChan <- func() {
@@ -392,7 +551,10 @@ func (d *dealer) removeSession(sess *wamp.Session) {
 
 // close stops the dealer, letting already queued actions finish.
 func (d *dealer) close() {
+	d.cancelCtx()
+	d.closeLock.Lock()
 	close(d.actionChan)
+	d.closeLock.Unlock()
 }
 
 func (d *dealer) run() {
@@ -404,7 +566,7 @@ func (d *dealer) run() {
 	}
 }
 
-func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool) []*wamp.Publish {
+func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool, concurrency int) []*wamp.Publish {
 	var metaPubs []*wamp.Publish
 	var reg *registration
 	switch match {
@@ -416,6 +578,23 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 		reg = d.wcProcRegMap[msg.Procedure]
 	}
 
+	if !wampURI {
+		switch d.dupRegMode {
+		case DuplicateRegistrationShared:
+			// Registrations that do not allow other callees are shared.
+			if invokePolicy == "" || invokePolicy == wamp.InvokeSingle {
+				invokePolicy = wamp.InvokeRoundRobin
+			}
+		case DuplicateRegistrationReplace:
+			// Revoke an existing registration that does not allow this
+			// callee, so that it is replaced by a new registration.
+			if reg != nil && (reg.policy == "" || reg.policy == wamp.InvokeSingle || reg.policy != invokePolicy) {
+				metaPubs = d.syncRevokeReg(reg, wamp.ErrRegistrationReplaced)
+				reg = nil
+			}
+		}
+	}
+
 	var created string
 	var regID wamp.ID
 	// If no existing registration found for the procedure, then create a new
@@ -431,6 +610,9 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 			policy:    invokePolicy,
 			disclose:  disclose,
 			callees:   []*wamp.Session{callee},
+
+			concurrency: map[*wamp.Session]int{},
+			active:      map[*wamp.Session]int{},
 		}
 		d.registrations[regID] = reg
 		switch match {
@@ -498,6 +680,10 @@ func (d *dealer) syncRegister(callee *wamp.Session, msg *wamp.Register, match, i
 		reg.callees = append(reg.callees, callee)
 	}
 
+	if concurrency != 0 {
+		reg.concurrency[callee] = concurrency
+	}
+
 	// Add the registration ID to the callees set of registrations.
 	if _, ok := d.calleeRegIDSet[callee]; !ok {
 		d.calleeRegIDSet[callee] = map[wamp.ID]struct{}{}
@@ -621,6 +807,40 @@ func (d *dealer) syncMatchProcedure(procedure wamp.URI) (*registration, bool) {
 }
 
 func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
+	reqID := requestID{
+		session: caller.ID,
+		request: msg.Request,
+	}
+	// A CALL with the same request ID as a call that is already in progress
+	// is the continuation of a progressive call invocation.
+	if invocationID, ok := d.invocationByCall[reqID]; ok {
+		invk, ok := d.invocations[invocationID]
+		if ok && (!invk.progress || msg.Procedure != invk.procedure) {
+			d.syncBadContinuation(caller, msg)
+			return
+		}
+		d.syncProgressiveCall(msg, invocationID)
+		return
+	}
+	if qc, ok := d.queuedCalls[reqID]; ok {
+		if !qc.progress || msg.Procedure != qc.msg.Procedure {
+			d.syncBadContinuation(caller, msg)
+			return
+		}
+		if len(qc.chunks) == maxQueuedChunks {
+			// Fail the call rather than hold an unlimited number of CALLs
+			// while it waits for a callee.
+			d.syncCancel(caller, &wamp.Cancel{Request: msg.Request},
+				wamp.CancelModeSkip, wamp.ErrOverload,
+				wamp.List{"too many progressive calls while queued"})
+			return
+		}
+		// Hold the continuation until the queued call is invoked.
+		qc.chunks = append(qc.chunks, msg)
+		qc.progress, _ = msg.Options[wamp.OptProgress].(bool)
+		return
+	}
+
 	reg, ok := d.syncMatchProcedure(msg.Procedure)
 	if !ok || len(reg.callees) == 0 {
 		// If no registered procedure, send error.
@@ -633,33 +853,110 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 		return
 	}
 
-	var callee *wamp.Session
+	if d.maxPending != 0 && len(d.invocations)+len(d.queuedCalls) >= d.maxPending {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrOverload,
+			Arguments: wamp.List{"too many calls in progress"},
+		})
+		return
+	}
+
+	callee := d.syncSelectCallee(reg)
+	if callee == nil {
+		// Every callee is at its concurrency limit, so queue the call until
+		// one of the callee's invocations is finished.
+		priority, _ := wamp.AsInt64(msg.Options[wamp.OptPriority])
+		qc := &queuedCall{
+			callID:   reqID,
+			caller:   caller,
+			msg:      msg,
+			priority: priority,
+		}
+		qc.progress, _ = msg.Options[wamp.OptProgress].(bool)
+		// The call timeout includes the time spent waiting in the queue.
+		if timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout]); timeout > 0 {
+			qc.timerCancel = d.startCallTimer(caller, msg.Request, timeout)
+		}
+		reg.enqueue(qc)
+		d.queuedCalls[reqID] = qc
+		return
+	}
+	d.syncInvoke(caller, msg, reg, callee, nil)
+}
+
+// syncSelectCallee selects a callee, for the registration, according to the
+// registration's invocation policy.  A callee that is at its concurrency limit
+// is passed over in favor of the next callee the policy would choose.  If all
+// callees are at their limit, then nil is returned.
+func (d *dealer) syncSelectCallee(reg *registration) *wamp.Session {
+	n := len(reg.callees)
+	available := func(i int) bool {
+		callee := reg.callees[i]
+		limit := reg.concurrency[callee]
+		return limit == 0 || reg.active[callee] < limit
+	}
+
+	if n == 1 {
+		if available(0) {
+			return reg.callees[0]
+		}
+		return nil
+	}
 
 	// If there are multiple callees, then select a callee based invocation
 	// policy.
-	if len(reg.callees) > 1 {
-		switch reg.policy {
-		case wamp.InvokeFirst:
-			callee = reg.callees[0]
-		case wamp.InvokeRoundRobin:
-			if reg.nextCallee >= len(reg.callees) {
+	switch reg.policy {
+	case wamp.InvokeFirst:
+		for i := 0; i < n; i++ {
+			if available(i) {
+				return reg.callees[i]
+			}
+		}
+	case wamp.InvokeRoundRobin:
+		for i := 0; i < n; i++ {
+			if reg.nextCallee >= n {
 				reg.nextCallee = 0
 			}
-			callee = reg.callees[reg.nextCallee]
+			next := reg.nextCallee
 			reg.nextCallee++
-		case wamp.InvokeRandom:
-			callee = reg.callees[d.prng.Int63n(int64(len(reg.callees)))]
-		case wamp.InvokeLast:
-			callee = reg.callees[len(reg.callees)-1]
-		default:
-			errMsg := fmt.Sprint("multiple callees registered for ",
-				msg.Procedure, " with '", wamp.InvokeSingle, "' policy")
-			// This is disallowed by the dealer, and is a programming error if
-			// it ever happened, so panic.
-			panic(errMsg)
+			if available(next) {
+				return reg.callees[next]
+			}
 		}
-	} else {
-		callee = reg.callees[0]
+	case wamp.InvokeRandom:
+		start := int(d.prng.Int63n(int64(n)))
+		for i := 0; i < n; i++ {
+			if next := (start + i) % n; available(next) {
+				return reg.callees[next]
+			}
+		}
+	case wamp.InvokeLast:
+		for i := n - 1; i >= 0; i-- {
+			if available(i) {
+				return reg.callees[i]
+			}
+		}
+	default:
+		errMsg := fmt.Sprint("multiple callees registered for ",
+			reg.procedure, " with '", wamp.InvokeSingle, "' policy")
+		// This is disallowed by the dealer, and is a programming error if
+		// it ever happened, so panic.
+		panic(errMsg)
+	}
+	return nil
+}
+
+// syncInvoke sends an INVOCATION for the call to the selected callee.  If
+// timerCancel is not nil, then it stops the call timeout timer that was
+// started when the call was queued.  Returns false if the call failed and an
+// ERROR was returned to the caller.
+func (d *dealer) syncInvoke(caller *wamp.Session, msg *wamp.Call, reg *registration, callee *wamp.Session, timerCancel context.CancelFunc) bool {
+	reqID := requestID{
+		session: caller.ID,
+		request: msg.Request,
 	}
 	details := wamp.Dict{}
 
@@ -701,7 +998,7 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 					Details: wamp.Dict{},
 					Error:   wamp.ErrOptionDisallowedDiscloseMe,
 				})
-				return
+				return false
 			}
 			if callee.HasFeature(wamp.RoleCallee, wamp.FeatureCallerIdent) {
 				discloseCaller(caller, details)
@@ -723,24 +1020,49 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 		}
 	}
 
+	// A Caller sends the first of a series of progressive call invocations
+	// by setting CALL.Options.progress|bool := true
+	if opt, _ := msg.Options[wamp.OptProgress].(bool); opt {
+		// The Callee must support progressive call invocations, since there
+		// is no way to deliver the remaining CALL messages otherwise.
+		if !callee.HasFeature(wamp.RoleCallee, wamp.FeatureProgCallInvocations) {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrFeatureNotSupported,
+				Arguments: wamp.List{"callee does not support progressive call invocations"},
+			})
+			return false
+		}
+		details[wamp.OptProgress] = true
+	}
+
 	if reg.match != wamp.MatchExact {
 		// According to the spec, a router must provide the actual procedure to
 		// the client.
 		details[wamp.OptProcedure] = msg.Procedure
 	}
 
-	reqID := requestID{
-		session: caller.ID,
-		request: msg.Request,
-	}
 	d.calls[reqID] = caller
 	invocationID := d.idGen.Next()
 	invk := &invocation{
-		callID: reqID,
-		callee: callee,
+		callID:      reqID,
+		callee:      callee,
+		regID:       reg.id,
+		timerCancel: timerCancel,
+		procedure:   msg.Procedure,
+		progress:    details[wamp.OptProgress] != nil,
+	}
+	if _, ok := d.fallbacks[msg.Procedure]; ok && details[wamp.OptProgress] == nil {
+		// Keep the call to forward it if the callee fails.  Progressive call
+		// invocations are not forwarded, since the callee may have already
+		// received some of the call's CALL messages.
+		invk.call = msg
 	}
 	d.invocations[invocationID] = invk
 	d.invocationByCall[reqID] = invocationID
+	reg.active[callee]++
 
 	// Send INVOCATION to the endpoint that has registered the requested
 	// procedure.
@@ -758,39 +1080,205 @@ func (d *dealer) syncCall(caller *wamp.Session, msg *wamp.Call) {
 			Error:     wamp.ErrNetworkFailure,
 			Arguments: wamp.List{"callee blocked - cannot call procedure"},
 		})
+		return false
+	}
+
+	if timeout != 0 && invk.timerCancel == nil {
+		invk.timerCancel = d.startCallTimer(caller, msg.Request, timeout)
+	}
+	return true
+}
+
+// startCallTimer starts a timer that cancels the call if it does not finish
+// within the timeout, given in milliseconds.  The returned function stops the
+// timer.
+func (d *dealer) startCallTimer(caller *wamp.Session, request wamp.ID, timeout int64) context.CancelFunc {
+	// Timer removed if context canceled, call cancelled if timeout.
+	timerCtx, timerCancel := context.WithCancel(d.ctx)
+	timer := d.clock.NewTimer(time.Duration(timeout) * time.Millisecond)
+
+	// Start goroutine to cancel pending call on timeout.  Works like Cancel
+	// with mode=killnowait, and includes an error message argument "call
+	// timeout"
+	go func() {
+		select {
+		case <-timer.C():
+		case <-timerCtx.Done():
+			// Timer canceled.  Got response from callee, caller canceled or
+			// ended session, or dealer closed.
+			timer.Stop()
+			return
+		}
+		d.closeLock.RLock()
+		defer d.closeLock.RUnlock()
+		if d.ctx.Err() != nil {
+			// Dealer closed.
+			return
+		}
+		select {
+		case d.actionChan <- func() {
+			errArgs := wamp.List{"call timeout"}
+			d.syncCancel(caller, &wamp.Cancel{Request: request},
+				wamp.CancelModeKillNoWait, wamp.ErrCanceled, errArgs)
+		}:
+		case <-d.ctx.Done():
+		}
+	}()
+	return timerCancel
+}
+
+// syncEndInvocation removes a finished invocation.  This frees a slot in the
+// callee's concurrency limit, so any calls queued for the registration are
+// dispatched if possible.
+func (d *dealer) syncEndInvocation(invocationID wamp.ID, invk *invocation) {
+	delete(d.invocations, invocationID)
+	reg, ok := d.registrations[invk.regID]
+	if !ok {
 		return
 	}
+	if reg.active[invk.callee] > 1 {
+		reg.active[invk.callee]--
+	} else {
+		delete(reg.active, invk.callee)
+	}
+	d.syncDispatchQueued(reg)
+}
 
-	if timeout != 0 {
-		// Timer removed if context canceled, call cancelled if timeout.
-		var timerCtx context.Context
-		timerCtx, invk.timerCancel = context.WithTimeout(context.Background(),
-			time.Duration(timeout)*time.Millisecond)
-
-		// Start goroutine to cancel pending call on timeout.  Works like
-		// Cancel with mode=killnowait, and includes an error message argument
-		// "call timeout"
-		go func() {
-			<-timerCtx.Done()
-			if timerCtx.Err() == context.Canceled {
-				// Timer canceled.  Got response from callee, or caller
-				// canceled or ended session.
-				return
+// syncDispatchQueued invokes the calls queued for the registration, in order,
+// until there are no more callees below their concurrency limit.
+func (d *dealer) syncDispatchQueued(reg *registration) {
+	for len(reg.queue) != 0 {
+		qc := reg.queue[0]
+		if qc.canceled {
+			reg.queue[0] = nil
+			reg.queue = reg.queue[1:]
+			continue
+		}
+		callee := d.syncSelectCallee(reg)
+		if callee == nil {
+			return
+		}
+		reg.queue[0] = nil
+		reg.queue = reg.queue[1:]
+		delete(d.queuedCalls, qc.callID)
+		if !d.syncInvoke(qc.caller, qc.msg, reg, callee, qc.timerCancel) {
+			if qc.timerCancel != nil {
+				qc.timerCancel()
 			}
-			d.actionChan <- func() {
-				errArgs := wamp.List{"call timeout"}
-				d.syncCancel(caller, &wamp.Cancel{Request: msg.Request},
-					wamp.CancelModeKillNoWait, wamp.ErrCanceled, errArgs)
+			continue
+		}
+		// Forward any progressive call invocations that arrived while the
+		// call was queued.
+		for _, chunk := range qc.chunks {
+			invocationID, ok := d.invocationByCall[qc.callID]
+			if !ok {
+				break
 			}
-		}()
+			d.syncProgressiveCall(chunk, invocationID)
+		}
+	}
+	reg.queue = nil
+}
+
+// syncFailQueued sends an ERROR to the caller of each call queued for the
+// registration.
+func (d *dealer) syncFailQueued(reg *registration, reason wamp.URI, errArgs wamp.List) {
+	for _, qc := range reg.queue {
+		if qc.canceled {
+			continue
+		}
+		qc.canceled = true
+		if qc.timerCancel != nil {
+			qc.timerCancel()
+		}
+		delete(d.queuedCalls, qc.callID)
+		d.trySend(qc.caller, &wamp.Error{
+			Type:      wamp.CALL,
+			Request:   qc.callID.request,
+			Error:     reason,
+			Details:   wamp.Dict{},
+			Arguments: errArgs,
+		})
+	}
+	reg.queue = nil
+}
+
+// syncProgressiveCall forwards a subsequent CALL, of a progressive call
+// invocation, to the callee handling the call as an INVOCATION with the same
+// invocation ID.  The final CALL is sent without progress=true.
+func (d *dealer) syncProgressiveCall(msg *wamp.Call, invocationID wamp.ID) {
+	invk, ok := d.invocations[invocationID]
+	if !ok {
+		d.log.Print("CRITICAL: missing invocation for progressive call")
+		return
+	}
+	if invk.canceled {
+		// Drop remaining progressive calls for a canceled call.
+		return
+	}
+	details := wamp.Dict{}
+	if opt, _ := msg.Options[wamp.OptProgress].(bool); opt {
+		details[wamp.OptProgress] = true
+	} else {
+		invk.progress = false
+	}
+	if !d.trySend(invk.callee, &wamp.Invocation{
+		Request:      invocationID,
+		Registration: invk.regID,
+		Details:      details,
+		Arguments:    msg.Arguments,
+		ArgumentsKw:  msg.ArgumentsKw,
+	}) {
+		d.syncError(&wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   invocationID,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrNetworkFailure,
+			Arguments: wamp.List{"callee blocked - cannot call procedure"},
+		})
 	}
 }
 
+// syncBadContinuation answers a CALL that has the request ID of a call in
+// progress, but that does not continue a progressive call invocation of the
+// same procedure.
+func (d *dealer) syncBadContinuation(caller *wamp.Session, msg *wamp.Call) {
+	d.log.Println("Protocol violation: CALL from", caller, "for request",
+		msg.Request, "does not continue a progressive call to", msg.Procedure)
+	d.trySend(caller, &wamp.Error{
+		Type:      msg.MessageType(),
+		Request:   msg.Request,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrProtocolViolation,
+		Arguments: wamp.List{"call does not continue a progressive call invocation"},
+	})
+}
+
 func (d *dealer) syncCancel(caller *wamp.Session, msg *wamp.Cancel, mode string, reason wamp.URI, errArgs wamp.List) {
 	reqID := requestID{
 		session: caller.ID,
 		request: msg.Request,
 	}
+	if qc, ok := d.queuedCalls[reqID]; ok {
+		// The call has not been invoked yet, so there is no callee to
+		// interrupt.  Remove it from the queue and send ERROR to the caller.
+		qc.canceled = true
+		if qc.timerCancel != nil {
+			qc.timerCancel()
+		}
+		delete(d.queuedCalls, reqID)
+		errMsg := &wamp.Error{
+			Type:    wamp.CALL,
+			Request: msg.Request,
+			Error:   reason,
+			Details: wamp.Dict{},
+		}
+		if len(errArgs) != 0 {
+			errMsg.Arguments = errArgs
+		}
+		d.trySend(caller, errMsg)
+		return
+	}
 	procCaller, ok := d.calls[reqID]
 	if !ok {
 		// There is no pending call to cancel.
@@ -863,7 +1351,7 @@ func (d *dealer) syncCancel(caller *wamp.Session, msg *wamp.Cancel, mode string,
 	// This also stops repeated CANCEL messages.
 	delete(d.calls, reqID)
 	delete(d.invocationByCall, reqID)
-	delete(d.invocations, invocationID)
+	d.syncEndInvocation(invocationID, invk)
 
 	errMsg := &wamp.Error{
 		Type:    wamp.CALL,
@@ -883,6 +1371,15 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, progress, canR
 	// Find and delete pending invocation.
 	invk, ok := d.invocations[msg.Request]
 	if !ok {
+		// If the invocation already finished with a final YIELD, then this is
+		// a protocol violation by the callee.  Drop the message without
+		// sending INTERRUPT, since there is nothing left to cancel.
+		if _, done := d.finished[msg.Request]; done {
+			d.log.Println("Protocol violation: dropped YIELD from", callee,
+				"received after final YIELD for request", msg.Request)
+			return false
+		}
+
 		// The pending invocation is gone, which means the caller has left the
 		// realm or canceled the call.
 		//
@@ -935,11 +1432,12 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, progress, canR
 			if keepInvocation {
 				return
 			}
-			delete(d.invocations, msg.Request)
 			// Delete callID -> invocation.
 			delete(d.invocationByCall, callID)
 			// Delete pending call since it is finished.
 			delete(d.calls, callID)
+			d.syncEndInvocation(msg.Request, invk)
+			d.syncAddFinished(msg.Request)
 		}()
 	}
 
@@ -974,6 +1472,17 @@ func (d *dealer) syncYield(callee *wamp.Session, msg *wamp.Yield, progress, canR
 	return false
 }
 
+// syncAddFinished records the ID of an invocation that finished with a final
+// YIELD.  Only the most recent maxFinishedInvocations IDs are kept.
+func (d *dealer) syncAddFinished(invocationID wamp.ID) {
+	if len(d.finishedOrder) == maxFinishedInvocations {
+		delete(d.finished, d.finishedOrder[0])
+		d.finishedOrder = d.finishedOrder[1:]
+	}
+	d.finished[invocationID] = struct{}{}
+	d.finishedOrder = append(d.finishedOrder, invocationID)
+}
+
 func (d *dealer) syncError(msg *wamp.Error) {
 	// Find and delete pending invocation.
 	invk, ok := d.invocations[msg.Request]
@@ -987,8 +1496,10 @@ func (d *dealer) syncError(msg *wamp.Error) {
 		invk.timerCancel()
 	}
 
-	delete(d.invocations, msg.Request)
 	callID := invk.callID
+	// End the invocation before any forwarding to a fallback, so that the
+	// failed invocation does not count against MaxPendingInvocations.
+	d.syncEndInvocation(msg.Request, invk)
 
 	// Delete invocationsByCall entry.  This will already be deleted if the
 	// call canceled with mode "skip" or "killnowait".
@@ -1004,21 +1515,74 @@ func (d *dealer) syncError(msg *wamp.Error) {
 	}
 	delete(d.calls, callID)
 
+	if d.syncCallFallback(caller, invk, msg.Error) {
+		return
+	}
+
+	// Forward the callee's error unchanged, except that Details must be a
+	// dict even if the callee did not provide one.
+	details := msg.Details
+	if details == nil {
+		details = wamp.Dict{}
+	}
+
 	// Send error to the caller.
 	d.trySend(caller, &wamp.Error{
 		Type:        wamp.CALL,
 		Request:     callID.request,
 		Error:       msg.Error,
-		Details:     msg.Details,
+		Details:     details,
 		Arguments:   msg.Arguments,
 		ArgumentsKw: msg.ArgumentsKw,
 	})
 }
 
+// syncCallFallback forwards a call, that the callee failed with the given
+// error, to the fallback procedure for the called procedure.  Returns false if
+// the call has no fallback, the error does not cause forwarding, or the
+// fallback procedure has no callees.  The forwarded call is not authorized,
+// since the caller was authorized to call the original procedure.
+func (d *dealer) syncCallFallback(caller *wamp.Session, invk *invocation, reason wamp.URI) bool {
+	if invk.call == nil || invk.canceled {
+		return false
+	}
+	if _, ok := d.fallbackErrors[reason]; !ok {
+		return false
+	}
+	fallback := d.fallbacks[invk.call.Procedure]
+	if reg, ok := d.syncMatchProcedure(fallback); !ok || len(reg.callees) == 0 {
+		return false
+	}
+	if d.debug {
+		d.log.Println("Forwarding call to", invk.call.Procedure, "from",
+			caller, "to fallback", fallback, "after error", reason)
+	}
+	call := *invk.call
+	call.Procedure = fallback
+	d.syncCall(caller, &call)
+	return true
+}
+
 func (d *dealer) syncRemoveSession(sess *wamp.Session) []*wamp.Publish {
 	var metaPubs []*wamp.Publish
+	// Drop any calls from the removed session that are waiting in a queue.
+	for callID, qc := range d.queuedCalls {
+		if qc.caller == sess {
+			qc.canceled = true
+			if qc.timerCancel != nil {
+				qc.timerCancel()
+			}
+			delete(d.queuedCalls, callID)
+		}
+	}
+
 	// Remove any remaining registrations for the removed session.
 	for regID := range d.calleeRegIDSet[sess] {
+		// Forget the session's invocations in progress, since a canceled
+		// invocation that is waiting for the callee to respond never ends.
+		if reg, ok := d.registrations[regID]; ok {
+			delete(reg.active, sess)
+		}
 		delReg, err := d.syncDelCalleeReg(sess, regID)
 		if err != nil {
 			panic("!!! Callee had ID of nonexistent registration")
@@ -1087,14 +1651,14 @@ func (d *dealer) syncRemoveSession(sess *wamp.Session) []*wamp.Publish {
 
 		// If there is a pending invocation for the call, remove it.
 		if invkID, ok := d.invocationByCall[req]; ok {
+			delete(d.invocationByCall, req)
 			if invk, ok := d.invocations[invkID]; ok {
 				// Stop any call timeout timer.
 				if invk.timerCancel != nil {
 					invk.timerCancel()
 				}
+				d.syncEndInvocation(invkID, invk)
 			}
-			delete(d.invocationByCall, req)
-			delete(d.invocations, invkID)
 		}
 	}
 	return metaPubs
@@ -1126,6 +1690,7 @@ func (d *dealer) syncDelCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, er
 				// Delete preserving order.
 				reg.callees = append(reg.callees[:i], reg.callees[i+1:]...)
 			}
+			delete(reg.concurrency, callee)
 			break
 		}
 	}
@@ -1133,6 +1698,8 @@ func (d *dealer) syncDelCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, er
 	// If no more callees for this registration, then delete the registration
 	// according to what match type it is.
 	if len(reg.callees) == 0 {
+		// Calls waiting for a callee can no longer be invoked.
+		d.syncFailQueued(reg, wamp.ErrCanceled, wamp.List{"callee gone"})
 		delete(d.registrations, regID)
 		switch reg.match {
 		default:
@@ -1151,6 +1718,50 @@ func (d *dealer) syncDelCalleeReg(callee *wamp.Session, regID wamp.ID) (bool, er
 	return false, nil
 }
 
+// syncRevokeReg removes all callees from the registration, which deletes the
+// registration, and sends each callee an UNREGISTERED that gives the reason
+// the registration was revoked.
+func (d *dealer) syncRevokeReg(reg *registration, reason wamp.URI) []*wamp.Publish {
+	var metaPubs []*wamp.Publish
+	callees := make([]*wamp.Session, len(reg.callees))
+	copy(callees, reg.callees)
+	for _, callee := range callees {
+		if regIDSet, ok := d.calleeRegIDSet[callee]; ok {
+			delete(regIDSet, reg.id)
+			if len(regIDSet) == 0 {
+				delete(d.calleeRegIDSet, callee)
+			}
+		}
+		delReg, _ := d.syncDelCalleeReg(callee, reg.id)
+
+		d.log.Println("Revoked registration", reg.id, "for procedure",
+			reg.procedure, "from callee", callee)
+		d.trySend(callee, &wamp.Unregistered{
+			Details: wamp.Dict{
+				wamp.OptRegistration: reg.id,
+				wamp.OptReason:       reason,
+			},
+		})
+
+		if d.metaPeer == nil {
+			continue
+		}
+		metaPubs = append(metaPubs, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     wamp.MetaEventRegOnUnregister,
+			Arguments: wamp.List{callee.ID, reg.id},
+		})
+		if delReg {
+			metaPubs = append(metaPubs, &wamp.Publish{
+				Request:   wamp.GlobalID(),
+				Topic:     wamp.MetaEventRegOnDelete,
+				Arguments: wamp.List{callee.ID, reg.id},
+			})
+		}
+	}
+	return metaPubs
+}
+
 // ----- Meta Procedure Handlers -----
 
 // regList retrieves registration IDs listed according to match policies.
@@ -1245,23 +1856,21 @@ func (d *dealer) regMatch(msg *wamp.Invocation) wamp.Message {
 // regGet retrieves information on a particular registration.
 func (d *dealer) regGet(msg *wamp.Invocation) wamp.Message {
 	var dict wamp.Dict
-	if len(msg.Arguments) != 0 {
-		if regID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			d.actionChan <- func() {
-				if reg, ok := d.registrations[regID]; ok {
-					dict = wamp.Dict{
-						"id":           regID,
-						"created":      reg.created,
-						"uri":          reg.procedure,
-						wamp.OptMatch:  reg.match,
-						wamp.OptInvoke: reg.policy,
-					}
+	if regID, err := wamp.InvocationArgID(msg, 0); err == nil {
+		sync := make(chan struct{})
+		d.actionChan <- func() {
+			if reg, ok := d.registrations[regID]; ok {
+				dict = wamp.Dict{
+					"id":           regID,
+					"created":      reg.created,
+					"uri":          reg.procedure,
+					wamp.OptMatch:  reg.match,
+					wamp.OptInvoke: reg.policy,
 				}
-				close(sync)
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if dict == nil {
 		return &wamp.Error{
@@ -1281,20 +1890,18 @@ func (d *dealer) regGet(msg *wamp.Invocation) wamp.Message {
 // attached to the registration.
 func (d *dealer) regListCallees(msg *wamp.Invocation) wamp.Message {
 	var calleeIDs []wamp.ID
-	if len(msg.Arguments) != 0 {
-		if regID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			d.actionChan <- func() {
-				if reg, ok := d.registrations[regID]; ok {
-					calleeIDs = make([]wamp.ID, len(reg.callees))
-					for i := range reg.callees {
-						calleeIDs[i] = reg.callees[i].ID
-					}
+	if regID, err := wamp.InvocationArgID(msg, 0); err == nil {
+		sync := make(chan struct{})
+		d.actionChan <- func() {
+			if reg, ok := d.registrations[regID]; ok {
+				calleeIDs = make([]wamp.ID, len(reg.callees))
+				for i := range reg.callees {
+					calleeIDs[i] = reg.callees[i].ID
 				}
-				close(sync)
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if calleeIDs == nil {
 		return &wamp.Error{
@@ -1314,21 +1921,19 @@ func (d *dealer) regListCallees(msg *wamp.Invocation) wamp.Message {
 // registration.
 func (d *dealer) regCountCallees(msg *wamp.Invocation) wamp.Message {
 	var count int
-	var ok bool
-	if len(msg.Arguments) != 0 {
-		var regID wamp.ID
-		if regID, ok = wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			d.actionChan <- func() {
-				if reg, found := d.registrations[regID]; found {
-					count = len(reg.callees)
-				} else {
-					ok = false
-				}
-				close(sync)
+	regID, err := wamp.InvocationArgID(msg, 0)
+	ok := err == nil
+	if ok {
+		sync := make(chan struct{})
+		d.actionChan <- func() {
+			if reg, found := d.registrations[regID]; found {
+				count = len(reg.callees)
+			} else {
+				ok = false
 			}
-			<-sync
+			close(sync)
 		}
+		<-sync
 	}
 	if !ok {
 		return &wamp.Error{
@@ -1344,6 +1949,49 @@ func (d *dealer) regCountCallees(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// regCallees retrieves the invocation policy of the registration, and the
+// session IDs of the callees attached to it, in the order that callees are
+// selected for the roundrobin, first, and last policies.  This is useful for
+// seeing how calls to a shared registration are distributed.
+func (d *dealer) regCallees(msg *wamp.Invocation) wamp.Message {
+	var dict wamp.Dict
+	if regID, err := wamp.InvocationArgID(msg, 0); err == nil {
+		sync := make(chan struct{})
+		d.actionChan <- func() {
+			if reg, ok := d.registrations[regID]; ok {
+				calleeIDs := make([]wamp.ID, len(reg.callees))
+				for i := range reg.callees {
+					calleeIDs[i] = reg.callees[i].ID
+				}
+				policy := reg.policy
+				if policy == "" {
+					policy = wamp.InvokeSingle
+				}
+				dict = wamp.Dict{
+					"id":           regID,
+					"uri":          reg.procedure,
+					wamp.OptInvoke: policy,
+					"callees":      calleeIDs,
+				}
+			}
+			close(sync)
+		}
+		<-sync
+	}
+	if dict == nil {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchRegistration,
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
 func (d *dealer) trySend(sess *wamp.Session, msg wamp.Message) bool {
 	if err := sess.TrySend(msg); err != nil {
 		d.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
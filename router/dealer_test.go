@@ -3,6 +3,7 @@ package router
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -11,7 +12,7 @@ import (
 )
 
 func newTestDealer() (*dealer, wamp.Peer) {
-	d := newDealer(logger, false, true, debug)
+	d := newDealer(logger, false, true, debug, nil)
 	metaClient, rtr := transport.LinkedPeers()
 	d.setMetaPeer(rtr)
 	return d, metaClient
@@ -1218,7 +1219,7 @@ func TestCallerIdentification(t *testing.T) {
 }
 
 func TestWrongYielder(t *testing.T) {
-	dealer := newDealer(logger, false, true, debug)
+	dealer := newDealer(logger, false, true, debug, nil)
 
 	// Register a procedure.
 	callee := newTestPeer()
@@ -1260,3 +1261,1017 @@ func TestWrongYielder(t *testing.T) {
 	case <-time.After(200 * time.Millisecond):
 	}
 }
+
+func TestProgressAfterFinalYield(t *testing.T) {
+	dealer := newDealer(logger, false, true, debug, nil)
+
+	// Register a procedure.  The callee supports call canceling, so the
+	// dealer would send an INTERRUPT if it thought the call was canceled.
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 0, nil, wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{wamp.FeatureCallCanceling: true},
+			},
+		},
+	})
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+
+	// Call the procedure, requesting progressive results.
+	dealer.call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptReceiveProgress: true},
+	})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Callee sends a progressive result followed by the final result.
+	for _, arg := range []string{"progress", "final"} {
+		progress := arg == "progress"
+		dealer.yield(calleeSess, &wamp.Yield{
+			Request:   inv.Request,
+			Options:   wamp.Dict{wamp.OptProgress: progress},
+			Arguments: wamp.List{arg},
+		})
+		rsp, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for RESULT")
+		}
+		rslt, ok := rsp.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		if rslt.Request != 124 {
+			t.Fatal("wrong request ID in RESULT")
+		}
+		if s, _ := wamp.AsString(rslt.Arguments[0]); s != arg {
+			t.Fatalf("expected %q result, got %q", arg, s)
+		}
+		if p, _ := wamp.AsBool(rslt.Details[wamp.OptProgress]); p != progress {
+			t.Fatal("wrong progress flag in RESULT")
+		}
+	}
+
+	// Callee sends a progressive result after the final result.
+	dealer.yield(calleeSess, &wamp.Yield{
+		Request:   inv.Request,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+		Arguments: wamp.List{"late"},
+	})
+
+	// Check that the late result was dropped, and that the callee was not
+	// sent an INTERRUPT.
+	select {
+	case rsp = <-caller.Recv():
+		t.Fatal("caller received unexpected", rsp.MessageType())
+	case rsp = <-callee.Recv():
+		t.Fatal("callee received unexpected", rsp.MessageType())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestProgressiveCallContinuation(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register a callee that supports progressive call invocations, and
+	// handles one invocation at a time.
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{wamp.FeatureProgCallInvocations: true},
+			},
+		},
+	})
+	dealer.register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptConcurrency: 1},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	checkViolation := func(msg *wamp.Call) {
+		t.Helper()
+		dealer.call(callerSession, msg)
+		rsp, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for ERROR")
+		}
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrProtocolViolation {
+			t.Fatal("expected", wamp.ErrProtocolViolation, "got", errMsg.Error)
+		}
+		select {
+		case rsp = <-callee.Recv():
+			t.Fatal("callee received", rsp.MessageType())
+		default:
+		}
+	}
+
+	// A call that is not progressive cannot be continued.
+	dealer.call(callerSession, &wamp.Call{Request: 1, Procedure: testProcedure})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	checkViolation(&wamp.Call{
+		Request:   1,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+
+	// A queued progressive call cannot be continued by a call to another
+	// procedure.
+	dealer.call(callerSession, &wamp.Call{
+		Request:   2,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	checkViolation(&wamp.Call{
+		Request:   2,
+		Procedure: "nexus.test.other",
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+
+	// The number of CALLs held for a queued call is limited.
+	for i := 0; i < maxQueuedChunks; i++ {
+		dealer.call(callerSession, &wamp.Call{
+			Request:   2,
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptProgress: true},
+		})
+	}
+	dealer.call(callerSession, &wamp.Call{
+		Request:   2,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	rsp, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrOverload {
+		t.Fatal("expected overload ERROR, got:", rsp)
+	}
+
+	// Finish the first call so that the callee is free, and start a
+	// progressive call.
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = (<-caller.Recv()).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+	dealer.call(callerSession, &wamp.Call{
+		Request:   3,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	if _, ok = (<-callee.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	// An invoked progressive call cannot be continued by a call to another
+	// procedure.
+	checkViolation(&wamp.Call{
+		Request:   3,
+		Procedure: "nexus.test.other",
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+
+	// After the final CALL, the call cannot be continued.
+	dealer.call(callerSession, &wamp.Call{Request: 3, Procedure: testProcedure})
+	if _, ok = (<-callee.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	checkViolation(&wamp.Call{Request: 3, Procedure: testProcedure})
+}
+
+func TestCalleeErrorForwarded(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSession,
+		&wamp.Call{Request: 124, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Callee responds with a structured validation error.
+	const errURI = wamp.URI("nexus.error.validation")
+	details := wamp.Dict{"retry": false}
+	args := wamp.List{"invalid input"}
+	kwargs := wamp.Dict{
+		"fields": wamp.Dict{
+			"name": "required",
+			"age":  wamp.List{"too small", 0},
+		},
+	}
+	dealer.error(&wamp.Error{
+		Type:        wamp.INVOCATION,
+		Request:     inv.Request,
+		Details:     details,
+		Error:       errURI,
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	})
+
+	// Check that caller received the error unchanged.
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR response, got:", rsp.MessageType())
+	}
+	if errMsg.Type != wamp.CALL || errMsg.Request != 124 {
+		t.Fatal("wrong type or request ID in ERROR")
+	}
+	if errMsg.Error != errURI {
+		t.Fatal("wrong error URI:", errMsg.Error)
+	}
+	if !reflect.DeepEqual(errMsg.Details, details) {
+		t.Fatal("wrong error details:", errMsg.Details)
+	}
+	if !reflect.DeepEqual(errMsg.Arguments, args) {
+		t.Fatal("wrong error arguments:", errMsg.Arguments)
+	}
+	if !reflect.DeepEqual(errMsg.ArgumentsKw, kwargs) {
+		t.Fatal("wrong error kwargs:", errMsg.ArgumentsKw)
+	}
+
+	// Check that the caller gets non-nil details if the callee sends none.
+	dealer.call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+	inv = (<-callee.Recv()).(*wamp.Invocation)
+	dealer.error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   errURI,
+	})
+	errMsg = (<-caller.Recv()).(*wamp.Error)
+	if errMsg.Details == nil {
+		t.Fatal("expected non-nil error details")
+	}
+}
+
+func TestCalleeConcurrency(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register callee that handles one invocation at a time.
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptConcurrency: 1},
+	})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Make several calls without waiting for results.
+	const callCount = 3
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	for i := 1; i <= callCount; i++ {
+		dealer.call(callerSession, &wamp.Call{
+			Request:   wamp.ID(i),
+			Procedure: testProcedure,
+			Arguments: wamp.List{i},
+		})
+	}
+
+	for i := 1; i <= callCount; i++ {
+		var inv *wamp.Invocation
+		select {
+		case rsp = <-callee.Recv():
+			var ok bool
+			if inv, ok = rsp.(*wamp.Invocation); !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for INVOCATION")
+		}
+		if inv.Arguments[0] != i {
+			t.Fatal("invocations not dispatched in call order")
+		}
+
+		// Callee must not get another invocation while one is in progress.
+		select {
+		case rsp = <-callee.Recv():
+			t.Fatal("callee received simultaneous invocation:", rsp.MessageType())
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		select {
+		case rsp = <-caller.Recv():
+			result, ok := rsp.(*wamp.Result)
+			if !ok {
+				t.Fatal("expected RESULT, got:", rsp.MessageType())
+			}
+			if result.Request != wamp.ID(i) {
+				t.Fatal("wrong result ID:", result.Request)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for RESULT")
+		}
+	}
+}
+
+func TestCallFallback(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	const fallbackProc = wamp.URI("nexus.test.fallback")
+	dealer.setCallFallbacks(map[wamp.URI]wamp.URI{testProcedure: fallbackProc}, nil)
+
+	register := func(procedure wamp.URI) (*testPeer, *wamp.Session) {
+		callee := newTestPeer()
+		calleeSess := wamp.NewSession(callee, 0, nil, nil)
+		dealer.register(calleeSess,
+			&wamp.Register{Request: 123, Procedure: procedure})
+		if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		return callee, calleeSess
+	}
+	primary, _ := register(testProcedure)
+	fallback, fallbackSess := register(fallbackProc)
+
+	caller := newTestPeer()
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	args := wamp.List{"hello"}
+	dealer.call(callerSession,
+		&wamp.Call{Request: 124, Procedure: testProcedure, Arguments: args})
+	inv, ok := (<-primary.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	// Primary callee is unavailable, so the call is forwarded to the
+	// fallback.
+	dealer.error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrUnavailable,
+	})
+	var rsp wamp.Message
+	select {
+	case rsp = <-fallback.Recv():
+	case rsp = <-caller.Recv():
+		t.Fatal("caller received", rsp.MessageType(), "instead of fallback")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for fallback INVOCATION")
+	}
+	inv, ok = rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if !reflect.DeepEqual(inv.Arguments, args) {
+		t.Fatal("wrong arguments in fallback INVOCATION:", inv.Arguments)
+	}
+	dealer.yield(fallbackSess, &wamp.Yield{Request: inv.Request, Arguments: wamp.List{"ok"}})
+
+	rslt, ok := (<-caller.Recv()).(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT")
+	}
+	if rslt.Request != 124 {
+		t.Fatal("wrong request ID in RESULT:", rslt.Request)
+	}
+	if s, _ := wamp.AsString(rslt.Arguments[0]); s != "ok" {
+		t.Fatal("wrong result:", rslt.Arguments)
+	}
+
+	// Check that other errors are returned to the caller.
+	dealer.call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+	inv = (<-primary.Recv()).(*wamp.Invocation)
+	dealer.error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrInvalidArgument,
+	})
+	errMsg, ok := (<-caller.Recv()).(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR")
+	}
+	if errMsg.Request != 125 || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error:", errMsg.Request, errMsg.Error)
+	}
+	select {
+	case rsp = <-fallback.Recv():
+		t.Fatal("fallback received", rsp.MessageType())
+	default:
+	}
+
+	// Check that a fallback procedure with its own fallback is rejected.
+	_, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI: testRealm,
+				CallFallbacks: map[wamp.URI]wamp.URI{
+					testProcedure: fallbackProc,
+					fallbackProc:  "nexus.test.fallback2",
+				},
+			},
+		},
+	}, logger)
+	if err == nil {
+		t.Fatal("expected error for chained call fallback")
+	}
+}
+
+func TestQueuedCallPriority(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register callee that handles one invocation at a time.
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptConcurrency: 1},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// The first call is invoked, and the others are queued.  The last call
+	// has a higher priority than the calls before it.
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	priorities := []int{0, 0, 0, 5, 10}
+	for i, priority := range priorities {
+		opts := wamp.Dict{}
+		if priority != 0 {
+			opts[wamp.OptPriority] = priority
+		}
+		dealer.call(callerSession, &wamp.Call{
+			Request:   wamp.ID(i + 1),
+			Procedure: testProcedure,
+			Options:   opts,
+			Arguments: wamp.List{i + 1},
+		})
+	}
+
+	// Check that the queued calls are invoked by priority, and then in call
+	// order.
+	for _, expect := range []int{1, 5, 4, 2, 3} {
+		var inv *wamp.Invocation
+		select {
+		case rsp := <-callee.Recv():
+			var ok bool
+			if inv, ok = rsp.(*wamp.Invocation); !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for INVOCATION")
+		}
+		if inv.Arguments[0] != expect {
+			t.Fatal("expected invocation of call", expect, "got", inv.Arguments[0])
+		}
+		dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		if _, ok := (<-caller.Recv()).(*wamp.Result); !ok {
+			t.Fatal("expected RESULT")
+		}
+	}
+}
+
+func TestQueuedCallTimeout(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register callee that handles one invocation at a time.
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptConcurrency: 1},
+	})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// The first call is invoked, and the second call, that has a timeout, is
+	// queued.
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSession, &wamp.Call{Request: 1, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.call(callerSession, &wamp.Call{
+		Request:   2,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 100},
+	})
+
+	// Check that the queued call times out while waiting for the callee.
+	select {
+	case rsp = <-caller.Recv():
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Request != 2 || errMsg.Error != wamp.ErrCanceled {
+			t.Fatal("expected canceled error for call 2, got:", errMsg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued call did not time out")
+	}
+
+	// Check that the timed out call is not invoked when the callee is free.
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = (<-caller.Recv()).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+	select {
+	case rsp = <-callee.Recv():
+		t.Fatal("timed out call was invoked:", rsp.MessageType())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCallTimeoutFractional(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					wamp.FeatureCallTimeout: true,
+				},
+			},
+		},
+	}
+	callee := newTestPeer()
+	calleeSess := wamp.NewSession(callee, 0, nil, calleeRoles)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Check that a fractional timeout, as JSON may give it, is truncated to
+	// whole milliseconds.
+	caller := newTestPeer()
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptTimeout: 1500.5},
+	})
+	inv, ok := (<-callee.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	if timeout, _ := wamp.AsInt64(inv.Details[wamp.OptTimeout]); timeout != 1500 {
+		t.Fatal("expected timeout of 1500, got", inv.Details[wamp.OptTimeout])
+	}
+	dealer.yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = (<-caller.Recv()).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT")
+	}
+}
+
+func TestCalleeGoneClearsActive(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+				},
+			},
+		},
+	}
+
+	// Register two callees to a shared registration, so that the
+	// registration remains after the first callee is gone.
+	callee1 := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess1 := wamp.NewSession(callee1, 0, nil, calleeRoles)
+	dealer.register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptConcurrency: 1,
+			wamp.OptInvoke:      wamp.InvokeFirst,
+		},
+	})
+	if _, ok := (<-callee1.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	callee2 := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess2 := wamp.NewSession(callee2, 0, nil, calleeRoles)
+	dealer.register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeFirst},
+	})
+	if _, ok := (<-callee2.Recv()).(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Call the first callee and cancel with mode kill, so that the
+	// invocation waits for the callee to respond.
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSession, &wamp.Call{Request: 125, Procedure: testProcedure})
+	if _, ok := (<-callee1.Recv()).(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION")
+	}
+	dealer.cancel(callerSession, &wamp.Cancel{
+		Request: 125,
+		Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKill},
+	})
+	if _, ok := (<-callee1.Recv()).(*wamp.Interrupt); !ok {
+		t.Fatal("expected INTERRUPT")
+	}
+
+	// Remove the first callee without it responding.
+	dealer.removeSession(calleeSess1)
+
+	// Check that the removed callee has no invocations in progress.
+	var active int
+	sync := make(chan struct{})
+	dealer.actionChan <- func() {
+		active = len(dealer.procRegMap[testProcedure].active)
+		close(sync)
+	}
+	<-sync
+	if active != 0 {
+		t.Fatal("expected no active callees, got", active)
+	}
+}
+
+func TestMaxPendingInvocations(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	const maxPending = 2
+	dealer.setMaxPending(maxPending)
+
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	call := func(reqID wamp.ID) {
+		dealer.call(callerSession, &wamp.Call{Request: reqID, Procedure: testProcedure})
+	}
+	recvInvocation := func() *wamp.Invocation {
+		select {
+		case rsp = <-callee.Recv():
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			return inv
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for INVOCATION")
+		}
+		return nil
+	}
+
+	// Saturate the dealer.
+	var invs []*wamp.Invocation
+	for i := 1; i <= maxPending; i++ {
+		call(wamp.ID(i))
+		invs = append(invs, recvInvocation())
+	}
+
+	// Check that the call beyond the maximum is rejected.
+	call(maxPending + 1)
+	select {
+	case rsp = <-caller.Recv():
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Request != maxPending+1 {
+			t.Fatal("wrong request ID in ERROR:", errMsg.Request)
+		}
+		if errMsg.Error != wamp.ErrOverload {
+			t.Fatal("wrong error URI:", errMsg.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ERROR")
+	}
+
+	// Finish an invocation, and check that its slot is freed.
+	dealer.yield(calleeSess, &wamp.Yield{Request: invs[0].Request})
+	select {
+	case rsp = <-caller.Recv():
+		if _, ok := rsp.(*wamp.Result); !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for RESULT")
+	}
+	call(maxPending + 2)
+	recvInvocation()
+}
+
+func TestCallFallbackMaxPending(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	const fallbackProc = wamp.URI("nexus.test.fallback")
+	dealer.setCallFallbacks(map[wamp.URI]wamp.URI{testProcedure: fallbackProc}, nil)
+	dealer.setMaxPending(1)
+
+	register := func(procedure wamp.URI) (*testPeer, *wamp.Session) {
+		callee := &testPeer{in: make(chan wamp.Message, 8)}
+		calleeSess := wamp.NewSession(callee, 0, nil, nil)
+		dealer.register(calleeSess,
+			&wamp.Register{Request: 123, Procedure: procedure})
+		if _, ok := (<-callee.Recv()).(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		return callee, calleeSess
+	}
+	primary, _ := register(testProcedure)
+	fallback, _ := register(fallbackProc)
+
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	callerSession := wamp.NewSession(caller, 0, nil, nil)
+	dealer.call(callerSession, &wamp.Call{Request: 124, Procedure: testProcedure})
+	inv, ok := (<-primary.Recv()).(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION")
+	}
+
+	// Check that the failed invocation does not count against the limit, so
+	// that the forwarded call is not rejected.
+	dealer.error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrUnavailable,
+	})
+	select {
+	case rsp := <-fallback.Recv():
+		if _, ok = rsp.(*wamp.Invocation); !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp := <-caller.Recv():
+		t.Fatal("caller received", rsp.MessageType(), "instead of fallback")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for fallback INVOCATION")
+	}
+}
+
+// registerTestCallee registers a new callee session for testProcedure, and
+// returns the callee and the dealer's reply.
+func registerTestCallee(t *testing.T, dealer *dealer, options wamp.Dict) (*testPeer, *wamp.Session, wamp.Message) {
+	callee := &testPeer{in: make(chan wamp.Message, 8)}
+	calleeSess := wamp.NewSession(callee, 0, nil, nil)
+	dealer.register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure, Options: options})
+	select {
+	case rsp := <-callee.Recv():
+		return callee, calleeSess, rsp
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for REGISTER reply")
+	}
+	return nil, nil, nil
+}
+
+// callTestProcedure calls testProcedure and returns the index of the callee
+// that is sent the INVOCATION.
+func callTestProcedure(t *testing.T, dealer *dealer, reqID wamp.ID, callees ...*testPeer) int {
+	caller := &testPeer{in: make(chan wamp.Message, 8)}
+	dealer.call(wamp.NewSession(caller, 0, nil, nil),
+		&wamp.Call{Request: reqID, Procedure: testProcedure})
+	for i := range callees {
+		select {
+		case rsp := <-callees[i].Recv():
+			if _, ok := rsp.(*wamp.Invocation); !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			return i
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("no callee received INVOCATION")
+	return -1
+}
+
+func TestDuplicateRegistrationReject(t *testing.T) {
+	dealer, _ := newTestDealer()
+	dealer.setDuplicateRegistration(DuplicateRegistrationReject)
+
+	callee1, _, rsp := registerTestCallee(t, dealer, nil)
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	_, _, rsp = registerTestCallee(t, dealer, nil)
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("wrong error URI:", errMsg.Error)
+	}
+	callTestProcedure(t, dealer, 1, callee1)
+}
+
+func TestDuplicateRegistrationReplace(t *testing.T) {
+	dealer, _ := newTestDealer()
+	dealer.setDuplicateRegistration(DuplicateRegistrationReplace)
+
+	callee1, calleeSess1, rsp := registerTestCallee(t, dealer, nil)
+	regID1 := rsp.(*wamp.Registered).Registration
+
+	// Check that a second callee replaces the first.
+	callee2, calleeSess2, rsp := registerTestCallee(t, dealer, nil)
+	registered, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if registered.Registration == regID1 {
+		t.Fatal("replacement has same registration ID as replaced registration")
+	}
+
+	// Check that the first callee is told that its registration is revoked.
+	select {
+	case rsp = <-callee1.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for UNREGISTERED")
+	}
+	unreg, ok := rsp.(*wamp.Unregistered)
+	if !ok {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	if unreg.Request != 0 {
+		t.Fatal("expected request ID 0, got", unreg.Request)
+	}
+	if id, _ := wamp.AsID(unreg.Details[wamp.OptRegistration]); id != regID1 {
+		t.Fatal("wrong registration in revocation details:", unreg.Details)
+	}
+	if reason, _ := wamp.AsURI(unreg.Details[wamp.OptReason]); reason != wamp.ErrRegistrationReplaced {
+		t.Fatal("wrong reason in revocation details:", unreg.Details)
+	}
+
+	if callTestProcedure(t, dealer, 1, callee1, callee2) != 1 {
+		t.Fatal("call invoked replaced callee")
+	}
+
+	if _, ok = dealer.calleeRegIDSet[calleeSess1]; ok {
+		t.Fatal("replaced callee still has registrations")
+	}
+	if _, ok = dealer.calleeRegIDSet[calleeSess2][registered.Registration]; !ok {
+		t.Fatal("replacement callee missing registration")
+	}
+	if _, ok = dealer.registrations[regID1]; ok {
+		t.Fatal("replaced registration was not deleted")
+	}
+
+	// Check that a shared registration is only replaced by a registration
+	// that does not share it using the same policy.
+	shared := wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin}
+	callee3, _, rsp := registerTestCallee(t, dealer, shared)
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if rsp = <-callee2.Recv(); rsp.MessageType() != wamp.UNREGISTERED {
+		t.Fatal("expected UNREGISTERED, got:", rsp.MessageType())
+	}
+	_, _, rsp = registerTestCallee(t, dealer, shared)
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	select {
+	case rsp = <-callee3.Recv():
+		t.Fatal("shared registration was revoked, got", rsp.MessageType())
+	default:
+	}
+}
+
+func TestDuplicateRegistrationShared(t *testing.T) {
+	dealer, _ := newTestDealer()
+	dealer.setDuplicateRegistration(DuplicateRegistrationShared)
+
+	callee1, _, rsp := registerTestCallee(t, dealer, nil)
+	regID := rsp.(*wamp.Registered).Registration
+	callee2, _, rsp := registerTestCallee(t, dealer,
+		wamp.Dict{wamp.OptInvoke: wamp.InvokeSingle})
+	registered, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("expected REGISTERED, got:", rsp.MessageType())
+	}
+	if registered.Registration != regID {
+		t.Fatal("expected callee to be added to existing registration")
+	}
+
+	// Check that calls are shared between the callees.
+	if callTestProcedure(t, dealer, 1, callee1, callee2) != 0 {
+		t.Fatal("expected first call to invoke first callee")
+	}
+	if callTestProcedure(t, dealer, 2, callee1, callee2) != 1 {
+		t.Fatal("expected second call to invoke second callee")
+	}
+
+	// Check that a registration with a different sharing policy is rejected.
+	_, _, rsp = registerTestCallee(t, dealer,
+		wamp.Dict{wamp.OptInvoke: wamp.InvokeRandom})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("expected procedure_already_exists ERROR, got:", rsp)
+	}
+}
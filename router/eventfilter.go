@@ -0,0 +1,346 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// maxFilterLen is the maximum length of a subscription filter expression.
+const maxFilterLen = 1024
+
+// eventFilter is a predicate, given by a subscriber in the "filter" option of
+// SUBSCRIBE, that the keyword arguments of an event must satisfy for the event
+// to be sent to the subscriber.
+//
+// The filter expression language is intentionally tiny, and has no function
+// calls or other side effects.  An expression compares a keyword argument with
+// a literal value, and comparisons can be combined using &&, ||, !, and
+// parentheses.  For example:
+//
+//	severity >= 3 && (source == "db" || host.name != 'test')
+//
+// Keyword argument names may use dots to select values in nested dictionaries,
+// as with host.name above.  Literals are numbers, strings in single or double
+// quotes, true, and false.  The comparison operators are ==, !=, <, <=, >, and
+// >=.  Numbers and strings can be compared using any operator, and bools using
+// == and !=.  A comparison is false if the keyword argument does not exist or
+// is not the same type as the literal.
+type eventFilter interface {
+	match(kwargs wamp.Dict) bool
+}
+
+type andFilter struct{ left, right eventFilter }
+
+func (f *andFilter) match(kwargs wamp.Dict) bool {
+	return f.left.match(kwargs) && f.right.match(kwargs)
+}
+
+type orFilter struct{ left, right eventFilter }
+
+func (f *orFilter) match(kwargs wamp.Dict) bool {
+	return f.left.match(kwargs) || f.right.match(kwargs)
+}
+
+type notFilter struct{ expr eventFilter }
+
+func (f *notFilter) match(kwargs wamp.Dict) bool { return !f.expr.match(kwargs) }
+
+// cmpFilter compares the keyword argument at path with a literal value, which
+// is a float64, string, or bool.
+type cmpFilter struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (f *cmpFilter) match(kwargs wamp.Dict) bool {
+	var v interface{} = kwargs
+	for _, name := range f.path {
+		d, ok := wamp.AsDict(v)
+		if !ok {
+			return false
+		}
+		if v, ok = d[name]; !ok {
+			return false
+		}
+	}
+
+	var cmp int
+	switch lit := f.value.(type) {
+	case float64:
+		n, ok := wamp.AsFloat64(v)
+		if !ok {
+			return false
+		}
+		if n < lit {
+			cmp = -1
+		} else if n > lit {
+			cmp = 1
+		}
+	case string:
+		s, ok := wamp.AsString(v)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(s, lit)
+	case bool:
+		b, ok := wamp.AsBool(v)
+		if !ok {
+			return false
+		}
+		if b != lit {
+			cmp = 1
+		}
+	}
+
+	switch f.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Kinds of filter expression tokens.
+const (
+	tokEOF = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// isOp returns true if the token is the operator op.  A string literal with
+// the same text is not an operator.
+func (t filterToken) isOp(op string) bool {
+	return t.kind == tokOp && t.text == op
+}
+
+// filterParser is a recursive descent parser for filter expressions.
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+// parseEventFilter parses a filter expression, and returns an error if the
+// expression is not valid.
+func parseEventFilter(expr string) (eventFilter, error) {
+	if len(expr) > maxFilterLen {
+		return nil, fmt.Errorf("filter longer than %d characters", maxFilterLen)
+	}
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return f, nil
+}
+
+func (p *filterParser) peek() filterToken { return p.tokens[p.next] }
+
+func (p *filterParser) take() filterToken {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+// parseOr parses: and { "||" and }
+func (p *filterParser) parseOr() (eventFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isOp("||") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orFilter{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { "&&" unary }
+func (p *filterParser) parseAnd() (eventFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isOp("&&") {
+		p.take()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andFilter{left, right}
+	}
+	return left, nil
+}
+
+// parseUnary parses: "!" unary | "(" or ")" | comparison
+func (p *filterParser) parseUnary() (eventFilter, error) {
+	tok := p.peek()
+	if tok.kind == tokOp {
+		switch tok.text {
+		case "!":
+			p.take()
+			expr, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &notFilter{expr}, nil
+		case "(":
+			p.take()
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if tok = p.take(); !tok.isOp(")") {
+				return nil, fmt.Errorf("missing ) at position %d", tok.pos)
+			}
+			return expr, nil
+		}
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses: ident op literal
+func (p *filterParser) parseComparison() (eventFilter, error) {
+	tok := p.take()
+	if tok.kind != tokIdent || tok.text == "true" || tok.text == "false" {
+		return nil, fmt.Errorf("expected name at position %d", tok.pos)
+	}
+	path := strings.Split(tok.text, ".")
+	for i := range path {
+		if path[i] == "" {
+			return nil, fmt.Errorf("invalid name %q at position %d", tok.text, tok.pos)
+		}
+	}
+
+	tok = p.take()
+	op := tok.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected comparison operator at position %d", tok.pos)
+	}
+	if tok.kind != tokOp {
+		return nil, fmt.Errorf("expected comparison operator at position %d", tok.pos)
+	}
+
+	tok = p.take()
+	var value interface{}
+	switch tok.kind {
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		value = n
+	case tokString:
+		value = tok.text
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		default:
+			return nil, fmt.Errorf("expected value at position %d", tok.pos)
+		}
+		if op != "==" && op != "!=" {
+			return nil, fmt.Errorf("invalid operator %s for bool at position %d", op, tok.pos)
+		}
+	default:
+		return nil, fmt.Errorf("expected value at position %d", tok.pos)
+	}
+	return &cmpFilter{path: path, op: op, value: value}, nil
+}
+
+// tokenizeFilter splits a filter expression into tokens.  The last token is
+// always tokEOF.
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && (isIdentStart(expr[i]) || isDigit(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokIdent, expr[start:i], start})
+		case isDigit(c) || (c == '-' && i+1 < len(expr) && isDigit(expr[i+1])):
+			start := i
+			i++
+			for i < len(expr) && (isDigit(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokNumber, expr[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			end := strings.IndexByte(expr[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i += end + 2
+			tokens = append(tokens, filterToken{tokString, expr[start+1 : i-1], start})
+		default:
+			op := expr[i : i+1]
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!", "(", ")":
+			default:
+				return nil, fmt.Errorf("unexpected %q at position %d", op, i)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	return append(tokens, filterToken{tokEOF, "end of filter", len(expr)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func TestEventFilterMatch(t *testing.T) {
+	kwargs := wamp.Dict{
+		"severity": 3,
+		"source":   "db",
+		"urgent":   true,
+		"ratio":    0.5,
+		"host":     wamp.Dict{"name": "web1", "port": uint16(8080)},
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"severity >= 3", true},
+		{"severity > 3", false},
+		{"severity == 3", true},
+		{"severity != 3", false},
+		{"severity < 4 && severity <= 3", true},
+		{"ratio < 1", true},
+		{"ratio == -0.5", false},
+		{"source == 'db'", true},
+		{`source == "db"`, true},
+		{"source != 'db'", false},
+		{"source < 'e'", true},
+		{"urgent == true", true},
+		{"urgent != false", true},
+		{"host.name == 'web1'", true},
+		{"host.port >= 8000", true},
+		{"host.missing == 1", false},
+		{"missing == 1", false},
+		{"missing != 1", false},
+		{"!(missing == 1)", true},
+		{"source == 3", false},
+		{"severity == 'db'", false},
+		{"severity > 5 || source == 'db'", true},
+		{"severity > 5 || source == 'web'", false},
+		{"(severity > 5 || source == 'db') && !urgent == true", false},
+		{"severity>=3&&source=='db'", true},
+	}
+	for _, tc := range tests {
+		f, err := parseEventFilter(tc.expr)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", tc.expr, err)
+			continue
+		}
+		if f.match(kwargs) != tc.match {
+			t.Errorf("filter %q should match %v", tc.expr, tc.match)
+		}
+	}
+
+	// Check that an event without kwargs does not match a comparison.
+	f, err := parseEventFilter("severity >= 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.match(nil) {
+		t.Error("filter should not match event without kwargs")
+	}
+}
+
+func TestEventFilterInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"   ",
+		"severity",
+		"severity >=",
+		"severity => 3",
+		"severity = 3",
+		"3 == severity",
+		"severity == other",
+		"urgent > true",
+		"source == 'db",
+		"(severity == 3",
+		"severity == 3)",
+		"severity == 3 &&",
+		"severity == 3 & source == 'db'",
+		"len(source) > 3",
+		"host..name == 1",
+		"true == true",
+		"severity == 1.2.3",
+		// Quoted operator text is a string, not an operator.
+		`severity == 1 "||" source == 'db'`,
+		`severity == 1 '&&' source == 'db'`,
+		`(severity == 1 ")"`,
+		`severity "==" 1`,
+	}
+	for _, expr := range invalid {
+		if _, err := parseEventFilter(expr); err == nil {
+			t.Errorf("expected error parsing %q", expr)
+		}
+	}
+
+	long := make([]byte, maxFilterLen+1)
+	for i := range long {
+		long[i] = '('
+	}
+	if _, err := parseEventFilter(string(long)); err == nil {
+		t.Error("expected error for filter that is too long")
+	}
+}
@@ -0,0 +1,111 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// disabled returns the names of the features that are disabled.
+func (f *Features) disabled() []string {
+	var names []string
+	for _, feature := range []struct {
+		off  bool
+		name string
+	}{
+		{f.DisableCallCanceling, wamp.FeatureCallCanceling},
+		{f.DisableCallTimeout, wamp.FeatureCallTimeout},
+		{f.DisableProgressiveCallResults, wamp.FeatureProgCallResults},
+		{f.DisableProgressiveCallInvocations, wamp.FeatureProgCallInvocations},
+		{f.DisablePatternBasedRegistration, wamp.FeaturePatternBasedReg},
+		{f.DisableSharedRegistration, wamp.FeatureSharedReg},
+		{f.DisablePatternBasedSubscription, wamp.FeaturePatternSub},
+		{f.DisableEventRetention, wamp.FeatureEventRetention},
+	} {
+		if feature.off {
+			names = append(names, feature.name)
+		}
+	}
+	return names
+}
+
+// filterRole returns the role, without the features that are disabled.  If
+// no features are disabled, then the role is returned unchanged.
+func (f *Features) filterRole(role wamp.Dict) wamp.Dict {
+	disabled := f.disabled()
+	if len(disabled) == 0 {
+		return role
+	}
+	features := wamp.Dict{}
+	for name, v := range wamp.DictChild(role, "features") {
+		features[name] = v
+	}
+	for _, name := range disabled {
+		delete(features, name)
+	}
+	filtered := wamp.Dict{}
+	for k, v := range role {
+		filtered[k] = v
+	}
+	filtered["features"] = features
+	return filtered
+}
+
+// featureError returns an ERROR for the message if the message uses a feature
+// that is disabled, or nil if it does not.
+func (f *Features) featureError(msg wamp.Message) *wamp.Error {
+	var feature string
+	var reqID wamp.ID
+	switch msg := msg.(type) {
+	case *wamp.Publish:
+		reqID = msg.Request
+		if retain, _ := msg.Options[wamp.OptRetain].(bool); retain && f.DisableEventRetention {
+			feature = wamp.FeatureEventRetention
+		}
+	case *wamp.Subscribe:
+		reqID = msg.Request
+		match, _ := wamp.AsString(msg.Options[wamp.OptMatch])
+		getRetained, _ := msg.Options[wamp.OptGetRetained].(bool)
+		if match != "" && match != wamp.MatchExact && f.DisablePatternBasedSubscription {
+			feature = wamp.FeaturePatternSub
+		} else if getRetained && f.DisableEventRetention {
+			feature = wamp.FeatureEventRetention
+		}
+	case *wamp.Register:
+		reqID = msg.Request
+		match, _ := wamp.AsString(msg.Options[wamp.OptMatch])
+		invoke, _ := wamp.AsString(msg.Options[wamp.OptInvoke])
+		if match != "" && match != wamp.MatchExact && f.DisablePatternBasedRegistration {
+			feature = wamp.FeaturePatternBasedReg
+		} else if invoke != "" && invoke != wamp.InvokeSingle && f.DisableSharedRegistration {
+			feature = wamp.FeatureSharedReg
+		}
+	case *wamp.Call:
+		reqID = msg.Request
+		timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+		receiveProgress, _ := msg.Options[wamp.OptReceiveProgress].(bool)
+		progress, _ := msg.Options[wamp.OptProgress].(bool)
+		if timeout > 0 && f.DisableCallTimeout {
+			feature = wamp.FeatureCallTimeout
+		} else if receiveProgress && f.DisableProgressiveCallResults {
+			feature = wamp.FeatureProgCallResults
+		} else if progress && f.DisableProgressiveCallInvocations {
+			feature = wamp.FeatureProgCallInvocations
+		}
+	case *wamp.Cancel:
+		reqID = msg.Request
+		if f.DisableCallCanceling {
+			feature = wamp.FeatureCallCanceling
+		}
+	}
+	if feature == "" {
+		return nil
+	}
+	return &wamp.Error{
+		Type:      msg.MessageType(),
+		Request:   reqID,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrFeatureNotSupported,
+		Arguments: wamp.List{fmt.Sprint(feature, " is disabled")},
+	}
+}
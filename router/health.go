@@ -0,0 +1,55 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Health status values reported by HealthHandler.
+const (
+	HealthOK      = "ok"
+	HealthClosing = "closing"
+)
+
+// healthStatus is the JSON body of a HealthHandler response.
+type healthStatus struct {
+	Status        string  `json:"status"`
+	Realms        int32   `json:"realms"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// HealthHandler returns an http.Handler that reports whether the router is
+// accepting clients, for use as a liveness or readiness endpoint.  The
+// handler responds with status 200 while the router is running, and with
+// status 503 once the router has started closing.  The response body is a JSON
+// object with the status, the number of realms, and the router's uptime.
+//
+// The handler can be served on the same http.ServeMux as a WebsocketServer:
+//
+//	mux.Handle("/ws", wsServer)
+//	mux.Handle("/healthz", router.HealthHandler(r))
+//
+// If the Router was not created by NewRouter, then the handler always
+// responds with status 200 and only reports the status.
+func HealthHandler(r Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := healthStatus{Status: HealthOK}
+		if rtr, ok := r.(*router); ok {
+			if atomic.LoadInt32(&rtr.closing) != 0 {
+				status.Status = HealthClosing
+			}
+			status.Realms = atomic.LoadInt32(&rtr.numRealms)
+			status.UptimeSeconds = rtr.clock.Now().Sub(rtr.started).Seconds()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Status != HealthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if req.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(&status)
+		}
+	})
+}
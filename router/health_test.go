@@ -0,0 +1,83 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+)
+
+func TestHealthHandler(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		GoodbyeTimeout: 500 * time.Millisecond,
+		Debug:          debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := HealthHandler(r)
+
+	getHealth := func() (int, healthStatus) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var status healthStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal("cannot decode health status:", err)
+		}
+		return rec.Code, status
+	}
+
+	code, status := getHealth()
+	if code != http.StatusOK {
+		t.Fatal("expected status 200, got", code)
+	}
+	if status.Status != HealthOK {
+		t.Fatal("expected status ok, got", status.Status)
+	}
+	if status.Realms != 1 {
+		t.Fatal("expected 1 realm, got", status.Realms)
+	}
+
+	// Attach a client that does not reply to GOODBYE, so that closing the
+	// router waits for the goodbye timeout.
+	if _, err = testClient(r); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+
+	// Check that the status is 503 while the router is closing.
+	for code == http.StatusOK {
+		select {
+		case <-closed:
+			t.Fatal("status did not change while router was closing")
+		case <-time.After(10 * time.Millisecond):
+		}
+		code, status = getHealth()
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("expected status 503, got", code)
+	}
+	if status.Status != HealthClosing {
+		t.Fatal("expected status closing, got", status.Status)
+	}
+
+	<-closed
+	if code, _ = getHealth(); code != http.StatusServiceUnavailable {
+		t.Fatal("expected status 503 after close, got", code)
+	}
+}
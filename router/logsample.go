@@ -0,0 +1,91 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/v3/stdlog"
+)
+
+// samplingLogger is a logger that coalesces identical log messages, so that a
+// flood of repeated messages does not flood the log.  The first occurrence of
+// a message is logged, and repeats of the message within the sampling window
+// are counted instead of logged.  The number of repeats is logged when the
+// window ends and the message is logged again, or when the window ends and
+// the logger is next used.
+type samplingLogger struct {
+	log    stdlog.StdLog
+	window time.Duration
+	clock  Clock
+
+	mutex     sync.Mutex
+	samples   map[string]*logSample
+	lastPrune time.Time
+}
+
+// logSample tracks the repeats of a message within a sampling window.
+type logSample struct {
+	start   time.Time
+	repeats int
+}
+
+func newSamplingLogger(logger stdlog.StdLog, window time.Duration, clock Clock) *samplingLogger {
+	return &samplingLogger{
+		log:       logger,
+		window:    window,
+		clock:     clock,
+		samples:   map[string]*logSample{},
+		lastPrune: clock.Now(),
+	}
+}
+
+func (l *samplingLogger) Print(v ...interface{}) {
+	l.sample(fmt.Sprint(v...))
+}
+
+func (l *samplingLogger) Println(v ...interface{}) {
+	l.sample(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l *samplingLogger) Printf(format string, v ...interface{}) {
+	l.sample(fmt.Sprintf(format, v...))
+}
+
+// sample logs the message, unless the message is a repeat within the sampling
+// window.
+func (l *samplingLogger) sample(msg string) {
+	now := l.clock.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s, ok := l.samples[msg]; ok && now.Sub(s.start) < l.window {
+		s.repeats++
+		return
+	}
+
+	// Once per window, remove the samples whose window has ended, and log
+	// the number of times each was repeated.
+	if now.Sub(l.lastPrune) >= l.window {
+		for m, s := range l.samples {
+			if now.Sub(s.start) >= l.window {
+				l.logRepeats(m, s)
+				delete(l.samples, m)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	if s, ok := l.samples[msg]; ok {
+		l.logRepeats(msg, s)
+	}
+	l.samples[msg] = &logSample{start: now}
+	l.log.Println(msg)
+}
+
+func (l *samplingLogger) logRepeats(msg string, s *logSample) {
+	if s.repeats != 0 {
+		l.log.Printf("Suppressed %d repeats of: %s", s.repeats, msg)
+	}
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// captureLogger records the lines that are logged.
+type captureLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Print(v ...interface{}) { l.add(fmt.Sprint(v...)) }
+
+func (l *captureLogger) Println(v ...interface{}) { l.add(fmt.Sprintln(v...)) }
+
+func (l *captureLogger) Printf(format string, v ...interface{}) {
+	l.add(fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) add(line string) {
+	l.mutex.Lock()
+	l.lines = append(l.lines, strings.TrimSuffix(line, "\n"))
+	l.mutex.Unlock()
+}
+
+// count returns the number of lines that start with the prefix.
+func (l *captureLogger) count(prefix string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var n int
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogSampling(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	clock := newFakeClock()
+	capture := &captureLogger{}
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:                  testRealm,
+				AnonymousAuth:        true,
+				UnknownMessagePolicy: UnknownMessageIgnore,
+			},
+		},
+		LogSampleWindow: time.Minute,
+		Clock:           clock,
+	}, capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sends unknown messages, each of which is logged by the router, and
+	// then waits for the router to handle them.
+	sendUnknown := func(n int) {
+		for i := 0; i < n; i++ {
+			cli.Send(&unknownMessage{Request: 55})
+		}
+		cli.Send(&wamp.Call{Request: 56, Procedure: "nexus.test.none"})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for ERROR")
+		}
+		if _, ok := msg.(*wamp.Error); !ok {
+			t.Fatal("expected ERROR, got:", msg.MessageType())
+		}
+	}
+
+	const logged = "Ignoring unexpected"
+	sendUnknown(1000)
+	if n := capture.count(logged); n != 1 {
+		t.Fatal("expected 1 log line for repeated message, got", n)
+	}
+	if n := capture.count("Suppressed"); n != 0 {
+		t.Fatal("repeats logged before window ended")
+	}
+
+	// Check that the message is logged again after the window, along with
+	// the number of repeats.
+	clock.Advance(time.Minute)
+	sendUnknown(1)
+	if n := capture.count(logged); n != 2 {
+		t.Fatal("expected 2 log lines after window, got", n)
+	}
+	if n := capture.count("Suppressed 999 repeats of: " + logged); n != 1 {
+		t.Fatal("number of repeats not logged")
+	}
+}
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// rateKey identifies the token bucket for a session, or for a session and
+// topic when rate limiting per topic.
+type rateKey struct {
+	sess  *wamp.Session
+	topic wamp.URI
+}
+
+// tokenBucket holds the tokens available to spend on publications.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate at which each session may publish, using a
+// token bucket for each session, or for each session and topic.  Checking the
+// rate limit never blocks; a publication is either allowed or not.
+type rateLimiter struct {
+	rate     float64
+	burst    float64
+	perTopic bool
+	clock    Clock
+
+	mutex   sync.Mutex
+	buckets map[rateKey]*tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter that allows rate publications per
+// second, with bursts of up to burst publications.  If burst is less than 1,
+// then a burst of one second of publications is allowed.  Returns nil if rate
+// is not positive, meaning no rate limit.  If clock is nil, then the system
+// clock is used.
+func newRateLimiter(rate float64, burst int, perTopic bool, clock Clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst < 1 {
+		b = rate
+		if b < 1 {
+			b = 1
+		}
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &rateLimiter{
+		rate:     rate,
+		burst:    b,
+		perTopic: perTopic,
+		clock:    clock,
+		buckets:  map[rateKey]*tokenBucket{},
+	}
+}
+
+// allow returns true if the session may publish to the topic now, and uses a
+// token if so.
+func (l *rateLimiter) allow(sess *wamp.Session, topic wamp.URI) bool {
+	key := rateKey{sess: sess}
+	if l.perTopic {
+		key.topic = topic
+	}
+	now := l.clock.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tb, ok := l.buckets[key]
+	if !ok {
+		tb = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = tb
+	} else {
+		// Add the tokens accumulated since the last publication.
+		tb.tokens += now.Sub(tb.last).Seconds() * l.rate
+		if tb.tokens > l.burst {
+			tb.tokens = l.burst
+		}
+		tb.last = now
+	}
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// removeSession removes the token buckets for the session.
+func (l *rateLimiter) removeSession(sess *wamp.Session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.perTopic {
+		delete(l.buckets, rateKey{sess: sess})
+		return
+	}
+	for key := range l.buckets {
+		if key.sess == sess {
+			delete(l.buckets, key)
+		}
+	}
+}
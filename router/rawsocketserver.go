@@ -8,12 +8,17 @@ import (
 	"time"
 
 	"github.com/gammazero/nexus/v3/transport"
+	"github.com/gammazero/nexus/v3/wamp"
 )
 
 // RawSocketServer handles socket connections.
 type RawSocketServer struct {
 	// RecvLimit is the maximum length of messages the server is willing to
-	// receive.  Defaults to maximum allowed for protocol: 16M.
+	// receive.  Defaults to maximum allowed for protocol: 16M.  The limit is
+	// rounded up to a power of 2 and announced in the rawsocket handshake.
+	// Messages sent to a client are limited to the smaller of this limit and
+	// the client's limit.  A client that sends a message larger than this
+	// limit is disconnected.
 	RecvLimit int
 
 	// KeepAlive is the TCP keep-alive period.  Default is disable keep-alive.
@@ -23,6 +28,21 @@ type RawSocketServer struct {
 	// client.  The default is defaultOutQueueSize.
 	OutQueueSize int
 
+	// HandshakeTimeout is the maximum time allowed for a client to complete
+	// the rawsocket handshake, and then to open a WAMP session by sending
+	// HELLO and completing authentication.  A client that does not finish
+	// within this time is disconnected.  This protects against clients that
+	// open connections and then never send anything.  The default is
+	// defaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// PostListen, if not nil, is called by the ListenAndServe methods after
+	// the listener is created and before serving any connections.  This
+	// allows a process that starts as root, to bind a privileged port, to
+	// then drop privileges or chroot.  If PostListen returns an error, then
+	// the listener is closed and the error is returned.
+	PostListen func() error
+
 	router Router
 }
 
@@ -40,6 +60,9 @@ func (s *RawSocketServer) ListenAndServe(network, address string) (io.Closer, er
 	if err != nil {
 		return nil, err
 	}
+	if err = postListen(l, s.PostListen); err != nil {
+		return nil, err
+	}
 
 	// Start request handler loop.
 	go s.requestHandler(l)
@@ -72,6 +95,9 @@ func (s *RawSocketServer) ListenAndServeTLS(network, address string, tlscfg *tls
 	if err != nil {
 		return nil, err
 	}
+	if err = postListen(l, s.PostListen); err != nil {
+		return nil, err
+	}
 
 	// Start request handler loop.
 	go s.requestHandler(l)
@@ -79,6 +105,27 @@ func (s *RawSocketServer) ListenAndServeTLS(network, address string, tlscfg *tls
 	return l, nil
 }
 
+// postListen calls the PostListen hook, if there is one, and closes the
+// listener if the hook returns an error.
+func postListen(l net.Listener, hook func() error) error {
+	if hook == nil {
+		return nil
+	}
+	if err := hook(); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+// Serve accepts client connections on the listener until the listener is
+// closed.  This allows serving clients on a listener created by the caller,
+// such as a unix socket with specific file permissions.  Serve blocks until
+// the listener is closed, so is usually run as a goroutine.
+func (s *RawSocketServer) Serve(l net.Listener) {
+	s.requestHandler(l)
+}
+
 func (s *RawSocketServer) requestHandler(l net.Listener) {
 	for {
 		conn, err := l.Accept()
@@ -107,13 +154,28 @@ func (s *RawSocketServer) handleRawSocket(conn net.Conn) {
 	if qsize == 0 {
 		qsize = defaultOutQueueSize
 	}
+	// Disconnect the client if it does not open a session in time.
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
 	peer, err := transport.AcceptRawSocket(conn, s.router.Logger(), s.RecvLimit, qsize)
 	if err != nil {
 		s.router.Logger().Println("Error accepting rawsocket client:", err)
 		return
 	}
 
-	if err := s.router.Attach(peer); err != nil {
+	_, isTLS := conn.(*tls.Conn)
+	transportDetails := wamp.Dict{
+		"type":      "rawsocket",
+		"peer":      conn.RemoteAddr().String(),
+		"is_secure": isTLS,
+	}
+	if err := s.router.AttachClient(peer, transportDetails); err != nil {
 		s.router.Logger().Println("Error attaching to router:", err)
+		return
 	}
+	conn.SetDeadline(time.Time{})
 }
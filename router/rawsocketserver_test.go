@@ -2,9 +2,14 @@ package router
 
 import (
 	"context"
+	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/v3/router/auth"
 	"github.com/gammazero/nexus/v3/transport"
 	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
@@ -75,3 +80,287 @@ func TestRSHandshakeMsgpack(t *testing.T) {
 	}
 	client.Close()
 }
+
+// acceptAuthenticator accepts every client that asks to authenticate with the
+// "testauth" authmethod.
+type acceptAuthenticator struct{}
+
+func (a *acceptAuthenticator) AuthMethod() string { return "testauth" }
+
+func (a *acceptAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	return &wamp.Welcome{Details: wamp.Dict{
+		"authid":       "tester",
+		"authrole":     "user",
+		"authprovider": "static",
+	}}, nil
+}
+
+func TestMethodSelector(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var mu sync.Mutex
+	var infos []TransportInfo
+	config := &Config{
+		RealmConfigs: []*RealmConfig{{
+			URI:              testRealm,
+			AnonymousAuth:    true,
+			RequireLocalAuth: true,
+			Authenticators:   []auth.Authenticator{&acceptAuthenticator{}},
+			// Allow anonymous only for local clients, and require testauth
+			// for remote clients.
+			MethodSelector: func(info TransportInfo) []string {
+				mu.Lock()
+				infos = append(infos, info)
+				mu.Unlock()
+				if info.Local {
+					return []string{"anonymous"}
+				}
+				return []string{"testauth"}
+			},
+		}},
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewRawSocketServer(r).Serve(l)
+
+	hello := func(cli wamp.Peer, authmethods ...string) wamp.Message {
+		details := wamp.Dict{
+			"roles":       clientRoles["roles"],
+			"authmethods": authmethods,
+		}
+		cli.Send(&wamp.Hello{Realm: testRealm, Details: details})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("no reply to HELLO:", err)
+		}
+		return msg
+	}
+	checkWelcome := func(msg wamp.Message, authmethod string) {
+		welcome, ok := msg.(*wamp.Welcome)
+		if !ok {
+			t.Fatal("expected WELCOME, got", msg.MessageType())
+		}
+		if am, _ := wamp.AsString(welcome.Details["authmethod"]); am != authmethod {
+			t.Fatalf("expected authmethod %q, got %q", authmethod, am)
+		}
+	}
+
+	// A local client is offered anonymous, but not testauth.
+	cli, rtr := transport.LinkedPeers()
+	go r.Attach(rtr)
+	checkWelcome(hello(cli, "testauth", "anonymous"), "anonymous")
+	cli.Close()
+
+	// A remote client is offered testauth, but not anonymous.
+	rcli, err := transport.ConnectRawSocketPeer(context.Background(), "tcp",
+		l.Addr().String(), serialize.JSON, nil, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWelcome(hello(rcli, "anonymous", "testauth"), "testauth")
+	rcli.Close()
+
+	rcli, err = transport.ConnectRawSocketPeer(context.Background(), "tcp",
+		l.Addr().String(), serialize.JSON, nil, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := hello(rcli, "anonymous")
+	rcli.Close()
+	abort, ok := msg.(*wamp.Abort)
+	if !ok {
+		t.Fatal("expected ABORT, got", msg.MessageType())
+	}
+	// Only the methods allowed for the remote client are suggested.
+	suggested, _ := wamp.AsList(abort.Details[wamp.OptSuggestedMethods])
+	if len(suggested) != 1 || suggested[0] != "testauth" {
+		t.Fatal("expected suggested methods [testauth], got", suggested)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(infos) != 4 {
+		t.Fatal("expected 4 calls to MethodSelector, got", len(infos))
+	}
+	if !infos[0].Local || infos[0].Type != "local" || infos[0].RemoteAddr != "" {
+		t.Fatalf("wrong transport info for local client: %+v", infos[0])
+	}
+	for _, info := range infos[1:] {
+		if info.Local || info.Type != "rawsocket" || info.TLS {
+			t.Fatalf("wrong transport info for remote client: %+v", info)
+		}
+		host, _, err := net.SplitHostPort(info.RemoteAddr)
+		if err != nil || host != "127.0.0.1" {
+			t.Fatal("wrong remote address:", info.RemoteAddr)
+		}
+	}
+}
+
+func TestRSPostListenError(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Check that an error from the hook aborts startup and closes the
+	// listener.
+	hookErr := errors.New("cannot drop privileges")
+	s := NewRawSocketServer(r)
+	s.PostListen = func() error { return hookErr }
+	clsr, err := s.ListenAndServe("tcp", tcpAddr)
+	if err != hookErr {
+		if clsr != nil {
+			clsr.Close()
+		}
+		t.Fatal("expected hook error, got:", err)
+	}
+	if conn, err := net.Dial("tcp", tcpAddr); err == nil {
+		conn.Close()
+		t.Fatal("listener was not closed")
+	}
+}
+
+func TestRSHandshakeTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	s := NewRawSocketServer(r)
+	s.HandshakeTimeout = 100 * time.Millisecond
+	clsr, err := s.ListenAndServe("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clsr.Close()
+
+	// Check that a connection that sends nothing is closed.
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 4))
+	if err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("connection was not closed by server")
+	}
+
+	// Check that a client that completes the rawsocket handshake, but does not
+	// send HELLO, is disconnected.
+	client, err := transport.ConnectRawSocketPeer(context.Background(), "tcp",
+		tcpAddr, serialize.JSON, nil, r.Logger(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case _, ok := <-client.Recv():
+		if ok {
+			t.Fatal("expected client to be disconnected")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client without HELLO was not disconnected")
+	}
+}
+
+func TestRealmCIDRs(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           "nexus.test.allowed",
+				AnonymousAuth: true,
+				AllowedCIDRs:  []string{"10.0.0.0/8", "127.0.0.0/8"},
+			},
+			{
+				URI:           "nexus.test.notallowed",
+				AnonymousAuth: true,
+				AllowedCIDRs:  []string{"10.0.0.0/8"},
+			},
+			{
+				URI:           "nexus.test.denied",
+				AnonymousAuth: true,
+				AllowedCIDRs:  []string{"127.0.0.0/8"},
+				DeniedCIDRs:   []string{"127.0.0.1/32"},
+			},
+		},
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewRawSocketServer(r).Serve(l)
+
+	hello := func(realm wamp.URI) wamp.Message {
+		cli, err := transport.ConnectRawSocketPeer(context.Background(), "tcp",
+			l.Addr().String(), serialize.JSON, nil, r.Logger(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Send(&wamp.Hello{Realm: realm, Details: clientRoles})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("no reply to HELLO:", err)
+		}
+		return msg
+	}
+
+	if msg := hello("nexus.test.allowed"); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME from allowed address, got", msg.MessageType())
+	}
+	for _, realm := range []wamp.URI{"nexus.test.notallowed", "nexus.test.denied"} {
+		msg := hello(realm)
+		abort, ok := msg.(*wamp.Abort)
+		if !ok {
+			t.Fatal("expected ABORT for realm", realm, "got", msg.MessageType())
+		}
+		if abort.Reason != wamp.ErrNotAuthorized {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
+		}
+	}
+
+	// Check that local clients are always allowed.
+	cli, err := testClientInRealm(r, "nexus.test.notallowed")
+	if err != nil {
+		t.Fatal("local client not allowed:", err)
+	}
+	cli.Close()
+
+	// Check that an invalid CIDR is rejected.
+	_, err = NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{{
+			URI:          testRealm,
+			AllowedCIDRs: []string{"127.0.0.1"},
+		}},
+	}, logger)
+	if err == nil {
+		t.Fatal("expected error for invalid CIDR")
+	}
+}
@@ -1,10 +1,17 @@
 package router
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"runtime/pprof"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gammazero/nexus/v3/router/auth"
 	"github.com/gammazero/nexus/v3/stdlog"
@@ -33,6 +40,14 @@ type realm struct {
 	broker *broker
 	dealer *dealer
 
+	// config is a copy of the configuration the realm was created with, as
+	// modified by any calls to UpdateConfig.
+	config RealmConfig
+
+	// Guards the realm policy values that can be replaced, by SetAuthorizer or
+	// UpdateConfig, while the realm is running.
+	policyLock sync.RWMutex
+
 	authorizer Authorizer
 
 	// authmethod -> Authenticator
@@ -40,12 +55,14 @@ type realm struct {
 
 	// session ID -> Session
 	clients map[wamp.ID]*wamp.Session
+	// session ID -> time joined
+	joined map[wamp.ID]time.Time
 	// session ID -> testament
 	testaments map[wamp.ID]testamentBucket
 
 	metaPeer  wamp.Peer
 	metaSess  *wamp.Session
-	metaIDGen *wamp.IDGen
+	metaIDGen *wamp.SyncIDGen
 
 	actionChan chan func()
 
@@ -54,22 +71,87 @@ type realm struct {
 
 	// Session meta-procedure registration ID -> handler map.
 	metaProcMap map[wamp.ID]func(*wamp.Invocation) wamp.Message
-	metaDone    chan struct{}
+	// Meta procedure REGISTER request ID -> registration waiting for reply.
+	metaRegPending map[wamp.ID]*metaRegistration
+	// Guards metaProcMap and metaRegPending.
+	metaProcLock sync.Mutex
+	metaDone     chan struct{}
+	// Canceled when the meta session is done, so that meta procedure handlers
+	// do not block sending to it.
+	metaCtx    context.Context
+	metaCancel context.CancelFunc
+	// Used by close() to wait for meta procedure handlers to exit.
+	waitMetaHandlers sync.WaitGroup
 
 	closed    bool
 	closeLock sync.Mutex
 
-	log   stdlog.StdLog
-	debug bool
+	log           stdlog.StdLog
+	debug         bool
+	profileLabels bool
+
+	// Time to wait for a client to reply to a GOODBYE sent by the router.
+	goodbyeTimeout time.Duration
 
-	localAuth  bool
-	localAuthz bool
+	clock Clock
+
+	localAuth      bool
+	localAuthz     bool
+	procFirst      bool
+	methodSelector func(TransportInfo) []string
+	postAuthHook   func(*wamp.Session) error
+	onDeny         func(*wamp.Session, wamp.Message, error)
+	observerRoles  map[string]struct{}
+	defaultRole    string
 
 	metaStrict     bool
 	metaIncDetails []string
 
+	unknownMsgPolicy string
+
+	// Network address ranges that clients may or may not join from.
+	allowedNets []*net.IPNet
+	deniedNets  []*net.IPNet
+
 	enableMetaKill   bool
 	enableMetaModify bool
+
+	// Maximum number of sessions, and the ABORT reason for a session that
+	// exceeds it.
+	maxSessions       int
+	maxSessionsReason wamp.URI
+
+	// Time a session may be idle before it is closed, and whether transport
+	// activity counts as session activity.
+	idleTimeout           time.Duration
+	idleTransportActivity bool
+
+	// Disabled features, and the broker and dealer roles announced to
+	// clients without the disabled features.
+	features   Features
+	brokerRole wamp.Dict
+	dealerRole wamp.Dict
+
+	// Applied to each message sent to a client session.
+	transform func(wamp.Message) wamp.Message
+}
+
+// errRealmFull is returned by handleSession if the realm already has the
+// maximum number of sessions.
+var errRealmFull = errors.New("realm has maximum number of sessions")
+
+// errRealmClosed is returned when using a realm that has been closed.
+var errRealmClosed = errors.New("realm closed")
+
+// errMetaClosed is returned when registering a meta procedure after the meta
+// session of the realm has exited.
+var errMetaClosed = errors.New("realm meta session closed")
+
+// metaRegistration is a meta procedure that is waiting for the dealer to reply
+// to its REGISTER message.
+type metaRegistration struct {
+	handler func(*wamp.Invocation) wamp.Message
+	reply   chan error
 }
 
 var (
@@ -85,26 +167,67 @@ func newRealm(config *RealmConfig, broker *broker, dealer *dealer, logger stdlog
 		return nil, fmt.Errorf(
 			"invalid realm URI %v (URI strict checking %v)", config.URI, config.StrictURI)
 	}
+	switch config.UnknownMessagePolicy {
+	case "", UnknownMessageAbort, UnknownMessageError, UnknownMessageIgnore:
+	default:
+		return nil, fmt.Errorf("invalid unknown message policy: %q",
+			config.UnknownMessagePolicy)
+	}
+	switch config.PublicationIDScheme {
+	case "", PublicationIDRandom, PublicationIDCounter:
+	default:
+		return nil, fmt.Errorf("invalid publication ID scheme: %q",
+			config.PublicationIDScheme)
+	}
+	allowedNets, err := parseCIDRs(config.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	deniedNets, err := parseCIDRs(config.DeniedCIDRs)
+	if err != nil {
+		return nil, err
+	}
 
 	r := &realm{
 		broker:      broker,
 		dealer:      dealer,
-		authorizer:  config.Authorizer,
+		config:      *config,
 		clients:     map[wamp.ID]*wamp.Session{},
+		joined:      map[wamp.ID]time.Time{},
 		testaments:  map[wamp.ID]testamentBucket{},
 		actionChan:  make(chan func()),
-		metaIDGen:   new(wamp.IDGen),
+		metaIDGen:   new(wamp.SyncIDGen),
 		metaDone:    make(chan struct{}),
 		metaProcMap: make(map[wamp.ID]func(*wamp.Invocation) wamp.Message, 9),
 		log:         logger,
 		debug:       debug,
-		localAuth:   config.RequireLocalAuth,
-		localAuthz:  config.RequireLocalAuthz,
-		metaStrict:  config.MetaStrict,
+		clock:       realClock{},
+
+		metaRegPending: map[wamp.ID]*metaRegistration{},
 
 		enableMetaKill:   config.EnableMetaKill,
 		enableMetaModify: config.EnableMetaModify,
+
+		allowedNets: allowedNets,
+		deniedNets:  deniedNets,
+
+		maxSessions:       config.MaxSessions,
+		maxSessionsReason: config.MaxSessionsReason,
+
+		idleTimeout:           config.IdleTimeout,
+		idleTransportActivity: config.IdleTimeoutTransportActivity,
+
+		features:   config.Features,
+		brokerRole: config.Features.filterRole(brokerRole),
+		dealerRole: config.Features.filterRole(dealerRole),
+
+		transform: config.Transform,
+	}
+	if r.maxSessionsReason == "" {
+		r.maxSessionsReason = wamp.ErrQuotaExceeded
 	}
+	r.metaCtx, r.metaCancel = context.WithCancel(context.Background())
+	r.applyPolicy(config)
 
 	if debug {
 		if r.enableMetaKill {
@@ -114,27 +237,180 @@ func newRealm(config *RealmConfig, broker *broker, dealer *dealer, logger stdlog
 			r.log.Println("Session meta modify_details procedure enabled")
 		}
 	}
+	r.authenticators = makeAuthenticators(config)
+
+	return r, nil
+}
+
+// applyPolicy sets the realm policy values from the given config.  Must be
+// called with policyLock held, or before the realm is running.
+func (r *realm) applyPolicy(config *RealmConfig) {
+	r.authorizer = config.Authorizer
+	r.localAuth = config.RequireLocalAuth
+	r.localAuthz = config.RequireLocalAuthz
+	r.procFirst = config.CheckProcedureBeforeAuthz
+	r.methodSelector = config.MethodSelector
+	r.postAuthHook = config.PostAuthHook
+	r.onDeny = config.OnDeny
+	r.observerRoles = nil
+	if len(config.ObserverAuthRoles) != 0 {
+		r.observerRoles = make(map[string]struct{}, len(config.ObserverAuthRoles))
+		for _, role := range config.ObserverAuthRoles {
+			r.observerRoles[role] = struct{}{}
+		}
+	}
+	r.defaultRole = config.DefaultAuthRole
+	r.metaStrict = config.MetaStrict
+	r.unknownMsgPolicy = config.UnknownMessagePolicy
+	r.metaIncDetails = nil
 	if r.metaStrict && len(config.MetaIncludeSessionDetails) != 0 {
 		r.metaIncDetails = make([]string, len(config.MetaIncludeSessionDetails))
 		copy(r.metaIncDetails, config.MetaIncludeSessionDetails)
 	}
+}
 
-	r.authenticators = map[string]auth.Authenticator{}
+// makeAuthenticators creates the authmethod to Authenticator map for the given
+// config.
+func makeAuthenticators(config *RealmConfig) map[string]auth.Authenticator {
+	authenticators := map[string]auth.Authenticator{}
 	for _, auth := range config.Authenticators {
-		r.authenticators[auth.AuthMethod()] = auth
+		authenticators[auth.AuthMethod()] = auth
 	}
 
 	// If allowing anonymous authentication, then install an anonymous
 	// authenticator if one has not already been provided in the config.
 	if config.AnonymousAuth {
-		if _, ok := r.authenticators["anonymous"]; !ok {
-			r.authenticators["anonymous"] = &auth.AnonymousAuth{
-				AuthRole: "anonymous",
+		if _, ok := authenticators["anonymous"]; !ok {
+			authRole := config.DefaultAuthRole
+			if authRole == "" {
+				authRole = "anonymous"
+			}
+			authenticators["anonymous"] = &auth.AnonymousAuth{
+				AuthRole: authRole,
 			}
 		}
 	}
+	return authenticators
+}
 
-	return r, nil
+// SetAuthorizer replaces the realm's Authorizer without affecting any sessions
+// attached to the realm.  Messages that are already being routed finish under
+// the previous Authorizer, and all subsequent messages are authorized by the
+// new Authorizer.  A nil Authorizer disables authorization.
+func (r *realm) SetAuthorizer(authorizer Authorizer) {
+	r.policyLock.Lock()
+	r.authorizer = authorizer
+	r.config.Authorizer = authorizer
+	r.policyLock.Unlock()
+}
+
+// UpdateConfig calls fn with a copy of the realm's current configuration, and
+// then applies the modified configuration to the running realm without
+// affecting any sessions attached to the realm.  Messages that are already
+// being routed finish under the previous configuration, and all subsequent
+// messages use the new configuration.
+//
+// The following configuration items can be updated: Authenticators,
+// Authorizer, AnonymousAuth, DefaultAuthRole, RequireLocalAuth,
+// RequireLocalAuthz, MethodSelector, PostAuthHook, OnDeny, ObserverAuthRoles,
+// MetaStrict, MetaIncludeSessionDetails, and UnknownMessagePolicy.  Changes to
+// any other items are ignored, since these only take effect when the realm is
+// created.  An error is returned if the realm is closed.
+func (r *realm) UpdateConfig(fn func(*RealmConfig)) error {
+	// Call fn without holding any lock, so that fn can call the router.
+	r.policyLock.RLock()
+	config := r.config
+	r.policyLock.RUnlock()
+	fn(&config)
+
+	// The lock is held in mutual exclusion with the closing of the realm, so
+	// that the realm's action channel is not closed while it is used.
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return errRealmClosed
+	}
+
+	r.policyLock.Lock()
+
+	// Restore items that cannot be changed on a running realm.
+	config.URI = r.config.URI
+	config.StrictURI = r.config.StrictURI
+	config.AllowDisclose = r.config.AllowDisclose
+	config.AllowSubscriberCount = r.config.AllowSubscriberCount
+	config.EnableMetaKill = r.config.EnableMetaKill
+	config.EnableMetaModify = r.config.EnableMetaModify
+	config.PublishFilterFactory = r.config.PublishFilterFactory
+	config.EventBatchWindow = r.config.EventBatchWindow
+	config.PublishRateLimit = r.config.PublishRateLimit
+	config.PublishRateBurst = r.config.PublishRateBurst
+	config.PublishRateLimitPerTopic = r.config.PublishRateLimitPerTopic
+	config.MaxSubscribersPerTopic = r.config.MaxSubscribersPerTopic
+	config.PublicationIDScheme = r.config.PublicationIDScheme
+	config.AllowedCIDRs = r.config.AllowedCIDRs
+	config.DeniedCIDRs = r.config.DeniedCIDRs
+	config.MaxSessions = r.config.MaxSessions
+	config.MaxSessionsReason = r.config.MaxSessionsReason
+	config.IdleTimeout = r.config.IdleTimeout
+	config.IdleTimeoutTransportActivity = r.config.IdleTimeoutTransportActivity
+	config.PublishDedupWindow = r.config.PublishDedupWindow
+	config.CallFallbacks = r.config.CallFallbacks
+	config.Features = r.config.Features
+	config.CallFallbackErrors = r.config.CallFallbackErrors
+	config.MaxPendingInvocations = r.config.MaxPendingInvocations
+	config.DuplicateRegistration = r.config.DuplicateRegistration
+	config.Transform = r.config.Transform
+
+	r.config = config
+	r.applyPolicy(&config)
+	r.policyLock.Unlock()
+
+	authenticators := makeAuthenticators(&config)
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		r.authenticators = authenticators
+		close(sync)
+	}
+	<-sync
+	if r.debug {
+		r.log.Println("Updated configuration for realm", config.URI)
+	}
+	return nil
+}
+
+// Sessions returns information about the sessions attached to the realm, not
+// including the realm's meta session.  All of the sessions are read together,
+// so the returned list is a consistent snapshot of the realm's sessions.  An
+// error is returned if the realm is closed.
+func (r *realm) Sessions() ([]wamp.SessionInfo, error) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return nil, errRealmClosed
+	}
+
+	var infos []wamp.SessionInfo
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		infos = make([]wamp.SessionInfo, 0, len(r.clients))
+		for sid, sess := range r.clients {
+			sess.Lock()
+			authid, _ := wamp.AsString(sess.Details["authid"])
+			authrole, _ := wamp.AsString(sess.Details["authrole"])
+			authmethod, _ := wamp.AsString(sess.Details["authmethod"])
+			sess.Unlock()
+			infos = append(infos, wamp.SessionInfo{
+				ID:         sid,
+				AuthID:     authid,
+				AuthRole:   authrole,
+				AuthMethod: authmethod,
+				Joined:     r.joined[sid],
+			})
+		}
+		close(sync)
+	}
+	<-sync
+	return infos, nil
 }
 
 // waitReady waits for the realm to be fully initialized and running.
@@ -203,6 +479,10 @@ func (r *realm) close() {
 	r.metaSess.EndRecv(shutdownGoodbye)
 	<-r.metaDone
 
+	// Stop and wait for any meta procedure handlers still running.
+	r.metaCancel()
+	r.waitMetaHandlers.Wait()
+
 	// handleInboundMessages() and metaProcedureHandler() are the only things
 	// than can submit request to the broker and dealer, so now that these are
 	// finished there can be no more messages to broker and dealer.
@@ -222,6 +502,10 @@ func (r *realm) run() {
 	// Create a local client for publishing meta events.
 	r.createMetaSession()
 
+	// Start handling replies and invocations to the meta session, before
+	// registering meta procedures.
+	go r.metaProcedureHandler()
+
 	// Register to handle session meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionCount, r.sessionCount)
 	r.registerMetaProcedure(wamp.MetaProcSessionList, r.sessionList)
@@ -242,6 +526,7 @@ func (r *realm) run() {
 	r.registerMetaProcedure(wamp.MetaProcRegGet, r.dealer.regGet)
 	r.registerMetaProcedure(wamp.MetaProcRegListCallees, r.dealer.regListCallees)
 	r.registerMetaProcedure(wamp.MetaProcRegCountCallees, r.dealer.regCountCallees)
+	r.registerMetaProcedure(wamp.MetaProcRegCallees, r.dealer.regCallees)
 
 	// Register to handle subscription meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSubList, r.broker.subList)
@@ -250,13 +535,12 @@ func (r *realm) run() {
 	r.registerMetaProcedure(wamp.MetaProcSubGet, r.broker.subGet)
 	r.registerMetaProcedure(wamp.MetaProcSubListSubscribers, r.broker.subListSubscribers)
 	r.registerMetaProcedure(wamp.MetaProcSubCountSubscribers, r.broker.subCountSubscribers)
+	r.registerMetaProcedure(wamp.MetaProcSubCount, r.broker.subCount)
 
 	// Register to handle testament meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionAddTestament, r.testamentAdd)
 	r.registerMetaProcedure(wamp.MetaProcSessionFlushTestaments, r.testamentFlush)
 
-	go r.metaProcedureHandler()
-
 	for action := range r.actionChan {
 		action()
 	}
@@ -285,18 +569,30 @@ func (r *realm) createMetaSession() {
 }
 
 // onJoin is called when a non-meta session joins this realm.  The session is
-// stored in the realm's clients and a meta event is published.
+// stored in the realm's clients and a meta event is published.  Returns
+// errRealmFull, without joining the session, if the realm already has the
+// maximum number of sessions.
 //
 // Note: onJoin() is called from handleSession, not handleInboundMessages, so
 // that it is not called for the meta client.
-func (r *realm) onJoin(sess *wamp.Session) {
+func (r *realm) onJoin(sess *wamp.Session) error {
 	r.waitHandlers.Add(1)
+	var full bool
 	sync := make(chan struct{})
 	r.actionChan <- func() {
-		r.clients[sess.ID] = sess
+		if r.maxSessions > 0 && len(r.clients) >= r.maxSessions {
+			full = true
+		} else {
+			r.clients[sess.ID] = sess
+			r.joined[sess.ID] = r.clock.Now()
+		}
 		close(sync)
 	}
 	<-sync
+	if full {
+		r.waitHandlers.Done()
+		return errRealmFull
+	}
 
 	// Session Meta Events MUST be dispatched by the Router to the same realm
 	// as the WAMP session which triggered the event.
@@ -312,6 +608,7 @@ func (r *realm) onJoin(sess *wamp.Session) {
 		Topic:     wamp.MetaEventSessionOnJoin,
 		Arguments: wamp.List{output},
 	})
+	return nil
 }
 
 // onLeave is called when a non-meta session leaves this realm.  The session is
@@ -333,6 +630,7 @@ func (r *realm) onLeave(sess *wamp.Session, shutdown, killAll bool) {
 	sync := make(chan struct{})
 	r.actionChan <- func() {
 		delete(r.clients, sess.ID)
+		delete(r.joined, sess.ID)
 		testaments, hasTstm = r.testaments[sess.ID]
 		if hasTstm {
 			delete(r.testaments, sess.ID)
@@ -389,26 +687,31 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 	r.closeLock.Lock()
 	if r.closed {
 		r.closeLock.Unlock()
-		err := errors.New("realm closed")
-		return err
+		return errRealmClosed
+	}
+
+	if r.transform != nil {
+		sess.Peer = &transformPeer{Peer: sess.Peer, transform: r.transform}
 	}
 
 	// Ensure session is capable of receiving exit signal before releasing lock
-	r.onJoin(sess)
+	if err := r.onJoin(sess); err != nil {
+		r.closeLock.Unlock()
+		return err
+	}
 	r.closeLock.Unlock()
 
 	if r.debug {
 		r.log.Println("Handling messages for session", sess)
 	}
 	go func() {
+		if r.profileLabels {
+			r.setProfileLabels(sess)
+		}
 		shutdown, killAll, err := r.handleInboundMessages(sess)
 		if err != nil {
-			abortMsg := wamp.Abort{
-				Reason:  wamp.ErrProtocolViolation,
-				Details: wamp.Dict{wamp.OptMessage: err.Error()},
-			}
 			r.log.Println("Aborting session", sess, ":", err)
-			sess.TrySend(&abortMsg)
+			sess.TrySend(newAbort(wamp.ErrProtocolViolation, err.Error(), nil))
 		}
 		r.onLeave(sess, shutdown, killAll)
 		sess.Close()
@@ -417,6 +720,65 @@ func (r *realm) handleSession(sess *wamp.Session) error {
 	return nil
 }
 
+// waitGoodbyeReply waits for the client to reply to the GOODBYE sent by the
+// router, discarding any other messages from the client.  Returns when the
+// reply is received, when the client disconnects, or when the goodbye timeout
+// expires, after which the caller closes the client's transport.
+func (r *realm) waitGoodbyeReply(sess *wamp.Session) {
+	if r.goodbyeTimeout == 0 || sess == r.metaSess {
+		return
+	}
+	timer := r.clock.NewTimer(r.goodbyeTimeout)
+	defer timer.Stop()
+	recv := sess.Recv()
+	for {
+		select {
+		case msg, open := <-recv:
+			if !open {
+				return
+			}
+			if _, ok := msg.(*wamp.Goodbye); ok {
+				return
+			}
+		case <-timer.C():
+			r.log.Println("Timed out waiting for GOODBYE reply from", sess)
+			return
+		}
+	}
+}
+
+// lastActivity returns the time of the session's last activity, given the time
+// of the last message received from the session.  If transport activity
+// counts as session activity, then the later of that time and the time the
+// transport last received anything is returned.
+func (r *realm) lastActivity(sess *wamp.Session, lastMsg time.Time) time.Time {
+	if !r.idleTransportActivity {
+		return lastMsg
+	}
+	peer := sess.Peer
+	if tp, ok := peer.(*transformPeer); ok {
+		peer = tp.Peer
+	}
+	if at, ok := peer.(transport.ActivityTracker); ok {
+		if lastRecv := at.LastRecv(); lastRecv.After(lastMsg) {
+			return lastRecv
+		}
+	}
+	return lastMsg
+}
+
+// setProfileLabels sets pprof labels, identifying the realm and session, on
+// the calling goroutine.
+func (r *realm) setProfileLabels(sess *wamp.Session) {
+	r.policyLock.RLock()
+	uri := r.config.URI
+	r.policyLock.RUnlock()
+	labels := pprof.Labels(
+		"realm", string(uri),
+		"session", strconv.FormatUint(uint64(sess.ID), 10))
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+}
+
 // handleInboundMessages handles the messages sent from a client session to
 // the router.
 func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
@@ -425,6 +787,20 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 	}
 	recv := sess.Recv()
 	recvDone := sess.RecvDone()
+
+	// If the realm has an idle timeout, then the idle timer fires when the
+	// session may have been idle for the timeout.  The time of the last
+	// message is recorded, instead of resetting the timer for each message.
+	var idleTimer Timer
+	var idleC <-chan time.Time
+	var lastActive time.Time
+	if r.idleTimeout > 0 && sess != r.metaSess {
+		idleTimer = r.clock.NewTimer(r.idleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C()
+		lastActive = r.clock.Now()
+	}
+
 	for {
 		var msg wamp.Message
 		var open bool
@@ -434,6 +810,21 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 				r.log.Println("Lost", sess)
 				return false, false, nil
 			}
+			if idleC != nil {
+				lastActive = r.clock.Now()
+			}
+		case <-idleC:
+			idle := r.clock.Now().Sub(r.lastActivity(sess, lastActive))
+			if idle < r.idleTimeout {
+				idleTimer.Reset(r.idleTimeout - idle)
+				continue
+			}
+			r.log.Printf("Closing session %s: idle for %s", sess, idle)
+			// Stop checking, and close the session the same as when it is
+			// killed.
+			idleC = nil
+			sess.EndRecv(makeGoodbye(wamp.CloseTimeout, "session idle"))
+			continue
 		case <-recvDone:
 			goodbye := sess.Goodbye()
 			switch goodbye {
@@ -442,6 +833,7 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 					r.log.Printf("Stop session %s: system shutdown", sess)
 				}
 				sess.TrySend(goodbye)
+				r.waitGoodbyeReply(sess)
 				return true, false, nil
 			}
 			if r.debug {
@@ -452,6 +844,7 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 				killAll = true
 			}
 			sess.TrySend(goodbye)
+			r.waitGoodbyeReply(sess)
 			return false, killAll, nil
 		}
 
@@ -460,12 +853,29 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 				msg.MessageType(), msg)
 		}
 
+		if sess != r.metaSess && r.noSuchProcedure(sess, msg) {
+			// Procedure not registered; error response sent.
+			continue
+		}
+
 		// Note: meta session is always authorized
-		if r.authorizer != nil && sess != r.metaSess && !r.authzMessage(sess, msg) {
+		if sess != r.metaSess && !r.authzMessage(sess, msg) {
 			// Not authorized; error response sent; do not process message.
 			continue
 		}
 
+		if errMsg := r.features.featureError(msg); errMsg != nil && sess != r.metaSess {
+			if pub, ok := msg.(*wamp.Publish); ok {
+				if ack, _ := pub.Options[wamp.OptAcknowledge].(bool); !ack {
+					r.log.Printf("Dropped publication from %s: %s", sess,
+						errMsg.Arguments[0])
+					continue
+				}
+			}
+			sess.TrySend(errMsg)
+			continue
+		}
+
 		switch msg := msg.(type) {
 		case *wamp.Publish:
 			r.broker.publish(sess, msg)
@@ -507,18 +917,79 @@ func (r *realm) handleInboundMessages(sess *wamp.Session) (bool, bool, error) {
 
 		default:
 			// Received unrecognized message type.
-			return false, false, fmt.Errorf("unexpected %v", msg.MessageType())
+			if !r.handleUnknownMessage(sess, msg) {
+				return false, false, fmt.Errorf("unexpected %v", msg.MessageType())
+			}
+		}
+	}
+}
+
+// handleUnknownMessage handles a message of a type that the router does not
+// handle, according to the realm's unknown message policy.  Returns false if
+// the session must be aborted.
+func (r *realm) handleUnknownMessage(sess *wamp.Session, msg wamp.Message) bool {
+	r.policyLock.RLock()
+	policy := r.unknownMsgPolicy
+	r.policyLock.RUnlock()
+
+	switch policy {
+	case UnknownMessageIgnore:
+		r.log.Println("Ignoring unexpected", msg.MessageType(), "from session", sess)
+		return true
+	case UnknownMessageError:
+		// Reply to the request ID of the message, if the message has one.
+		var reqID wamp.ID
+		if v := reflect.ValueOf(msg); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+			if f := v.Elem().FieldByName("Request"); f.IsValid() && f.Type() == reflect.TypeOf(reqID) {
+				reqID = f.Interface().(wamp.ID)
+			}
 		}
+		sess.TrySend(&wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   reqID,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrProtocolViolation,
+			Arguments: wamp.List{fmt.Sprint("unexpected ", msg.MessageType())},
+		})
+		return true
+	}
+	return false
+}
+
+// noSuchProcedure checks, if configured to check before authorization, that
+// the procedure of a CALL is registered.  If not, then an ERROR is sent to the
+// caller and true is returned.
+func (r *realm) noSuchProcedure(sess *wamp.Session, msg wamp.Message) bool {
+	call, ok := msg.(*wamp.Call)
+	if !ok {
+		return false
+	}
+	r.policyLock.RLock()
+	procFirst := r.procFirst
+	r.policyLock.RUnlock()
+	if !procFirst || r.dealer.hasProcedure(call.Procedure) {
+		return false
 	}
+	sess.TrySend(&wamp.Error{
+		Type:    call.MessageType(),
+		Request: call.Request,
+		Details: wamp.Dict{},
+		Error:   wamp.ErrNoSuchProcedure,
+	})
+	return true
 }
 
 // authzMessage checks if the session is authorized to send the message.  If
 // authorization fails or if the session is not authorized, then an error
 // response is returned to the client, and this method returns false.
 func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
-	// If the client is local, then do not check authorization, unless
-	// requested in config.
-	if sess.Peer.IsLocal() && !r.localAuthz {
+	// Get the current authorization policy.  The message is authorized using
+	// this policy even if the policy is replaced while authorizing.
+	r.policyLock.RLock()
+	authorizer, localAuthz, onDeny := r.authorizer, r.localAuthz, r.onDeny
+	observerRoles := r.observerRoles
+	r.policyLock.RUnlock()
+	if authorizer == nil && len(observerRoles) == 0 {
 		return true
 	}
 
@@ -528,11 +999,45 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 		Details: sess.Details,
 	}
 
-	// Write-lock the session, becuase there is no telling what the Authorizer
-	// will do to the session details.
-	sess.Lock()
-	isAuthz, err := r.authorizer.Authorize(safeSession, msg)
-	sess.Unlock()
+	isAuthz := true
+	var err error
+
+	// If the client is local, then do not check authorization, unless
+	// requested in config.
+	if authorizer != nil && (!sess.Peer.IsLocal() || localAuthz) {
+		// Write-lock the session, becuase there is no telling what the
+		// Authorizer will do to the session details.
+		sess.Lock()
+		before := authIdentity(sess.Details)
+		isAuthz, err = authorizer.Authorize(safeSession, msg)
+		after := authIdentity(sess.Details)
+		sess.Unlock()
+
+		// If the Authorizer changed the session's authid or authrole, then
+		// tell meta subscribers about the change.
+		if before["authid"] != after["authid"] || before["authrole"] != after["authrole"] {
+			if r.debug {
+				r.log.Printf("Session %v auth changed from %v to %v", sess, before, after)
+			}
+			r.metaPeer.Send(&wamp.Publish{
+				Request:   wamp.GlobalID(),
+				Topic:     wamp.MetaEventSessionOnReauth,
+				Arguments: wamp.List{sess.ID, before, after},
+			})
+		}
+	}
+
+	// An observer session is only allowed to read meta information, even if
+	// the Authorizer allows more.  The authrole is checked after the
+	// Authorizer, since the Authorizer may make the session an observer.
+	if isAuthz && len(observerRoles) != 0 && !observerAllowed(msg) {
+		sess.Lock()
+		authrole, _ := wamp.AsString(sess.Details["authrole"])
+		sess.Unlock()
+		if _, ok := observerRoles[authrole]; ok {
+			isAuthz = false
+		}
+	}
 
 	if !isAuthz {
 		skipResponse := false
@@ -572,6 +1077,13 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 			errRsp.Error = wamp.ErrNotAuthorized
 			r.log.Println("Client", sess, msg.MessageType(), "not authorized")
 		}
+		if onDeny != nil {
+			reason := err
+			if reason == nil {
+				reason = ErrNotAuthorized
+			}
+			onDeny(safeSession, msg, reason)
+		}
 		if !skipResponse {
 			err = sess.TrySend(errRsp)
 			if err != nil {
@@ -583,11 +1095,110 @@ func (r *realm) authzMessage(sess *wamp.Session, msg wamp.Message) bool {
 	return true
 }
 
+// observerReadProcs are the built-in meta procedures that only read
+// information about the router, which observer sessions are allowed to call.
+var observerReadProcs = map[wamp.URI]struct{}{
+	wamp.MetaProcSessionCount:        {},
+	wamp.MetaProcSessionList:         {},
+	wamp.MetaProcSessionGet:          {},
+	wamp.MetaProcRegList:             {},
+	wamp.MetaProcRegLookup:           {},
+	wamp.MetaProcRegMatch:            {},
+	wamp.MetaProcRegGet:              {},
+	wamp.MetaProcRegListCallees:      {},
+	wamp.MetaProcRegCountCallees:     {},
+	wamp.MetaProcRegCallees:          {},
+	wamp.MetaProcSubList:             {},
+	wamp.MetaProcSubLookup:           {},
+	wamp.MetaProcSubMatch:            {},
+	wamp.MetaProcSubGet:              {},
+	wamp.MetaProcSubListSubscribers:  {},
+	wamp.MetaProcSubCountSubscribers: {},
+	wamp.MetaProcSubCount:            {},
+}
+
+// observerAllowed returns true if an observer session is allowed to send the
+// message.  Observers may only subscribe to meta events, call the built-in
+// meta procedures that only read information, cancel those calls, and leave
+// the realm.
+func observerAllowed(msg wamp.Message) bool {
+	switch msg := msg.(type) {
+	case *wamp.Call:
+		_, ok := observerReadProcs[msg.Procedure]
+		return ok
+	case *wamp.Subscribe:
+		return strings.HasPrefix(string(msg.Topic), "wamp.")
+	case *wamp.Unsubscribe, *wamp.Cancel, *wamp.Goodbye:
+		return true
+	}
+	return false
+}
+
+// parseCIDRs parses a list of CIDR notation IP address ranges.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// addrAllowed returns true if the client is allowed to join the realm from
+// its network address.
+func (r *realm) addrAllowed(client wamp.Peer, details wamp.Dict) bool {
+	if client.IsLocal() || (len(r.allowedNets) == 0 && len(r.deniedNets) == 0) {
+		return true
+	}
+	host := transportInfo(client, details).RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(r.allowedNets) == 0
+	}
+	for _, ipNet := range r.deniedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.allowedNets) == 0 {
+		return true
+	}
+	for _, ipNet := range r.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// postAuth calls the realm's PostAuthHook, if any, with the authenticated
+// session.  Returns the hook's error if the session is rejected.
+func (r *realm) postAuth(sess *wamp.Session) error {
+	r.policyLock.RLock()
+	hook := r.postAuthHook
+	r.policyLock.RUnlock()
+
+	if hook == nil {
+		return nil
+	}
+	return hook(sess)
+}
+
 // authClient authenticates the client according to the authmethods in the
 // HELLO message details and the authenticators available for this realm.
 func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*wamp.Welcome, error) {
+	r.policyLock.RLock()
+	localAuth, methodSelector, defaultRole := r.localAuth, r.methodSelector, r.defaultRole
+	r.policyLock.RUnlock()
+
 	// If the client is local, then no authentication is required.
-	if client.IsLocal() && !r.localAuth {
+	if client.IsLocal() && !localAuth {
 		// Create welcome details for local client.
 		authid, _ := wamp.AsString(details["authid"])
 		if authid == "" {
@@ -599,8 +1210,8 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 			"authmethod":   "local",
 			"authprovider": "static",
 			"roles": wamp.Dict{
-				wamp.RoleBroker: r.broker.role(),
-				wamp.RoleDealer: r.dealer.role(),
+				wamp.RoleBroker: r.brokerRole,
+				wamp.RoleDealer: r.dealerRole,
 			},
 		}
 		return &wamp.Welcome{Details: details}, nil
@@ -629,6 +1240,24 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 		return nil, errors.New("no authentication supplied")
 	}
 
+	// Only use the authmethods that are allowed for the client's transport.
+	if methodSelector != nil {
+		allowed := methodSelector(transportInfo(client, details))
+		var selected []string
+		for _, am := range authmethods {
+			for i := range allowed {
+				if am == allowed[i] {
+					selected = append(selected, am)
+					break
+				}
+			}
+		}
+		if len(selected) == 0 {
+			return nil, errors.New("no authentication method allowed for transport")
+		}
+		authmethods = selected
+	}
+
 	authr, method := r.getAuthenticator(authmethods)
 	if authr == nil {
 		return nil, errors.New("could not authenticate with any method")
@@ -640,13 +1269,37 @@ func (r *realm) authClient(sid wamp.ID, client wamp.Peer, details wamp.Dict) (*w
 		return nil, err
 	}
 	welcome.Details["authmethod"] = method
+	if defaultRole != "" {
+		if authrole, _ := wamp.AsString(welcome.Details["authrole"]); authrole == "" {
+			welcome.Details["authrole"] = defaultRole
+		}
+	}
 	welcome.Details["roles"] = wamp.Dict{
-		wamp.RoleBroker: r.broker.role(),
-		wamp.RoleDealer: r.dealer.role(),
+		wamp.RoleBroker: r.brokerRole,
+		wamp.RoleDealer: r.dealerRole,
 	}
 	return welcome, nil
 }
 
+// transportInfo returns information about the client's transport, from the
+// client peer and the transport details in the HELLO details.
+func transportInfo(client wamp.Peer, details wamp.Dict) TransportInfo {
+	info := TransportInfo{Local: client.IsLocal()}
+	if info.Local {
+		info.Type = "local"
+	}
+	transDict := wamp.DictChild(details, "transport")
+	if transDict == nil {
+		return info
+	}
+	if typ, ok := wamp.AsString(transDict["type"]); ok {
+		info.Type = typ
+	}
+	info.TLS, _ = wamp.AsBool(transDict["is_secure"])
+	info.RemoteAddr, _ = wamp.AsString(transDict["peer"])
+	return info
+}
+
 // getAuthenticator finds the first authenticator registered for the methods.
 func (r *realm) getAuthenticator(methods []string) (auth auth.Authenticator, authMethod string) {
 	sync := make(chan struct{})
@@ -668,42 +1321,179 @@ func (r *realm) getAuthenticator(methods []string) (auth auth.Authenticator, aut
 	return
 }
 
+// authMethods returns the sorted names of the authentication methods that
+// the realm has authenticators for, and that the MethodSelector, if any,
+// allows for the client's transport.
+func (r *realm) authMethods(client wamp.Peer, details wamp.Dict) []string {
+	r.policyLock.RLock()
+	methodSelector := r.methodSelector
+	r.policyLock.RUnlock()
+
+	var methods []string
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		methods = make([]string, 0, len(r.authenticators))
+		for method := range r.authenticators {
+			methods = append(methods, method)
+		}
+		close(sync)
+	}
+	<-sync
+
+	if methodSelector != nil {
+		allowed := methodSelector(transportInfo(client, details))
+		selected := methods[:0]
+		for _, method := range methods {
+			for i := range allowed {
+				if method == allowed[i] {
+					selected = append(selected, method)
+					break
+				}
+			}
+		}
+		methods = selected
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// registerMetaProcedure registers one of the meta procedures that the realm
+// provides, at realm startup.
 func (r *realm) registerMetaProcedure(procedure wamp.URI, f func(*wamp.Invocation) wamp.Message) {
+	err := r.addMetaProcedure(procedure, f)
+	if err == nil {
+		return
+	}
+	if err == errMetaClosed {
+		// This would only happen if the meta client was closed before or
+		// during meta procedure registration at realm startup.
+		r.log.Println("Shutdown during meta procedure registration")
+		return
+	}
+	errMsg := fmt.Sprint("PANIC! Failed to register session meta procedure: ", err)
+	r.log.Print(errMsg)
+	panic(errMsg)
+}
+
+// InvocationHandler handles an invocation of a procedure registered by
+// RegisterMetaProcedure.  It returns a *wamp.Yield with the result of the call,
+// or a *wamp.Error.  The router sets the request ID of the returned message.
+type InvocationHandler func(*wamp.Invocation) wamp.Message
+
+// respond calls the handler and returns its response to the invocation.
+func (h InvocationHandler) respond(inv *wamp.Invocation) wamp.Message {
+	switch rsp := h(inv).(type) {
+	case *wamp.Yield:
+		rsp.Request = inv.Request
+		if rsp.Options == nil {
+			rsp.Options = wamp.Dict{}
+		}
+		return rsp
+	case *wamp.Error:
+		rsp.Type = wamp.INVOCATION
+		rsp.Request = inv.Request
+		if rsp.Details == nil {
+			rsp.Details = wamp.Dict{}
+		}
+		return rsp
+	}
+	return &wamp.Error{
+		Type:      wamp.INVOCATION,
+		Request:   inv.Request,
+		Details:   wamp.Dict{},
+		Error:     wamp.ErrRuntimeError,
+		Arguments: wamp.List{"invalid response from meta procedure handler"},
+	}
+}
+
+// RegisterMetaProcedure registers a procedure that is handled by the router
+// itself, in the same way as the realm's built-in meta procedures.  Calls to
+// the procedure are authorized like any other CALL.  Each invocation is
+// handled in a separate goroutine, and the details of the invocation include
+// the caller's session information.  Closing the realm waits for handlers
+// that are running to return.
+//
+// The procedure must be in the wamp. namespace, which clients cannot register
+// procedures in, and must not be the URI of a built-in meta procedure or of
+// another procedure registered by RegisterMetaProcedure.  An error is returned
+// if the realm is closed.
+func (r *realm) RegisterMetaProcedure(procedure wamp.URI, handler InvocationHandler) error {
+	if !strings.HasPrefix(string(procedure), "wamp.") {
+		return errors.New("meta procedure must be in the wamp. namespace")
+	}
+	if handler == nil {
+		return errors.New("nil invocation handler")
+	}
+
+	// The lock is held in mutual exclusion with the closing of the realm, so
+	// that no procedure is registered once the realm is closing.
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return errRealmClosed
+	}
+	return r.addMetaProcedure(procedure, func(inv *wamp.Invocation) wamp.Message {
+		r.waitMetaHandlers.Add(1)
+		go func() {
+			defer r.waitMetaHandlers.Done()
+			r.metaPeer.SendCtx(r.metaCtx, handler.respond(inv))
+		}()
+		return nil
+	})
+}
+
+// addMetaProcedure registers a procedure for the meta session, and waits for
+// the dealer to reply.  A nil message returned by f is not sent, and means
+// that f sends the response to the invocation itself.
+func (r *realm) addMetaProcedure(procedure wamp.URI, f func(*wamp.Invocation) wamp.Message) error {
+	reqID := r.metaIDGen.Next()
+	reg := &metaRegistration{
+		handler: f,
+		reply:   make(chan error, 1),
+	}
+	r.metaProcLock.Lock()
+	r.metaRegPending[reqID] = reg
+	r.metaProcLock.Unlock()
+
 	// Register the meta procedure.  The "disclose_caller" option must be
 	// enabled for the testament API and the meta session API.
-	r.metaPeer.Send(&wamp.Register{
-		Request: r.metaIDGen.Next(),
+	err := r.metaPeer.SendCtx(r.metaCtx, &wamp.Register{
+		Request: reqID,
 		Options: wamp.Dict{
 			"disclose_caller": true,
 		},
 		Procedure: procedure,
 	})
-	msg := <-r.metaPeer.Recv()
-	if msg == nil {
-		// This would only happen if the meta client was closed before or
-		// during meta procedure registration at realm startup.  Safety first.
-		return
+	if err != nil {
+		r.metaProcLock.Lock()
+		delete(r.metaRegPending, reqID)
+		r.metaProcLock.Unlock()
+		return errMetaClosed
 	}
-	reg, ok := msg.(*wamp.Registered)
-	if !ok {
-		err, ok := msg.(*wamp.Error)
-		if !ok {
-			if _, ok = msg.(*wamp.Goodbye); ok {
-				r.log.Println("Shutdown during meta procedure registration")
-				return
-			}
-			r.log.Println("PANIC! Received unexpected", msg.MessageType())
-			panic("cannot register meta procedure")
-		}
-		errMsg := fmt.Sprintf(
-			"PANIC! Failed to register session meta procedure: %v", err.Error)
-		if len(err.Arguments) != 0 {
-			errMsg += fmt.Sprint(": ", err.Arguments[0])
+	select {
+	case err := <-reg.reply:
+		return err
+	case <-r.metaDone:
+		return errMetaClosed
+	}
+}
+
+// metaRegistered handles the dealer's reply to a meta procedure REGISTER.
+func (r *realm) metaRegistered(reqID, regID wamp.ID, err error) {
+	r.metaProcLock.Lock()
+	reg, ok := r.metaRegPending[reqID]
+	if ok {
+		delete(r.metaRegPending, reqID)
+		if err == nil {
+			r.metaProcMap[regID] = reg.handler
 		}
-		r.log.Print(errMsg)
-		panic(errMsg)
 	}
-	r.metaProcMap[reg.Registration] = f
+	r.metaProcLock.Unlock()
+	if !ok {
+		r.log.Println("Meta session received reply for unknown request", reqID)
+		return
+	}
+	reg.reply <- err
 }
 
 func (r *realm) metaProcedureHandler() {
@@ -712,7 +1502,9 @@ func (r *realm) metaProcedureHandler() {
 	for msg := range r.metaPeer.Recv() {
 		switch msg := msg.(type) {
 		case *wamp.Invocation:
+			r.metaProcLock.Lock()
 			metaProcHandler, ok := r.metaProcMap[msg.Registration]
+			r.metaProcLock.Unlock()
 			if !ok {
 				r.metaPeer.Send(&wamp.Error{
 					Type:    msg.MessageType(),
@@ -722,7 +1514,23 @@ func (r *realm) metaProcedureHandler() {
 				})
 				continue
 			}
-			rsp = metaProcHandler(msg)
+			if rsp = metaProcHandler(msg); rsp == nil {
+				continue
+			}
+		case *wamp.Registered:
+			r.metaRegistered(msg.Request, msg.Registration, nil)
+			continue
+		case *wamp.Error:
+			if msg.Type != wamp.REGISTER {
+				r.log.Println("Meta procedure received unexpected ERROR", msg.Error)
+				continue
+			}
+			errMsg := string(msg.Error)
+			if len(msg.Arguments) != 0 {
+				errMsg += fmt.Sprint(": ", msg.Arguments[0])
+			}
+			r.metaRegistered(msg.Request, 0, errors.New(errMsg))
+			continue
 		case *wamp.Goodbye:
 			if r.debug {
 				r.log.Print("Session meta procedure handler exiting GOODBYE")
@@ -849,12 +1657,8 @@ func (r *realm) sessionList(msg *wamp.Invocation) wamp.Message {
 // sessionGet is the session meta procedure that retrieves information on a
 // specific session.
 func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
-	if len(msg.Arguments) == 0 {
-		return makeError(msg.Request, wamp.ErrNoSuchSession)
-	}
-
-	sid, ok := wamp.AsID(msg.Arguments[0])
-	if !ok {
+	sid, err := wamp.InvocationArgID(msg, 0)
+	if err != nil {
 		return makeError(msg.Request, wamp.ErrNoSuchSession)
 	}
 
@@ -889,12 +1693,8 @@ func (r *realm) sessionGet(msg *wamp.Invocation) wamp.Message {
 // its own session.  Specifying the caller's own session will result in a
 // wamp.error.no_such_session since no other session with that ID exists.
 func (r *realm) sessionKill(msg *wamp.Invocation) wamp.Message {
-	if len(msg.Arguments) == 0 {
-		return makeError(msg.Request, wamp.ErrNoSuchSession)
-	}
-
-	sid, ok := wamp.AsID(msg.Arguments[0])
-	if !ok {
+	sid, err := wamp.InvocationArgID(msg, 0)
+	if err != nil {
 		return makeError(msg.Request, wamp.ErrNoSuchSession)
 	}
 	caller, _ := wamp.AsID(msg.Details["caller"])
@@ -908,8 +1708,7 @@ func (r *realm) sessionKill(msg *wamp.Invocation) wamp.Message {
 	}
 	message, _ := wamp.AsString(msg.ArgumentsKw["message"])
 
-	err := r.killSession(sid, reason, message)
-	if err != nil {
+	if err = r.killSession(sid, reason, message); err != nil {
 		return makeError(msg.Request, wamp.ErrNoSuchSession)
 	}
 
@@ -1000,17 +1799,18 @@ func (r *realm) sessionKillAll(msg *wamp.Invocation) wamp.Message {
 // 1. `session|id` - The ID of the session to modify.
 // 2. `details|dict` - Details delta.
 func (r *realm) sessionModifyDetails(msg *wamp.Invocation) wamp.Message {
-	if len(msg.Arguments) < 2 {
-		return makeError(msg.Request, wamp.ErrInvalidArgument)
-	}
-	sid, ok := wamp.AsID(msg.Arguments[0])
-	if !ok {
+	sid, err := wamp.InvocationArgID(msg, 0)
+	if err != nil {
 		return makeError(msg.Request, wamp.ErrInvalidArgument)
 	}
 	if sid == r.metaSess.ID {
 		return makeError(msg.Request, wamp.ErrNoSuchSession)
 	}
-	delta, ok := wamp.AsDict(msg.Arguments[1])
+	arg, err := wamp.InvocationArg(msg, 1)
+	if err != nil {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	delta, ok := wamp.AsDict(arg)
 	if !ok {
 		return makeError(msg.Request, wamp.ErrInvalidArgument)
 	}
@@ -1129,17 +1929,28 @@ func (r *realm) testamentFlush(msg *wamp.Invocation) wamp.Message {
 	return &wamp.Yield{Request: msg.Request}
 }
 
+// authIdentity returns the authid and authrole from the session details.
+func authIdentity(details wamp.Dict) wamp.Dict {
+	authid, _ := wamp.AsString(details["authid"])
+	authrole, _ := wamp.AsString(details["authrole"])
+	return wamp.Dict{"authid": authid, "authrole": authrole}
+}
+
 // cleanSessionDetails returns a dictionary that only contains allowed session
 // details. transport.auth is never allowed, because the data in transport.auth
 // may not be serializable and may expose auth information to session meta.
 func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
+	r.policyLock.RLock()
+	metaStrict, metaIncDetails := r.metaStrict, r.metaIncDetails
+	r.policyLock.RUnlock()
+
 	var clean wamp.Dict
 	// If in strict mode, only include allowed values.
-	if r.metaStrict {
+	if metaStrict {
 		stdItems := []string{"session", "authid", "authrole", "authmethod",
 			"authprovider", "transport"}
 
-		clean = make(wamp.Dict, len(stdItems)+len(r.metaIncDetails))
+		clean = make(wamp.Dict, len(stdItems)+len(metaIncDetails))
 		// Copy standard details.
 		for _, k := range stdItems {
 			if v, ok := details[k]; ok {
@@ -1147,7 +1958,7 @@ func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
 			}
 		}
 		// Copy additional includes.
-		for _, k := range r.metaIncDetails {
+		for _, k := range metaIncDetails {
 			if v, ok := details[k]; ok {
 				clean[k] = v
 			}
@@ -1169,7 +1980,7 @@ func (r *realm) cleanSessionDetails(details wamp.Dict) wamp.Dict {
 	}
 
 	// If a copy was not previously needed, it is now.
-	if !r.metaStrict {
+	if !metaStrict {
 		clean = make(wamp.Dict, len(details))
 		for k, v := range details {
 			clean[k] = v
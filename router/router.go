@@ -13,6 +13,7 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gammazero/nexus/v3/stdlog"
@@ -45,18 +46,66 @@ type Router interface {
 	RemoveRealm(wamp.URI)
 }
 
+// RealmUpdater changes the policy of the realms of a running router.  It is
+// implemented by the Router returned by NewRouter, and is separate from Router
+// so that other Router implementations need not provide it.  Use a type
+// assertion to get a RealmUpdater from a Router:
+//
+//	updater, ok := r.(router.RealmUpdater)
+type RealmUpdater interface {
+	// SetAuthorizer replaces the Authorizer of a realm, without affecting the
+	// sessions attached to the realm.
+	SetAuthorizer(wamp.URI, Authorizer) error
+
+	// UpdateRealmConfig applies the changes, made by the given function, to
+	// the configuration of a running realm.
+	UpdateRealmConfig(wamp.URI, func(*RealmConfig)) error
+}
+
+// SessionLister lists the sessions attached to the realms of a router.  It is
+// implemented by the Router returned by NewRouter, and is separate from Router
+// so that other Router implementations need not provide it.  Use a type
+// assertion to get a SessionLister from a Router.
+type SessionLister interface {
+	// Sessions returns a snapshot of information about the sessions attached
+	// to a realm.
+	Sessions(wamp.URI) ([]wamp.SessionInfo, error)
+}
+
+// MetaProcedureRegistrar registers procedures that are handled by the router
+// itself.  It is implemented by the Router returned by NewRouter, and is
+// separate from Router so that other Router implementations need not provide
+// it.  Use a type assertion to get a MetaProcedureRegistrar from a Router.
+type MetaProcedureRegistrar interface {
+	// RegisterMetaProcedure registers a procedure, in the named realm, that is
+	// handled by the router itself.
+	RegisterMetaProcedure(realm, procedure wamp.URI, handler InvocationHandler) error
+}
+
 // router is the default WAMP router implementation.
 type router struct {
+	// Set to 1 when the router starts closing.  Read by HealthHandler.
+	closing int32
+	// Number of realms.  Read by HealthHandler.
+	numRealms int32
+
 	realms map[wamp.URI]*realm
 
 	actionChan chan func()
 	waitRealms sync.WaitGroup
 
 	realmTemplate *RealmConfig
+	realmProvider func(wamp.URI) (*RealmConfig, bool)
 	closed        bool
 
-	log   stdlog.StdLog
-	debug bool
+	log            stdlog.StdLog
+	debug          bool
+	profileLabels  bool
+	goodbyeTimeout time.Duration
+	clock          Clock
+
+	// Time the router was created.
+	started time.Time
 }
 
 // NewRouter creates a WAMP router instance.
@@ -71,8 +120,20 @@ func NewRouter(config *Config, logger stdlog.StdLog) (Router, error) {
 		realms:        map[wamp.URI]*realm{},
 		actionChan:    make(chan func()),
 		realmTemplate: config.RealmTemplate,
+		realmProvider: config.RealmProvider,
 		log:           logger,
 		debug:         config.Debug,
+		profileLabels: config.ProfileLabels,
+
+		goodbyeTimeout: config.GoodbyeTimeout,
+		clock:          config.Clock,
+	}
+	if r.clock == nil {
+		r.clock = realClock{}
+	}
+	r.started = r.clock.Now()
+	if config.LogSampleWindow > 0 {
+		r.log = newSamplingLogger(logger, config.LogSampleWindow, r.clock)
 	}
 
 	for _, realmConfig := range config.RealmConfigs {
@@ -128,20 +189,17 @@ func (r *router) Attach(client wamp.Peer) error {
 // See websocketpeer.WebSocketConfig for information provided by websocket
 // connections.
 func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) error {
-	sendAbort := func(reason wamp.URI, abortErr error) {
-		abortMsg := wamp.Abort{Reason: reason}
-		abortMsg.Details = wamp.Dict{}
-		if abortErr != nil {
-			abortMsg.Details[wamp.OptMessage] = abortErr.Error()
-			r.log.Println("Aborting client connection:", abortErr)
-		}
-		client.Send(&abortMsg) // Blocking OK; this is session goroutine.
+	sendAbort := func(abortMsg *wamp.Abort) {
+		r.log.Println("Aborting client connection:", abortMsg.Reason,
+			abortMsg.Details[wamp.OptMessage])
+		client.Send(abortMsg) // Blocking OK; this is session goroutine.
 		client.Close()
 	}
 
 	// Receive HELLO message from the client.
 	msg, err := wamp.RecvTimeout(client, helloTimeout)
 	if err != nil {
+		client.Close()
 		return errors.New("did not receive HELLO: " + err.Error())
 	}
 	if r.debug {
@@ -155,23 +213,38 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	if !ok {
 		// Received unexpected message - protocol violation.
 		err = fmt.Errorf("expected HELLO, received %s", msg.MessageType())
-		sendAbort(wamp.ErrProtocolViolation, err)
+		sendAbort(newAbort(wamp.ErrProtocolViolation, err.Error(), nil))
 		return err
 	}
 
 	// Client is required to provide a non-empty realm.
 	if string(hello.Realm) == "" {
 		err = errors.New("no realm requested")
-		sendAbort(wamp.ErrNoSuchRealm, err)
+		sendAbort(newAbort(wamp.ErrNoSuchRealm, err.Error(), nil))
 		return err
 	}
+	// If the realm does not exist, then get its configuration from the realm
+	// provider.  This is done outside of the router goroutine, since the
+	// provider may be slow.
+	var provided *RealmConfig
+	if r.realmProvider != nil {
+		if _, err = r.getRealm(hello.Realm); err != nil {
+			if config, ok := r.realmProvider(hello.Realm); ok && config != nil {
+				provided = new(RealmConfig)
+				*provided = *config
+				provided.URI = hello.Realm
+			}
+		}
+	}
+
 	// Lookup or create realm to attach to.
 	var realm *realm
 	sync := make(chan error)
 	r.actionChan <- func() {
 		if r.closed {
-			sendAbort(wamp.ErrSystemShutdown, nil)
-			sync <- errors.New("router is closing, not accepting new clients")
+			err := errors.New("router is closing, not accepting new clients")
+			sendAbort(newAbort(wamp.ErrSystemShutdown, err.Error(), nil))
+			sync <- err
 			return
 		}
 		// Realm is a string identifying the realm this session should attach
@@ -179,22 +252,28 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 		var found bool
 		realm, found = r.realms[hello.Realm]
 		if !found {
+			// Create the new realm using the provided configuration, or
+			// based on the template.
+			config := provided
+			if config == nil && r.realmTemplate != nil {
+				config = new(RealmConfig)
+				*config = *r.realmTemplate
+				config.URI = hello.Realm
+			}
 			// If the router is not configured to automatically create the
 			// realm, then respond with an ABORT message.
-			if r.realmTemplate == nil {
-				sendAbort(wamp.ErrNoSuchRealm, nil)
-				sync <- fmt.Errorf("no realm \"%s\" exists on this router",
+			if config == nil {
+				err := fmt.Errorf("no realm \"%s\" exists on this router",
 					string(hello.Realm))
+				sendAbort(newAbort(wamp.ErrNoSuchRealm, err.Error(), nil))
+				sync <- err
 				return
 			}
-
-			// Create the new realm based on template
-			config := *r.realmTemplate
-			config.URI = hello.Realm
-			if realm, err = r.addRealm(&config); err != nil {
-				sendAbort(wamp.ErrNoSuchRealm, nil)
-				sync <- fmt.Errorf("failed to create realm \"%s\"",
+			if realm, err = r.addRealm(config); err != nil {
+				err = fmt.Errorf("failed to create realm \"%s\"",
 					string(hello.Realm))
+				sendAbort(newAbort(wamp.ErrNoSuchRealm, err.Error(), nil))
+				sync <- err
 				return
 
 			}
@@ -225,7 +304,7 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	}
 	if !rolesOK {
 		err = errors.New("client did not announce any supported roles")
-		sendAbort(wamp.ErrNoSuchRole, err)
+		sendAbort(newAbort(wamp.ErrNoSuchRole, err.Error(), nil))
 		return err
 	}
 
@@ -234,13 +313,24 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 		hello.Details["transport"] = transportDetails
 	}
 
+	// Check that the client may join the realm from its network address.
+	if !realm.addrAllowed(client, hello.Details) {
+		err = errors.New("client address not allowed in realm")
+		sendAbort(newAbort(wamp.ErrNotAuthorized, err.Error(), nil))
+		return err
+	}
+
 	// Handle any necessary client auth.  This results in either a WELCOME
 	// message or an error.
 	//
 	// Authentication may take some time.
 	welcome, err := realm.authClient(sid, client, hello.Details)
 	if err != nil {
-		sendAbort(wamp.ErrAuthenticationFailed, err)
+		// Suggest the authentication methods that the realm supports for
+		// the client's transport.
+		sendAbort(newAbort(wamp.ErrAuthenticationFailed, err.Error(), wamp.Dict{
+			wamp.OptSuggestedMethods: realm.authMethods(client, hello.Details),
+		}))
 		return errors.New("authentication error: " + err.Error())
 	}
 
@@ -266,9 +356,24 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 
 	sess.Details = sessDetails
 
+	// Let the realm reject the authenticated session for any other reasons.
+	if err := realm.postAuth(sess); err != nil {
+		reason := wamp.ErrNotAuthorized
+		var rejectErr *RejectSessionError
+		if errors.As(err, &rejectErr) {
+			reason = rejectErr.Reason
+		}
+		sendAbort(newAbort(reason, err.Error(), nil))
+		return errors.New("session rejected: " + err.Error())
+	}
+
 	if err := realm.handleSession(sess); err != nil {
-		// Any error returned here is a shutdown error.
-		sendAbort(wamp.ErrSystemShutdown, nil)
+		if errors.Is(err, errRealmFull) {
+			sendAbort(newAbort(realm.maxSessionsReason, err.Error(), nil))
+			return err
+		}
+		// Any other error returned here is a shutdown error.
+		sendAbort(newAbort(wamp.ErrSystemShutdown, err.Error(), nil))
 		return err
 	}
 
@@ -279,8 +384,27 @@ func (r *router) AttachClient(client wamp.Peer, transportDetails wamp.Dict) erro
 	return nil
 }
 
+// newAbort creates an ABORT message with the given reason.  The details always
+// contain a human-readable message describing why the session was aborted,
+// along with any additional details given.
+func newAbort(reason wamp.URI, message string, details wamp.Dict) *wamp.Abort {
+	abortDetails := make(wamp.Dict, len(details)+1)
+	for k, v := range details {
+		abortDetails[k] = v
+	}
+	if message == "" {
+		message = string(reason)
+	}
+	abortDetails[wamp.OptMessage] = message
+	return &wamp.Abort{
+		Reason:  reason,
+		Details: abortDetails,
+	}
+}
+
 // Close stops the router and waits message processing to stop.
 func (r *router) Close() {
+	atomic.StoreInt32(&r.closing, 1)
 	sync := make(chan struct{})
 	r.actionChan <- func() {
 		// Prevent new or attachment to existing realms.
@@ -290,6 +414,7 @@ func (r *router) Close() {
 			realm.close()
 			// Delete the realm
 			delete(r.realms, uri)
+			atomic.AddInt32(&r.numRealms, -1)
 			r.log.Println("Realm", uri, "completed shutdown")
 		}
 		close(sync)
@@ -325,6 +450,7 @@ func (r *router) RemoveRealm(name wamp.URI) {
 			// if found, go ahead and remove the realm from the router to
 			// prevent new clients from joining it.
 			delete(r.realms, name)
+			atomic.AddInt32(&r.numRealms, -1)
 			r.log.Printf("Removed realm: %s", name)
 		}
 		close(sync)
@@ -339,6 +465,69 @@ func (r *router) RemoveRealm(name wamp.URI) {
 	}
 }
 
+// SetAuthorizer replaces the Authorizer of the named realm.  Messages already
+// being routed finish under the previous Authorizer, and all subsequent
+// messages are authorized by the new Authorizer.
+func (r *router) SetAuthorizer(name wamp.URI, authorizer Authorizer) error {
+	realm, err := r.getRealm(name)
+	if err != nil {
+		return err
+	}
+	realm.SetAuthorizer(authorizer)
+	return nil
+}
+
+// UpdateRealmConfig calls fn with a copy of the named realm's configuration
+// and applies the modified configuration to the running realm.  See
+// realm.UpdateConfig for the configuration items that can be changed.
+func (r *router) UpdateRealmConfig(name wamp.URI, fn func(*RealmConfig)) error {
+	realm, err := r.getRealm(name)
+	if err != nil {
+		return err
+	}
+	return realm.UpdateConfig(fn)
+}
+
+// Sessions returns information about the sessions attached to the named realm.
+// This gives in-process tooling typed access to the same information that is
+// available using the session meta procedures.
+func (r *router) Sessions(name wamp.URI) ([]wamp.SessionInfo, error) {
+	realm, err := r.getRealm(name)
+	if err != nil {
+		return nil, err
+	}
+	return realm.Sessions()
+}
+
+// RegisterMetaProcedure registers a procedure, in the named realm, that is
+// handled by the router itself alongside the built-in meta procedures.  This
+// allows an embedding application to provide its own procedures, such as
+// wamp.myapp.flush_cache, without running a separate callee.  See
+// realm.RegisterMetaProcedure.
+func (r *router) RegisterMetaProcedure(name, procedure wamp.URI, handler InvocationHandler) error {
+	realm, err := r.getRealm(name)
+	if err != nil {
+		return err
+	}
+	return realm.RegisterMetaProcedure(procedure, handler)
+}
+
+// getRealm returns the named realm, or an error if the realm does not exist.
+func (r *router) getRealm(name wamp.URI) (*realm, error) {
+	var realm *realm
+	var ok bool
+	sync := make(chan struct{})
+	r.actionChan <- func() {
+		realm, ok = r.realms[name]
+		close(sync)
+	}
+	<-sync
+	if !ok {
+		return nil, fmt.Errorf("no realm \"%s\" exists on this router", string(name))
+	}
+	return realm, nil
+}
+
 // addRealm attempts to create and add a realm to this router.
 //
 // this method should ONLY be called from within an atomic func
@@ -347,15 +536,22 @@ func (r *router) addRealm(config *RealmConfig) (*realm, error) {
 		return nil, errors.New("realm already exists: " + string(config.URI))
 	}
 
-	realm, err := newRealm(
-		config,
-		newBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug, config.PublishFilterFactory),
-		newDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug),
-		r.log, r.debug)
+	dealer, err := newRealmDealer(config, r.log, r.debug, r.clock)
+	if err != nil {
+		return nil, err
+	}
+	broker := newRealmBroker(config, r.log, r.debug, r.clock)
+	realm, err := newRealm(config, broker, dealer, r.log, r.debug)
 	if err != nil {
+		broker.close()
+		dealer.close()
 		return nil, err
 	}
+	realm.profileLabels = r.profileLabels
+	realm.goodbyeTimeout = r.goodbyeTimeout
+	realm.clock = r.clock
 	r.realms[config.URI] = realm
+	atomic.AddInt32(&r.numRealms, 1)
 
 	r.waitRealms.Add(1)
 	go func() {
@@ -1,13 +1,19 @@
 package router
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"runtime/pprof"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gammazero/nexus/v3/router/auth"
 	"github.com/gammazero/nexus/v3/stdlog"
 	"github.com/gammazero/nexus/v3/transport"
 	"github.com/gammazero/nexus/v3/wamp"
@@ -148,8 +154,16 @@ func TestHandshakeBadRealm(t *testing.T) {
 	if err != nil {
 		t.Fatal("timed out waiting for response to HELLO")
 	}
-	if _, ok := msg.(*wamp.Abort); !ok {
-		t.Error("Expected ABORT after bad handshake")
+	abort, ok := msg.(*wamp.Abort)
+	if !ok {
+		t.Fatal("Expected ABORT after bad handshake")
+	}
+	if abort.Reason != wamp.ErrNoSuchRealm {
+		t.Error("Expected reason to be", wamp.ErrNoSuchRealm)
+	}
+	abortMsg, _ := wamp.AsString(abort.Details[wamp.OptMessage])
+	if !strings.Contains(abortMsg, "does.not.exist") {
+		t.Error("Expected ABORT message to describe missing realm, got:", abortMsg)
 	}
 }
 
@@ -396,6 +410,101 @@ func TestRouterCall(t *testing.T) {
 	}
 }
 
+func TestRealmSessions(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lister := r.(SessionLister)
+
+	infos, err := lister.Sessions(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Fatal("expected no sessions, got", len(infos))
+	}
+
+	before := time.Now()
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	infos, err = lister.Sessions(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("expected 2 sessions, got", len(infos))
+	}
+	for _, cli := range []*wamp.Session{cli1, cli2} {
+		var info *wamp.SessionInfo
+		for i := range infos {
+			if infos[i].ID == cli.ID {
+				info = &infos[i]
+				break
+			}
+		}
+		if info == nil {
+			t.Fatal("missing session", cli.ID)
+		}
+		authid, _ := wamp.AsString(cli.Details["authid"])
+		authrole, _ := wamp.AsString(cli.Details["authrole"])
+		authmethod, _ := wamp.AsString(cli.Details["authmethod"])
+		if info.AuthID != authid || info.AuthRole != authrole || info.AuthMethod != authmethod {
+			t.Fatalf("wrong session info %+v for details %v", *info, cli.Details)
+		}
+		if info.AuthRole == "" || info.AuthMethod == "" {
+			t.Fatal("missing authrole or authmethod")
+		}
+		if info.Joined.Before(before) || info.Joined.After(after) {
+			t.Fatal("wrong join time:", info.Joined)
+		}
+	}
+
+	// Check that a session that leaves is not in the snapshot.
+	cli1.Send(&wamp.Goodbye{})
+	if _, err = wamp.RecvTimeout(cli1, time.Second); err != nil {
+		t.Fatal("no goodbye message after sending goodbye:", err)
+	}
+	cli1.Close()
+	// The session is removed from the realm after GOODBYE is sent.
+	for i := 0; i < 100; i++ {
+		if infos, err = lister.Sessions(testRealm); err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(infos) != 1 || infos[0].ID != cli2.ID {
+		t.Fatal("expected only session", cli2.ID, "got", infos)
+	}
+
+	if _, err = lister.Sessions("nexus.no.such.realm"); err == nil {
+		t.Fatal("expected error for unknown realm")
+	}
+
+	// Check that the sessions of a closed realm cannot be listed.
+	realm, err := r.(*router).getRealm(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoveRealm(testRealm)
+	if _, err = realm.Sessions(); err == nil {
+		t.Fatal("expected error for closed realm")
+	}
+}
+
 func TestSessionCountMetaProcedure(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
@@ -932,6 +1041,107 @@ func TestRegistrationMetaProcedures(t *testing.T) {
 	}
 }
 
+func TestRegistrationCalleesMetaProcedure(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register three callees to a shared registration.
+	var regID wamp.ID
+	calleeIDs := map[wamp.ID]bool{}
+	for i := 0; i < 3; i++ {
+		callee, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callee.Send(&wamp.Register{
+			Request:   wamp.GlobalID(),
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+		})
+		msg, err := wamp.RecvTimeout(callee, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for REGISTERED")
+		}
+		registered, ok := msg.(*wamp.Registered)
+		if !ok {
+			t.Fatal("expected REGISTERED, got", msg.MessageType())
+		}
+		regID = registered.Registration
+		calleeIDs[callee.ID] = true
+	}
+
+	callID := wamp.GlobalID()
+	caller.Send(&wamp.Call{
+		Request:   callID,
+		Procedure: wamp.MetaProcRegCallees,
+		Arguments: wamp.List{regID},
+	})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	if result.Request != callID {
+		t.Fatal("wrong result ID")
+	}
+	if len(result.Arguments) == 0 {
+		t.Fatal("missing expected arguemnt")
+	}
+	dict, ok := result.Arguments[0].(wamp.Dict)
+	if !ok {
+		t.Fatal("expected wamp.Dict")
+	}
+	if id, _ := wamp.AsID(dict["id"]); id != regID {
+		t.Fatal("wrong registration ID:", id)
+	}
+	if policy, _ := wamp.AsString(dict[wamp.OptInvoke]); policy != wamp.InvokeRoundRobin {
+		t.Fatal("wrong invocation policy:", policy)
+	}
+	idList, ok := dict["callees"].([]wamp.ID)
+	if !ok {
+		t.Fatal("expected []wamp.ID")
+	}
+	if len(idList) != 3 {
+		t.Fatal("expected 3 callees in list, got", len(idList))
+	}
+	for _, id := range idList {
+		if !calleeIDs[id] {
+			t.Fatal("unexpected callee session ID:", id)
+		}
+		delete(calleeIDs, id)
+	}
+
+	// Check that an unknown registration is an error.
+	caller.Send(&wamp.Call{
+		Request:   wamp.GlobalID(),
+		Procedure: wamp.MetaProcRegCallees,
+		Arguments: wamp.List{wamp.GlobalID()},
+	})
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for ERROR")
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNoSuchRegistration {
+		t.Fatal("wrong error URI:", errMsg.Error)
+	}
+}
+
 func TestSubscriptionMetaProcedures(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
@@ -1219,6 +1429,113 @@ func TestSubscriptionMetaProcedures(t *testing.T) {
 	}
 }
 
+func TestSubscriptionCountMetaProcedure(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subCount := func(topic wamp.URI) int64 {
+		callID := wamp.GlobalID()
+		caller.Send(&wamp.Call{
+			Request:   callID,
+			Procedure: wamp.MetaProcSubCount,
+			Arguments: wamp.List{topic},
+		})
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for RESULT")
+		}
+		result, ok := msg.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+		if result.Request != callID {
+			t.Fatal("wrong result ID")
+		}
+		if len(result.Arguments) == 0 {
+			t.Fatal("missing expected arguemnt")
+		}
+		count, ok := wamp.AsInt64(result.Arguments[0])
+		if !ok {
+			t.Fatal("Argument is not an int")
+		}
+		return count
+	}
+
+	subscribe := func(sess *wamp.Session, topic wamp.URI, match string) {
+		reqID := wamp.GlobalID()
+		opts := wamp.Dict{}
+		if match != "" {
+			opts[wamp.OptMatch] = match
+		}
+		sess.Send(&wamp.Subscribe{Request: reqID, Topic: topic, Options: opts})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for SUBSCRIBED")
+		}
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+		}
+	}
+
+	if n := subCount(testTopic); n != 0 {
+		t.Fatal("expected 0 subscribers, got", n)
+	}
+
+	sub1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub2, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sub1 has overlapping exact and prefix subscriptions, and sub2 has
+	// overlapping exact and wildcard subscriptions.
+	subscribe(sub1, testTopic, "")
+	subscribe(sub1, testTopicPfx, wamp.MatchPrefix)
+	subscribe(sub2, testTopic, "")
+	subscribe(sub2, testTopicWC, wamp.MatchWildcard)
+
+	if n := subCount(testTopic); n != 4 {
+		t.Fatal("expected 4 subscribers, got", n)
+	}
+	// Only the prefix subscription matches.
+	if n := subCount("nexus.test.other"); n != 1 {
+		t.Fatal("expected 1 subscriber, got", n)
+	}
+	// Only the wildcard subscription matches.
+	if n := subCount("nexus.other.event"); n != 1 {
+		t.Fatal("expected 1 subscriber, got", n)
+	}
+	if n := subCount("other.topic"); n != 0 {
+		t.Fatal("expected 0 subscribers, got", n)
+	}
+
+	// Check that a missing topic is an error.
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: wamp.MetaProcSubCount})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for ERROR")
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got", msg.MessageType())
+	}
+	if errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error URI:", errMsg.Error)
+	}
+}
+
 func TestDynamicRealmChange(t *testing.T) {
 	defer leaktest.Check(t)
 
@@ -1273,3 +1590,917 @@ func TestDynamicRealmChange(t *testing.T) {
 		}
 	}
 }
+
+func TestProfileLabels(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		Debug:         debug,
+		ProfileLabels: true,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// Check that the goroutine handling the session has the realm and
+	// session labels.
+	sessLabel := fmt.Sprintf("\"session\":\"%d\"", cli.ID)
+	realmLabel := fmt.Sprintf("\"realm\":\"%s\"", testRealm)
+	hasLabels := func() bool {
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "# labels:") &&
+				strings.Contains(line, sessLabel) &&
+				strings.Contains(line, realmLabel) {
+				return true
+			}
+		}
+		return false
+	}
+	// The session goroutine may still be starting.
+	for i := 0; !hasLabels(); i++ {
+		if i == 100 {
+			t.Fatal("did not find goroutine with session labels")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGoodbyeTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const goodbyeTimeout = 200 * time.Millisecond
+	config := &Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+			},
+		},
+		Debug:          debug,
+		GoodbyeTimeout: goodbyeTimeout,
+	}
+	r, err := NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client that ignores GOODBYE.
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	r.Close()
+	elapsed := time.Since(start)
+	if elapsed < goodbyeTimeout {
+		t.Fatal("router did not wait for GOODBYE reply")
+	}
+	if elapsed > goodbyeTimeout+time.Second {
+		t.Fatal("router did not close client after goodbye timeout")
+	}
+
+	// Check that the client got GOODBYE and was then disconnected.
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+	select {
+	case _, ok := <-cli.Recv():
+		if ok {
+			t.Fatal("expected client to be disconnected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client was not disconnected")
+	}
+
+	// Check that the router does not wait for the timeout when the client
+	// replies to GOODBYE.
+	config.GoodbyeTimeout = 5 * time.Second
+	r, err = NewRouter(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err = testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for msg := range cli.Recv() {
+			if _, ok := msg.(*wamp.Goodbye); ok {
+				cli.Send(&wamp.Goodbye{
+					Reason:  wamp.CloseGoodbyeAndOut,
+					Details: wamp.Dict{},
+				})
+			}
+		}
+	}()
+	start = time.Now()
+	r.Close()
+	if time.Since(start) >= config.GoodbyeTimeout {
+		t.Fatal("router waited for timeout after GOODBYE reply")
+	}
+}
+
+// unknownMessage is a message of a type that the router does not know.
+type unknownMessage struct {
+	Request wamp.ID
+}
+
+func (msg *unknownMessage) MessageType() wamp.MessageType { return 99 }
+
+func TestUnknownMessagePolicy(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	newRouter := func(policy string) (Router, error) {
+		return NewRouter(&Config{
+			RealmConfigs: []*RealmConfig{
+				{
+					URI:                  testRealm,
+					AnonymousAuth:        true,
+					UnknownMessagePolicy: policy,
+				},
+			},
+			Debug: debug,
+		}, logger)
+	}
+
+	// Sends an unknown message, followed by a call if the session is expected
+	// to remain open, and returns the messages received until the reply to the
+	// call or an ABORT.
+	sendUnknown := func(policy string) []wamp.Message {
+		r, err := newRouter(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		cli, err := testClient(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Send(&unknownMessage{Request: 55})
+		if policy == UnknownMessageIgnore || policy == UnknownMessageError {
+			cli.Send(&wamp.Call{Request: 56, Procedure: "nexus.test.none"})
+		}
+		var msgs []wamp.Message
+		for {
+			msg, err := wamp.RecvTimeout(cli, time.Second)
+			if err != nil {
+				t.Fatal("timed out waiting for message with policy", policy)
+			}
+			msgs = append(msgs, msg)
+			if msg.MessageType() == wamp.ABORT {
+				return msgs
+			}
+			if errMsg, ok := msg.(*wamp.Error); ok && errMsg.Request == 56 {
+				return msgs
+			}
+		}
+	}
+
+	for _, policy := range []string{"", UnknownMessageAbort} {
+		msgs := sendUnknown(policy)
+		if len(msgs) != 1 || msgs[0].MessageType() != wamp.ABORT {
+			t.Fatalf("policy %q: expected ABORT, got %v", policy, msgs)
+		}
+	}
+
+	msgs := sendUnknown(UnknownMessageIgnore)
+	if len(msgs) != 1 {
+		t.Fatalf("policy ignore: expected only reply to call, got %v", msgs)
+	}
+
+	msgs = sendUnknown(UnknownMessageError)
+	if len(msgs) != 2 {
+		t.Fatalf("policy error: expected ERROR and reply to call, got %v", msgs)
+	}
+	errMsg, ok := msgs[0].(*wamp.Error)
+	if !ok {
+		t.Fatal("policy error: expected ERROR, got", msgs[0].MessageType())
+	}
+	if errMsg.Type != 99 || errMsg.Request != 55 {
+		t.Fatal("policy error: wrong type or request ID in ERROR")
+	}
+	if errMsg.Error != wamp.ErrProtocolViolation {
+		t.Fatal("policy error: wrong error URI:", errMsg.Error)
+	}
+
+	// Check that an invalid policy is rejected.
+	if _, err := newRouter("bogus"); err == nil {
+		t.Fatal("expected error for invalid policy")
+	}
+}
+
+// authidAuthenticator accepts every client that asks to authenticate with the
+// "testauth" authmethod, using the authid given in HELLO.
+type authidAuthenticator struct{}
+
+func (a *authidAuthenticator) AuthMethod() string { return "testauth" }
+
+func (a *authidAuthenticator) Authenticate(sid wamp.ID, details wamp.Dict, client wamp.Peer) (*wamp.Welcome, error) {
+	authid, _ := wamp.AsString(details["authid"])
+	return &wamp.Welcome{Details: wamp.Dict{
+		"authid":       authid,
+		"authrole":     "user",
+		"authprovider": "static",
+	}}, nil
+}
+
+func TestPostAuthHook(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const suspendedReason = wamp.URI("nexus.error.account_suspended")
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{{
+			URI:              testRealm,
+			RequireLocalAuth: true,
+			Authenticators:   []auth.Authenticator{&authidAuthenticator{}},
+			PostAuthHook: func(sess *wamp.Session) error {
+				switch authid, _ := wamp.AsString(sess.Details["authid"]); authid {
+				case "suspended":
+					return &RejectSessionError{
+						Reason:  suspendedReason,
+						Message: "account suspended",
+					}
+				case "banned":
+					return errors.New("account banned")
+				}
+				return nil
+			},
+		}},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	hello := func(authid string) wamp.Message {
+		cli, rtr := transport.LinkedPeers()
+		defer cli.Close()
+		go r.Attach(rtr)
+		cli.Send(&wamp.Hello{Realm: testRealm, Details: wamp.Dict{
+			"roles":       clientRoles["roles"],
+			"authmethods": []string{"testauth"},
+			"authid":      authid,
+		}})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("no reply to HELLO:", err)
+		}
+		return msg
+	}
+	checkAbort := func(msg wamp.Message, reason wamp.URI, message string) {
+		abort, ok := msg.(*wamp.Abort)
+		if !ok {
+			t.Fatal("expected ABORT, got", msg.MessageType())
+		}
+		if abort.Reason != reason {
+			t.Fatal("wrong ABORT reason:", abort.Reason)
+		}
+		if abort.Details[wamp.OptMessage] != message {
+			t.Fatal("wrong ABORT message:", abort.Details[wamp.OptMessage])
+		}
+	}
+
+	if msg := hello("someone"); msg.MessageType() != wamp.WELCOME {
+		t.Fatal("expected WELCOME, got", msg.MessageType())
+	}
+	checkAbort(hello("suspended"), suspendedReason, "account suspended")
+	checkAbort(hello("banned"), wamp.ErrNotAuthorized, "account banned")
+
+	// Check that rejected sessions did not join the realm.
+	infos, err := r.(SessionLister).Sessions(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range infos {
+		if infos[i].AuthID != "someone" {
+			t.Fatal("rejected session joined realm:", infos[i].AuthID)
+		}
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				Features: Features{
+					DisableCallCanceling:            true,
+					DisablePatternBasedSubscription: true,
+				},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cli, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that the disabled features are not announced.
+	if _, err = wamp.DictValue(cli.Details, []string{"roles", "dealer", "features", wamp.FeatureCallCanceling}); err == nil {
+		t.Fatal("call canceling feature announced when disabled")
+	}
+	if _, err = wamp.DictValue(cli.Details, []string{"roles", "broker", "features", wamp.FeaturePatternSub}); err == nil {
+		t.Fatal("pattern subscription feature announced when disabled")
+	}
+	if _, err = wamp.DictValue(cli.Details, []string{"roles", "dealer", "features", wamp.FeatureCallTimeout}); err != nil {
+		t.Fatal("call timeout feature not announced")
+	}
+	// Check that the shared role info was not modified.
+	if _, err = wamp.DictValue(dealerRole, []string{"features", wamp.FeatureCallCanceling}); err != nil {
+		t.Fatal("disabling feature modified dealer role")
+	}
+
+	// Check that CANCEL is rejected.
+	cli.Send(&wamp.Cancel{Request: 123})
+	msg, err := wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := msg.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", msg.MessageType())
+	}
+	if errMsg.Type != wamp.CANCEL || errMsg.Request != 123 {
+		t.Fatal("wrong type or request ID in ERROR")
+	}
+	if errMsg.Error != wamp.ErrFeatureNotSupported {
+		t.Fatal("wrong error URI:", errMsg.Error)
+	}
+
+	// Check that prefix subscription is rejected, and exact subscription is
+	// allowed.
+	cli.Send(&wamp.Subscribe{
+		Request: 124,
+		Topic:   "nexus.test",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	msg, err = wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ERROR")
+	}
+	if errMsg, ok = msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrFeatureNotSupported {
+		t.Fatal("expected feature not supported ERROR, got:", msg)
+	}
+	cli.Send(&wamp.Subscribe{Request: 125, Topic: "nexus.test"})
+	msg, err = wamp.RecvTimeout(cli, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for SUBSCRIBED")
+	}
+	if _, ok = msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				MaxSessions:   2,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cli1, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testClient(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that the third session is aborted.
+	client, server := transport.LinkedPeers()
+	go client.Send(&wamp.Hello{Realm: testRealm, Details: clientRoles})
+	if err = r.Attach(server); err == nil {
+		t.Fatal("expected error attaching session to full realm")
+	}
+	msg, err := wamp.RecvTimeout(client, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for ABORT")
+	}
+	abort, ok := msg.(*wamp.Abort)
+	if !ok {
+		t.Fatal("expected ABORT, got:", msg.MessageType())
+	}
+	if abort.Reason != wamp.ErrQuotaExceeded {
+		t.Fatal("wrong ABORT reason:", abort.Reason)
+	}
+
+	// Check that a session can join after another session leaves.
+	cli1.Send(&wamp.Goodbye{})
+	if _, err = wamp.RecvTimeout(cli1, time.Second); err != nil {
+		t.Fatal("no GOODBYE reply:", err)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, err = testClient(r); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session could not join after session left:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const serverTime = "2020-01-01T00:00:00Z"
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				AllowDisclose: true,
+				Transform: func(msg wamp.Message) wamp.Message {
+					event, ok := msg.(*wamp.Event)
+					if !ok {
+						return msg
+					}
+					out := *event
+					out.Details = wamp.Dict{"server_time": serverTime}
+					for k, v := range event.Details {
+						out.Details[k] = v
+					}
+					return &out
+				},
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that messages other than EVENT are delivered unchanged.
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for SUBSCRIBED")
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	pub.Send(&wamp.Publish{
+		Request: wamp.GlobalID(),
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptDiscloseMe: true},
+	})
+	msg, err = wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for EVENT")
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected EVENT, got:", msg.MessageType())
+	}
+	if st, _ := wamp.AsString(event.Details["server_time"]); st != serverTime {
+		t.Fatal("transform did not add server_time detail")
+	}
+	if _, ok = event.Details["publisher"]; !ok {
+		t.Fatal("transform lost existing event details")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const idleTimeout = time.Minute
+	clock := newFakeClock()
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:           testRealm,
+				AnonymousAuth: true,
+				IdleTimeout:   idleTimeout,
+			},
+		},
+		Debug: debug,
+		Clock: clock,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	subscribe := func(cli *wamp.Session) {
+		t.Helper()
+		cli.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+		msg, err := wamp.RecvTimeout(cli, time.Second)
+		if err != nil {
+			t.Fatal("timed out waiting for SUBSCRIBED")
+		}
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("expected SUBSCRIBED, got:", msg.MessageType())
+		}
+	}
+
+	// Send a message from each client, so that each session is handling
+	// messages and has started its idle timer.
+	idle, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(idle)
+	active, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(active)
+
+	clock.Advance(idleTimeout / 2)
+	subscribe(active)
+	clock.Advance(idleTimeout/2 + time.Second)
+
+	// Check that the idle session is closed.
+	msg, err := wamp.RecvTimeout(idle, time.Second)
+	if err != nil {
+		t.Fatal("timed out waiting for GOODBYE")
+	}
+	goodbye, ok := msg.(*wamp.Goodbye)
+	if !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+	if goodbye.Reason != wamp.CloseTimeout {
+		t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+	}
+
+	// Check that the active session is not closed.
+	if msg, err = wamp.RecvTimeout(active, 100*time.Millisecond); err == nil {
+		t.Fatal("active session received unexpected", msg.MessageType())
+	}
+
+	active.Send(&wamp.Goodbye{Reason: wamp.CloseRealm, Details: wamp.Dict{}})
+	if msg, err = wamp.RecvTimeout(active, time.Second); err != nil {
+		t.Fatal("timed out waiting for GOODBYE")
+	}
+	if _, ok = msg.(*wamp.Goodbye); !ok {
+		t.Fatal("expected GOODBYE, got:", msg.MessageType())
+	}
+}
+
+func TestRealmProvider(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var provided []wamp.URI
+	var mu sync.Mutex
+	r, err := NewRouter(&Config{
+		RealmProvider: func(realm wamp.URI) (*RealmConfig, bool) {
+			mu.Lock()
+			provided = append(provided, realm)
+			mu.Unlock()
+			if !realm.PrefixMatch("tenant.") {
+				return nil, false
+			}
+			return &RealmConfig{
+				AnonymousAuth:    true,
+				RequireLocalAuth: true,
+				DefaultAuthRole:  string(realm),
+			}, true
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	const tenantRealm = wamp.URI("tenant.acme")
+	cli, err := testClientInRealm(r, tenantRealm)
+	if err != nil {
+		t.Fatal("failed to join provided realm:", err)
+	}
+	if authrole, _ := wamp.AsString(cli.Details["authrole"]); authrole != string(tenantRealm) {
+		t.Fatal("provided realm config not used, authrole:", authrole)
+	}
+
+	// Check that the provider is not called for a realm that exists.
+	if _, err = testClientInRealm(r, tenantRealm); err != nil {
+		t.Fatal("failed to join provided realm:", err)
+	}
+
+	// Check that a realm the provider does not provide cannot be joined.
+	if _, err = testClientInRealm(r, "other.realm"); err == nil {
+		t.Fatal("expected error joining realm that was not provided")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(provided) != 2 || provided[0] != tenantRealm || provided[1] != "other.realm" {
+		t.Fatal("wrong realms requested from provider:", provided)
+	}
+}
+
+func TestRegisterMetaProcedure(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(&Config{
+		RealmConfigs: []*RealmConfig{
+			{
+				URI:               testRealm,
+				AnonymousAuth:     true,
+				Authorizer:        &testAuthzMeta{},
+				RequireLocalAuthz: true,
+			},
+		},
+		Debug: debug,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	registrar := r.(MetaProcedureRegistrar)
+
+	const killIdleProc = wamp.URI("wamp.session.kill_idle")
+	const flushProc = wamp.URI("wamp.myapp.flush_cache")
+	var mu sync.Mutex
+	var callerID wamp.ID
+	flush := func(inv *wamp.Invocation) wamp.Message {
+		mu.Lock()
+		callerID, _ = wamp.AsID(inv.Details["caller"])
+		mu.Unlock()
+		if len(inv.Arguments) != 0 {
+			return &wamp.Error{Error: wamp.ErrInvalidArgument}
+		}
+		return &wamp.Yield{Arguments: wamp.List{"flushed"}}
+	}
+	if err = registrar.RegisterMetaProcedure(testRealm, flushProc, flush); err != nil {
+		t.Fatal("failed to register meta procedure:", err)
+	}
+	if err = registrar.RegisterMetaProcedure(testRealm, killIdleProc, flush); err != nil {
+		t.Fatal("failed to register meta procedure:", err)
+	}
+	if err = registrar.RegisterMetaProcedure(testRealm, "myapp.flush_cache", flush); err == nil {
+		t.Fatal("expected error registering meta procedure outside wamp namespace")
+	}
+
+	// Check that built-in meta procedures cannot be replaced.
+	if err = registrar.RegisterMetaProcedure(testRealm, wamp.MetaProcSessionCount, flush); err == nil {
+		t.Fatal("expected error registering built-in meta procedure")
+	}
+	if err = registrar.RegisterMetaProcedure("nexus.no.realm", flushProc, flush); err == nil {
+		t.Fatal("expected error registering in missing realm")
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(procedure wamp.URI, args wamp.List) wamp.Message {
+		t.Helper()
+		reqID := wamp.GlobalID()
+		caller.Send(&wamp.Call{Request: reqID, Procedure: procedure, Arguments: args})
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *wamp.Result:
+			if msg.Request != reqID {
+				t.Fatal("wrong request ID in RESULT")
+			}
+		case *wamp.Error:
+			if msg.Request != reqID {
+				t.Fatal("wrong request ID in ERROR")
+			}
+		}
+		return msg
+	}
+
+	msg := call(flushProc, nil)
+	result, ok := msg.(*wamp.Result)
+	if !ok {
+		t.Fatal("Expected RESULT, got:", msg.MessageType())
+	}
+	if len(result.Arguments) != 1 || result.Arguments[0] != "flushed" {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+	mu.Lock()
+	if callerID != caller.ID {
+		t.Fatal("caller not disclosed to meta procedure handler")
+	}
+	mu.Unlock()
+
+	msg = call(flushProc, wamp.List{"bogus"})
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("Expected invalid_argument ERROR, got:", msg)
+	}
+
+	// Check that built-in meta procedures still work.
+	msg = call(wamp.MetaProcSessionCount, nil)
+	if _, ok = msg.(*wamp.Result); !ok {
+		t.Fatal("Expected RESULT, got:", msg.MessageType())
+	}
+
+	// Check that calls are authorized.
+	msg = call(killIdleProc, nil)
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("Expected not_authorized ERROR, got:", msg)
+	}
+}
+
+func TestMetaProcedureBlocking(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	const slowProc = wamp.URI("wamp.myapp.slow")
+	release := make(chan struct{})
+	slow := func(inv *wamp.Invocation) wamp.Message {
+		<-release
+		return &wamp.Yield{}
+	}
+	registrar := r.(MetaProcedureRegistrar)
+	if err = registrar.RegisterMetaProcedure(testRealm, slowProc, slow); err != nil {
+		t.Fatal("failed to register meta procedure:", err)
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: slowID, Procedure: slowProc})
+
+	// Check that a blocked handler does not delay other meta procedures.
+	countID := wamp.GlobalID()
+	caller.Send(&wamp.Call{Request: countID, Procedure: wamp.MetaProcSessionCount})
+	msg, err := wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		close(release)
+		t.Fatal("session count delayed by blocked meta procedure:", err)
+	}
+	if result, ok := msg.(*wamp.Result); !ok || result.Request != countID {
+		t.Fatal("Expected RESULT for session count, got:", msg)
+	}
+
+	close(release)
+	msg, err = wamp.RecvTimeout(caller, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := msg.(*wamp.Result); !ok || result.Request != slowID {
+		t.Fatal("Expected RESULT for slow procedure, got:", msg)
+	}
+}
+
+func TestMetaProcedureRealmClosed(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	realm, err := r.(*router).getRealm(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const slowProc = wamp.URI("wamp.myapp.slow")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := func(inv *wamp.Invocation) wamp.Message {
+		close(started)
+		<-release
+		return &wamp.Yield{}
+	}
+	if err = realm.RegisterMetaProcedure(slowProc, slow); err != nil {
+		t.Fatal("failed to register meta procedure:", err)
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller.Send(&wamp.Call{Request: wamp.GlobalID(), Procedure: slowProc})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("meta procedure handler not called")
+	}
+
+	// Check that removing the realm waits for the running handler, and that
+	// the handler's response does not block after the realm is closed.
+	removed := make(chan struct{})
+	go func() {
+		r.RemoveRealm(testRealm)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("realm closed while meta procedure handler running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("realm did not close after meta procedure handler returned")
+	}
+
+	// Check that a meta procedure cannot be registered on a closed realm.
+	err = realm.RegisterMetaProcedure("wamp.myapp.other", slow)
+	if err == nil {
+		t.Fatal("expected error registering meta procedure on closed realm")
+	}
+}
+
+func TestUpdateRealmConfigClosed(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	updater := r.(RealmUpdater)
+
+	// Check that the update function can call the router.
+	done := make(chan error, 1)
+	go func() {
+		done <- updater.UpdateRealmConfig(testRealm, func(cfg *RealmConfig) {
+			if err := updater.SetAuthorizer(testRealm, nil); err != nil {
+				t.Error("failed to set authorizer:", err)
+			}
+			cfg.MetaStrict = true
+		})
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("failed to update realm config:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update function blocked calling the router")
+	}
+
+	// Check that a closed realm cannot be updated.
+	realm, err := r.(*router).getRealm(testRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoveRealm(testRealm)
+	err = realm.UpdateConfig(func(cfg *RealmConfig) {
+		cfg.MetaStrict = false
+	})
+	if err == nil {
+		t.Fatal("expected error updating closed realm")
+	}
+}
@@ -120,3 +120,116 @@ func TestSessionTestaments(t *testing.T) {
 
 	sub.Close()
 }
+
+// Test that testaments of both scopes are published when the session leaves,
+// that flushing removes the testaments of only the flushed scope, and that an
+// invalid scope is rejected.
+func TestSessionTestamentScopes(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{
+		Request: wamp.GlobalID(),
+		Topic:   "testament",
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("expected SUBSCRIBED, got", msg.MessageType())
+	}
+
+	caller, err := testClient(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Calls a testament meta procedure and returns the response.
+	callMeta := func(procedure wamp.URI, args wamp.List, kwargs wamp.Dict) wamp.Message {
+		t.Helper()
+		callID := wamp.GlobalID()
+		caller.Send(&wamp.Call{
+			Request:     callID,
+			Procedure:   procedure,
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+		msg, err := wamp.RecvTimeout(caller, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *wamp.Result:
+			if msg.Request != callID {
+				t.Fatal("wrong result ID")
+			}
+		case *wamp.Error:
+			if msg.Request != callID {
+				t.Fatal("wrong error ID")
+			}
+		}
+		return msg
+	}
+	addTestament := func(topic wamp.URI, scope string) {
+		t.Helper()
+		msg := callMeta(wamp.MetaProcSessionAddTestament,
+			wamp.List{topic, wamp.List{scope}, wamp.Dict{}},
+			wamp.Dict{"scope": scope})
+		if _, ok := msg.(*wamp.Result); !ok {
+			t.Fatal("expected RESULT, got", msg.MessageType())
+		}
+	}
+
+	addTestament("testament.detached", "detached")
+	addTestament("testament.destroyed", "destroyed")
+	addTestament("testament.flushed", "destroyed")
+
+	msg = callMeta(wamp.MetaProcSessionAddTestament,
+		wamp.List{"testament.bad", wamp.List{}, wamp.Dict{}},
+		wamp.Dict{"scope": "bogus"})
+	if errMsg, ok := msg.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected invalid_argument ERROR for invalid scope, got", msg)
+	}
+
+	// Flushing the destroyed testaments removes both destroyed testaments, so
+	// add the destroyed testament back.
+	msg = callMeta(wamp.MetaProcSessionFlushTestaments, nil, wamp.Dict{"scope": "destroyed"})
+	if _, ok := msg.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got", msg.MessageType())
+	}
+	addTestament("testament.destroyed", "destroyed")
+
+	caller.Close()
+
+	// Check that the detached testament is published, followed by the
+	// destroyed testament, and that the flushed testament is not published.
+	for _, scope := range []string{"detached", "destroyed"} {
+		msg, err = wamp.RecvTimeout(sub, time.Second)
+		if err != nil {
+			t.Fatal("did not receive", scope, "testament:", err)
+		}
+		event, ok := msg.(*wamp.Event)
+		if !ok {
+			t.Fatal("expected EVENT, got", msg.MessageType())
+		}
+		if event.Details[detailTopic] != wamp.URI("testament."+scope) {
+			t.Fatal("wrong topic for", scope, "testament:", event.Details[detailTopic])
+		}
+		if val, _ := wamp.AsString(event.Arguments[0]); val != scope {
+			t.Fatal("wrong argument for", scope, "testament:", val)
+		}
+	}
+	if msg, err = wamp.RecvTimeout(sub, 200*time.Millisecond); err == nil {
+		t.Fatal("unexpected message:", msg)
+	}
+	sub.Close()
+}
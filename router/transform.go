@@ -0,0 +1,37 @@
+package router
+
+import (
+	"context"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+// transformPeer wraps the peer of a client session, and applies the realm's
+// Transform function to each message sent to the peer.  The transform is
+// called by the goroutine sending the message, before the message is written
+// to the peer, and not while holding any session or realm lock.
+type transformPeer struct {
+	wamp.Peer
+	transform func(wamp.Message) wamp.Message
+}
+
+func (p *transformPeer) Send(msg wamp.Message) error {
+	return p.Peer.Send(p.apply(msg))
+}
+
+func (p *transformPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	return p.Peer.SendCtx(ctx, p.apply(msg))
+}
+
+func (p *transformPeer) TrySend(msg wamp.Message) error {
+	return p.Peer.TrySend(p.apply(msg))
+}
+
+// apply returns the transformed message.  If the transform returns nil, then
+// the original message is sent.
+func (p *transformPeer) apply(msg wamp.Message) wamp.Message {
+	if out := p.transform(msg); out != nil {
+		return out
+	}
+	return msg
+}
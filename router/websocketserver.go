@@ -26,6 +26,10 @@ const (
 	cborWebsocketProtocol    = "wamp.2.cbor"
 
 	defaultOutQueueSize = 64
+
+	// defaultHandshakeTimeout is the time allowed for a client to finish
+	// connecting and opening a WAMP session, if not configured.
+	defaultHandshakeTimeout = 10 * time.Second
 )
 
 type protocol struct {
@@ -96,6 +100,25 @@ type WebsocketServer struct {
 	// client.  The default is defaultOutQueueSize.
 	OutQueueSize int
 
+	// HandshakeTimeout is the maximum time allowed for a client to send the
+	// HTTP upgrade request headers, and then to open a WAMP session by
+	// sending HELLO and completing authentication.  A client that does not
+	// finish within this time is disconnected.  This protects against clients
+	// that open connections and then never send anything.  The default is
+	// defaultHandshakeTimeout.
+	//
+	// The HTTP request timeout only applies when using the server's
+	// ListenAndServe methods.  When using ServeHTTP with another http.Server,
+	// configure that server's ReadHeaderTimeout.
+	HandshakeTimeout time.Duration
+
+	// PostListen, if not nil, is called by the ListenAndServe methods after
+	// the listener is created and before serving any connections.  This
+	// allows a process that starts as root, to bind a privileged port, to
+	// then drop privileges or chroot.  If PostListen returns an error, then
+	// the listener is closed and the error is returned.
+	PostListen func() error
+
 	router    Router
 	protocols map[string]protocol
 }
@@ -229,13 +252,18 @@ func (s *WebsocketServer) ListenAndServe(address string) (io.Closer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = postListen(l, s.PostListen); err != nil {
+		return nil, err
+	}
 
 	// Run service on configured port.
 	server := &http.Server{
-		Handler: s,
-		Addr:    l.Addr().String(),
+		Handler:           s,
+		Addr:              l.Addr().String(),
+		ReadHeaderTimeout: s.handshakeTimeout(),
 	}
-	go server.Serve(l)
+	// Count the bytes on each connection so that the peers can report them.
+	go server.Serve(transport.NewCountingListener(l))
 	return l, nil
 }
 
@@ -267,12 +295,16 @@ func (s *WebsocketServer) ListenAndServeTLS(address string, tlscfg *tls.Config,
 	if err != nil {
 		return nil, err
 	}
+	if err = postListen(l, s.PostListen); err != nil {
+		return nil, err
+	}
 
 	// Run service on configured port.
 	server := &http.Server{
-		Handler:   s,
-		Addr:      l.Addr().String(),
-		TLSConfig: tlscfg,
+		Handler:           s,
+		Addr:              l.Addr().String(),
+		TLSConfig:         tlscfg,
+		ReadHeaderTimeout: s.handshakeTimeout(),
 	}
 	go server.ServeTLS(l, "", "")
 	return l, nil
@@ -326,7 +358,12 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.handleWebsocket(conn, wamp.Dict{"auth": authDict})
+	s.handleWebsocket(conn, wamp.Dict{
+		"type":      "websocket",
+		"peer":      r.RemoteAddr,
+		"is_secure": r.TLS != nil,
+		"auth":      authDict,
+	})
 }
 
 // addProtocol registers a serializer for protocol and payload type.
@@ -374,9 +411,36 @@ func (s *WebsocketServer) handleWebsocket(conn transport.WebsocketConnection, tr
 	if qsize == 0 {
 		qsize = defaultOutQueueSize
 	}
+	// Disconnect the client if it does not open a session in time.
+	setHandshakeDeadline(conn, time.Now().Add(s.handshakeTimeout()))
 	peer := transport.NewWebsocketPeer(conn, serializer, payloadType, s.router.Logger(), s.KeepAlive, qsize)
 	if err := s.router.AttachClient(peer, transportDetails); err != nil {
 		s.router.Logger().Println("Client cannot attach to router:", err)
+		return
+	}
+	setHandshakeDeadline(conn, time.Time{})
+}
+
+func (s *WebsocketServer) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout == 0 {
+		return defaultHandshakeTimeout
+	}
+	return s.HandshakeTimeout
+}
+
+// deadlineConn is implemented by websocket connections that support read
+// deadlines, such as *websocket.Conn.
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// setHandshakeDeadline sets the read deadline of the connection, if it
+// supports deadlines.  A zero time clears the deadline.  The write deadline is
+// not set, because a websocket connection's write deadline cannot be changed
+// while the peer is writing to the connection.
+func setHandshakeDeadline(conn transport.WebsocketConnection, t time.Time) {
+	if dc, ok := conn.(deadlineConn); ok {
+		dc.SetReadDeadline(t)
 	}
 }
 
@@ -3,8 +3,10 @@ package router
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
 	"github.com/gammazero/nexus/v3/transport"
@@ -227,3 +229,68 @@ func TestAllowOriginsWithPorts(t *testing.T) {
 		t.Error("Should have allowed:", allowed)
 	}
 }
+
+func TestWSPostListen(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Check that the listener accepts connections when the hook is called.
+	var called bool
+	s := NewWebsocketServer(r)
+	s.PostListen = func() error {
+		called = true
+		conn, err := net.Dial("tcp", wsAddr)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal("hook failed:", err)
+	}
+	defer closer.Close()
+	if !called {
+		t.Fatal("hook was not called")
+	}
+}
+
+func TestWSHandshakeTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, err := NewRouter(routerConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := NewWebsocketServer(r)
+	s.HandshakeTimeout = 100 * time.Millisecond
+	closer, err := s.ListenAndServe(wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// Check that a client that does not send HELLO is disconnected.
+	client, err := transport.ConnectWebsocketPeer(context.Background(),
+		fmt.Sprintf("ws://%s/", wsAddr), serialize.JSON, nil, r.Logger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case _, ok := <-client.Recv():
+		if ok {
+			t.Fatal("expected client to be disconnected")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client without HELLO was not disconnected")
+	}
+}
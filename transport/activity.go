@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ActivityTracker is implemented by peers that record when they last received
+// anything from the other side of the connection.  This includes
+// transport-level pings and pongs, as well as WAMP messages.
+type ActivityTracker interface {
+	// LastRecv returns the time when anything was last received.
+	LastRecv() time.Time
+}
+
+// lastRecv records the time that anything was last received.  The zero value
+// means that nothing has been received.
+type lastRecv struct {
+	nanos int64
+}
+
+// touch sets the time that anything was last received to now.
+func (r *lastRecv) touch() { atomic.StoreInt64(&r.nanos, time.Now().UnixNano()) }
+
+// LastRecv returns the time when anything was last received.  Returns the zero
+// time if nothing has been received.
+func (r *lastRecv) LastRecv() time.Time {
+	nanos := atomic.LoadInt64(&r.nanos)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ByteCounter is implemented by peers and connections that count the number
+// of bytes they transfer.
+type ByteCounter interface {
+	// BytesSent returns the number of bytes written to the connection.
+	BytesSent() uint64
+	// BytesReceived returns the number of bytes read from the connection.
+	BytesReceived() uint64
+}
+
+// CountingConn is a net.Conn that counts the bytes read from and written to
+// the connection it wraps.  Since it counts the bytes passed to the network
+// connection, the counts include any framing, compression, and encryption
+// done above it.
+type CountingConn struct {
+	// Keep 64-bit words first for atomic alignment on 32-bit platforms.
+	sent     uint64
+	received uint64
+
+	net.Conn
+}
+
+// NewCountingConn returns a CountingConn that wraps conn.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+// Read reads data from the connection and counts the bytes read.
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.received, uint64(n))
+	return n, err
+}
+
+// Write writes data to the connection and counts the bytes written.
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.sent, uint64(n))
+	return n, err
+}
+
+// BytesSent returns the number of bytes written to the connection.
+func (c *CountingConn) BytesSent() uint64 { return atomic.LoadUint64(&c.sent) }
+
+// BytesReceived returns the number of bytes read from the connection.
+func (c *CountingConn) BytesReceived() uint64 {
+	return atomic.LoadUint64(&c.received)
+}
+
+// countingListener is a net.Listener that wraps accepted connections in a
+// CountingConn.
+type countingListener struct {
+	net.Listener
+}
+
+// NewCountingListener returns a net.Listener that wraps each accepted
+// connection in a CountingConn.
+func NewCountingListener(l net.Listener) net.Listener {
+	return countingListener{l}
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewCountingConn(conn), nil
+}
+
+// connByteCounter returns the ByteCounter for a connection, or for the
+// network connection underlying a websocket connection.  Returns nil if the
+// connection does not count bytes.
+func connByteCounter(conn interface{}) ByteCounter {
+	if bc, ok := conn.(ByteCounter); ok {
+		return bc
+	}
+	if uc, ok := conn.(interface{ UnderlyingConn() net.Conn }); ok {
+		if bc, ok := uc.UnderlyingConn().(ByteCounter); ok {
+			return bc
+		}
+	}
+	return nil
+}
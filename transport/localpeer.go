@@ -3,6 +3,7 @@ package transport
 import (
 	"context"
 
+	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 )
 
@@ -41,10 +42,28 @@ func LinkedPeersQSize(queueSize int) (wamp.Peer, wamp.Peer) {
 	return c, r
 }
 
+// LinkedPeersSerialized is the same as LinkedPeersQSize, except that each
+// message sent by either peer is serialized and then deserialized using the
+// given serializer, and the deserialized message is received by the other
+// peer.  This exercises serialization without a network connection, so that
+// serialization problems are found by in-process tests.  A message that
+// cannot be serialized or deserialized is not sent, and the error is returned
+// by Send.  If serializer is nil, then messages are passed as is, the same as
+// LinkedPeersQSize.
+func LinkedPeersSerialized(queueSize int, serializer serialize.Serializer) (wamp.Peer, wamp.Peer) {
+	c, r := LinkedPeersQSize(queueSize)
+	c.(*localPeer).serializer = serializer
+	r.(*localPeer).serializer = serializer
+	return c, r
+}
+
 // localPeer implements Peer
 type localPeer struct {
 	rd <-chan wamp.Message
 	wr chan<- wamp.Message
+
+	// If not nil, serializes and deserializes each sent message.
+	serializer serialize.Serializer
 }
 
 // IsLocal returns true is the wamp.Peer is a localPeer.
@@ -55,10 +74,18 @@ func (p *localPeer) Recv() <-chan wamp.Message { return p.rd }
 
 // TrySend writes a message to the peer's outbound message channel.
 func (p *localPeer) TrySend(msg wamp.Message) error {
+	msg, err := p.roundTrip(msg)
+	if err != nil {
+		return err
+	}
 	return wamp.TrySend(p.wr, msg)
 }
 
 func (p *localPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
+	msg, err := p.roundTrip(msg)
+	if err != nil {
+		return err
+	}
 	return wamp.SendCtx(ctx, p.wr, msg)
 }
 
@@ -66,10 +93,27 @@ func (p *localPeer) SendCtx(ctx context.Context, msg wamp.Message) error {
 // Typically called by clients, since it is OK for the router to block a client
 // since this will not block other clients.
 func (p *localPeer) Send(msg wamp.Message) error {
+	msg, err := p.roundTrip(msg)
+	if err != nil {
+		return err
+	}
 	p.wr <- msg
 	return nil
 }
 
+// roundTrip returns the message after serializing and deserializing it, if
+// the peer has a serializer.  Otherwise, the message is returned as is.
+func (p *localPeer) roundTrip(msg wamp.Message) (wamp.Message, error) {
+	if p.serializer == nil {
+		return msg, nil
+	}
+	b, err := p.serializer.Serialize(msg)
+	if err != nil {
+		return nil, err
+	}
+	return p.serializer.Deserialize(b)
+}
+
 // Close closes the outgoing channel, waking any readers waiting on data from
 // this peer.
 func (p *localPeer) Close() { close(p.wr) }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gammazero/nexus/v3/transport/serialize"
 	"github.com/gammazero/nexus/v3/wamp"
 )
 
@@ -110,3 +111,49 @@ func BenchmarkRouterToClient(b *testing.B) {
 		<-c.Recv()
 	}
 }
+
+func TestSerializedLinkedPeers(t *testing.T) {
+	c, r := LinkedPeersSerialized(0, &serialize.JSONSerializer{})
+
+	sent := &wamp.Welcome{ID: 123, Details: wamp.Dict{"x": 42}}
+	if err := r.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-c.Recv()
+	welcome, ok := msg.(*wamp.Welcome)
+	if !ok {
+		t.Fatal("expected WELCOME, got:", msg.MessageType())
+	}
+	if welcome == sent {
+		t.Fatal("message was not serialized")
+	}
+	if welcome.ID != 123 {
+		t.Fatal("wrong session ID:", welcome.ID)
+	}
+	// JSON decodes numbers as uint64, so the value only has the original type
+	// if the message was not serialized.
+	if _, ok = welcome.Details["x"].(int); ok {
+		t.Fatal("message details were not serialized")
+	}
+	if x, _ := wamp.AsInt64(welcome.Details["x"]); x != 42 {
+		t.Fatal("wrong detail value:", welcome.Details["x"])
+	}
+
+	// Check that a message that cannot be serialized is not sent.
+	bad := &wamp.Event{Details: wamp.Dict{}, Arguments: wamp.List{complex(1, 2)}}
+	if err := r.TrySend(bad); err == nil {
+		t.Fatal("expected error sending message that cannot be serialized")
+	}
+	select {
+	case msg = <-c.Recv():
+		t.Fatal("received message that cannot be serialized")
+	default:
+	}
+
+	// Check that messages are passed as is without a serializer.
+	c, r = LinkedPeersSerialized(0, nil)
+	r.Send(sent)
+	if msg = <-c.Recv(); msg != sent {
+		t.Fatal("message was changed without serializer")
+	}
+}
@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pinger is implemented by peers that can measure the round-trip time to the
+// other side of the connection using transport-level pings.
+type Pinger interface {
+	// Ping sends a transport-level ping and waits for the matching pong.
+	// Returns the round-trip time, or an error if the context is done before
+	// the pong is received.
+	Ping(ctx context.Context) (time.Duration, error)
+}
+
+// ErrPeerClosed is returned by Ping if the peer is closed while waiting for a
+// pong.
+var ErrPeerClosed = errors.New("peer closed")
+
+// pingTracker matches received pongs with the pings waiting for them.  Each
+// ping has a unique payload that the other side returns in its pong.
+type pingTracker struct {
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[string]chan struct{}
+}
+
+// ping sends a ping, using the send function, and waits for the matching pong
+// or for ctx or done to be done.
+func (p *pingTracker) ping(ctx context.Context, done <-chan struct{}, send func(payload []byte) error) (time.Duration, error) {
+	p.mutex.Lock()
+	p.seq++
+	payload := "ping-" + strconv.FormatUint(p.seq, 10)
+	if p.pending == nil {
+		p.pending = map[string]chan struct{}{}
+	}
+	pong := make(chan struct{})
+	p.pending[payload] = pong
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		delete(p.pending, payload)
+		p.mutex.Unlock()
+	}()
+
+	start := time.Now()
+	if err := send([]byte(payload)); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-done:
+		return 0, ErrPeerClosed
+	}
+}
+
+// pong wakes the ping waiting for the pong with the given payload.  Pongs that
+// do not match a waiting ping, such as keepalive pongs, are ignored.
+func (p *pingTracker) pong(payload string) {
+	p.mutex.Lock()
+	if pong, ok := p.pending[payload]; ok {
+		close(pong)
+		delete(p.pending, payload)
+	}
+	p.mutex.Unlock()
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"strings"
 	"time"
@@ -19,7 +18,11 @@ import (
 // rawSocketPeer implements the Peer interface, connecting the Send and Recv
 // methods to a socket.
 type rawSocketPeer struct {
-	conn       net.Conn
+	// Time anything, including pings and pongs, was last received.  Keep
+	// 64-bit words first for atomic alignment on 32-bit platforms.
+	lastRecv
+
+	conn       *CountingConn
 	serializer serialize.Serializer
 	sendLimit  int
 	recvLimit  int
@@ -36,9 +39,16 @@ type rawSocketPeer struct {
 
 	writerDone chan struct{}
 
+	// Pings sent by Ping that are waiting for a pong.
+	pings pingTracker
+
 	log stdlog.StdLog
 }
 
+// ErrSerializerUnsupported is returned when connecting a peer to a router that
+// does not support the requested serialization.
+var ErrSerializerUnsupported = errors.New("serializer unsupported")
+
 const (
 	// Serializers
 	rawsocketJSON    = 1
@@ -62,8 +72,18 @@ const (
 //
 // If recvLimit is > 0, then the client will not receive messages with size
 // larger than the nearest power of 2 greater than or equal to recvLimit.  If
-// recvLimit is <= 0, then the default of 16M is used.
+// recvLimit is <= 0, then the default of 16M is used.  Messages are not sent if
+// larger than the smaller of this limit and the limit of the other side, and
+// the connection is closed if a message larger than recvLimit is received.
 func ConnectRawSocketPeer(ctx context.Context, network, addr string, serialization serialize.Serialization, tlsConfig *tls.Config, logger stdlog.StdLog, recvLimit int) (wamp.Peer, error) {
+	return ConnectRawSocketPeerDial(ctx, nil, network, addr, serialization, tlsConfig, logger, recvLimit)
+}
+
+// ConnectRawSocketPeerDial is the same as ConnectRawSocketPeer, except that
+// the network connection is made by calling dial.  This allows the use of a
+// proxy-aware or instrumented dialer.  If dial is nil, then the connection is
+// made using a net.Dialer.
+func ConnectRawSocketPeerDial(ctx context.Context, dial DialContextFunc, network, addr string, serialization serialize.Serialization, tlsConfig *tls.Config, logger stdlog.StdLog, recvLimit int) (wamp.Peer, error) {
 	err := checkNetworkType(network)
 	if err != nil {
 		return nil, err
@@ -74,8 +94,11 @@ func ConnectRawSocketPeer(ctx context.Context, network, addr string, serializati
 		return nil, err
 	}
 
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, network, addr)
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +150,9 @@ func ConnectRawSocketPeer(ctx context.Context, network, addr string, serializati
 //
 // If recvLimit is > 0, then the client will not receive messages with size
 // larger than the nearest power of 2 greater than or equal to recvLimit.  If
-// recvLimit is <= 0, then the default of 16M is used.
+// recvLimit is <= 0, then the default of 16M is used.  Messages are not sent if
+// larger than the smaller of this limit and the limit of the other side, and
+// the connection is closed if a message larger than recvLimit is received.
 func AcceptRawSocket(conn net.Conn, logger stdlog.StdLog, recvLimit, outQueueSize int) (wamp.Peer, error) {
 	peer, err := serverHandshake(conn, logger, recvLimit, outQueueSize)
 	if err != nil {
@@ -142,7 +167,7 @@ func AcceptRawSocket(conn net.Conn, logger stdlog.StdLog, recvLimit, outQueueSiz
 // servers to handle connections from clients.
 func newRawSocketPeer(conn net.Conn, serializer serialize.Serializer, logger stdlog.StdLog, sendLimit, recvLimit, outQueueSize int) *rawSocketPeer {
 	rs := &rawSocketPeer{
-		conn:       conn,
+		conn:       NewCountingConn(conn),
 		serializer: serializer,
 		sendLimit:  sendLimit,
 		recvLimit:  recvLimit,
@@ -188,6 +213,30 @@ func (rs *rawSocketPeer) Send(msg wamp.Message) error {
 
 func (rs *rawSocketPeer) IsLocal() bool { return false }
 
+// Serialization returns the serialization used by the peer.
+func (rs *rawSocketPeer) Serialization() serialize.Serialization {
+	return serializationOf(rs.serializer)
+}
+
+// BytesSent returns the number of bytes written to the socket.
+func (rs *rawSocketPeer) BytesSent() uint64 { return rs.conn.BytesSent() }
+
+// BytesReceived returns the number of bytes read from the socket.
+func (rs *rawSocketPeer) BytesReceived() uint64 { return rs.conn.BytesReceived() }
+
+// Ping sends a rawsocket PING message and waits for the matching PONG.
+// Returns the round-trip time.
+func (rs *rawSocketPeer) Ping(ctx context.Context) (time.Duration, error) {
+	return rs.pings.ping(ctx, rs.ctxSender.Done(), func(payload []byte) error {
+		// Write the header and payload together so that they are not
+		// interleaved with messages written by sendHandler.
+		lenBytes := intToBytes(len(payload))
+		buf := append([]byte{0x1, lenBytes[0], lenBytes[1], lenBytes[2]}, payload...)
+		_, err := rs.conn.Write(buf)
+		return err
+	})
+}
+
 // Close closes the rawsocket peer.  This closes the local send channel, and
 // sends a close control message to the socket to tell the other side to
 // close.
@@ -213,34 +262,26 @@ func (rs *rawSocketPeer) sendHandler() {
 	defer close(rs.writerDone)
 	defer rs.cancelSender()
 
+	var buf []byte
 	senderDone := rs.ctxSender.Done()
-sendLoop:
 	for {
 		select {
 		case msg := <-rs.wr:
-			b, err := rs.serializer.Serialize(msg)
-			if err != nil {
-				rs.log.Print(err)
-				continue sendLoop
+			buf = rs.appendMessage(buf[:0], msg)
+			// Any other messages that are already queued are written along
+			// with this one, so that a burst of messages is written to the
+			// connection at once.
+			for n := len(rs.wr); n > 0; n-- {
+				msg = <-rs.wr
+				buf = rs.appendMessage(buf, msg)
 			}
-			if len(b) > rs.sendLimit {
-				rs.log.Println("Message size", len(b), "exceeds limit of",
-					rs.sendLimit)
-				continue sendLoop
-			}
-			lenBytes := intToBytes(len(b))
-			header := []byte{0x0, lenBytes[0], lenBytes[1], lenBytes[2]}
-			if _, err = rs.conn.Write(header); err != nil {
-				if !wamp.IsGoodbyeAck(msg) {
-					rs.log.Println("Error writing header:", err)
-				}
-				continue sendLoop
+			if len(buf) == 0 {
+				continue
 			}
-			if _, err = rs.conn.Write(b); err != nil {
+			if _, err := rs.conn.Write(buf); err != nil {
 				if !wamp.IsGoodbyeAck(msg) {
 					rs.log.Println("Error writing message:", msg, err)
 				}
-				continue sendLoop
 			}
 		case <-senderDone:
 			return
@@ -248,6 +289,25 @@ sendLoop:
 	}
 }
 
+// appendMessage appends the header and serialized message to buf.  If the
+// message cannot be serialized or is too large, then buf is returned
+// unchanged.
+func (rs *rawSocketPeer) appendMessage(buf []byte, msg wamp.Message) []byte {
+	b, err := rs.serializer.Serialize(msg)
+	if err != nil {
+		rs.log.Print(err)
+		return buf
+	}
+	if len(b) > rs.sendLimit {
+		rs.log.Println("Message size", len(b), "exceeds limit of",
+			rs.sendLimit)
+		return buf
+	}
+	lenBytes := intToBytes(len(b))
+	buf = append(buf, 0x0, lenBytes[0], lenBytes[1], lenBytes[2])
+	return append(buf, b...)
+}
+
 // recvHandler pulls messages from the socket and pushes them to the read
 // channel.
 func (rs *rawSocketPeer) recvHandler() {
@@ -276,6 +336,8 @@ MsgLoop:
 			return
 		}
 
+		rs.touch()
+
 		length := bytesToInt(header[1:])
 		if length > rs.recvLimit {
 			rs.log.Print("Received message that exceeded size limit, closing")
@@ -313,12 +375,13 @@ MsgLoop:
 			}
 			continue MsgLoop
 		case 2: // PONG
-			_, err = io.CopyN(ioutil.Discard, rs.conn, int64(length))
-			if err != nil {
+			buf := make([]byte, length)
+			if _, err = io.ReadFull(rs.conn, buf); err != nil {
 				rs.log.Println("Error reading PONG:", err)
 				rs.conn.Close()
 				return
 			}
+			rs.pings.pong(string(buf))
 			continue MsgLoop
 		}
 
@@ -369,7 +432,7 @@ func clientHandshake(conn net.Conn, logger stdlog.StdLog, protocol byte, recvLim
 		case 0:
 			return nil, errors.New("illegal error code")
 		case 1:
-			return nil, errors.New("serializer unsupported")
+			return nil, ErrSerializerUnsupported
 		case 2:
 			return nil, errors.New("maximum message length unacceptable")
 		case 3:
@@ -395,7 +458,7 @@ func clientHandshake(conn net.Conn, logger stdlog.StdLog, protocol byte, recvLim
 		serializer = &serialize.CBORSerializer{}
 	}
 
-	sendLimit := byteToLength(buf[1] >> 4)
+	sendLimit := negotiateLimit(buf[1]>>4, maxRecvLen)
 	recvLimit = byteToLength(maxRecvLen)
 	return newRawSocketPeer(conn, serializer, logger, sendLimit, recvLimit, 0), nil
 }
@@ -438,7 +501,7 @@ func serverHandshake(conn net.Conn, logger stdlog.StdLog, recvLimit, outQueueSiz
 		return nil, fmt.Errorf("error sending handshake: %s", err)
 	}
 
-	sendLimit := byteToLength(buf[1] >> 4)
+	sendLimit := negotiateLimit(buf[1]>>4, maxRecvLen)
 	recvLimit = byteToLength(maxRecvLen)
 	return newRawSocketPeer(conn, serializer, logger, sendLimit, recvLimit, outQueueSize), nil
 }
@@ -457,6 +520,17 @@ func fitRecvLimit(recvLimit int) byte {
 	return 0xf
 }
 
+// negotiateLimit returns the maximum length of messages sent to the other
+// side.  This is the smaller of the length the other side is willing to
+// receive and the local receive limit, so that neither side sends a message
+// larger than its own limit.
+func negotiateLimit(remote, local byte) int {
+	if local < remote {
+		return byteToLength(local)
+	}
+	return byteToLength(remote)
+}
+
 // intToBytes encodes a 24-bit integer into 3 bytes.
 func intToBytes(i int) [3]byte {
 	return [3]byte{
@@ -491,6 +565,19 @@ func checkNetworkType(network string) error {
 	return nil
 }
 
+// serializationOf returns the Serialization implemented by a serializer.
+func serializationOf(serializer serialize.Serializer) serialize.Serialization {
+	switch serializer.(type) {
+	case *serialize.JSONSerializer:
+		return serialize.JSON
+	case *serialize.MessagePackSerializer:
+		return serialize.MSGPACK
+	case *serialize.CBORSerializer:
+		return serialize.CBOR
+	}
+	return serialize.AUTO
+}
+
 // getProtoByte returns the RawSocket byte value for a serialization protocol.
 func getProtoByte(serialization serialize.Serialization) (byte, error) {
 	switch serialization {
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/v3/wamp"
+)
+
+func rawSocketPeers(t *testing.T, clientLimit, serverLimit int) (*rawSocketPeer, *rawSocketPeer) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	cliConn, srvConn := net.Pipe()
+
+	type result struct {
+		peer *rawSocketPeer
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		peer, err := serverHandshake(srvConn, logger, serverLimit, 0)
+		done <- result{peer, err}
+	}()
+	cli, err := clientHandshake(cliConn, logger, rawsocketJSON, clientLimit)
+	if err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal("server handshake failed:", res.err)
+	}
+	return cli, res.peer
+}
+
+func TestRawSocketNegotiateLimit(t *testing.T) {
+	cli, srv := rawSocketPeers(t, 4096, 1000)
+	defer cli.Close()
+	defer srv.Close()
+
+	// Server limit is rounded up to a power of 2, and each side sends no more
+	// than the smaller of the two limits.
+	if srv.recvLimit != 1024 {
+		t.Fatal("expected server receive limit 1024, got", srv.recvLimit)
+	}
+	if cli.recvLimit != 4096 {
+		t.Fatal("expected client receive limit 4096, got", cli.recvLimit)
+	}
+	if cli.sendLimit != 1024 {
+		t.Fatal("expected client send limit 1024, got", cli.sendLimit)
+	}
+	if srv.sendLimit != 1024 {
+		t.Fatal("expected server send limit 1024, got", srv.sendLimit)
+	}
+
+	// A message within the limit is received.
+	cli.Send(&wamp.Hello{Realm: "nexus.test"})
+	select {
+	case msg := <-srv.Recv():
+		if _, ok := msg.(*wamp.Hello); !ok {
+			t.Fatal("expected HELLO, got", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive message")
+	}
+}
+
+func TestRawSocketOversizedFrame(t *testing.T) {
+	cli, srv := rawSocketPeers(t, 0, 1024)
+	defer cli.Close()
+	defer srv.Close()
+
+	// Write a frame header announcing a message longer than the server limit,
+	// as a peer that ignores the negotiated limit would.
+	lenBytes := intToBytes(2048)
+	go cli.conn.Write([]byte{0x0, lenBytes[0], lenBytes[1], lenBytes[2]})
+
+	// Server must drop the connection.
+	select {
+	case msg, ok := <-srv.Recv():
+		if ok {
+			t.Fatal("expected connection to close, got", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close connection for oversized frame")
+	}
+}
@@ -542,3 +542,44 @@ func benchmarkSerialize(b *testing.B, s Serializer, msg wamp.Message) {
 		}
 	}
 }
+
+// Test that a number decoded by any serializer can be converted to int64 and
+// float64.
+func TestNumberConversion(t *testing.T) {
+	serializers := map[string]Serializer{
+		"json":    &JSONSerializer{},
+		"msgpack": &MessagePackSerializer{},
+		"cbor":    &CBORSerializer{},
+	}
+	for name, s := range serializers {
+		for _, num := range []interface{}{42, uint8(42), int64(42), 42.0, float32(42)} {
+			b, err := s.Serialize(&wamp.Event{
+				Subscription: 1,
+				Publication:  2,
+				Details:      wamp.Dict{},
+				Arguments:    wamp.List{num},
+				ArgumentsKw:  wamp.Dict{"num": num},
+			})
+			if err != nil {
+				t.Fatal(name, "serialize error:", err)
+			}
+			msg, err := s.Deserialize(b)
+			if err != nil {
+				t.Fatal(name, "deserialize error:", err)
+			}
+			event := msg.(*wamp.Event)
+			for _, v := range []interface{}{event.Arguments[0], event.ArgumentsKw["num"]} {
+				i64, ok := wamp.AsInt64(v)
+				if !ok || i64 != 42 {
+					t.Errorf("%s: %T(%v) decoded as %T, AsInt64 returned %d, %t",
+						name, num, num, v, i64, ok)
+				}
+				f64, ok := wamp.AsFloat64(v)
+				if !ok || f64 != 42.0 {
+					t.Errorf("%s: %T(%v) decoded as %T, AsFloat64 returned %f, %t",
+						name, num, num, v, f64, ok)
+				}
+			}
+		}
+	}
+}
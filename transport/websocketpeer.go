@@ -19,12 +19,20 @@ import (
 // DialFunc is an alternate Dial function for the websocket dialer.
 type DialFunc func(network, addr string) (net.Conn, error)
 
+// DialContextFunc is an alternate function for dialing the network connection
+// to a router, such as a dialer that connects through a proxy.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // WebsocketConfig is used to configure client websocket settings.
 type WebsocketConfig struct {
 	// Supplies alternate Dial function for the websocket dialer.
 	// See https://godoc.org/github.com/gorilla/websocket#Dialer
 	Dial DialFunc
 
+	// Supplies alternate context-aware Dial function for the websocket
+	// dialer.  If set, this is used instead of Dial.
+	DialContext DialContextFunc
+
 	// Request per message write compression, if allowed by server.
 	EnableCompression bool `json:"enable_compression"`
 
@@ -43,6 +51,13 @@ type WebsocketConfig struct {
 	// If a "pong" response is not received after 2 intervals have elapsed then
 	// the websocket connection is closed.
 	KeepAlive time.Duration
+
+	// Header is added to the HTTP request of the websocket handshake.  This
+	// may be used to set headers needed by a proxy or load balancer, or
+	// credentials, such as Authorization, needed by a gateway.  The headers
+	// set by the websocket protocol, such as Upgrade and
+	// Sec-Websocket-Protocol, cannot be set.
+	Header http.Header `json:"-"`
 }
 
 // WebsocketConnection is the interface that a websocket connection must implement.
@@ -74,6 +89,14 @@ func (e *WebsocketError) Error() string {
 // websocketPeer implements the Peer interface, connecting the Send and Recv
 // methods to a websocket.
 type websocketPeer struct {
+	// Count of message payload bytes, used when conn does not count bytes.
+	// Keep 64-bit words first for atomic alignment on 32-bit platforms.
+	sent     uint64
+	received uint64
+
+	// Time anything, including pings and pongs, was last received.
+	lastRecv
+
 	conn        WebsocketConnection
 	serializer  serialize.Serializer
 	payloadType int
@@ -90,6 +113,12 @@ type websocketPeer struct {
 
 	writerDone chan struct{}
 
+	// Counts bytes on the network connection underlying the websocket.
+	counter ByteCounter
+
+	// Pings sent by Ping that are waiting for a pong.
+	pings pingTracker
+
 	log stdlog.StdLog
 }
 
@@ -137,9 +166,13 @@ func ConnectWebsocketPeer(ctx context.Context, routerURL string, serialization s
 	}
 
 	var keepAlive time.Duration = 0
+	var header http.Header
 
+	var netDial DialFunc
+	var netDialContext DialContextFunc
 	if wsCfg != nil {
-		dialer.NetDial = wsCfg.Dial
+		netDial = wsCfg.Dial
+		netDialContext = wsCfg.DialContext
 		if wsCfg.ProxyURL != "" {
 			proxyURL, err := url.Parse(wsCfg.ProxyURL)
 			if err != nil {
@@ -150,9 +183,29 @@ func ConnectWebsocketPeer(ctx context.Context, routerURL string, serialization s
 		dialer.Jar = wsCfg.Jar
 		dialer.EnableCompression = wsCfg.EnableCompression
 		keepAlive = wsCfg.KeepAlive
+		header = wsCfg.Header
+	}
+
+	// Count the bytes on the network connection, so that counts include
+	// websocket framing, compression, and TLS.
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if netDialContext != nil {
+			conn, err = netDialContext(ctx, network, addr)
+		} else if netDial != nil {
+			conn, err = netDial(network, addr)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewCountingConn(conn), nil
 	}
 
-	conn, rsp, err := dialer.DialContext(ctx, routerURL, nil)
+	conn, rsp, err := dialer.DialContext(ctx, routerURL, header)
 	if err != nil {
 		return nil, &WebsocketError{
 			Err:      err,
@@ -170,6 +223,10 @@ func ConnectWebsocketPeer(ctx context.Context, routerURL string, serialization s
 	case msgpackWebsocketProtocol:
 		payloadType = websocket.BinaryMessage
 		serializer = &serialize.MessagePackSerializer{}
+	default:
+		// The server did not agree to any of the requested subprotocols.
+		conn.Close()
+		return nil, ErrSerializerUnsupported
 	}
 
 	return NewWebsocketPeer(conn, serializer, payloadType, logger, keepAlive, 0), nil
@@ -201,6 +258,8 @@ func NewWebsocketPeer(conn WebsocketConnection, serializer serialize.Serializer,
 		// messages to be put into an outbound queue that can grow.
 		wr: make(chan wamp.Message, outQueueSize),
 
+		counter: connByteCounter(conn),
+
 		log: logger,
 	}
 	w.ctxSender, w.cancelSender = context.WithCancel(context.Background())
@@ -235,6 +294,43 @@ func (w *websocketPeer) Send(msg wamp.Message) error {
 
 func (w *websocketPeer) IsLocal() bool { return false }
 
+// Serialization returns the serialization used by the peer.
+func (w *websocketPeer) Serialization() serialize.Serialization {
+	return serializationOf(w.serializer)
+}
+
+// BytesSent returns the number of bytes sent over the websocket.  If the
+// network connection underlying the websocket does not count bytes, then only
+// the size of message payloads is counted.
+func (w *websocketPeer) BytesSent() uint64 {
+	if w.counter != nil {
+		return w.counter.BytesSent()
+	}
+	return atomic.LoadUint64(&w.sent)
+}
+
+// BytesReceived returns the number of bytes received over the websocket.  If
+// the network connection underlying the websocket does not count bytes, then
+// only the size of message payloads is counted.
+func (w *websocketPeer) BytesReceived() uint64 {
+	if w.counter != nil {
+		return w.counter.BytesReceived()
+	}
+	return atomic.LoadUint64(&w.received)
+}
+
+// Ping sends a websocket ping control frame and waits for the matching pong.
+// Returns the round-trip time.
+func (w *websocketPeer) Ping(ctx context.Context) (time.Duration, error) {
+	return w.pings.ping(ctx, w.ctxSender.Done(), func(payload []byte) error {
+		deadline := time.Now().Add(ctrlTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		return w.conn.WriteControl(websocket.PingMessage, payload, deadline)
+	})
+}
+
 // Close closes the websocket peer.  This closes the local send channel, and
 // sends a close control message to the websocket to tell the other side to
 // close.
@@ -267,12 +363,18 @@ func (w *websocketPeer) sendHandler() {
 
 	pongs := make(chan string, 1) // capacity must be >= 1
 	w.conn.SetPingHandler(func(m string) error {
+		w.touch()
 		select {
 		case pongs <- m:
 		default:
 		}
 		return nil
 	})
+	w.conn.SetPongHandler(func(m string) error {
+		w.touch()
+		w.pings.pong(m)
+		return nil
+	})
 
 sendLoop:
 	for {
@@ -290,6 +392,9 @@ sendLoop:
 				}
 				return
 			}
+			if w.counter == nil {
+				atomic.AddUint64(&w.sent, uint64(len(b)))
+			}
 		case m := <-pongs:
 			err := w.conn.WriteMessage(websocket.PongMessage, []byte(m))
 			if err != nil {
@@ -307,6 +412,7 @@ func (w *websocketPeer) sendHandlerKeepAlive(keepAlive time.Duration) {
 
 	pongs := make(chan string, 1) // capacity must be >= 1
 	w.conn.SetPingHandler(func(m string) error {
+		w.touch()
 		select {
 		case pongs <- m:
 		default:
@@ -316,8 +422,10 @@ func (w *websocketPeer) sendHandlerKeepAlive(keepAlive time.Duration) {
 
 	var pendingPongs int32
 	w.conn.SetPongHandler(func(msg string) error {
+		w.touch()
 		// Any response resets counter.
 		atomic.StoreInt32(&pendingPongs, 0)
+		w.pings.pong(msg)
 		return nil
 	})
 
@@ -342,6 +450,9 @@ recvLoop:
 				}
 				return
 			}
+			if w.counter == nil {
+				atomic.AddUint64(&w.sent, uint64(len(b)))
+			}
 		case <-ticker.C:
 			// If missed 2 responses, close websocket.
 			if atomic.LoadInt32(&pendingPongs) >= 2 {
@@ -400,6 +511,10 @@ func (w *websocketPeer) recvHandler() {
 		if msgType == websocket.CloseMessage {
 			return
 		}
+		w.touch()
+		if w.counter == nil {
+			atomic.AddUint64(&w.received, uint64(len(b)))
+		}
 
 		msg, err := w.serializer.Deserialize(b)
 		if err != nil {
@@ -1,6 +1,10 @@
 package wamp
 
-import "reflect"
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
 
 // AsString is an extended type assertion for string.
 func AsString(v interface{}) (string, bool) {
@@ -36,7 +40,11 @@ func AsURI(v interface{}) (URI, bool) {
 	return URI(""), false
 }
 
-// AsInt64 is an extended type assertion for int64.
+// AsInt64 is an extended type assertion for int64.  This accepts any of the
+// integer and floating point types that the JSON, msgpack, and CBOR
+// serializers produce for a number.  A floating point value is truncated
+// toward zero, and is only converted if it is within the range of int64.  An
+// unsigned value is only converted if it is within the range of int64.
 func AsInt64(v interface{}) (int64, bool) {
 	switch v := v.(type) {
 	case int64:
@@ -44,24 +52,51 @@ func AsInt64(v interface{}) (int64, bool) {
 	case ID:
 		return int64(v), true
 	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
 		return int64(v), true
 	case int:
 		return int64(v), true
 	case int32:
 		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int8:
+		return int64(v), true
 	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return 0, false
+		}
 		return int64(v), true
 	case uint32:
 		return int64(v), true
-	case float64:
+	case uint16:
 		return int64(v), true
-	case float32:
+	case uint8:
 		return int64(v), true
+	case float64:
+		return floatToInt64(v)
+	case float32:
+		return floatToInt64(float64(v))
 	}
 	return 0, false
 }
 
-// AsFloat64 is an extended type assertion for float64.
+// floatToInt64 truncates a float64 to an int64 if the float64 is within the
+// range of int64.
+func floatToInt64(f float64) (int64, bool) {
+	// -2^63 is exactly representable as float64, but 2^63-1 is not, so the
+	// upper bound is exclusive of 2^63.
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// AsFloat64 is an extended type assertion for float64.  This accepts any of
+// the integer and floating point types that the JSON, msgpack, and CBOR
+// serializers produce for a number.
 func AsFloat64(v interface{}) (float64, bool) {
 	switch v := v.(type) {
 	case float64:
@@ -78,10 +113,18 @@ func AsFloat64(v interface{}) (float64, bool) {
 		return float64(v), true
 	case int32:
 		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int8:
+		return float64(v), true
 	case uint:
 		return float64(v), true
 	case uint32:
 		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
 	}
 	return 0.0, false
 }
@@ -169,3 +212,68 @@ func OptionFlag(opts Dict, optionName string) bool {
 	opt, _ := AsBool(opts[optionName])
 	return opt
 }
+
+// ArgumentError describes a missing or mistyped positional argument of a
+// message.  It corresponds to the wamp.error.invalid_argument error URI.
+type ArgumentError struct {
+	// Index of the positional argument.
+	Index int
+	// Reason the argument is not acceptable.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ArgumentError) Error() string {
+	return fmt.Sprintf("%s: argument %d %s", ErrInvalidArgument, e.Index, e.Reason)
+}
+
+// URI returns the error URI that corresponds to the argument error.
+func (e *ArgumentError) URI() URI { return ErrInvalidArgument }
+
+// CallArg returns the positional argument at index from the CALL message.  An
+// *ArgumentError is returned if the call does not have an argument at index.
+func CallArg(call *Call, index int) (interface{}, error) {
+	return listArg(call.Arguments, index)
+}
+
+// CallArgID returns the positional argument at index from the CALL message as
+// an ID.  An *ArgumentError is returned if the call does not have an argument
+// at index, or if the argument is not an ID.
+func CallArgID(call *Call, index int) (ID, error) {
+	return listArgID(call.Arguments, index)
+}
+
+// InvocationArg returns the positional argument at index from the INVOCATION
+// message, as CallArg does for a CALL.  This is for use by procedures that the
+// router handles itself, such as the meta procedures.
+func InvocationArg(inv *Invocation, index int) (interface{}, error) {
+	return listArg(inv.Arguments, index)
+}
+
+// InvocationArgID returns the positional argument at index from the
+// INVOCATION message as an ID, as CallArgID does for a CALL.
+func InvocationArgID(inv *Invocation, index int) (ID, error) {
+	return listArgID(inv.Arguments, index)
+}
+
+func listArg(args List, index int) (interface{}, error) {
+	if index < 0 || index >= len(args) {
+		return nil, &ArgumentError{Index: index, Reason: "missing"}
+	}
+	return args[index], nil
+}
+
+func listArgID(args List, index int) (ID, error) {
+	arg, err := listArg(args, index)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := AsID(arg)
+	if !ok {
+		return 0, &ArgumentError{
+			Index:  index,
+			Reason: fmt.Sprintf("has type %T, expected ID", arg),
+		}
+	}
+	return id, nil
+}
@@ -1,6 +1,7 @@
 package wamp
 
 import (
+	"math"
 	"testing"
 )
 
@@ -180,12 +181,44 @@ func TestAsInt64(t *testing.T) {
 	if i64 != int64(numConv) {
 		t.Error(wrongValueMsg)
 	}
+	if _, ok = AsInt64(int16(numConv)); !ok {
+		t.Error(failMsg)
+	}
+	if _, ok = AsInt64(int8(42)); !ok {
+		t.Error(failMsg)
+	}
+	if _, ok = AsInt64(uint16(numConv)); !ok {
+		t.Error(failMsg)
+	}
+	if _, ok = AsInt64(uint8(42)); !ok {
+		t.Error(failMsg)
+	}
 	if _, ok = AsInt64(strConv); ok {
 		t.Error(shouldFailMsg)
 	}
 	if _, ok = AsInt64(nil); ok {
 		t.Error(shouldFailMsg)
 	}
+	// Check that a fractional value is truncated.
+	if i64, ok = AsInt64(42.5); !ok || i64 != 42 {
+		t.Error(wrongValueMsg)
+	}
+	if i64, ok = AsInt64(float32(-42.5)); !ok || i64 != -42 {
+		t.Error(wrongValueMsg)
+	}
+	// Check that values that cannot be represented as int64 are refused.
+	if _, ok = AsInt64(math.Inf(1)); ok {
+		t.Error(shouldFailMsg)
+	}
+	if _, ok = AsInt64(math.NaN()); ok {
+		t.Error(shouldFailMsg)
+	}
+	if _, ok = AsInt64(float64(math.MaxInt64)); ok {
+		t.Error(shouldFailMsg)
+	}
+	if _, ok = AsInt64(uint64(math.MaxUint64)); ok {
+		t.Error(shouldFailMsg)
+	}
 }
 
 func TestAsFloat64(t *testing.T) {
@@ -255,3 +288,92 @@ func TestListToStrings(t *testing.T) {
 		t.Fatal("should not have converted")
 	}
 }
+
+func TestCallArg(t *testing.T) {
+	call := &Call{
+		Request:   123,
+		Procedure: "test.proc",
+		Arguments: List{ID(42), "hello", 3.0},
+	}
+
+	arg, err := CallArg(call, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arg != "hello" {
+		t.Fatal(wrongValueMsg)
+	}
+
+	id, err := CallArgID(call, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Fatal(wrongValueMsg)
+	}
+	// A float from JSON decoding is acceptable as an ID.
+	if id, err = CallArgID(call, 2); err != nil || id != 3 {
+		t.Fatal("Failed to convert float to ID")
+	}
+
+	// Out of range.
+	for _, index := range []int{3, -1} {
+		if _, err = CallArg(call, index); err == nil {
+			t.Fatal("Expected error for out of range argument")
+		}
+		argErr, ok := err.(*ArgumentError)
+		if !ok {
+			t.Fatal("Expected *ArgumentError")
+		}
+		if argErr.URI() != ErrInvalidArgument || argErr.Index != index {
+			t.Fatal("Wrong error content:", argErr)
+		}
+		if _, err = CallArgID(call, index); err == nil {
+			t.Fatal("Expected error for out of range argument")
+		}
+	}
+
+	// Type mismatch.
+	_, err = CallArgID(call, 1)
+	if err == nil {
+		t.Fatal("Expected error for mistyped argument")
+	}
+	if _, ok := err.(*ArgumentError); !ok {
+		t.Fatal("Expected *ArgumentError")
+	}
+	if err.Error() != "wamp.error.invalid_argument: argument 1 has type string, expected ID" {
+		t.Fatal("Unexpected error message:", err)
+	}
+}
+
+func TestInvocationArg(t *testing.T) {
+	inv := &Invocation{
+		Request:   123,
+		Arguments: List{ID(42), "hello"},
+	}
+
+	arg, err := InvocationArg(inv, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arg != "hello" {
+		t.Fatal(wrongValueMsg)
+	}
+	id, err := InvocationArgID(inv, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Fatal(wrongValueMsg)
+	}
+
+	if _, err = InvocationArg(inv, 2); err == nil {
+		t.Fatal("Expected error for out of range argument")
+	}
+	if _, err = InvocationArgID(inv, 1); err == nil {
+		t.Fatal("Expected error for mistyped argument")
+	}
+	if _, ok := err.(*ArgumentError); !ok {
+		t.Fatal("Expected *ArgumentError")
+	}
+}
@@ -74,3 +74,38 @@ func (u URI) WildcardMatch(wildcard URI) bool {
 	}
 	return true
 }
+
+// URIPrefix returns the first n dot-separated components of the URI.  If the
+// URI has n or fewer components, then the whole URI is returned.  If n is not
+// positive, then an empty URI is returned.
+//
+// For example, URIPrefix("tenant.service.method", 1) returns "tenant".
+func URIPrefix(uri URI, n int) URI {
+	if n <= 0 {
+		return ""
+	}
+	s := string(uri)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '.' {
+			n--
+			if n == 0 {
+				return URI(s[:i])
+			}
+		}
+	}
+	return uri
+}
+
+// URIHasPrefix returns true if the leading components of the URI are the
+// same as the components of prefix.  Unlike PrefixMatch, the prefix must end
+// at a component boundary, so "tenant.a" has the prefix "tenant" but not the
+// prefix "ten".  A URI has itself as a prefix.
+func URIHasPrefix(uri, prefix URI) bool {
+	if !strings.HasPrefix(string(uri), string(prefix)) {
+		return false
+	}
+	if len(uri) == len(prefix) || prefix == "" || prefix[len(prefix)-1] == '.' {
+		return true
+	}
+	return uri[len(prefix)] == '.'
+}
@@ -196,3 +196,50 @@ func TestValidURI(t *testing.T) {
 	}
 
 }
+
+func TestURIPrefix(t *testing.T) {
+	uri := URI("tenant.service.method")
+	expect := map[int]URI{
+		-1: "",
+		0:  "",
+		1:  "tenant",
+		2:  "tenant.service",
+		3:  "tenant.service.method",
+		4:  "tenant.service.method",
+	}
+	for n, want := range expect {
+		if got := URIPrefix(uri, n); got != want {
+			t.Errorf("URIPrefix(%q, %d) = %q, expected %q", uri, n, got, want)
+		}
+	}
+	if got := URIPrefix("tenant", 2); got != "tenant" {
+		t.Errorf("expected single component URI, got %q", got)
+	}
+}
+
+func TestURIHasPrefix(t *testing.T) {
+	uri := URI("tenant.service.method")
+	matches := []URI{
+		"tenant",
+		"tenant.",
+		"tenant.service",
+		"tenant.service.method",
+	}
+	for i := range matches {
+		if !URIHasPrefix(uri, matches[i]) {
+			t.Error("expected", uri, "to have prefix", matches[i])
+		}
+	}
+
+	nonMatches := []URI{
+		"ten",
+		"tenant.serv",
+		"tenant.service.method.extra",
+		"other",
+	}
+	for i := range nonMatches {
+		if URIHasPrefix(uri, nonMatches[i]) {
+			t.Error("expected", uri, "to not have prefix", nonMatches[i])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package wamp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// DictFromHeader converts an HTTP header to a Dict.  A header with a single
+// value is stored as a string, and a header with multiple values is stored as
+// a []interface{} of strings.
+func DictFromHeader(header http.Header) Dict {
+	return dictFromMultiMap(header)
+}
+
+// DictToHeader converts a Dict to an HTTP header.  This is the inverse of
+// DictFromHeader.  List values become multiple header values, and other
+// values are formatted as strings.  Keys are converted to canonical header
+// keys.
+func DictToHeader(dict Dict) http.Header {
+	header := make(http.Header, len(dict))
+	for k, v := range dict {
+		for _, s := range multiValues(v) {
+			header.Add(k, s)
+		}
+	}
+	return header
+}
+
+// DictFromValues converts URL query values to a Dict.  A key with a single
+// value is stored as a string, and a key with multiple values is stored as a
+// []interface{} of strings.
+func DictFromValues(values url.Values) Dict {
+	return dictFromMultiMap(values)
+}
+
+// DictToValues converts a Dict to URL query values.  This is the inverse of
+// DictFromValues.  List values become multiple values for the key, and other
+// values are formatted as strings.
+func DictToValues(dict Dict) url.Values {
+	values := make(url.Values, len(dict))
+	for k, v := range dict {
+		for _, s := range multiValues(v) {
+			values.Add(k, s)
+		}
+	}
+	return values
+}
+
+func dictFromMultiMap(m map[string][]string) Dict {
+	dict := make(Dict, len(m))
+	for k, vals := range m {
+		switch len(vals) {
+		case 0:
+		case 1:
+			dict[k] = vals[0]
+		default:
+			list := make([]interface{}, len(vals))
+			for i := range vals {
+				list[i] = vals[i]
+			}
+			dict[k] = list
+		}
+	}
+	return dict
+}
+
+// multiValues returns the string values of a Dict value.  A nil value has no
+// values.
+func multiValues(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	}
+	if s, ok := AsString(v); ok {
+		return []string{s}
+	}
+	if list, ok := AsList(v); ok {
+		strs := make([]string, 0, len(list))
+		for i := range list {
+			if s, ok := AsString(list[i]); ok {
+				strs = append(strs, s)
+			} else {
+				strs = append(strs, fmt.Sprint(list[i]))
+			}
+		}
+		return strs
+	}
+	return []string{fmt.Sprint(v)}
+}
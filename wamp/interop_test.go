@@ -0,0 +1,54 @@
+package wamp
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDictHeaderRoundTrip(t *testing.T) {
+	header := http.Header{}
+	header.Add("Accept", "text/html")
+	header.Add("Accept", "application/json")
+	header.Set("X-Request-Id", "1234")
+
+	dict := DictFromHeader(header)
+	accept, ok := dict["Accept"].([]interface{})
+	if !ok {
+		t.Fatalf("expected []interface{} for multi-valued header, got %T", dict["Accept"])
+	}
+	if len(accept) != 2 || accept[0] != "text/html" || accept[1] != "application/json" {
+		t.Fatal("wrong values for multi-valued header:", accept)
+	}
+	if dict["X-Request-Id"] != "1234" {
+		t.Fatal("wrong value for single-valued header:", dict["X-Request-Id"])
+	}
+
+	if h := DictToHeader(dict); !reflect.DeepEqual(h, header) {
+		t.Fatal("header changed in round trip:", h)
+	}
+}
+
+func TestDictValuesRoundTrip(t *testing.T) {
+	values := url.Values{}
+	values.Add("id", "1")
+	values.Add("id", "2")
+	values.Set("name", "nexus")
+
+	dict := DictFromValues(values)
+	ids, ok := dict["id"].([]interface{})
+	if !ok || len(ids) != 2 {
+		t.Fatal("wrong value for multi-valued key:", dict["id"])
+	}
+
+	if v := DictToValues(dict); !reflect.DeepEqual(v, values) {
+		t.Fatal("values changed in round trip:", v)
+	}
+
+	// Non-string values are formatted as strings.
+	v := DictToValues(Dict{"n": List{1, "two"}, "flag": true})
+	if !reflect.DeepEqual(v["n"], []string{"1", "two"}) || v.Get("flag") != "true" {
+		t.Fatal("wrong conversion of non-string values:", v)
+	}
+}
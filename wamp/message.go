@@ -5,6 +5,9 @@ defined by the WAMP specification.
 */
 package wamp
 
+// MessageType is the WAMP message code that identifies the type of a message.
+// Every Message returns its type from MessageType, so that messages can be
+// dispatched by type without a type switch.
 type MessageType int
 
 // Message is a generic container for a WAMP message.
@@ -225,9 +228,11 @@ func (msg *Publish) MessageType() MessageType { return PUBLISH }
 // Acknowledge sent by a Broker to a Publisher for acknowledged publications.
 //
 // [PUBLISHED, PUBLISH.Request|id, Publication|id]
+// [PUBLISHED, PUBLISH.Request|id, Publication|id, Details|dict]
 type Published struct {
 	Request     ID
 	Publication ID
+	Details     Dict `wamp:"omitempty"`
 }
 
 func (msg *Published) MessageType() MessageType { return PUBLISHED }
@@ -331,8 +336,15 @@ func (msg *Unregister) MessageType() MessageType { return UNREGISTER }
 // the Callee:
 //
 // [UNREGISTERED, UNREGISTER.Request|id]
+//
+// A Dealer that revokes a registration sends an UNREGISTERED message, with a
+// Request of 0, that identifies the registration and the reason it was
+// revoked:
+//
+// [UNREGISTERED, 0, Details|dict]
 type Unregistered struct {
 	Request ID
+	Details Dict `wamp:"omitempty"`
 }
 
 func (msg *Unregistered) MessageType() MessageType { return UNREGISTERED }
@@ -44,3 +44,102 @@ func TestMessage(t *testing.T) {
 		t.Fatal("Message should be nil for bad type")
 	}
 }
+
+func TestConcreteMessageType(t *testing.T) {
+	msgs := map[MessageType]Message{
+		HELLO:        &Hello{},
+		WELCOME:      &Welcome{},
+		ABORT:        &Abort{},
+		CHALLENGE:    &Challenge{},
+		AUTHENTICATE: &Authenticate{},
+		GOODBYE:      &Goodbye{},
+		ERROR:        &Error{},
+		PUBLISH:      &Publish{},
+		PUBLISHED:    &Published{},
+		SUBSCRIBE:    &Subscribe{},
+		SUBSCRIBED:   &Subscribed{},
+		UNSUBSCRIBE:  &Unsubscribe{},
+		UNSUBSCRIBED: &Unsubscribed{},
+		EVENT:        &Event{},
+		CALL:         &Call{},
+		CANCEL:       &Cancel{},
+		RESULT:       &Result{},
+		REGISTER:     &Register{},
+		REGISTERED:   &Registered{},
+		UNREGISTER:   &Unregister{},
+		UNREGISTERED: &Unregistered{},
+		INVOCATION:   &Invocation{},
+		INTERRUPT:    &Interrupt{},
+		YIELD:        &Yield{},
+	}
+	if len(msgs) != len(mtStrings) {
+		t.Fatal("not all message types tested")
+	}
+	for mt, msg := range msgs {
+		if msg.MessageType() != mt {
+			t.Errorf("%T has message type %v, expected %v", msg, msg.MessageType(), mt)
+		}
+	}
+}
+
+// benchMsgs is a mix of the messages most often received by a router.
+var benchMsgs = []Message{
+	&Publish{}, &Call{}, &Yield{}, &Subscribe{}, &Register{}, &Error{},
+	&Cancel{}, &Unsubscribe{}, &Unregister{}, &Goodbye{},
+}
+
+var benchCount int
+
+func BenchmarkDispatchTypeSwitch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		switch benchMsgs[i%len(benchMsgs)].(type) {
+		case *Publish:
+			benchCount++
+		case *Subscribe:
+			benchCount += 2
+		case *Unsubscribe:
+			benchCount += 3
+		case *Register:
+			benchCount += 4
+		case *Unregister:
+			benchCount += 5
+		case *Call:
+			benchCount += 6
+		case *Yield:
+			benchCount += 7
+		case *Cancel:
+			benchCount += 8
+		case *Error:
+			benchCount += 9
+		case *Goodbye:
+			benchCount += 10
+		}
+	}
+}
+
+func BenchmarkDispatchMessageType(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		switch benchMsgs[i%len(benchMsgs)].MessageType() {
+		case PUBLISH:
+			benchCount++
+		case SUBSCRIBE:
+			benchCount += 2
+		case UNSUBSCRIBE:
+			benchCount += 3
+		case REGISTER:
+			benchCount += 4
+		case UNREGISTER:
+			benchCount += 5
+		case CALL:
+			benchCount += 6
+		case YIELD:
+			benchCount += 7
+		case CANCEL:
+			benchCount += 8
+		case ERROR:
+			benchCount += 9
+		case GOODBYE:
+			benchCount += 10
+		}
+	}
+}
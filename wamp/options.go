@@ -3,19 +3,53 @@ package wamp
 // Consts for message options and option values.
 const (
 	// Message option keywords.
-	OptAcknowledge     = "acknowledge"
-	OptDiscloseCaller  = "disclose_caller"
-	OptDiscloseMe      = "disclose_me"
-	OptExcludeMe       = "exclude_me"
-	OptInvoke          = "invoke"
-	OptMatch           = "match"
-	OptMessage         = "message"
-	OptMode            = "mode"
-	OptProcedure       = "procedure"
-	OptProgress        = "progress"
-	OptReason          = "reason"
-	OptReceiveProgress = "receive_progress"
-	OptTimeout         = "timeout"
+	OptAcknowledge             = "acknowledge"
+	OptConcurrency             = "concurrency"
+	OptDiscloseCaller          = "disclose_caller"
+	OptDiscloseMe              = "disclose_me"
+	OptDiscloseSubscriberCount = "disclose_subscriber_count"
+	OptExcludeMe               = "exclude_me"
+	OptFilter                  = "filter"
+	OptGetRetained             = "get_retained"
+	OptInvoke                  = "invoke"
+	OptMatch                   = "match"
+	OptMessage                 = "message"
+	OptMode                    = "mode"
+	OptProcedure               = "procedure"
+	OptProgress                = "progress"
+	OptReason                  = "reason"
+	OptReceiveProgress         = "receive_progress"
+	OptRetain                  = "retain"
+	OptTimeout                 = "timeout"
+
+	// PUBLISH option giving the number of seconds that a retained event is
+	// kept by the broker.  (non-standard)
+	OptRetainTTL = "retain_ttl"
+
+	// PUBLISH option giving a key that identifies the publication, so that
+	// the broker can drop repeats of the publication.  (non-standard)
+	OptDedupKey = "dedup_key"
+
+	// CALL option giving the priority of a call that is queued because all
+	// callees are at their concurrency limit.  Calls with a higher priority
+	// are invoked first.  (non-standard)
+	OptPriority = "priority"
+
+	// SUBSCRIBE option giving the quality of service for delivering events to
+	// the subscriber.  (non-standard)
+	OptQoS = "qos"
+
+	// ABORT message detail keywords.
+	OptSuggestedMethods = "suggested_methods"
+
+	// PUBLISHED message detail keywords.
+	OptSubscriberCount = "subscriber_count"
+
+	// UNREGISTERED message detail keywords, for a revoked registration.
+	OptRegistration = "registration"
+
+	// EVENT message detail keywords.
+	OptRetained = "retained"
 
 	// Values for URI matching mode.
 	MatchExact    = "exact"
@@ -27,6 +61,10 @@ const (
 	CancelModeKillNoWait = "killnowait"
 	CancelModeSkip       = "skip"
 
+	// Values for subscription quality of service.
+	QoSBestEffort = "best_effort"
+	QoSReliable   = "reliable"
+
 	// Values for call invocation policy.
 	InvokeSingle     = "single"
 	InvokeRoundRobin = "roundrobin"
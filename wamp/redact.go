@@ -0,0 +1,83 @@
+package wamp
+
+import "reflect"
+
+// Redacted is the value that replaces redacted values.
+const Redacted = "***"
+
+var (
+	redactDictType = reflect.TypeOf(Dict{})
+	redactListType = reflect.TypeOf(List{})
+)
+
+// Redact returns a copy of the message in which the value of every dictionary
+// item with one of the given keys, at any depth, is replaced by "***".  This
+// is used to remove secrets, such as a ticket in HELLO authextra, from a
+// message before logging it.
+//
+// All dictionaries and lists in the returned message are copies, so the
+// original message is not modified.  Copies of map[string]interface{} values
+// are Dict.  Other values are shared with the original message.
+func Redact(msg Message, keys []string) Message {
+	val := reflect.ValueOf(msg)
+	if msg == nil || val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return msg
+	}
+	redactKeys := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		redactKeys[k] = struct{}{}
+	}
+
+	// Make a shallow copy of the message, and then replace each Dict and List
+	// field with a redacted copy.
+	clone := reflect.New(val.Elem().Type())
+	clone.Elem().Set(val.Elem())
+	for i := 0; i < clone.Elem().NumField(); i++ {
+		field := clone.Elem().Field(i)
+		switch field.Type() {
+		case redactDictType:
+			if !field.IsNil() {
+				field.Set(reflect.ValueOf(redactDict(field.Interface().(Dict), redactKeys)))
+			}
+		case redactListType:
+			if !field.IsNil() {
+				field.Set(reflect.ValueOf(redactList(field.Interface().(List), redactKeys)))
+			}
+		}
+	}
+	return clone.Interface().(Message)
+}
+
+func redactDict(dict map[string]interface{}, keys map[string]struct{}) Dict {
+	out := make(Dict, len(dict))
+	for k, v := range dict {
+		if _, ok := keys[k]; ok {
+			out[k] = Redacted
+			continue
+		}
+		out[k] = redactValue(v, keys)
+	}
+	return out
+}
+
+func redactList(list []interface{}, keys map[string]struct{}) List {
+	out := make(List, len(list))
+	for i := range list {
+		out[i] = redactValue(list[i], keys)
+	}
+	return out
+}
+
+func redactValue(v interface{}, keys map[string]struct{}) interface{} {
+	switch v := v.(type) {
+	case Dict:
+		return redactDict(v, keys)
+	case map[string]interface{}:
+		return redactDict(v, keys)
+	case List:
+		return redactList(v, keys)
+	case []interface{}:
+		return redactList(v, keys)
+	}
+	return v
+}
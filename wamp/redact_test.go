@@ -0,0 +1,75 @@
+package wamp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	hello := &Hello{
+		Realm: URI("nexus.test.realm"),
+		Details: Dict{
+			"authid":      "jdoe",
+			"authmethods": List{"ticket"},
+			"authextra": map[string]interface{}{
+				"ticket": "secret1",
+				"nested": Dict{"token": "secret2", "keep": 1},
+			},
+		},
+	}
+	orig := &Hello{
+		Realm: hello.Realm,
+		Details: Dict{
+			"authid":      "jdoe",
+			"authmethods": List{"ticket"},
+			"authextra": map[string]interface{}{
+				"ticket": "secret1",
+				"nested": Dict{"token": "secret2", "keep": 1},
+			},
+		},
+	}
+
+	redacted, ok := Redact(hello, []string{"ticket", "token"}).(*Hello)
+	if !ok {
+		t.Fatal("redacted message is not HELLO")
+	}
+	expect := &Hello{
+		Realm: hello.Realm,
+		Details: Dict{
+			"authid":      "jdoe",
+			"authmethods": List{"ticket"},
+			"authextra": Dict{
+				"ticket": Redacted,
+				"nested": Dict{"token": Redacted, "keep": 1},
+			},
+		},
+	}
+	if !reflect.DeepEqual(redacted, expect) {
+		t.Fatalf("wrong redacted message: %+v", redacted)
+	}
+
+	// Check that the original message was not modified.
+	if !reflect.DeepEqual(hello, orig) {
+		t.Fatalf("original message was modified: %+v", hello)
+	}
+
+	// Check that lists and messages without dicts are redacted.
+	event := &Event{
+		Subscription: 1,
+		Publication:  2,
+		Arguments:    List{Dict{"password": "secret"}},
+	}
+	redactedEvent := Redact(event, []string{"password"}).(*Event)
+	if redactedEvent.Subscription != 1 || redactedEvent.Publication != 2 {
+		t.Fatal("IDs not copied to redacted message")
+	}
+	if redactedEvent.Details != nil {
+		t.Fatal("nil dict should remain nil")
+	}
+	if redactedEvent.Arguments[0].(Dict)["password"] != Redacted {
+		t.Fatal("value in argument list not redacted")
+	}
+	if event.Arguments[0].(Dict)["password"] != "secret" {
+		t.Fatal("original argument list was modified")
+	}
+}
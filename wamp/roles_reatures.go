@@ -10,17 +10,19 @@ const (
 	RoleSubscriber = "subscriber"
 
 	// RPC features
-	FeatureCallCanceling    = "call_canceling"
-	FeatureCallTimeout      = "call_timeout"
-	FeatureCallerIdent      = "caller_identification"
-	FeaturePatternBasedReg  = "pattern_based_registration"
-	FeatureProgCallResults  = "progressive_call_results"
-	FeatureSessionMetaAPI   = "session_meta_api"
-	FeatureSharedReg        = "shared_registration"
-	FeatureRegMetaAPI       = "registration_meta_api"
-	FeatureTestamentMetaAPI = "testament_meta_api"
+	FeatureCallCanceling       = "call_canceling"
+	FeatureCallTimeout         = "call_timeout"
+	FeatureCallerIdent         = "caller_identification"
+	FeaturePatternBasedReg     = "pattern_based_registration"
+	FeatureProgCallInvocations = "progressive_call_invocations"
+	FeatureProgCallResults     = "progressive_call_results"
+	FeatureSessionMetaAPI      = "session_meta_api"
+	FeatureSharedReg           = "shared_registration"
+	FeatureRegMetaAPI          = "registration_meta_api"
+	FeatureTestamentMetaAPI    = "testament_meta_api"
 
 	// PubSub features
+	FeatureEventRetention       = "event_retention"
 	FeaturePatternSub           = "pattern_based_subscription"
 	FeaturePubExclusion         = "publisher_exclusion"
 	FeaturePubIdent             = "publisher_identification"
@@ -3,6 +3,7 @@ package wamp
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Session is an active WAMP session.  It associates a session ID and details
@@ -24,6 +25,19 @@ type Session struct {
 	goodbye *Goodbye
 }
 
+// SessionInfo is a snapshot of the information identifying a session that has
+// joined a realm.
+type SessionInfo struct {
+	// Unique session ID.
+	ID ID
+	// Authentication ID, role, and method of the session.
+	AuthID     string
+	AuthRole   string
+	AuthMethod string
+	// Time when the session joined the realm.
+	Joined time.Time
+}
+
 var (
 	// NoGoodbye indicates that no Goodbye message was sent out
 	NoGoodbye = &Goodbye{}
@@ -52,6 +52,10 @@ const (
 	CloseGoodbyeAndOut = URI("wamp.close.goodbye_and_out")
 	ErrGoodbyeAndOut   = CloseGoodbyeAndOut
 
+	// The Peer closed the session because it was idle for too long - used
+	// as a GOODBYE reason.
+	CloseTimeout = URI("wamp.close.timeout")
+
 	// -- Authorization --
 
 	// A join, call, register, publish or subscribe failed, since the Peer is
@@ -95,6 +99,17 @@ const (
 	// Exclusion lead to the exclusion of (any) Callee providing the procedure.
 	ErrNoEligibleCallee = URI("wamp.error.no_eligible_callee")
 
+	// A Callee is unable to handle a call, for example because it is
+	// overloaded or shutting down.
+	ErrUnavailable = URI("wamp.error.unavailable")
+
+	// A Dealer rejected a call because it has too many calls in progress.
+	ErrOverload = URI("wamp.error.overload")
+
+	// A Dealer revoked a registration because another Callee registered the
+	// same procedure (non-standard).
+	ErrRegistrationReplaced = URI("wamp.error.registration_replaced")
+
 	// A Router rejected client request to disclose its identity.
 	ErrOptionDisallowedDiscloseMe = URI("wamp.error.option_disallowed.disclose_me")
 
@@ -104,6 +119,22 @@ const (
 	// A Peer received invalid WAMP protocol message.
 	ErrProtocolViolation = URI("wamp.error.protocol_violation")
 
+	// A Dealer or Broker could not perform a request, since a Peer involved in
+	// the request does not support a feature required by the request.
+	ErrFeatureNotSupported = URI("wamp.error.feature_not_supported")
+
+	// A Broker rejected a publication because the publisher exceeded the
+	// publish rate limit (non-standard).
+	ErrRateLimitExceeded = URI("wamp.error.rate_limit_exceeded")
+
+	// A Broker rejected a subscription because the topic already has the
+	// maximum number of subscribers (non-standard).
+	ErrQuotaExceeded = URI("wamp.error.quota_exceeded")
+
+	// A Callee failed to process a call because of an internal error, such as
+	// a panic in the procedure's handler (non-standard).
+	ErrRuntimeError = URI("wamp.error.runtime_error")
+
 	// -- Session Meta Events --
 
 	// Fired when a session joins a realm on the router.
@@ -112,6 +143,10 @@ const (
 	// Fired when a session leaves a realm on the router or is disconnected.
 	MetaEventSessionOnLeave = URI("wamp.session.on_leave")
 
+	// Fired when the authid or authrole of a session changes while the
+	// session is attached to a realm.
+	MetaEventSessionOnReauth = URI("wamp.session.on_reauth")
+
 	// -- Session Meta Procedures --
 
 	// Obtains the number of sessions currently attached to the realm.
@@ -180,6 +215,10 @@ const (
 	// Obtains the number of sessions currently attached to the registration.
 	MetaProcRegCountCallees = URI("wamp.registration.count_callees")
 
+	// Retrieves the invocation policy of a registration and the session IDs
+	// of the callees attached to it (non-standard).
+	MetaProcRegCallees = URI("wamp.registration.callees")
+
 	// -- Subscription Meta Events --
 
 	// Fired when a subscription is created through a subscription request for
@@ -219,6 +258,11 @@ const (
 	// Obtains the number of sessions currently attached to the subscription.
 	MetaProcSubCountSubscribers = URI("wamp.subscription.count_suscribers")
 
+	// Obtains the number of subscribers that an event published to a topic
+	// would be delivered to, summed over all subscriptions matching the topic
+	// irrespective of match policy (non-standard).
+	MetaProcSubCount = URI("wamp.subscription.count")
+
 	// -- Testament Meta Procedures --
 
 	// Add a Testament which will be published on a particular topic when the